@@ -0,0 +1,378 @@
+// Package asm implements an assembler for the subset of the nasm syntax and
+// of the x86 instruction set used by the code generator and the runtime.
+// It encodes instructions directly into the sections of a linker object.
+package asm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"pl0/linker"
+)
+
+// Error describes an assembly error at a source line.
+type Error struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// symbol is a label or a constant defined with equ.
+type symbol struct {
+	value value
+	file  string
+	line  int
+}
+
+// fixup is a field to complete once every symbol is defined.
+type fixup struct {
+	sect linker.Section // Section holding the field
+	off  int            // Offset of the field within sect
+	size int            // Size of the field in bytes
+	rel  bool           // Field is a displacement from the end of the instruction
+	tail int            // Bytes following the field in the instruction
+	v    value
+	file string
+	line int
+}
+
+// Assembler assembles source files into a single relocatable object. The
+// entry point of the object is the first global symbol.
+type Assembler struct {
+	is64 bool
+
+	sect    linker.Section
+	text    []byte
+	data    []byte
+	bss     int
+	syms    map[string]*symbol
+	globals []string
+	fixups  []fixup
+	scope   string // Last non-local label, prefixed to local labels
+
+	file string
+	line int
+	err  error
+}
+
+// New returns an assembler for the architecture arch ("386" or "amd64").
+func New(arch string) (*Assembler, error) {
+	a := &Assembler{syms: make(map[string]*symbol)}
+	switch arch {
+	case "386":
+	case "amd64":
+		a.is64 = true
+	default:
+		return nil, fmt.Errorf("unsupported architecture %q", arch)
+	}
+	return a, nil
+}
+
+// errorf records the first error.
+func (a *Assembler) errorf(format string, args ...interface{}) {
+	if a.err == nil {
+		a.err = &Error{File: a.file, Line: a.line, Msg: fmt.Sprintf(format, args...)}
+	}
+}
+
+// Assemble assembles the source read from r, continuing the sections of
+// previously assembled sources.
+func (a *Assembler) Assemble(name string, r io.Reader) error {
+	a.file, a.line, a.scope = name, 0, ""
+	a.sect = linker.Text
+	s := bufio.NewScanner(r)
+	for s.Scan() && a.err == nil {
+		a.line++
+		a.statement(s.Text())
+	}
+	if err := s.Err(); err != nil && a.err == nil {
+		a.err = err
+	}
+	return a.err
+}
+
+// Object resolves the references between assembled sources and returns the
+// resulting object.
+func (a *Assembler) Object() (*linker.Object, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	obj := &linker.Object{
+		Is64: a.is64,
+		Text: a.text,
+		Data: a.data,
+		Bss:  uint32(a.bss),
+	}
+	for _, f := range a.fixups {
+		a.file, a.line = f.file, f.line
+		a.resolve(obj, f)
+	}
+	if a.err != nil {
+		return nil, a.err
+	}
+	for _, g := range a.globals {
+		if s := a.syms[g]; s != nil && s.value.kind == relative && s.value.sect == linker.Text {
+			obj.Entry = uint32(s.value.off)
+			return obj, nil
+		}
+	}
+	return nil, fmt.Errorf("entry symbol not found")
+}
+
+// resolve completes a fixup, or turns it into a relocation for the linker.
+func (a *Assembler) resolve(obj *linker.Object, f fixup) {
+	v := f.v
+	if v.kind == undefined {
+		s := a.syms[v.sym]
+		if s == nil {
+			a.errorf("undefined symbol %s", v.sym)
+			return
+		}
+		v = value{kind: s.value.kind, sect: s.value.sect, off: s.value.off + v.off}
+	}
+	field := a.section(f.sect)[f.off : f.off+f.size]
+
+	switch {
+	case v.kind == absolute && !f.rel:
+		a.put(field, v.off)
+	case v.kind == absolute:
+		a.errorf("relative reference to an absolute value")
+	case f.rel && v.sect == f.sect:
+		a.put(field, v.off-int64(f.off+f.size+f.tail))
+	case f.sect != linker.Text || f.size != 4:
+		a.errorf("unsupported reference to %s section", sectionNames[v.sect])
+	default:
+		// The linker computes displacements from the end of the field
+		addend := v.off
+		if f.rel {
+			addend -= int64(f.tail)
+		}
+		obj.Relocs = append(obj.Relocs, linker.Reloc{
+			Off:    uint32(f.off),
+			Sect:   v.sect,
+			Addend: uint32(addend),
+			PCRel:  f.rel,
+		})
+	}
+}
+
+// put stores a little endian value in a field, checking it fits.
+func (a *Assembler) put(field []byte, v int64) {
+	switch len(field) {
+	case 1:
+		if v < -128 || v > 255 {
+			a.errorf("value %d does not fit in a byte", v)
+		}
+		field[0] = byte(v)
+	case 4:
+		if v < -1<<31 || v > 1<<32-1 {
+			a.errorf("value %d does not fit in a double word", v)
+		}
+		binary.LittleEndian.PutUint32(field, uint32(v))
+	case 8:
+		binary.LittleEndian.PutUint64(field, uint64(v))
+	}
+}
+
+var sectionNames = [...]string{
+	linker.Text: ".text",
+	linker.Data: ".data",
+	linker.Bss:  ".bss",
+}
+
+// section returns the contents of a section.
+func (a *Assembler) section(s linker.Section) []byte {
+	if s == linker.Data {
+		return a.data
+	}
+	return a.text
+}
+
+// pc returns the current location.
+func (a *Assembler) pc() int {
+	switch a.sect {
+	case linker.Data:
+		return len(a.data)
+	case linker.Bss:
+		return a.bss
+	}
+	return len(a.text)
+}
+
+// bytes appends to the current section.
+func (a *Assembler) bytes(b ...byte) {
+	switch a.sect {
+	case linker.Text:
+		a.text = append(a.text, b...)
+	case linker.Data:
+		a.data = append(a.data, b...)
+	default:
+		a.errorf("data in %s section", sectionNames[a.sect])
+	}
+}
+
+// field appends a field of size bytes holding v, recording a fixup unless v
+// is known and absolute. A relative field holds a displacement from the end
+// of the instruction, tail bytes after the field.
+func (a *Assembler) field(v value, size int, rel bool, tail int) {
+	off := a.pc()
+	a.bytes(make([]byte, size)...)
+	if a.err != nil {
+		return
+	}
+	if v.kind == absolute && !rel {
+		a.put(a.section(a.sect)[off:off+size], v.off)
+		return
+	}
+	a.fixups = append(a.fixups, fixup{
+		sect: a.sect,
+		off:  off,
+		size: size,
+		rel:  rel,
+		tail: tail,
+		v:    v,
+		file: a.file,
+		line: a.line,
+	})
+}
+
+// define defines a symbol.
+func (a *Assembler) define(name string, v value) {
+	if s, ok := a.syms[name]; ok {
+		a.errorf("symbol %s redefined (previous definition at %s:%d)", name, s.file, s.line)
+		return
+	}
+	a.syms[name] = &symbol{value: v, file: a.file, line: a.line}
+}
+
+// statement assembles a single source line.
+func (a *Assembler) statement(line string) {
+	toks, err := scan(line)
+	if err != nil {
+		a.errorf("%v", err)
+		return
+	}
+	if len(toks) == 0 {
+		return
+	}
+
+	// Label
+	if len(toks) >= 2 && toks[0].kind == tIdent && toks[1].kind == ':' {
+		name := a.qualify(toks[0].text)
+		toks = toks[2:]
+		if len(toks) > 0 && toks[0].kind == tIdent && strings.EqualFold(toks[0].text, "equ") {
+			v := a.expr(toks[1:])
+			if v.kind == undefined {
+				a.errorf("equ refers to undefined symbol %s", v.sym)
+			}
+			a.define(name, v)
+			return
+		}
+		a.define(name, value{kind: relative, sect: a.sect, off: int64(a.pc())})
+		if len(toks) == 0 {
+			return
+		}
+	}
+	if toks[0].kind != tIdent {
+		a.errorf("unexpected %q, expecting instruction", toks[0].text)
+		return
+	}
+
+	op := strings.ToLower(toks[0].text)
+	args := split(toks[1:])
+	switch op {
+	case "section", "segment":
+		a.directiveSection(args)
+	case "global":
+		for _, arg := range args {
+			if len(arg) != 1 || arg[0].kind != tIdent {
+				a.errorf("malformed global directive")
+				return
+			}
+			a.globals = append(a.globals, arg[0].text)
+		}
+	case "db", "dd", "dq":
+		a.directiveData(op, args)
+	case "resb", "resd", "resq":
+		a.directiveReserve(op, args)
+	default:
+		ops := make([]operand, len(args))
+		for i, arg := range args {
+			ops[i] = a.operand(arg)
+		}
+		if a.err == nil {
+			a.instruction(op, ops)
+		}
+	}
+}
+
+// qualify prefixes a local label with the enclosing non-local label.
+func (a *Assembler) qualify(name string) string {
+	if strings.HasPrefix(name, ".") {
+		return a.scope + name
+	}
+	a.scope = name
+	return name
+}
+
+func (a *Assembler) directiveSection(args [][]token) {
+	if len(args) != 1 || len(args[0]) != 1 {
+		a.errorf("malformed section directive")
+		return
+	}
+	switch args[0][0].text {
+	case ".text":
+		a.sect = linker.Text
+	case ".data":
+		a.sect = linker.Data
+	case ".bss":
+		a.sect = linker.Bss
+	default:
+		a.errorf("unsupported section %s", args[0][0].text)
+	}
+}
+
+func (a *Assembler) directiveData(op string, args [][]token) {
+	size := map[string]int{"db": 1, "dd": 4, "dq": 8}[op]
+	for _, arg := range args {
+		if len(arg) == 1 && arg[0].kind == tString {
+			if size != 1 {
+				a.errorf("string operand of %s", op)
+				return
+			}
+			a.bytes([]byte(arg[0].text)...)
+			continue
+		}
+		v := a.expr(arg)
+		if v.kind != absolute {
+			a.errorf("%s requires a constant operand", op)
+			return
+		}
+		a.field(v, size, false, 0)
+	}
+}
+
+func (a *Assembler) directiveReserve(op string, args [][]token) {
+	size := map[string]int{"resb": 1, "resd": 4, "resq": 8}[op]
+	if len(args) != 1 {
+		a.errorf("%s requires a single operand", op)
+		return
+	}
+	v := a.expr(args[0])
+	if v.kind != absolute || v.off < 0 {
+		a.errorf("%s requires a constant count", op)
+		return
+	}
+	if a.sect == linker.Bss {
+		a.bss += int(v.off) * size
+		return
+	}
+	a.bytes(make([]byte, int(v.off)*size)...)
+}
@@ -0,0 +1,176 @@
+package asm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"pl0/linker"
+)
+
+// assemble assembles src for arch, with an entry point at its beginning.
+func assemble(arch, src string) (*linker.Object, error) {
+	a, err := New(arch)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.Assemble("test.asm", strings.NewReader("global start\nstart:\n"+src)); err != nil {
+		return nil, err
+	}
+	return a.Object()
+}
+
+func TestEncode(t *testing.T) {
+	// Expected encodings were produced by an independent assembler
+	tests := []struct {
+		arch string
+		in   string
+		want string
+	}{
+		{"386", "MOV EAX, [EBP + -4]", "8b 45 fc"},
+		{"386", "MOV [EBP + -8], EAX", "89 45 f8"},
+		{"386", "MOV EAX, [ESP + 4]", "8b 44 24 04"},
+		{"386", "MOV EAX, [EBP + -400]", "8b 85 70 fe ff ff"},
+		{"386", "MOV EAX, -7", "b8 f9 ff ff ff"},
+		{"386", "MOV ESP, EBP", "89 ec"},
+		{"386", "PUSH dword [EBP + 8]", "ff 75 08"},
+		{"386", "push dword 1000", "68 e8 03 00 00"},
+		{"386", "SUB ESP, 12", "83 ec 0c"},
+		{"386", "CMP EDX, EAX", "39 c2"},
+		{"386", "IDIV ECX", "f7 f9"},
+		{"386", "NEG EAX", "f7 d8"},
+		{"386", "TEST EAX, 1", "a9 01 00 00 00"},
+		{"386", "CMOVGE EAX, [EBP + 8]", "0f 4d 45 08"},
+		{"386", "CMOVPO EAX, EDX", "0f 4b c2"},
+		{"386", "cmp bl, '0'", "80 fb 30"},
+		{"386", "imul eax, 1000", "69 c0 e8 03 00 00"},
+		{"386", "imul eax, ecx", "0f af c1"},
+		{"386", "dec ebx", "4b"},
+		{"386", "int 0x80", "cd 80"},
+		{"386", "mov byte [EBX], al", "88 03"},
+		{"amd64", "MOV RAX, [RBP + -8]", "48 8b 45 f8"},
+		{"amd64", "MOV RAX, -1", "48 c7 c0 ff ff ff ff"},
+		{"amd64", "MOV RAX, 5000000000", "48 b8 00 f2 05 2a 01 00 00 00"},
+		{"amd64", "PUSH qword [RBP + 16]", "ff 75 10"},
+		{"amd64", "SUB RSP, 24", "48 83 ec 18"},
+		{"amd64", "IDIV RCX", "48 f7 f9"},
+		{"amd64", "TEST RAX, -1", "48 a9 ff ff ff ff"},
+		{"amd64", "CMOVL RAX, [RBX + 8]", "48 0f 4c 43 08"},
+		{"amd64", "imul rax, 10", "48 6b c0 0a"},
+		{"amd64", "inc rbx", "48 ff c3"},
+		{"amd64", "cqo", "48 99"},
+		{"amd64", "syscall", "0f 05"},
+		{"amd64", "xor ebx, ebx", "31 db"},
+	}
+	for _, tt := range tests {
+		obj, err := assemble(tt.arch, tt.in)
+		if err != nil {
+			t.Errorf("%s %q: %v", tt.arch, tt.in, err)
+			continue
+		}
+		if got := fmt.Sprintf("% x", obj.Text); got != tt.want {
+			t.Errorf("%s %q: got %s, want %s", tt.arch, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestReferences(t *testing.T) {
+	src := `
+	call f
+	jmp .skip
+.skip:
+	mov eax, [_x]
+	mov eax, _x
+	ret
+f:	ret
+	section .data
+_x:	dd 7
+	section .bss
+_y:	resd 1
+	section .text
+	mov [_y], eax
+`
+	obj, err := assemble("386", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "e8 11 00 00 00 e9 00 00 00 00 8b 05 00 00 00 00 b8 00 00 00 00 c3 c3 89 05 00 00 00 00"
+	if got := fmt.Sprintf("% x", obj.Text); got != want {
+		t.Errorf("got text %s, want %s", got, want)
+	}
+	wantRelocs := []linker.Reloc{
+		{Off: 12, Sect: linker.Data},
+		{Off: 17, Sect: linker.Data},
+		{Off: 25, Sect: linker.Bss},
+	}
+	if fmt.Sprint(obj.Relocs) != fmt.Sprint(wantRelocs) {
+		t.Errorf("got relocations %v, want %v", obj.Relocs, wantRelocs)
+	}
+	if fmt.Sprintf("% x", obj.Data) != "07 00 00 00" || obj.Bss != 4 {
+		t.Errorf("got data % x and bss %d", obj.Data, obj.Bss)
+	}
+}
+
+func TestRipRelative(t *testing.T) {
+	obj, err := assemble("amd64", "mov byte [rel _b], al\nsection .data\n_b: db 0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The displacement is relative to the end of the instruction
+	want := []linker.Reloc{{Off: 2, Sect: linker.Data, Addend: 0, PCRel: true}}
+	if fmt.Sprint(obj.Relocs) != fmt.Sprint(want) {
+		t.Errorf("got relocations %v, want %v", obj.Relocs, want)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		arch string
+		in   string
+		want string
+	}{
+		{"386", "mov eax, rbx", "test.asm:3: mismatch in operand sizes"},
+		{"386", "push rax", "test.asm:3: invalid operand size for push"},
+		{"386", "frob eax", "test.asm:3: unsupported instruction frob"},
+		{"386", "jmp nowhere", "test.asm:3: undefined symbol nowhere"},
+		{"386", "start: ret", "test.asm:3: symbol start redefined (previous definition at test.asm:2)"},
+		{"amd64", "mov [rbx], 1", "test.asm:3: operation size not specified"},
+	}
+	for _, tt := range tests {
+		_, err := assemble(tt.arch, tt.in)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s %q: got error %v, want %s", tt.arch, tt.in, err, tt.want)
+		}
+	}
+}
+
+func TestRuntime(t *testing.T) {
+	files, err := filepath.Glob("../include/runtime_*.asm")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no runtime sources found: %v", err)
+	}
+	for _, file := range files {
+		arch := strings.TrimSuffix(file[strings.LastIndex(file, "_")+1:], ".asm")
+		a, err := New(arch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = a.Assemble(file, f)
+		f.Close()
+		if err == nil {
+			err = a.Assemble("main.asm", strings.NewReader("global start\nstart: call EXIT\n"))
+		}
+		if err == nil {
+			_, err = a.Object()
+		}
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+		}
+	}
+}
@@ -0,0 +1,479 @@
+package asm
+
+import (
+	"strings"
+
+	"pl0/linker"
+)
+
+// Condition codes, as encoded in Jcc and CMOVcc.
+var conditions = map[string]byte{
+	"o": 0x0, "no": 0x1,
+	"b": 0x2, "c": 0x2, "nae": 0x2,
+	"ae": 0x3, "nb": 0x3, "nc": 0x3,
+	"e": 0x4, "z": 0x4,
+	"ne": 0x5, "nz": 0x5,
+	"be": 0x6, "na": 0x6,
+	"a": 0x7, "nbe": 0x7,
+	"s": 0x8, "ns": 0x9,
+	"p": 0xA, "pe": 0xA,
+	"np": 0xB, "po": 0xB,
+	"l": 0xC, "nge": 0xC,
+	"ge": 0xD, "nl": 0xD,
+	"le": 0xE, "ng": 0xE,
+	"g": 0xF, "nle": 0xF,
+}
+
+// Arithmetic instructions, by their ModRM opcode extension.
+var arith = map[string]byte{
+	"add": 0, "or": 1, "adc": 2, "sbb": 3, "and": 4, "sub": 5, "xor": 6, "cmp": 7,
+}
+
+// Unary instructions of group 3, by their ModRM opcode extension.
+var unary = map[string]byte{
+	"not": 2, "neg": 3, "mul": 4, "imul": 5, "div": 6, "idiv": 7,
+}
+
+// inst describes the encoding of an instruction.
+type inst struct {
+	w      bool    // Operand size is 64 bits (REX.W)
+	op     []byte  // Opcode
+	modrm  bool    // Opcode is followed by ModRM
+	reg    byte    // ModRM reg field: register or opcode extension
+	rm     operand // ModRM r/m operand: register or memory
+	imm    *value  // Immediate
+	immLen int     // Size of the immediate in bytes
+	rel    *value  // Branch target, encoded as a 32-bit displacement
+}
+
+// encode appends an instruction to the text section.
+func (a *Assembler) encode(in inst) {
+	if a.sect != linker.Text {
+		a.errorf("instruction outside of text section")
+		return
+	}
+	if in.w {
+		a.bytes(0x48)
+	}
+	a.bytes(in.op...)
+	if in.modrm {
+		a.modrm(in.reg, in.rm, in.immLen)
+	}
+	if in.imm != nil {
+		a.field(*in.imm, in.immLen, false, 0)
+	}
+	if in.rel != nil {
+		a.field(*in.rel, 4, true, 0)
+	}
+}
+
+// modrm appends the ModRM byte with its SIB and displacement. The
+// instruction ends tail bytes after the displacement.
+func (a *Assembler) modrm(reg byte, rm operand, tail int) {
+	reg = (reg & 7) << 3
+	if rm.kind == opReg {
+		a.bytes(0xC0 | reg | rm.reg.num)
+		return
+	}
+
+	disp := rm.imm
+	switch {
+	case rm.rel:
+		a.bytes(0x05 | reg)
+		a.field(disp, 4, true, tail)
+
+	case !rm.hasBase && a.is64:
+		a.bytes(0x04|reg, 0x25) // SIB: no base, no index
+		a.field(disp, 4, false, 0)
+
+	case !rm.hasBase:
+		a.bytes(0x05 | reg)
+		a.field(disp, 4, false, 0)
+
+	default:
+		base := rm.base.num
+		sib := base == 4 // ESP/RSP needs a SIB byte
+		var mod byte
+		switch {
+		case disp.kind != absolute:
+			mod = 0x80
+		case disp.off == 0 && base != 5: // EBP/RBP needs a displacement
+			mod = 0x00
+		case -128 <= disp.off && disp.off <= 127:
+			mod = 0x40
+		default:
+			mod = 0x80
+		}
+		if sib {
+			a.bytes(mod|reg|0x04, 0x24)
+		} else {
+			a.bytes(mod | reg | base)
+		}
+		switch mod {
+		case 0x40:
+			a.field(disp, 1, false, 0)
+		case 0x80:
+			a.field(disp, 4, false, 0)
+		}
+	}
+}
+
+// size determines the operation size from the operands, which must agree.
+func (a *Assembler) size(ops ...operand) int {
+	size := 0
+	for _, x := range ops {
+		if x.kind == opImm || x.size == 0 {
+			continue
+		}
+		if size != 0 && size != x.size {
+			a.errorf("mismatch in operand sizes")
+			return 0
+		}
+		size = x.size
+	}
+	switch {
+	case size == 0:
+		a.errorf("operation size not specified")
+	case size == 2:
+		a.errorf("16-bit operations are not supported")
+	case size == 8 && !a.is64:
+		a.errorf("64-bit operations are not supported in 32-bit mode")
+	}
+	return size
+}
+
+// word is the size of the native stack slot.
+func (a *Assembler) word() int {
+	if a.is64 {
+		return 8
+	}
+	return 4
+}
+
+// isImm8 tells whether an immediate operand is encodable in a signed byte.
+func isImm8(v value) bool {
+	return v.kind == absolute && -128 <= v.off && v.off <= 127
+}
+
+// instruction assembles an instruction.
+func (a *Assembler) instruction(mn string, ops []operand) {
+	nops := func(n int) bool {
+		if len(ops) != n {
+			a.errorf("invalid number of operands for %s", mn)
+			return false
+		}
+		return true
+	}
+	kinds := func(k ...int) bool {
+		for i := range k {
+			if ops[i].kind != k[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	switch {
+	case mn == "ret" && nops(0):
+		a.encode(inst{op: []byte{0xC3}})
+
+	case mn == "syscall" && nops(0):
+		a.encode(inst{op: []byte{0x0F, 0x05}})
+
+	case mn == "cdq" && nops(0):
+		a.encode(inst{op: []byte{0x99}})
+
+	case mn == "cqo" && nops(0):
+		a.encode(inst{w: true, op: []byte{0x99}})
+
+	case mn == "int" && nops(1):
+		if !kinds(opImm) {
+			a.errorf("invalid operand for int")
+			return
+		}
+		a.encode(inst{op: []byte{0xCD}, imm: &ops[0].imm, immLen: 1})
+
+	case mn == "call" || mn == "jmp":
+		if !nops(1) {
+			return
+		}
+		if !kinds(opImm) {
+			a.errorf("indirect %s is not supported", mn)
+			return
+		}
+		op := byte(0xE8)
+		if mn == "jmp" {
+			op = 0xE9
+		}
+		a.encode(inst{op: []byte{op}, rel: &ops[0].imm})
+
+	case strings.HasPrefix(mn, "j") && conditions[mn[1:]] != 0 || mn == "jo":
+		if !nops(1) {
+			return
+		}
+		if !kinds(opImm) {
+			a.errorf("invalid operand for %s", mn)
+			return
+		}
+		cc := conditions[mn[1:]]
+		a.encode(inst{op: []byte{0x0F, 0x80 | cc}, rel: &ops[0].imm})
+
+	case strings.HasPrefix(mn, "cmov") && (conditions[mn[4:]] != 0 || mn == "cmovo"):
+		if !nops(2) {
+			return
+		}
+		if !kinds(opReg) || ops[1].kind == opImm {
+			a.errorf("invalid operands for %s", mn)
+			return
+		}
+		size := a.size(ops...)
+		if size == 1 {
+			a.errorf("invalid operand size for %s", mn)
+			return
+		}
+		cc := conditions[mn[4:]]
+		a.encode(inst{w: size == 8, op: []byte{0x0F, 0x40 | cc}, modrm: true, reg: ops[0].reg.num, rm: ops[1]})
+
+	case mn == "push" || mn == "pop":
+		if !nops(1) {
+			return
+		}
+		x := ops[0]
+		if x.kind != opImm && x.size != 0 && x.size != a.word() {
+			a.errorf("invalid operand size for %s", mn)
+			return
+		}
+		switch {
+		case x.kind == opReg && mn == "push":
+			a.encode(inst{op: []byte{0x50 | x.reg.num}})
+		case x.kind == opReg:
+			a.encode(inst{op: []byte{0x58 | x.reg.num}})
+		case x.kind == opMem && x.size == 0:
+			a.errorf("operation size not specified")
+		case x.kind == opMem && mn == "push":
+			a.encode(inst{op: []byte{0xFF}, modrm: true, reg: 6, rm: x})
+		case x.kind == opMem:
+			a.encode(inst{op: []byte{0x8F}, modrm: true, reg: 0, rm: x})
+		case mn == "push" && isImm8(x.imm):
+			a.encode(inst{op: []byte{0x6A}, imm: &x.imm, immLen: 1})
+		case mn == "push":
+			a.encode(inst{op: []byte{0x68}, imm: &x.imm, immLen: 4})
+		default:
+			a.errorf("invalid operand for pop")
+		}
+
+	case mn == "mov":
+		if !nops(2) {
+			return
+		}
+		a.mov(ops[0], ops[1])
+
+	case mn == "lea":
+		if !nops(2) {
+			return
+		}
+		if !kinds(opReg, opMem) || ops[0].size == 1 {
+			a.errorf("invalid operands for lea")
+			return
+		}
+		a.encode(inst{w: ops[0].size == 8, op: []byte{0x8D}, modrm: true, reg: ops[0].reg.num, rm: ops[1]})
+
+	case arith[mn] != 0 || mn == "add":
+		if !nops(2) {
+			return
+		}
+		a.arith(arith[mn], ops[0], ops[1])
+
+	case mn == "test":
+		if !nops(2) {
+			return
+		}
+		a.test(ops[0], ops[1])
+
+	case mn == "imul" && len(ops) > 1:
+		a.imul(ops)
+
+	case unary[mn] != 0 || mn == "inc" || mn == "dec":
+		if !nops(1) {
+			return
+		}
+		x := ops[0]
+		if x.kind == opImm {
+			a.errorf("invalid operand for %s", mn)
+			return
+		}
+		size := a.size(x)
+		if !a.is64 && x.kind == opReg && size == 4 && (mn == "inc" || mn == "dec") {
+			// Single byte form, a REX prefix in 64-bit mode
+			op := byte(0x40)
+			if mn == "dec" {
+				op = 0x48
+			}
+			a.encode(inst{op: []byte{op | x.reg.num}})
+			return
+		}
+		op, ext := byte(0xF7), unary[mn]
+		switch mn {
+		case "inc":
+			op, ext = 0xFF, 0
+		case "dec":
+			op, ext = 0xFF, 1
+		}
+		if size == 1 {
+			op--
+		}
+		a.encode(inst{w: size == 8, op: []byte{op}, modrm: true, reg: ext, rm: x})
+
+	default:
+		if a.err == nil {
+			a.errorf("unsupported instruction %s", mn)
+		}
+	}
+}
+
+// mov assembles a data transfer between registers, memory and immediates.
+func (a *Assembler) mov(dst, src operand) {
+	size := a.size(dst, src)
+	if a.err != nil {
+		return
+	}
+	w := size == 8
+	switch {
+	case dst.kind == opReg && src.kind == opImm:
+		switch {
+		case size == 1:
+			a.encode(inst{op: []byte{0xB0 | dst.reg.num}, imm: &src.imm, immLen: 1})
+		case size == 4:
+			a.encode(inst{op: []byte{0xB8 | dst.reg.num}, imm: &src.imm, immLen: 4})
+		case src.imm.kind == absolute && int64(int32(src.imm.off)) == src.imm.off:
+			// Sign extended 32-bit immediate
+			a.encode(inst{w: true, op: []byte{0xC7}, modrm: true, reg: 0, rm: dst, imm: &src.imm, immLen: 4})
+		case src.imm.kind == absolute:
+			a.encode(inst{w: true, op: []byte{0xB8 | dst.reg.num}, imm: &src.imm, immLen: 8})
+		default:
+			a.errorf("64-bit address immediate is not supported, use lea")
+		}
+
+	case dst.kind == opMem && src.kind == opImm:
+		if size == 1 {
+			a.encode(inst{op: []byte{0xC6}, modrm: true, rm: dst, imm: &src.imm, immLen: 1})
+		} else {
+			a.encode(inst{w: w, op: []byte{0xC7}, modrm: true, rm: dst, imm: &src.imm, immLen: 4})
+		}
+
+	case src.kind == opReg && dst.kind != opImm:
+		op := byte(0x89)
+		if size == 1 {
+			op = 0x88
+		}
+		a.encode(inst{w: w, op: []byte{op}, modrm: true, reg: src.reg.num, rm: dst})
+
+	case dst.kind == opReg && src.kind == opMem:
+		op := byte(0x8B)
+		if size == 1 {
+			op = 0x8A
+		}
+		a.encode(inst{w: w, op: []byte{op}, modrm: true, reg: dst.reg.num, rm: src})
+
+	default:
+		a.errorf("invalid operands for mov")
+	}
+}
+
+// arith assembles one of the two operand arithmetic instructions.
+func (a *Assembler) arith(ext byte, dst, src operand) {
+	size := a.size(dst, src)
+	if a.err != nil {
+		return
+	}
+	w := size == 8
+	base := ext << 3 // Opcode of the 8-bit r/m, reg form
+	switch {
+	case dst.kind == opImm:
+		a.errorf("invalid destination operand")
+	case src.kind == opImm && size == 1:
+		a.encode(inst{op: []byte{0x80}, modrm: true, reg: ext, rm: dst, imm: &src.imm, immLen: 1})
+	case src.kind == opImm && isImm8(src.imm):
+		a.encode(inst{w: w, op: []byte{0x83}, modrm: true, reg: ext, rm: dst, imm: &src.imm, immLen: 1})
+	case src.kind == opImm:
+		a.encode(inst{w: w, op: []byte{0x81}, modrm: true, reg: ext, rm: dst, imm: &src.imm, immLen: 4})
+	case src.kind == opReg:
+		if size != 1 {
+			base++
+		}
+		a.encode(inst{w: w, op: []byte{base}, modrm: true, reg: src.reg.num, rm: dst})
+	case dst.kind == opReg:
+		base += 2
+		if size != 1 {
+			base++
+		}
+		a.encode(inst{w: w, op: []byte{base}, modrm: true, reg: dst.reg.num, rm: src})
+	default:
+		a.errorf("invalid operands")
+	}
+}
+
+// test assembles a logical compare.
+func (a *Assembler) test(dst, src operand) {
+	size := a.size(dst, src)
+	if a.err != nil {
+		return
+	}
+	w := size == 8
+	switch {
+	case dst.kind == opImm:
+		a.errorf("invalid operands for test")
+	case src.kind == opImm && dst.kind == opReg && dst.reg.num == 0 && size == 1:
+		a.encode(inst{op: []byte{0xA8}, imm: &src.imm, immLen: 1})
+	case src.kind == opImm && dst.kind == opReg && dst.reg.num == 0:
+		// Accumulator form
+		a.encode(inst{w: w, op: []byte{0xA9}, imm: &src.imm, immLen: 4})
+	case src.kind == opImm && size == 1:
+		a.encode(inst{op: []byte{0xF6}, modrm: true, reg: 0, rm: dst, imm: &src.imm, immLen: 1})
+	case src.kind == opImm:
+		a.encode(inst{w: w, op: []byte{0xF7}, modrm: true, reg: 0, rm: dst, imm: &src.imm, immLen: 4})
+	case src.kind == opReg && size == 1:
+		a.encode(inst{op: []byte{0x84}, modrm: true, reg: src.reg.num, rm: dst})
+	case src.kind == opReg:
+		a.encode(inst{w: w, op: []byte{0x85}, modrm: true, reg: src.reg.num, rm: dst})
+	default:
+		a.errorf("invalid operands for test")
+	}
+}
+
+// imul assembles the two and three operand forms of a signed multiply.
+func (a *Assembler) imul(ops []operand) {
+	if len(ops) > 3 || ops[0].kind != opReg {
+		a.errorf("invalid operands for imul")
+		return
+	}
+	dst, src := ops[0], ops[1]
+	var imm *value
+	switch {
+	case len(ops) == 3 && ops[2].kind == opImm && src.kind != opImm:
+		imm = &ops[2].imm
+	case len(ops) == 2 && src.kind == opImm:
+		src, imm = dst, &ops[1].imm
+	case len(ops) == 2:
+	default:
+		a.errorf("invalid operands for imul")
+		return
+	}
+	size := a.size(dst, src)
+	if a.err != nil {
+		return
+	}
+	if size == 1 {
+		a.errorf("invalid operand size for imul")
+		return
+	}
+	w := size == 8
+	switch {
+	case imm == nil:
+		a.encode(inst{w: w, op: []byte{0x0F, 0xAF}, modrm: true, reg: dst.reg.num, rm: src})
+	case isImm8(*imm):
+		a.encode(inst{w: w, op: []byte{0x6B}, modrm: true, reg: dst.reg.num, rm: src, imm: imm, immLen: 1})
+	default:
+		a.encode(inst{w: w, op: []byte{0x69}, modrm: true, reg: dst.reg.num, rm: src, imm: imm, immLen: 4})
+	}
+}
@@ -0,0 +1,286 @@
+package asm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"pl0/linker"
+)
+
+// Token kinds, besides single character punctuation.
+const (
+	tIdent  = 'i'
+	tNumber = 'n'
+	tString = 's'
+)
+
+type token struct {
+	kind byte
+	text string
+	num  int64
+}
+
+func isIdentChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '_' || c == '.' || c == '$' || c == '?' || c == '@'
+}
+
+// scan splits a source line into tokens, dropping the comment.
+func scan(line string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ';':
+			return toks, nil
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '\'' || c == '"':
+			j := strings.IndexByte(line[i+1:], c)
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			s := line[i+1 : i+1+j]
+			toks = append(toks, token{kind: tString, text: s})
+			i += j + 2
+		case '0' <= c && c <= '9':
+			j := i
+			for j < len(line) && isIdentChar(line[j]) {
+				j++
+			}
+			n, err := strconv.ParseInt(line[i:j], 0, 64)
+			if err != nil {
+				u, uerr := strconv.ParseUint(line[i:j], 0, 64)
+				if uerr != nil {
+					return nil, fmt.Errorf("invalid number %s", line[i:j])
+				}
+				n = int64(u)
+			}
+			toks = append(toks, token{kind: tNumber, text: line[i:j], num: n})
+			i = j
+		case isIdentChar(c):
+			j := i
+			for j < len(line) && isIdentChar(line[j]) {
+				j++
+			}
+			toks = append(toks, token{kind: tIdent, text: line[i:j]})
+			i = j
+		case strings.IndexByte("[],:+-*", c) >= 0:
+			toks = append(toks, token{kind: c, text: string(c)})
+			i++
+		default:
+			return nil, fmt.Errorf("illegal character %q", c)
+		}
+	}
+	return toks, nil
+}
+
+// split splits tokens into comma separated operands.
+func split(toks []token) [][]token {
+	if len(toks) == 0 {
+		return nil
+	}
+	var args [][]token
+	start := 0
+	for i, t := range toks {
+		if t.kind == ',' {
+			args = append(args, toks[start:i])
+			start = i + 1
+		}
+	}
+	return append(args, toks[start:])
+}
+
+// Value kinds
+const (
+	absolute  = iota // A number
+	relative         // An offset in a section
+	undefined        // An offset from a symbol not defined yet
+)
+
+// value is the result of evaluating an expression.
+type value struct {
+	kind int
+	sect linker.Section // Section of a relative value
+	sym  string         // Symbol of an undefined value
+	off  int64
+}
+
+// expr evaluates a sum of numbers, characters, symbols and the current
+// location ($). A relative or undefined term may only be added, except
+// that the difference of two locations in the same section is absolute.
+func (a *Assembler) expr(toks []token) value {
+	var sum value
+	if len(toks) == 0 {
+		a.errorf("missing expression")
+		return sum
+	}
+	for len(toks) > 0 {
+		neg := false
+		for len(toks) > 0 && (toks[0].kind == '+' || toks[0].kind == '-') {
+			neg = neg != (toks[0].kind == '-')
+			toks = toks[1:]
+		}
+		if len(toks) == 0 {
+			a.errorf("missing operand in expression")
+			return sum
+		}
+		var v value
+		t := toks[0]
+		toks = toks[1:]
+		switch {
+		case t.kind == tNumber:
+			v = value{kind: absolute, off: t.num}
+		case t.kind == tString && len(t.text) == 1:
+			v = value{kind: absolute, off: int64(t.text[0])}
+		case t.kind == tIdent && t.text == "$":
+			v = value{kind: relative, sect: a.sect, off: int64(a.pc())}
+		case t.kind == tIdent:
+			name := t.text
+			if strings.HasPrefix(name, ".") {
+				name = a.scope + name
+			}
+			if s, ok := a.syms[name]; ok {
+				v = s.value
+			} else {
+				v = value{kind: undefined, sym: name}
+			}
+		default:
+			a.errorf("unexpected %q in expression", t.text)
+			return sum
+		}
+		sum = a.add(sum, v, neg)
+		if len(toks) > 0 && toks[0].kind != '+' && toks[0].kind != '-' {
+			a.errorf("unexpected %q in expression", toks[0].text)
+			return sum
+		}
+	}
+	return sum
+}
+
+// add adds (or subtracts) v to sum.
+func (a *Assembler) add(sum, v value, neg bool) value {
+	off := v.off
+	if neg {
+		off = -off
+	}
+	switch {
+	case v.kind == absolute:
+		sum.off += off
+	case !neg && sum.kind == absolute:
+		sum = value{kind: v.kind, sect: v.sect, sym: v.sym, off: sum.off + off}
+	case neg && v.kind == relative && sum.kind == relative && sum.sect == v.sect:
+		sum = value{kind: absolute, off: sum.off + off}
+	default:
+		a.errorf("invalid expression")
+	}
+	return sum
+}
+
+// Operand kinds
+const (
+	opReg = iota
+	opImm
+	opMem
+)
+
+// reg is a general purpose register.
+type reg struct {
+	num  byte // Register number, as encoded in ModRM
+	size int  // Size in bytes
+}
+
+var registers = map[string]reg{
+	"al": {0, 1}, "cl": {1, 1}, "dl": {2, 1}, "bl": {3, 1},
+
+	"eax": {0, 4}, "ecx": {1, 4}, "edx": {2, 4}, "ebx": {3, 4},
+	"esp": {4, 4}, "ebp": {5, 4}, "esi": {6, 4}, "edi": {7, 4},
+
+	"rax": {0, 8}, "rcx": {1, 8}, "rdx": {2, 8}, "rbx": {3, 8},
+	"rsp": {4, 8}, "rbp": {5, 8}, "rsi": {6, 8}, "rdi": {7, 8},
+}
+
+var sizes = map[string]int{"byte": 1, "word": 2, "dword": 4, "qword": 8}
+
+// operand is an instruction operand.
+type operand struct {
+	kind int
+	size int // Size in bytes, or 0 if not specified
+
+	reg reg // Register operand
+
+	imm value // Immediate operand, or memory displacement
+
+	base    reg  // Base register of a memory operand
+	hasBase bool // Memory operand has a base register
+	rel     bool // Memory operand is relative to the instruction pointer
+}
+
+// operand parses an instruction operand.
+func (a *Assembler) operand(toks []token) operand {
+	var x operand
+	if len(toks) == 0 {
+		a.errorf("missing operand")
+		return x
+	}
+	if toks[0].kind == tIdent {
+		if size, ok := sizes[strings.ToLower(toks[0].text)]; ok {
+			x.size = size
+			toks = toks[1:]
+		}
+	}
+	if len(toks) == 1 && toks[0].kind == tIdent {
+		if r, ok := registers[strings.ToLower(toks[0].text)]; ok {
+			if x.size != 0 && x.size != r.size {
+				a.errorf("mismatch in operand sizes")
+			}
+			return operand{kind: opReg, size: r.size, reg: r}
+		}
+	}
+	if len(toks) == 0 || toks[0].kind != '[' {
+		x.kind = opImm
+		x.imm = a.expr(toks)
+		return x
+	}
+
+	// Memory operand
+	if toks[len(toks)-1].kind != ']' {
+		a.errorf("missing ] in memory operand")
+		return x
+	}
+	x.kind = opMem
+	toks = toks[1 : len(toks)-1]
+	if len(toks) > 0 && toks[0].kind == tIdent && strings.EqualFold(toks[0].text, "rel") {
+		if !a.is64 {
+			a.errorf("rip relative addressing in 32-bit mode")
+		}
+		x.rel = true
+		toks = toks[1:]
+	}
+
+	// Extract the base register, leaving a zero in the displacement
+	disp := make([]token, len(toks))
+	copy(disp, toks)
+	for i, t := range disp {
+		r, ok := registers[strings.ToLower(t.text)]
+		if t.kind != tIdent || !ok {
+			continue
+		}
+		if x.hasBase || (i > 0 && disp[i-1].kind != '+') {
+			a.errorf("unsupported addressing mode")
+			return x
+		}
+		if r.size != map[bool]int{false: 4, true: 8}[a.is64] {
+			a.errorf("invalid base register %s", t.text)
+			return x
+		}
+		x.base, x.hasBase = r, true
+		disp[i] = token{kind: tNumber, text: "0"}
+	}
+	if x.hasBase && x.rel {
+		a.errorf("rip relative addressing with a base register")
+	}
+	x.imm = a.expr(disp)
+	return x
+}
@@ -0,0 +1,595 @@
+// Package cgen translates PL/0 programs to portable C99 source code.
+//
+// Each block becomes a C function, and its variables the members of a
+// frame structure allocated on the C stack by that function. A frame
+// starts with the static link: a pointer to the frame of the lexically
+// enclosing block, through which non-local variables are accessed. The
+// main block has no enclosing block, so its static link is always null.
+//
+// Nested procedures become top-level functions, named after the path of
+// enclosing procedures: procedure q declared in p is translated to pl0_p_q,
+// with a frame of type struct frame_pl0_p_q. Their parameters follow the
+// static link, and are copied into the frame: a VAR parameter is a pointer
+// to the variable passed to it. An array is an array member, whose indexes
+// are checked at run time. A function returns an int64_t, held by the
+// result member of its frame until it returns.
+//
+// The operands of C operators and function calls are evaluated in no
+// particular order, while PL/0 evaluates them from left to right: an
+// operand followed by a call to a function, which may have side effects,
+// is first stored in a temporary.
+//
+// Arithmetic wraps around on overflow, as in the native code.
+package cgen
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"pl0/compiler"
+	"pl0/compiler/ast"
+	"pl0/compiler/token"
+)
+
+// translator holds the state of the translation of a program.
+type translator struct {
+	file   *token.File
+	level  int                    // Level of the current block
+	names  map[*ast.Object]string // C functions of the procedures
+	errors compiler.ErrorList
+
+	types bytes.Buffer  // Frame structures
+	decls bytes.Buffer  // Function prototypes
+	funcs bytes.Buffer  // Function definitions
+	out   *bytes.Buffer // Body of the current function
+	used  bool          // Current function accesses its frame
+	temps int           // Number of temporaries of the current function
+}
+
+// Translate resolves a program and writes its C translation to w. The
+// error, if any, is a compiler.ErrorList, in which case nothing is written.
+func Translate(w io.Writer, prog *ast.Program) error {
+	if err := compiler.Resolve(prog); err != nil {
+		return err
+	}
+	t := &translator{file: prog.File, names: make(map[*ast.Object]string)}
+	t.block("pl0", "", false, nil, prog.Main)
+	if err := t.errors.Err(); err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	// Keep the program name from closing the comment
+	name := strings.Replace(prog.Name, "*/", "* /", -1)
+	fmt.Fprintf(&b, "/* program: %s, translated by pl0 */\n", name)
+	b.WriteString(runtime)
+	b.WriteString("\n/* Frames */\n\n")
+	b.Write(t.types.Bytes())
+	b.WriteString("/* Procedures */\n\n")
+	b.Write(t.decls.Bytes())
+	b.WriteString("\n")
+	b.Write(t.funcs.Bytes())
+	b.WriteString("int main(void)\n{\n\tpl0(NULL);\n\treturn 0;\n}\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// runtime holds the headers and helper functions used by the translation.
+// The helpers are inline, so that unused ones do not cause warnings.
+const runtime = `
+#include <inttypes.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+static inline void rt_error(const char *pos, const char *msg)
+{
+	fflush(stdout);
+	fprintf(stderr, "%s: %s\n", pos, msg);
+	exit(1);
+}
+
+static inline int64_t rt_add(int64_t x, int64_t y) { return (int64_t)((uint64_t)x + (uint64_t)y); }
+static inline int64_t rt_sub(int64_t x, int64_t y) { return (int64_t)((uint64_t)x - (uint64_t)y); }
+static inline int64_t rt_mul(int64_t x, int64_t y) { return (int64_t)((uint64_t)x * (uint64_t)y); }
+static inline int64_t rt_neg(int64_t x) { return (int64_t)(0 - (uint64_t)x); }
+
+static inline int64_t rt_div(int64_t x, int64_t y, const char *pos)
+{
+	if (y == 0)
+		rt_error(pos, "division by zero");
+	if (y == -1)
+		return rt_neg(x);
+	return x / y;
+}
+
+static inline int64_t rt_index(int64_t i, int64_t n, const char *pos)
+{
+	char msg[64];
+
+	if (i < 0 || i >= n) {
+		sprintf(msg, "index %" PRId64 " out of range [0:%" PRId64 "]", i, n);
+		rt_error(pos, msg);
+	}
+	return i;
+}
+
+static inline void rt_print(int64_t x)
+{
+	printf("%" PRId64 "\n", x);
+}
+
+static inline int64_t rt_read(const char *pos)
+{
+	char line[64], *end;
+	long long x;
+
+	if (fgets(line, sizeof line, stdin) == NULL)
+		rt_error(pos, "unexpected end of input");
+	x = strtoll(line, &end, 10);
+	end += strspn(end, " \t\r\n");
+	if (end == line || *end != '\0')
+		rt_error(pos, "invalid input number");
+	return (int64_t)x;
+}
+`
+
+// error records an error at pos.
+func (t *translator) error(pos token.Pos, kind compiler.ErrorKind, msg string) {
+	t.errors.Add(t.position(pos), kind, msg)
+}
+
+func (t *translator) position(pos token.Pos) token.Position {
+	if t.file == nil {
+		return token.Position{}
+	}
+	return t.file.Position(pos)
+}
+
+// member returns the member of a variable in the frame structure.
+func member(obj *ast.Object) string {
+	return "v_" + obj.Name
+}
+
+// param returns the C parameter of a procedure parameter.
+func param(obj *ast.Object) string {
+	return "p_" + obj.Name
+}
+
+// variable returns the C lvalue of a variable, or of the result of an
+// enclosing function.
+func (t *translator) variable(obj *ast.Object) string {
+	if obj.Kind == ast.Func {
+		return t.frame(obj.Level+1) + "->result"
+	}
+	x := t.frame(obj.Level) + "->" + member(obj)
+	if obj.Ref {
+		return "*" + x
+	}
+	return x
+}
+
+// address returns the C expression for a pointer to a variable, or the
+// pointer held by a VAR parameter.
+func (t *translator) address(obj *ast.Object) string {
+	x := t.frame(obj.Level) + "->" + member(obj)
+	if obj.Ref {
+		return x
+	}
+	return "&" + x
+}
+
+// element returns the C lvalue of an array element, with its index checked
+// by the C expression index.
+func (t *translator) element(x *ast.IndexExpr, index string) string {
+	obj := x.X.Obj
+	return t.frame(obj.Level) + "->" + member(obj) + "[" + index + "]"
+}
+
+// index returns the C expression checking the index of an array element.
+func (t *translator) index(x *ast.IndexExpr) string {
+	return "rt_index(" + t.expr(x.Index) + ", " + literal(int64(x.X.Obj.Len)) + ", " + t.pos(x.Index.Pos()) + ")"
+}
+
+// assign writes the assignment of the C expression returned by value to
+// the variable or array element lhs. The index of an element is computed
+// first, stored in a temporary if it or the value has effects, as told by
+// effects.
+func (t *translator) assign(depth int, lhs ast.Expr, value func() string, effects bool) {
+	x, ok := lhs.(*ast.IndexExpr)
+	if !ok {
+		v := value()
+		t.printf(depth, "%s = %s;\n", t.variable(lhs.(*ast.Ident).Obj), v)
+		return
+	}
+	i := t.index(x)
+	if effects || calls(x.Index) {
+		tmp := t.temp()
+		t.printf(depth, "%s = %s;\n", tmp, i)
+		i = tmp
+	}
+	t.printf(depth, "%s = %s;\n", t.element(x, i), value())
+}
+
+// frame returns the C expression for a pointer to the frame of the block at
+// the given level, following static links from the current frame.
+func (t *translator) frame(level int) string {
+	t.used = true
+	return "f" + strings.Repeat("->link", t.level-level)
+}
+
+// block translates a block to a function with the given name and
+// parameters, after the functions of its procedures, returning a result
+// if fn is set. The static link of the frame points to the frame of the
+// enclosing block, of type struct frame_<outer>.
+func (t *translator) block(name, outer string, fn bool, params []*ast.Param, b *ast.Block) {
+	link := "void"
+	if outer != "" {
+		link = "struct frame_" + outer
+	}
+	fmt.Fprintf(&t.types, "struct frame_%s {\n\t%s *link;\n", name, link)
+	signature := link + " *link"
+	for _, p := range params {
+		typ := "int64_t "
+		if p.Var.IsValid() {
+			typ = "int64_t *"
+		}
+		fmt.Fprintf(&t.types, "\t%s%s;\n", typ, member(p.Name.Obj))
+		signature += ", " + typ + param(p.Name.Obj)
+	}
+	for _, v := range b.Vars {
+		if obj := v.Name.Obj; obj.Len > 0 {
+			fmt.Fprintf(&t.types, "\tint64_t %s[%d];\n", member(obj), obj.Len)
+		} else {
+			fmt.Fprintf(&t.types, "\tint64_t %s;\n", member(obj))
+		}
+	}
+	typ := "void"
+	if fn {
+		typ = "int64_t"
+		fmt.Fprintf(&t.types, "\tint64_t result;\n")
+	}
+	fmt.Fprintf(&t.types, "};\n\n")
+	fmt.Fprintf(&t.decls, "static %s %s(%s);\n", typ, name, signature)
+
+	for _, p := range b.Procs {
+		fname := name + "_" + p.Name.Name
+		t.names[p.Name.Obj] = fname
+		t.level++
+		t.block(fname, name, p.Tok == token.FUNCTION, p.Params, p.Block)
+		t.level--
+	}
+
+	t.out, t.used, t.temps = new(bytes.Buffer), false, 0
+	t.stmt(b.Body, 1)
+	if fn {
+		t.printf(1, "return %s->result;\n", t.frame(t.level))
+	}
+	fmt.Fprintf(&t.funcs, "static %s %s(%s)\n{\n", typ, name, signature)
+	if t.temps > 0 {
+		fmt.Fprintf(&t.funcs, "\tint64_t ")
+		for i := 1; i <= t.temps; i++ {
+			if i > 1 {
+				fmt.Fprintf(&t.funcs, ", ")
+			}
+			fmt.Fprintf(&t.funcs, "t%d", i)
+		}
+		fmt.Fprintf(&t.funcs, ";\n")
+	}
+	if t.used {
+		init := ".link = link"
+		for _, p := range params {
+			init += ", ." + member(p.Name.Obj) + " = " + param(p.Name.Obj)
+		}
+		fmt.Fprintf(&t.funcs, "\tstruct frame_%s frame = {%s}, *f = &frame;\n\n", name, init)
+	} else {
+		fmt.Fprintf(&t.funcs, "\t(void)link;\n")
+		for _, p := range params {
+			fmt.Fprintf(&t.funcs, "\t(void)%s;\n", param(p.Name.Obj))
+		}
+	}
+	t.funcs.Write(t.out.Bytes())
+	fmt.Fprintf(&t.funcs, "}\n\n")
+}
+
+// printf writes a line of the current function, indented by depth tabs.
+func (t *translator) printf(depth int, format string, args ...interface{}) {
+	t.out.WriteString(strings.Repeat("\t", depth))
+	fmt.Fprintf(t.out, format, args...)
+}
+
+// pos returns a C string literal holding the position pos, for run-time
+// error messages.
+func (t *translator) pos(pos token.Pos) string {
+	return cstring(t.position(pos).String())
+}
+
+// cstring returns a C string literal holding s.
+func cstring(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c >= 0x7f || c == '?':
+			// Octal escapes, also avoiding trigraphs
+			fmt.Fprintf(&b, "\\%03o", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func (t *translator) stmt(s ast.Stmt, depth int) {
+	switch s := s.(type) {
+	case nil:
+		// Empty statement
+
+	case *ast.AssignStmt:
+		t.assign(depth, s.Lhs, func() string { return t.expr(s.Rhs) }, calls(s.Rhs))
+
+	case *ast.CallStmt:
+		t.printf(depth, "%s;\n", t.call(s.Proc.Obj, s.Args))
+
+	case *ast.ReturnStmt:
+		t.printf(depth, "return %s;\n", t.expr(s.X))
+
+	case *ast.SendStmt:
+		t.printf(depth, "rt_print(%s);\n", t.expr(s.X))
+
+	case *ast.ReceiveStmt:
+		t.assign(depth, s.X, func() string { return "rt_read(" + t.pos(s.Pos()) + ")" }, true)
+
+	case *ast.BeginStmt:
+		for _, s := range s.List {
+			t.stmt(s, depth)
+		}
+
+	case *ast.IfStmt:
+		t.printf(depth, "if (%s) {\n", t.cond(s.Cond))
+		t.stmt(s.Body, depth+1)
+		if s.Else != nil {
+			t.printf(depth, "} else {\n")
+			t.stmt(s.Else, depth+1)
+		}
+		t.printf(depth, "}\n")
+
+	case *ast.WhileStmt:
+		t.printf(depth, "while (%s) {\n", t.cond(s.Cond))
+		t.stmt(s.Body, depth+1)
+		t.printf(depth, "}\n")
+
+	case *ast.RepeatStmt:
+		t.printf(depth, "do {\n")
+		for _, s := range s.List {
+			t.stmt(s, depth+1)
+		}
+		t.printf(depth, "} while (!(%s));\n", t.cond(s.Cond))
+
+	case *ast.ForStmt:
+		t.loop(s, depth)
+
+	default:
+		panic(fmt.Sprintf("unsupported statement: %T", s))
+	}
+}
+
+// loop translates a FOR loop. Its limit, unless constant, is held by a
+// temporary, as is its start if either calls a function. The loop is left
+// when the variable reaches the limit, before stepping it, so that it
+// never steps past the limit.
+func (t *translator) loop(s *ast.ForStmt, depth int) {
+	enter, leave, step := "<=", ">=", "++"
+	if s.Dir == token.DOWNTO {
+		enter, leave, step = ">=", "<=", "--"
+	}
+	from, limit := t.expr(s.From), t.expr(s.Limit)
+	if !constant(s.Limit) {
+		if calls(s.From, s.Limit) {
+			tmp := t.temp()
+			t.printf(depth, "%s = %s;\n", tmp, from)
+			from = tmp
+		}
+		tmp := t.temp()
+		t.printf(depth, "%s = %s;\n", tmp, limit)
+		limit = tmp
+	}
+	v := t.variable(s.Var.Obj)
+	t.printf(depth, "%s = %s;\n", v, from)
+	t.printf(depth, "if (%s %s %s) {\n", v, enter, limit)
+	t.printf(depth+1, "for (;;) {\n")
+	t.stmt(s.Body, depth+2)
+	t.printf(depth+2, "if (%s %s %s) {\n", v, leave, limit)
+	t.printf(depth+3, "break;\n")
+	t.printf(depth+2, "}\n")
+	t.printf(depth+2, "%s%s;\n", v, step)
+	t.printf(depth+1, "}\n")
+	t.printf(depth, "}\n")
+}
+
+// constant reports whether x is a number or a constant.
+func constant(x ast.Expr) bool {
+	switch x := x.(type) {
+	case *ast.Number:
+		return true
+	case *ast.Ident:
+		return x.Obj.Kind == ast.Con
+	}
+	return false
+}
+
+var relations = map[token.Token]string{
+	token.EQL: "==",
+	token.NEQ: "!=",
+	token.LSS: "<",
+	token.LEQ: "<=",
+	token.GRT: ">",
+	token.GEQ: ">=",
+}
+
+func (t *translator) cond(c ast.Cond) string {
+	switch c := c.(type) {
+	case *ast.OddCond:
+		return t.expr(c.X) + " % 2 != 0"
+
+	case *ast.RelCond:
+		op, ok := relations[c.Op]
+		if !ok {
+			panic(fmt.Sprintf("unsupported relation operator: %q", c.Op))
+		}
+		var pre string
+		x := t.hoist(&pre, c.X, c.Y)
+		return sequence(pre, x+" "+op+" "+t.expr(c.Y))
+	}
+	panic(fmt.Sprintf("unsupported condition: %T", c))
+}
+
+var operations = map[token.Token]string{
+	token.PLUS:  "rt_add",
+	token.MINUS: "rt_sub",
+	token.TIMES: "rt_mul",
+}
+
+// expr returns the C expression for an expression.
+func (t *translator) expr(x ast.Expr) string {
+	switch x := x.(type) {
+	case *ast.Number:
+		return literal(t.number(x))
+
+	case *ast.Ident:
+		if obj := x.Obj; obj.Kind == ast.Con {
+			return literal(obj.Value)
+		}
+		return t.variable(x.Obj)
+
+	case *ast.UnaryExpr:
+		switch x.Op {
+		case token.PLUS:
+			return t.expr(x.X)
+		case token.MINUS:
+			return "rt_neg(" + t.expr(x.X) + ")"
+		}
+		panic(fmt.Sprintf("unsupported unary operator: %q", x.Op))
+
+	case *ast.BinaryExpr:
+		var pre string
+		a := t.hoist(&pre, x.X, x.Y)
+		if x.Op == token.DIV {
+			return sequence(pre, "rt_div("+a+", "+t.expr(x.Y)+", "+t.pos(x.OpPos)+")")
+		}
+		fn, ok := operations[x.Op]
+		if !ok {
+			panic(fmt.Sprintf("unsupported binary operator: %q", x.Op))
+		}
+		return sequence(pre, fn+"("+a+", "+t.expr(x.Y)+")")
+
+	case *ast.IndexExpr:
+		return t.element(x, t.index(x))
+
+	case *ast.CallExpr:
+		return t.call(x.Func.Obj, x.Args)
+	}
+	panic(fmt.Sprintf("unsupported expression: %T", x))
+}
+
+// call returns the C call of a procedure or function with the given
+// arguments.
+func (t *translator) call(obj *ast.Object, args []ast.Expr) string {
+	var pre string
+	list := t.frame(obj.Level)
+	for i, p := range obj.Proc.Params {
+		x := args[i]
+		e, elem := x.(*ast.IndexExpr)
+		switch {
+		case !p.Var.IsValid():
+			list += ", " + t.hoist(&pre, x, args[i+1:]...)
+		case elem:
+			// The index is checked before the following arguments
+			k := t.index(e)
+			if following := args[i+1:]; len(following) > 0 && (calls(e.Index) || calls(following...)) {
+				tmp := t.temp()
+				pre += tmp + " = " + k + ", "
+				k = tmp
+			}
+			list += ", &" + t.element(e, k)
+		default:
+			list += ", " + t.address(x.(*ast.Ident).Obj)
+		}
+	}
+	return sequence(pre, t.names[obj]+"("+list+")")
+}
+
+// hoist returns the C expression for x, to be evaluated before the
+// expressions following it. If x or one of them calls a function, x is
+// first stored in a new temporary by an assignment appended to pre, and
+// the temporary is returned.
+func (t *translator) hoist(pre *string, x ast.Expr, following ...ast.Expr) string {
+	v := t.expr(x)
+	if _, ok := x.(*ast.Number); ok || len(following) == 0 || !calls(x) && !calls(following...) {
+		return v
+	}
+	tmp := t.temp()
+	*pre += tmp + " = " + v + ", "
+	return tmp
+}
+
+// temp returns a new temporary of the current function.
+func (t *translator) temp() string {
+	t.temps++
+	return "t" + strconv.Itoa(t.temps)
+}
+
+// sequence returns the C expression evaluating the assignments pre, then x.
+func sequence(pre, x string) string {
+	if pre == "" {
+		return x
+	}
+	return "(" + pre + x + ")"
+}
+
+// calls reports whether one of the expressions calls a function.
+func calls(xs ...ast.Expr) bool {
+	for _, x := range xs {
+		switch x := x.(type) {
+		case *ast.CallExpr:
+			return true
+		case *ast.UnaryExpr:
+			if calls(x.X) {
+				return true
+			}
+		case *ast.BinaryExpr:
+			if calls(x.X, x.Y) {
+				return true
+			}
+		case *ast.IndexExpr:
+			if calls(x.Index) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// literal returns the C literal for a value.
+func literal(v int64) string {
+	if v < -1<<31 || v >= 1<<31 {
+		return "INT64_C(" + strconv.FormatInt(v, 10) + ")"
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+func (t *translator) number(n *ast.Number) int64 {
+	v, err := strconv.ParseInt(n.Value, 10, 64)
+	if err != nil {
+		t.error(n.Pos(), compiler.SyntaxError, "number "+n.Value+" out of range")
+	}
+	return v
+}
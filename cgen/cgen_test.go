@@ -0,0 +1,251 @@
+package cgen
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"pl0/compiler"
+)
+
+var outputRE = regexp.MustCompile(`\{\s*Output:([^}]*)\}`)
+
+func translate(t *testing.T, filename, src string) string {
+	prog, err := compiler.Parse(filename, strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	var out bytes.Buffer
+	if err := Translate(&out, prog); err != nil {
+		t.Fatalf("Translate: %v", err)
+	}
+	return out.String()
+}
+
+func TestTranslate(t *testing.T) {
+	got := translate(t, "test.pl0", `
+CONST k = 3;
+VAR x;
+PROCEDURE p;
+	VAR y;
+	PROCEDURE q;
+	BEGIN x := x - y; IF x > 0 THEN CALL q END;
+BEGIN y := k; CALL q END;
+BEGIN ? x; CALL p; ! x / 2 END.`)
+	want := `/* Frames */
+
+struct frame_pl0 {
+	void *link;
+	int64_t v_x;
+};
+
+struct frame_pl0_p {
+	struct frame_pl0 *link;
+	int64_t v_y;
+};
+
+struct frame_pl0_p_q {
+	struct frame_pl0_p *link;
+};
+
+/* Procedures */
+
+static void pl0(void *link);
+static void pl0_p(struct frame_pl0 *link);
+static void pl0_p_q(struct frame_pl0_p *link);
+
+static void pl0_p_q(struct frame_pl0_p *link)
+{
+	struct frame_pl0_p_q frame = {.link = link}, *f = &frame;
+
+	f->link->link->v_x = rt_sub(f->link->link->v_x, f->link->v_y);
+	if (f->link->link->v_x > 0) {
+		pl0_p_q(f->link);
+	}
+}
+
+static void pl0_p(struct frame_pl0 *link)
+{
+	struct frame_pl0_p frame = {.link = link}, *f = &frame;
+
+	f->v_y = 3;
+	pl0_p_q(f);
+}
+
+static void pl0(void *link)
+{
+	struct frame_pl0 frame = {.link = link}, *f = &frame;
+
+	f->v_x = rt_read("test.pl0:9:7");
+	pl0_p(f);
+	rt_print(rt_div(f->v_x, 2, "test.pl0:9:24"));
+}
+
+int main(void)
+{
+	pl0(NULL);
+	return 0;
+}
+`
+	if i := strings.Index(got, "/* Frames */"); i < 0 || got[i:] != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestTranslateFunc(t *testing.T) {
+	got := translate(t, "test.pl0", `
+VAR x;
+FUNCTION f(n);
+BEGIN IF n < 1 THEN RETURN 0; f := n + f(n - 1) END;
+BEGIN x := 3; ! x + f(x) END.`)
+	for _, want := range []string{`
+static int64_t pl0_f(struct frame_pl0 *link, int64_t p_n)
+{
+	int64_t t1;
+	struct frame_pl0_f frame = {.link = link, .v_n = p_n}, *f = &frame;
+
+	if (f->v_n < 1) {
+		return 0;
+	}
+	f->result = (t1 = f->v_n, rt_add(t1, pl0_f(f->link, rt_sub(f->v_n, 1))));
+	return f->result;
+}
+`, `
+	rt_print((t1 = f->v_x, rt_add(t1, pl0_f(f, f->v_x))));
+`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got:\n%s\nwant it to contain:\n%s", got, want)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"! y.", []string{"test.pl0:1:3: undefined identifier y"}},
+		{"CONST c = 1; VAR c; c := 2.", []string{
+			"test.pl0:1:18: duplicate identifier c",
+			"test.pl0:1:21: cannot assign to c (kind CONST)",
+		}},
+		{"VAR x; PROCEDURE p; ; BEGIN ! p; CALL x END.", []string{
+			"test.pl0:1:31: cannot use p (kind PROCEDURE) in expression",
+			"test.pl0:1:39: cannot call non-procedure x (kind VAR)",
+		}},
+	}
+	for _, tt := range tests {
+		prog, err := compiler.Parse("test.pl0", strings.NewReader(tt.src))
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.src, err)
+		}
+		var out bytes.Buffer
+		err = Translate(&out, prog)
+		list, ok := err.(compiler.ErrorList)
+		if !ok {
+			t.Errorf("%q: got %v, want an ErrorList", tt.src, err)
+			continue
+		}
+		var got []string
+		for _, e := range list {
+			got = append(got, e.Error())
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%q: got %q, want %q", tt.src, got, tt.want)
+		}
+		if out.Len() > 0 {
+			t.Errorf("%q: output written despite errors", tt.src)
+		}
+	}
+}
+
+// build translates a program and builds it with the system C compiler,
+// returning the path of the executable.
+func build(t *testing.T, dir, filename, src string) string {
+	cfile := filepath.Join(dir, "prog.c")
+	if err := ioutil.WriteFile(cfile, []byte(translate(t, filename, src)), 0666); err != nil {
+		t.Fatal(err)
+	}
+	exe := filepath.Join(dir, "prog")
+	out, err := exec.Command("cc", "-std=c99", "-Wall", "-Wextra", "-pedantic", "-Werror", "-o", exe, cfile).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: cc: %v\n%s", filename, err, out)
+	}
+	return exe
+}
+
+func tempDir(t *testing.T) string {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("no C compiler")
+	}
+	dir, err := ioutil.TempDir("", "cgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// TestPrograms builds and runs the test programs, comparing their output
+// with the expected output noted in their { Output: ... } comments.
+func TestPrograms(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	files, err := filepath.Glob("../test/t.*.pl0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []string
+		for _, m := range outputRE.FindAllSubmatch(src, -1) {
+			want = append(want, strings.Fields(string(m[1]))...)
+		}
+		out, err := exec.Command(build(t, dir, file, string(src))).Output()
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		got := strings.Fields(string(out))
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: got %v, want %v", file, got, want)
+		}
+	}
+}
+
+func TestRuntime(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		src, in, out, err string
+	}{
+		{"VAR x; BEGIN ? x; ! x * 2; ! -x / (0 - 1) END.", "-21\n", "-42\n-21\n", ""},
+		{"VAR x; BEGIN ? x; ! x + 1; ! x * x END.", "9223372036854775807\n", "-9223372036854775808\n1\n", ""},
+		{"VAR x; BEGIN x := 0; ! 1; ! 1 / x END.", "", "1\n", "test.pl0:1:31: division by zero\n"},
+		{"VAR x; ? x.", "abc\n", "", "test.pl0:1:8: invalid input number\n"},
+		{"VAR x; ? x.", "", "", "test.pl0:1:8: unexpected end of input\n"},
+		{"VAR a[2]; BEGIN ? a[1]; ! a[1]; ! a[a[1]] END.", "2\n", "2\n", "test.pl0:1:37: index 2 out of range [0:2]\n"},
+	}
+	for _, tt := range tests {
+		cmd := exec.Command(build(t, dir, "test.pl0", tt.src))
+		cmd.Stdin = strings.NewReader(tt.in)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		err := cmd.Run()
+		if (err != nil) != (tt.err != "") {
+			t.Errorf("%q: got error %v", tt.src, err)
+		}
+		if stdout.String() != tt.out || stderr.String() != tt.err {
+			t.Errorf("%q: got %q, %q, want %q, %q", tt.src, stdout.String(), stderr.String(), tt.out, tt.err)
+		}
+	}
+}
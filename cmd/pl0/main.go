@@ -1,26 +1,45 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
+	"pl0/asm"
+	"pl0/cgen"
 	"pl0/compiler"
+	"pl0/compiler/ast"
+	"pl0/interp"
 	"pl0/linker"
+	"pl0/pcode"
+	"pl0/wasm"
 )
 
 var s = flag.Bool("S", false, "only output assembly")
+var optimize = flag.Bool("O", false, "optimize the generated assembly")
+var bounds = flag.Bool("bounds", false, "check array indexes at run time")
+var verbose = flag.Bool("v", false, "report the dead code removed")
 var o = flag.String("o", "", "resulting executable name")
+var t = flag.String("target", compiler.DefaultTarget.String(), "target operating system and architecture")
+var emit = flag.String("emit", "exe", "kind of output: exe, pcode, c or wasm")
+
+// formats maps a target operating system to its executable file format.
+var formats = map[string]linker.Format{
+	"darwin": linker.MachO,
+	"linux":  linker.ELF,
+}
 
 var pl0root = "/usr/local/pl0"
 
-func init() {
+// findRoot locates the PL0ROOT directory, holding the runtime sources.
+func findRoot() {
 	if custom := os.Getenv("PL0ROOT"); custom != "" {
 		pl0root = custom
 	}
@@ -36,32 +55,244 @@ func main() {
 	log.SetFlags(0)
 
 	args := flag.Args()
-	if len(args) > 1 {
-		fmt.Fprintf(os.Stderr, "pl0: multiple pl0 files given\n")
+	if len(args) > 0 {
+		switch args[0] {
+		case "run":
+			run(args[1:])
+			return
+		case "dis":
+			disassemble(sourceArg(args[1:], ".p0c"))
+			return
+		case "vet":
+			vet(sourceArg(args[1:], ".pl0"))
+			return
+		}
+	}
+	pl0file := sourceArg(args, ".pl0")
+
+	switch *emit {
+	case "exe":
+	case "pcode":
+		compilePcode(pl0file)
+		return
+	case "c":
+		compileC(pl0file)
+		return
+	case "wasm":
+		compileWasm(pl0file)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "pl0: unsupported output kind %q\n", *emit)
 		os.Exit(2)
 	}
-	if len(args) == 0 || !strings.HasSuffix(args[0], ".pl0") {
-		fmt.Fprintf(os.Stderr, "pl0: no pl0 file given\n")
+
+	target, err := compiler.ParseTarget(*t)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pl0: %v\n", err)
 		os.Exit(2)
 	}
 
-	compile(args[0])
+	compile(pl0file, target)
+}
+
+// sourceArg returns the single file argument, which must have one of the
+// given suffixes.
+func sourceArg(args []string, suffixes ...string) string {
+	if len(args) > 1 {
+		fmt.Fprintf(os.Stderr, "pl0: multiple files given\n")
+		os.Exit(2)
+	}
+	if len(args) == 1 {
+		for _, suffix := range suffixes {
+			if strings.HasSuffix(args[0], suffix) {
+				return args[0]
+			}
+		}
+	}
+	fmt.Fprintf(os.Stderr, "pl0: no %s file given\n", strings.Join(suffixes, " or "))
+	os.Exit(2)
+	return ""
+}
+
+// run runs a program, wired to the standard input and output. A source
+// file is run by the interpreter, unless tracing; a compiled .p0c file is
+// run by the P-code virtual machine.
+func run(args []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	trace := flags.Bool("trace", false, "trace the P-code virtual machine on standard error")
+	flags.Usage = usage
+	flags.Parse(args)
+	file := sourceArg(flags.Args(), ".pl0", ".p0c")
+
+	out := bufio.NewWriter(os.Stdout)
+	var err error
+	if strings.HasSuffix(file, ".pl0") && !*trace {
+		err = interp.Run(parse(file), os.Stdin, out)
+	} else {
+		var prog *pcode.Program
+		if strings.HasSuffix(file, ".pl0") {
+			prog = translatePcode(file)
+		} else {
+			prog = readPcode(file)
+		}
+		vm := pcode.NewVM(prog, os.Stdin, out)
+		if *trace {
+			vm.Trace = os.Stderr
+		}
+		err = vm.Run()
+	}
+	out.Flush()
+	if err != nil {
+		printErrors(err)
+		os.Exit(1)
+	}
+}
+
+// parse parses a source file, exiting on errors.
+func parse(pl0file string) *ast.Program {
+	prog, err := compiler.Parse(pl0file, nil)
+	if err != nil {
+		printErrors(err)
+		os.Exit(1)
+	}
+	return prog
+}
+
+// translatePcode translates a source file to P-code, exiting on errors.
+func translatePcode(pl0file string) *pcode.Program {
+	prog, err := pcode.Compile(parse(pl0file))
+	if err != nil {
+		printErrors(err)
+		os.Exit(1)
+	}
+	return prog
 }
 
-func compile(pl0file string) {
-	// Create the intermediate assembly output file
-	asmfile, err := ioutil.TempFile("", "pl0__")
+// readPcode reads a compiled .p0c file, exiting on errors.
+func readPcode(p0cfile string) *pcode.Program {
+	f, err := os.Open(p0cfile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(2)
 	}
-	defer os.Remove(asmfile.Name())
+	defer f.Close()
+	prog, err := pcode.Read(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", p0cfile, err)
+		os.Exit(1)
+	}
+	return prog
+}
+
+// compilePcode translates a source file to a .p0c file, named after the
+// source file unless -o is given. With -S, the disassembly is written to
+// the standard output instead.
+func compilePcode(pl0file string) {
+	prog := translatePcode(pl0file)
+	if *s {
+		if err := pcode.Disassemble(os.Stdout, prog); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	name := strings.TrimSuffix(filepath.Base(pl0file), ".pl0") + ".p0c"
+	if *o != "" {
+		name = *o
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := pcode.Write(f, prog); err != nil {
+		f.Close()
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// compileC translates a source file to a C file, named after the source
+// file unless -o is given. With -S, the C code is written to the standard
+// output instead.
+func compileC(pl0file string) {
+	var code bytes.Buffer
+	if err := cgen.Translate(&code, parse(pl0file)); err != nil {
+		printErrors(err)
+		os.Exit(1)
+	}
+	name := strings.TrimSuffix(filepath.Base(pl0file), ".pl0") + ".c"
+	if *o != "" {
+		name = *o
+	}
+	if *s {
+		if _, err := io.Copy(os.Stdout, &code); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := ioutil.WriteFile(name, code.Bytes(), 0666); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// compileWasm translates a source file to a WebAssembly module, named
+// after the source file unless -o is given.
+func compileWasm(pl0file string) {
+	if *s {
+		fmt.Fprintf(os.Stderr, "pl0: -S is not supported with -emit wasm\n")
+		os.Exit(2)
+	}
+	var code bytes.Buffer
+	if err := wasm.Compile(&code, parse(pl0file)); err != nil {
+		printErrors(err)
+		os.Exit(1)
+	}
+	name := strings.TrimSuffix(filepath.Base(pl0file), ".pl0") + ".wasm"
+	if *o != "" {
+		name = *o
+	}
+	if err := ioutil.WriteFile(name, code.Bytes(), 0666); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// vet prints the warnings of a source file, exiting with a non-zero status
+// if there are any.
+func vet(pl0file string) {
+	warnings, err := compiler.Vet(parse(pl0file))
+	if err != nil {
+		printErrors(err)
+		os.Exit(1)
+	}
+	if len(warnings) > 0 {
+		printErrors(warnings)
+		os.Exit(1)
+	}
+}
+
+// disassemble writes the listing of a compiled .p0c file to the standard
+// output.
+func disassemble(p0cfile string) {
+	out := bufio.NewWriter(os.Stdout)
+	if err := pcode.Disassemble(out, readPcode(p0cfile)); err != nil {
+		log.Fatal(err)
+	}
+	if err := out.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func compile(pl0file string, target compiler.Target) {
+	findRoot()
 
 	srcfile, err := os.Open(pl0file)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(2)
 	}
+	defer srcfile.Close()
 
 	progname := strings.TrimSuffix(filepath.Base(srcfile.Name()), ".pl0")
 	if *o != "" {
@@ -69,33 +300,67 @@ func compile(pl0file string) {
 	}
 
 	// Compile
-	compiler.ParseAndTranslate(srcfile, asmfile, progname)
+	var code bytes.Buffer
+	c := compiler.NewCompiler(target)
+	c.Optimize = *optimize
+	c.Bounds = *bounds
+	if *verbose {
+		c.Verbose = os.Stderr
+	}
+	if err := c.ParseAndTranslate(pl0file, srcfile, &code, progname); err != nil {
+		printErrors(err)
+		os.Exit(1)
+	}
 
 	if *s {
-		asmfile.Seek(0, 0) // Rewind to the beginning
-		if _, err := io.Copy(os.Stdout, asmfile); err != nil {
+		if _, err := io.Copy(os.Stdout, &code); err != nil {
 			log.Fatal(err)
 		}
 		return
 	}
 
-	runtime := filepath.Join(pl0root, "include", "runtime.asm")
-	nasmpath := filepath.Join(pl0root, "bin", "asm")
-
-	// Create object file
-	objpath := asmfile.Name() + ".o"
-	assembler := exec.Command(nasmpath, "-p", runtime, "-f", "macho32", "-o", objpath, asmfile.Name())
-	assembler.Stderr = os.Stderr
-	assembler.Stdout = os.Stdout
-	if err := assembler.Run(); err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
+	// Assemble the runtime and the program into a single object
+	runtime := filepath.Join(pl0root, "include", "runtime_"+target.OS+"_"+target.Arch+".asm")
+	obj, err := assemble(target.Arch, runtime, pl0file, &code)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "asm: %v\n", err)
 		os.Exit(1)
 	}
-	defer os.Remove(objpath)
 
 	// Create binary executable
-	if err := linker.Link(progname, objpath); err != nil {
+	if err := linker.LinkObject(progname, obj, formats[target.OS]); err != nil {
 		fmt.Fprintf(os.Stderr, "link: %v\n", err)
 		os.Exit(1)
 	}
 }
+
+// printErrors prints compile errors, one per line.
+func printErrors(err error) {
+	if list, ok := err.(compiler.ErrorList); ok {
+		for _, e := range list {
+			fmt.Fprintf(os.Stderr, "%v\n", e)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%v\n", err)
+}
+
+// assemble assembles the runtime followed by the generated code.
+func assemble(arch, runtime, name string, code io.Reader) (*linker.Object, error) {
+	a, err := asm.New(arch)
+	if err != nil {
+		return nil, err
+	}
+	rt, err := os.Open(runtime)
+	if err != nil {
+		return nil, err
+	}
+	defer rt.Close()
+	if err := a.Assemble(runtime, rt); err != nil {
+		return nil, err
+	}
+	if err := a.Assemble(name, code); err != nil {
+		return nil, err
+	}
+	return a.Object()
+}
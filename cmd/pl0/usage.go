@@ -10,6 +10,9 @@ var version string
 
 func usage() {
 	fmt.Fprintf(os.Stderr, `usage: %s [-o output] [flags] pl0file
+       %[1]s run [-trace] pl0file|p0cfile
+       %[1]s dis p0cfile
+       %[1]s vet pl0file
 
 Compile the program comprising the named PL/0 source file.
 A PL/0 source file is defined to be a file ending in a literal ".pl0" suffix.
@@ -25,6 +28,58 @@ The -S flag instructs the compiler to only output the assembly used
 to create the resulting executable file (not including any internal
 runtime code). In this case, the -o flag is ignored if provided.
 
+The -O flag runs a peephole optimizer over the generated assembly of a
+native executable, replacing instruction sequences with shorter ones:
+values stored then reloaded, or moved between registers, operands loaded
+into a register before their use, and jumps to the next instruction or to
+other jumps.
+
+The -bounds flag checks the indexes of arrays at run time in a native
+executable: an index out of range aborts the program, reporting its
+source line on the standard error. Constant indexes out of range are
+always compile errors, and the other kinds of output always check
+indexes at run time.
+
+The -v flag reports on the standard error the dead code removed from a
+native executable: procedures and functions never called, variables never
+used, the bodies of IF statements and WHILE loops whose condition is
+always false, and the ELSE branches of IF statements whose condition is
+always true.
+
+The -target flag selects the operating system and architecture of the
+resulting executable, given as os/arch. The supported targets are
+darwin/386 and darwin/amd64 (Mach-O executables), and linux/386 and
+linux/amd64 (static ELF executables). It defaults to the host operating
+system and architecture. The numbers of a 386 executable are 32-bit, and
+those of the other kinds of output 64-bit.
+
+The -emit flag selects the kind of output: exe (the default) for a native
+executable, pcode for a P-code program for the stack machine of Wirth's
+PL/0 compiler, written to a file with the ".p0c" suffix, or c for a C99
+translation, written to a file with the ".c" suffix, to be built with any
+C compiler (e.g., 'pl0 -emit c primes.pl0 && cc -o primes primes.c'), or
+wasm for a WebAssembly module, written to a file with the ".wasm" suffix,
+to be run in a browser with docs/js/pl0.js. With -S, the P-code is
+disassembled, or the C code is written, to the standard output instead.
+
+The run command runs the program with the built-in interpreter instead
+of compiling it, reading input from the standard input and writing output
+to the standard output. It does not require PL0ROOT. Its numbers are
+64-bit whatever the -target, so a program overflowing the numbers of a
+386 executable prints different results. A ".p0c" file is run by the
+P-code virtual machine; the -trace flag runs a source file on it too,
+printing each instruction and the stack before its execution to the
+standard error, with frames delimited by "|".
+
+The dis command disassembles a ".p0c" file to the standard output.
+
+The vet command reports suspicious constructs of a source file on the
+standard error: variables never read, or possibly read before they are
+assigned, constants never used, procedures and functions never called,
+functions which may return without a result, and variables of a procedure
+shadowing a variable of an enclosing block. It exits with a non-zero
+status if there are any.
+
 version: %s
 
 `,
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"pl0/compiler/ir"
+)
+
+// dotCFG prints a digraph of the basic blocks of each function of the
+// program, followed by the call graph.
+func dotCFG(p *ir.Program) {
+	for _, f := range p.Funcs {
+		fmt.Printf("digraph %q {\n", f.Name)
+		fmt.Printf("\tlabel=%q;\n", funcTitle(f))
+		fmt.Println("\tnode [shape=box, fontname=monospace];")
+		for _, b := range f.Blocks {
+			var lines []string
+			for _, in := range b.Instrs {
+				lines = append(lines, in.String())
+			}
+			label := b.String() + ":\\l" + strings.Join(lines, "\\l") + "\\l"
+			attrs := ""
+			if b.Index == 0 {
+				attrs = ", style=bold"
+			}
+			fmt.Printf("\t%s [label=\"%s\"%s];\n", b, label, attrs)
+		}
+		for _, b := range f.Blocks {
+			succs := b.Succs()
+			for i, s := range succs {
+				switch {
+				case b.Last().Op == ir.If && i == 0:
+					fmt.Printf("\t%s -> %s [label=\"true\"];\n", b, s)
+				case b.Last().Op == ir.If:
+					fmt.Printf("\t%s -> %s [label=\"false\"];\n", b, s)
+				default:
+					fmt.Printf("\t%s -> %s;\n", b, s)
+				}
+			}
+		}
+		fmt.Println("}")
+	}
+
+	// Procedures are named by index, as nested procedures may share a name
+	ids := make(map[*ir.Func]string)
+	for i, f := range p.Funcs {
+		ids[f] = fmt.Sprintf("f%d", i)
+	}
+	reachable := make(map[*ir.Func]bool)
+	for _, f := range p.Reachable() {
+		reachable[f] = true
+	}
+	fmt.Printf("digraph %q {\n", "calls "+p.Name)
+	fmt.Printf("\tlabel=%q;\n", "call graph of "+p.Name)
+	for _, f := range p.Funcs {
+		attrs := ""
+		switch {
+		case f == p.Main:
+			attrs = ", shape=doublecircle"
+		case !reachable[f]:
+			attrs = ", style=dashed" // Never called
+		}
+		fmt.Printf("\t%s [label=%q, tooltip=%q%s];\n", ids[f], f.Name, funcTitle(f), attrs)
+	}
+	for _, f := range p.Funcs {
+		for _, g := range f.Callees() {
+			fmt.Printf("\t%s -> %s;\n", ids[f], ids[g])
+		}
+	}
+	fmt.Println("}")
+}
+
+// funcTitle describes a function by its name and lexical nesting.
+func funcTitle(f *ir.Func) string {
+	title := f.Name
+	for g := f.Parent; g != nil; g = g.Parent {
+		title = g.Name + "." + title
+	}
+	return title
+}
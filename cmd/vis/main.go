@@ -15,12 +15,20 @@ import (
 
 var version string
 
+var cfg = flag.Bool("cfg", false, "draw the control-flow and call graphs")
+
 func usage() {
-	fmt.Fprintf(os.Stderr, `usage: %s pl0file
+	fmt.Fprintf(os.Stderr, `usage: %s [-cfg] pl0file
 
 Visualize the program comprising the named PL/0 source file.
 A PL/0 source file is defined to be a file ending in a literal ".pl0" suffix.
 
+The syntax tree of the program is written to the standard output, as a
+Graphviz digraph. With -cfg, the control-flow graph of each procedure is
+written instead, as a digraph of the basic blocks of its intermediate code,
+followed by the call graph of the program (e.g., 'vis -cfg primes.pl0 |
+dot -Tsvg -O' writes one SVG file per graph).
+
 version: %s
 
 `,
@@ -45,13 +53,38 @@ func main() {
 
 	p, err := compiler.Parse(args[0], nil)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	file = p.File
+	if *cfg {
+		prog, err := compiler.Lower(p)
+		if err != nil {
+			fatal(err)
+		}
+		dotCFG(prog)
+		return
 	}
 	dot(p)
 }
 
+// fatal prints the compile errors in err, one per line, and exits.
+func fatal(err error) {
+	if list, ok := err.(compiler.ErrorList); ok {
+		for _, e := range list {
+			log.Print(e)
+		}
+		os.Exit(1)
+	}
+	log.Fatal(err)
+}
+
+// file converts node positions to source positions.
+var file *token.File
+
 func dot(n ast.Node) {
 	switch n := n.(type) {
+	case nil:
+		// Empty statement
 	case *ast.Program:
 		fmt.Printf("digraph %q {\n", n.Name)
 		printNode(n, "Program")
@@ -83,13 +116,39 @@ func dot(n ast.Node) {
 		dot(n.Name)
 		dot(n.Value)
 
+	case *ast.VarDecl:
+		printNode(n, "VarDecl")
+		printEdge(n, n.Name)
+		dot(n.Name)
+		if n.Len != nil {
+			printLabeledEdge(n, n.Len, "[]")
+			dot(n.Len)
+		}
+
 	case *ast.ProcDecl:
-		printNode(n, "ProcDecl")
+		if n.Tok == token.FUNCTION {
+			printNode(n, "FuncDecl")
+		} else {
+			printNode(n, "ProcDecl")
+		}
 		printEdge(n, n.Name)
-		printEdge(n, n.Block)
 		dot(n.Name)
+		for _, p := range n.Params {
+			printEdge(n, p)
+			dot(p)
+		}
+		printEdge(n, n.Block)
 		dot(n.Block)
 
+	case *ast.Param:
+		if n.Var.IsValid() {
+			printNode(n, "VAR Param")
+		} else {
+			printNode(n, "Param")
+		}
+		printEdge(n, n.Name)
+		dot(n.Name)
+
 	case *ast.AssignStmt:
 		printNode(n, ":=")
 		printEdge(n, n.Lhs)
@@ -101,6 +160,15 @@ func dot(n ast.Node) {
 		printNode(n, "CALL")
 		printEdge(n, n.Proc)
 		dot(n.Proc)
+		for _, x := range n.Args {
+			printEdge(n, x)
+			dot(x)
+		}
+
+	case *ast.ReturnStmt:
+		printNode(n, "RETURN")
+		printEdge(n, n.X)
+		dot(n.X)
 
 	case *ast.SendStmt:
 		printNode(n, "!")
@@ -109,8 +177,8 @@ func dot(n ast.Node) {
 
 	case *ast.ReceiveStmt:
 		printNode(n, "?")
-		printEdge(n, n.Name)
-		dot(n.Name)
+		printEdge(n, n.X)
+		dot(n.X)
 
 	case *ast.BeginStmt:
 		printNode(n, "Stmts")
@@ -125,6 +193,10 @@ func dot(n ast.Node) {
 		printEdge(n, n.Body)
 		dot(n.Cond)
 		dot(n.Body)
+		if n.Else != nil {
+			printLabeledEdge(n, n.Else, "ELSE")
+			dot(n.Else)
+		}
 
 	case *ast.WhileStmt:
 		printNode(n, "WHILE")
@@ -133,6 +205,26 @@ func dot(n ast.Node) {
 		dot(n.Cond)
 		dot(n.Body)
 
+	case *ast.RepeatStmt:
+		printNode(n, "REPEAT")
+		for _, s := range n.List {
+			printEdge(n, s)
+			dot(s)
+		}
+		printLabeledEdge(n, n.Cond, "UNTIL")
+		dot(n.Cond)
+
+	case *ast.ForStmt:
+		printNode(n, "FOR")
+		printEdge(n, n.Var)
+		printLabeledEdge(n, n.From, ":=")
+		printLabeledEdge(n, n.Limit, n.Dir.String())
+		printEdge(n, n.Body)
+		dot(n.Var)
+		dot(n.From)
+		dot(n.Limit)
+		dot(n.Body)
+
 	case *ast.OddCond:
 		printNode(n, "ODD")
 		printEdge(n, n.X)
@@ -173,15 +265,43 @@ func dot(n ast.Node) {
 			panic(fmt.Sprintf("unsupported binary operator: %q", n.Op))
 		}
 
+	case *ast.IndexExpr:
+		printNode(n, "[]")
+		printEdge(n, n.X)
+		printEdge(n, n.Index)
+		dot(n.X)
+		dot(n.Index)
+
+	case *ast.CallExpr:
+		printNode(n, "Call")
+		printEdge(n, n.Func)
+		dot(n.Func)
+		for _, x := range n.Args {
+			printEdge(n, x)
+			dot(x)
+		}
+
 	default:
 		panic(fmt.Sprintf("unsupported node: %T", n))
 	}
 }
 
 func printNode(n ast.Node, display string) {
-	fmt.Printf("\t\"%p\" [label=%q];\n", n, display)
+	pos := file.Position(n.Pos())
+	end := file.Position(n.End())
+	fmt.Printf("\t\"%p\" [label=%q, tooltip=\"%d:%d-%d:%d\"];\n", n, display,
+		pos.Line, pos.Column, end.Line, end.Column)
 }
 
 func printEdge(x, y ast.Node) {
+	if y == nil {
+		return // Empty statement
+	}
 	fmt.Printf("\t\"%p\" -> \"%p\";\n", x, y)
 }
+
+// printLabeledEdge prints an edge telling apart a child of the same kind
+// as others, such as the else branch of an IF statement.
+func printLabeledEdge(x, y ast.Node, label string) {
+	fmt.Printf("\t\"%p\" -> \"%p\" [label=%q];\n", x, y, label)
+}
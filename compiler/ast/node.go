@@ -4,7 +4,11 @@ import (
 	"pl0/compiler/token"
 )
 
-type Node interface{ node() }
+// All node types implement the Node interface.
+type Node interface {
+	Pos() token.Pos // Position of first character belonging to the node
+	End() token.Pos // Position of first character immediately after the node
+}
 
 type Stmt interface {
 	Node
@@ -22,15 +26,18 @@ type Expr interface {
 }
 
 type Program struct {
-	Name string
-	Main *Block
+	Name   string
+	File   *token.File // Source file, to convert positions
+	Main   *Block
+	Period token.Pos // Position of the final "."
 }
 
 type Block struct {
+	Start  token.Pos // Position of the first token of the block
 	Consts []*ConstDecl
-	Vars   []*Ident
-	Procs  []*ProcDecl
-	Body   Stmt
+	Vars   []*VarDecl
+	Procs  []*ProcDecl // Procedures and functions
+	Body   Stmt        // Body statement; or nil
 }
 
 type ConstDecl struct {
@@ -38,64 +45,142 @@ type ConstDecl struct {
 	Value *Number
 }
 
+// A VarDecl declares a variable, or an array of Len variables indexed from 0.
+type VarDecl struct {
+	Name   *Ident
+	Lbrack token.Pos // Position of "[", if an array
+	Len    *Number   // Length of an array; or nil
+	Rbrack token.Pos // Position of "]", if an array
+}
+
+// A ProcDecl declares a procedure, or a function returning a value.
 type ProcDecl struct {
-	Name  *Ident
-	Block *Block
+	Procedure token.Pos   // Position of Tok
+	Tok       token.Token // PROCEDURE or FUNCTION
+	Name      *Ident
+	Lparen    token.Pos // Position of "(", if any
+	Params    []*Param  // Parameters, in order
+	Rparen    token.Pos // Position of ")", if any
+	Block     *Block
+	Semicolon token.Pos // Position of the terminating ";"
+}
+
+// A Param is a parameter of a procedure or function, passed by value or,
+// if declared after VAR, by reference.
+type Param struct {
+	Var  token.Pos // Position of "VAR" for a reference parameter; or token.NoPos
+	Name *Ident
 }
 
 // Statement nodes.
 type (
+	// A BadStmt is a placeholder for a statement containing syntax errors.
+	BadStmt struct {
+		From, To token.Pos // Position range of the bad statement
+	}
+
+	// An AssignStmt assigns to a variable, or an element of an array.
 	AssignStmt struct {
-		Lhs *Ident
-		Rhs Expr
+		Lhs    Expr      // Ident or IndexExpr
+		TokPos token.Pos // Position of ":="
+		Rhs    Expr
 	}
 
 	CallStmt struct {
-		Proc *Ident
+		Call   token.Pos // Position of "CALL"
+		Proc   *Ident
+		Lparen token.Pos // Position of "(", if any
+		Args   []Expr    // Arguments, in order
+		Rparen token.Pos // Position of ")", if any
 	}
 
 	SendStmt struct {
-		X Expr
+		Send token.Pos // Position of "!"
+		X    Expr
 	}
 
 	ReceiveStmt struct {
-		Name *Ident
+		Recv token.Pos // Position of "?"
+		X    Expr      // Ident or IndexExpr
+	}
+
+	// A ReturnStmt ends a function, with X as its result.
+	ReturnStmt struct {
+		Return token.Pos // Position of "RETURN"
+		X      Expr
 	}
 
 	BeginStmt struct {
-		List []Stmt
+		Begin  token.Pos // Position of "BEGIN"
+		List   []Stmt    // Statements; an empty statement is nil
+		EndPos token.Pos // Position of "END"
 	}
 
 	IfStmt struct {
-		Cond Cond
-		Body Stmt
+		If      token.Pos // Position of "IF"
+		Cond    Cond
+		Then    token.Pos // Position of "THEN"
+		Body    Stmt      // Body statement; or nil
+		ElsePos token.Pos // Position of "ELSE", if any
+		Else    Stmt      // Else statement; or nil
 	}
 
 	WhileStmt struct {
-		Cond Cond
-		Body Stmt
+		While token.Pos // Position of "WHILE"
+		Cond  Cond
+		Do    token.Pos // Position of "DO"
+		Body  Stmt      // Body statement; or nil
+	}
+
+	// A RepeatStmt runs its statements until its condition holds, at
+	// least once.
+	RepeatStmt struct {
+		Repeat token.Pos // Position of "REPEAT"
+		List   []Stmt    // Statements; an empty statement is nil
+		Until  token.Pos // Position of "UNTIL"
+		Cond   Cond
+	}
+
+	// A ForStmt runs its body for each value of Var from From up to
+	// Limit, or down to it, evaluated once.
+	ForStmt struct {
+		For    token.Pos // Position of "FOR"
+		Var    *Ident
+		TokPos token.Pos // Position of ":="
+		From   Expr
+		DirPos token.Pos   // Position of Dir
+		Dir    token.Token // TO or DOWNTO
+		Limit  Expr
+		Do     token.Pos // Position of "DO"
+		Body   Stmt      // Body statement; or nil
 	}
 )
 
 // All nodes that implement the Stmt interface
+func (*BadStmt) stmtNode()     {}
 func (*AssignStmt) stmtNode()  {}
 func (*CallStmt) stmtNode()    {}
 func (*SendStmt) stmtNode()    {}
 func (*ReceiveStmt) stmtNode() {}
+func (*ReturnStmt) stmtNode()  {}
 func (*BeginStmt) stmtNode()   {}
 func (*IfStmt) stmtNode()      {}
 func (*WhileStmt) stmtNode()   {}
+func (*RepeatStmt) stmtNode()  {}
+func (*ForStmt) stmtNode()     {}
 
 // Condition nodes.
 type (
 	OddCond struct {
-		X Expr
+		Odd token.Pos // Position of "ODD"
+		X   Expr
 	}
 
 	RelCond struct {
-		X  Expr
-		Op token.Token
-		Y  Expr
+		X     Expr
+		OpPos token.Pos // Position of Op
+		Op    token.Token
+		Y     Expr
 	}
 )
 
@@ -105,47 +190,170 @@ func (*RelCond) condNode() {}
 
 // Expression nodes.
 type (
+	// A BadExpr is a placeholder for an expression containing syntax errors.
+	BadExpr struct {
+		From, To token.Pos // Position range of the bad expression
+	}
+
 	Ident struct {
-		Name string
+		NamePos token.Pos // Position of the identifier
+		Name    string
+		Obj     *Object // Denoted object, set by resolution; or nil
 	}
 
 	Number struct {
-		Value string
+		ValuePos token.Pos // Position of the number
+		Value    string
 	}
 
 	UnaryExpr struct {
-		X  Expr
-		Op token.Token
+		OpPos token.Pos // Position of Op
+		Op    token.Token
+		X     Expr
 	}
 
 	BinaryExpr struct {
-		X  Expr
-		Op token.Token
-		Y  Expr
+		X     Expr
+		OpPos token.Pos // Position of Op
+		Op    token.Token
+		Y     Expr
+	}
+
+	// An IndexExpr denotes the element of an array at an index.
+	IndexExpr struct {
+		X      *Ident
+		Lbrack token.Pos // Position of "["
+		Index  Expr
+		Rbrack token.Pos // Position of "]"
+	}
+
+	// A CallExpr calls a function, denoting its result.
+	CallExpr struct {
+		Func   *Ident
+		Lparen token.Pos // Position of "("
+		Args   []Expr    // Arguments, in order
+		Rparen token.Pos // Position of ")"
 	}
 )
 
 // All nodes that implement the Expr interface
+func (*BadExpr) exprNode()    {}
 func (*Ident) exprNode()      {}
 func (*Number) exprNode()     {}
 func (*UnaryExpr) exprNode()  {}
 func (*BinaryExpr) exprNode() {}
+func (*IndexExpr) exprNode()  {}
+func (*CallExpr) exprNode()   {}
+
+// Pos and End implementations for the nodes.
+
+func (p *Program) Pos() token.Pos { return p.Main.Pos() }
+func (p *Program) End() token.Pos { return p.Period + 1 }
+
+func (b *Block) Pos() token.Pos { return b.Start }
+func (b *Block) End() token.Pos {
+	switch {
+	case b.Body != nil:
+		return b.Body.End()
+	case len(b.Procs) > 0:
+		return b.Procs[len(b.Procs)-1].End()
+	case len(b.Vars) > 0:
+		return b.Vars[len(b.Vars)-1].End()
+	case len(b.Consts) > 0:
+		return b.Consts[len(b.Consts)-1].End()
+	}
+	return b.Start
+}
+
+func (d *ConstDecl) Pos() token.Pos { return d.Name.Pos() }
+func (d *ConstDecl) End() token.Pos { return d.Value.End() }
+
+func (d *VarDecl) Pos() token.Pos { return d.Name.Pos() }
+func (d *VarDecl) End() token.Pos {
+	if d.Len != nil {
+		return d.Rbrack + 1
+	}
+	return d.Name.End()
+}
+
+func (d *ProcDecl) Pos() token.Pos { return d.Procedure }
+func (d *ProcDecl) End() token.Pos { return d.Semicolon + 1 }
+
+func (p *Param) Pos() token.Pos {
+	if p.Var.IsValid() {
+		return p.Var
+	}
+	return p.Name.Pos()
+}
+func (p *Param) End() token.Pos { return p.Name.End() }
+
+func (s *BadStmt) Pos() token.Pos     { return s.From }
+func (s *AssignStmt) Pos() token.Pos  { return s.Lhs.Pos() }
+func (s *CallStmt) Pos() token.Pos    { return s.Call }
+func (s *SendStmt) Pos() token.Pos    { return s.Send }
+func (s *ReceiveStmt) Pos() token.Pos { return s.Recv }
+func (s *ReturnStmt) Pos() token.Pos  { return s.Return }
+func (s *BeginStmt) Pos() token.Pos   { return s.Begin }
+func (s *IfStmt) Pos() token.Pos      { return s.If }
+func (s *WhileStmt) Pos() token.Pos   { return s.While }
+func (s *RepeatStmt) Pos() token.Pos  { return s.Repeat }
+func (s *ForStmt) Pos() token.Pos     { return s.For }
+
+func (s *BadStmt) End() token.Pos    { return s.To }
+func (s *AssignStmt) End() token.Pos { return s.Rhs.End() }
+func (s *CallStmt) End() token.Pos {
+	if s.Rparen.IsValid() {
+		return s.Rparen + 1
+	}
+	return s.Proc.End()
+}
+func (s *SendStmt) End() token.Pos    { return s.X.End() }
+func (s *ReceiveStmt) End() token.Pos { return s.X.End() }
+func (s *ReturnStmt) End() token.Pos  { return s.X.End() }
+func (s *BeginStmt) End() token.Pos   { return s.EndPos + token.Pos(len(token.END.String())) }
+func (s *IfStmt) End() token.Pos {
+	if s.Else != nil {
+		return s.Else.End()
+	}
+	if s.ElsePos.IsValid() {
+		return s.ElsePos + token.Pos(len(token.ELSE.String()))
+	}
+	if s.Body != nil {
+		return s.Body.End()
+	}
+	return s.Then + token.Pos(len(token.THEN.String()))
+}
+func (s *WhileStmt) End() token.Pos {
+	if s.Body != nil {
+		return s.Body.End()
+	}
+	return s.Do + token.Pos(len(token.DO.String()))
+}
+func (s *RepeatStmt) End() token.Pos { return s.Cond.End() }
+func (s *ForStmt) End() token.Pos {
+	if s.Body != nil {
+		return s.Body.End()
+	}
+	return s.Do + token.Pos(len(token.DO.String()))
+}
+
+func (c *OddCond) Pos() token.Pos { return c.Odd }
+func (c *RelCond) Pos() token.Pos { return c.X.Pos() }
+func (c *OddCond) End() token.Pos { return c.X.End() }
+func (c *RelCond) End() token.Pos { return c.Y.End() }
+
+func (x *BadExpr) Pos() token.Pos    { return x.From }
+func (x *Ident) Pos() token.Pos      { return x.NamePos }
+func (x *Number) Pos() token.Pos     { return x.ValuePos }
+func (x *UnaryExpr) Pos() token.Pos  { return x.OpPos }
+func (x *BinaryExpr) Pos() token.Pos { return x.X.Pos() }
+func (x *IndexExpr) Pos() token.Pos  { return x.X.Pos() }
+func (x *CallExpr) Pos() token.Pos   { return x.Func.Pos() }
 
-// All nodes implement the Node interface
-func (*Program) node()     {}
-func (*Block) node()       {}
-func (*ConstDecl) node()   {}
-func (*ProcDecl) node()    {}
-func (*AssignStmt) node()  {}
-func (*CallStmt) node()    {}
-func (*SendStmt) node()    {}
-func (*ReceiveStmt) node() {}
-func (*BeginStmt) node()   {}
-func (*IfStmt) node()      {}
-func (*WhileStmt) node()   {}
-func (*OddCond) node()     {}
-func (*RelCond) node()     {}
-func (*Ident) node()       {}
-func (*Number) node()      {}
-func (*UnaryExpr) node()   {}
-func (*BinaryExpr) node()  {}
+func (x *BadExpr) End() token.Pos    { return x.To }
+func (x *Ident) End() token.Pos      { return x.NamePos + token.Pos(len(x.Name)) }
+func (x *Number) End() token.Pos     { return x.ValuePos + token.Pos(len(x.Value)) }
+func (x *UnaryExpr) End() token.Pos  { return x.X.End() }
+func (x *BinaryExpr) End() token.Pos { return x.Y.End() }
+func (x *IndexExpr) End() token.Pos  { return x.Rbrack + 1 }
+func (x *CallExpr) End() token.Pos   { return x.Rparen + 1 }
@@ -0,0 +1,48 @@
+package ast
+
+import (
+	"strconv"
+
+	"pl0/compiler/token"
+)
+
+// ObjKind describes what an object represents.
+type ObjKind int
+
+const (
+	Bad  ObjKind = iota // For error handling
+	Con                 // Constant
+	Var                 // Variable
+	Proc                // Procedure
+	Func                // Function
+)
+
+func (k ObjKind) String() string {
+	switch k {
+	case Con:
+		return "CONST"
+	case Var:
+		return "VAR"
+	case Proc:
+		return "PROCEDURE"
+	case Func:
+		return "FUNCTION"
+	default:
+		return "kind(" + strconv.Itoa(int(k)) + ")"
+	}
+}
+
+// An Object describes a named constant, variable, procedure or function.
+// Resolution links each identifier to the object it denotes, or declares.
+type Object struct {
+	Kind   ObjKind
+	Name   string
+	Level  int       // Level of the declaring block; 0 for the main block
+	Offset int       // Index of a variable in its block, or of a parameter, from 0
+	Param  bool      // A parameter variable
+	Ref    bool      // A VAR parameter, denoting the variable passed to it
+	Len    int       // Length of an array variable; or 0
+	Value  int64     // Value of a constant
+	Proc   *ProcDecl // Declaration of a procedure or function
+	Pos    token.Pos // Position of the declaring identifier
+}
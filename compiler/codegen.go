@@ -1,251 +1,658 @@
 package compiler
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"pl0/compiler/ast"
+	"pl0/compiler/ir"
 	"pl0/compiler/token"
 	"strconv"
 )
 
-var (
-	out     io.Writer // Output stream
-	labelno int       // Label Counter
-	level   int       // Lexical level
-)
+// A Compiler translates programs for a target. It holds its own scanner,
+// symbol table and code generator state, so distinct compilers may be used
+// concurrently. A compiler may translate several programs in turn.
+type Compiler struct {
+	Parser
+
+	target Target  // Target operating system and architecture
+	m      machine // Target machine description
+
+	// Optimize enables the peephole optimization of the generated code.
+	Optimize bool
+
+	// Bounds enables the checking of array indexes at run time: an index
+	// out of range aborts the program, reporting its source line.
+	Bounds bool
+
+	// Verbose, if not nil, receives a line for each piece of dead code
+	// removed from the program, starting with its position.
+	Verbose io.Writer
+
+	out      io.Writer     // Output stream
+	labelno  int           // Label Counter
+	level    int           // Lexical level
+	universe *object       // Outermost scope
+	topScope *object       // Innermost scope
+	procs    []*ast.Object // Procedures and functions enclosing the current block
+	loops    []*ast.Object // Variables of the FOR loops enclosing the current statement
+
+	fn    *ir.Func                 // Function being lowered
+	cur   *ir.Block                // Block being lowered
+	irVar map[*ast.Object]*ir.Var  // Variables of the objects lowered
+	irFn  map[*ast.Object]*ir.Func // Functions of the procedures lowered
+	exit  *ir.Block                // Block returning from the function being lowered
+
+	defs   []*ir.Instr          // Instruction defining each register of the function
+	need   []int                // Scratch registers needed to evaluate each register
+	calls  []bool               // Whether the tree of each register calls a function
+	live   []pending            // Values computed and not yet used, oldest first
+	vars   map[*ir.Var]string   // Variables of the function kept in registers
+	saved  []string             // Callee-saved registers used by the function
+	labels map[*ir.Block]string // Labels of the blocks of the function
+	slots  map[*ir.Var]int      // Frame slots up to the end of each local variable
+}
+
+// NewCompiler returns a compiler for the given target.
+func NewCompiler(target Target) *Compiler {
+	return &Compiler{target: target, m: machines[target.Arch]}
+}
+
+// ParseAndTranslate parses a program from the source file filename, read
+// from in, and translates it to assembly. The output is incomplete if an
+// error is returned, which is an ErrorList.
+func (c *Compiler) ParseAndTranslate(filename string, in io.Reader, out io.Writer, name string) (err error) {
+	defer c.catch(&err)
+	c.Init(token.NewFile(filename), in)
+	prog := c.parseProgram(name)
+	if len(c.errors) > 0 {
+		return nil
+	}
+	c.resolve(prog)
+	if len(c.errors) > 0 {
+		return nil
+	}
+	c.gen(prog, out)
+	return nil
+}
 
 // gen takes a program in abstract form and generates code suitable for use
 // by an assembler.
-func gen(prog *ast.Program, w io.Writer) {
-	out = w
-
-	header(prog.Name)
-	prolog()
-	genMain(prog.Main)
-	epilog()
-}
-
-// genMain emits code for the main program node.
-func genMain(b *ast.Block) {
-	level = 0
-	genBlock("MAIN", b)
-	allocStatic(universe)
-}
-
-// genBlock emits code for a block node.
-func genBlock(name string, b *ast.Block) {
-	for _, c := range b.Consts {
-		obj := newObj(c.Name.Name, constCls)
-		obj.lev = level
-		obj.val = c.Value.Value
-	}
-	for p, v := range b.Vars {
-		obj := newObj(v.Name, varCls)
-		obj.lev = level
-		obj.pos = p + 1
-	}
-	for _, p := range b.Procs {
-		level++
-		obj := newObj(p.Name.Name, procCls)
-		obj.lev = level
-		openScope()
-		genBlock(obj.name, p.Block)
-		obj.dsc = topScope.next
-		closeScope()
-		level--
-	}
-	procProlog(name, len(b.Vars))
-	genStmt(b.Body)
-	procEpilog()
-}
-
-// genStmt emits code for the various statement nodes.
-func genStmt(s ast.Stmt) {
-	switch s := s.(type) {
-	case *ast.AssignStmt:
-		obj := find(s.Lhs.Name)
-		genExpr(s.Rhs)
-		if obj.kind == varCls {
-			storeVariable(obj, level)
+func (c *Compiler) gen(prog *ast.Program, w io.Writer) {
+	p := c.lower(prog)
+	if len(c.errors) > 0 {
+		return
+	}
+	ir.Fold(p, 8*c.m.word)
+	for _, r := range ir.Eliminate(p) {
+		if c.Verbose != nil {
+			fmt.Fprintf(c.Verbose, "%v: %s\n", c.file.Position(r.Pos), r.Msg)
+		}
+	}
+	var code bytes.Buffer
+	c.out = w
+	if c.Optimize {
+		c.out = &code
+	}
+	c.labelno = 0
+
+	c.layout(p)
+	c.header(p.Name)
+	c.prolog()
+	for _, f := range p.Funcs {
+		c.genFunc(f)
+	}
+	c.allocStatic(p.Main.Vars)
+	c.epilog()
+	if c.Optimize {
+		if err := peephole(c.m, &code, w); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// genFunc emits code for a function. The statements are generated in
+// order, each evaluating the expression trees of its operands.
+func (c *Compiler) genFunc(f *ir.Func) {
+	c.registerVars(f)
+	c.numberTrees(f)
+	c.live = c.live[:0]
+
+	// Label the blocks that are not only reached by falling through
+	c.labels = make(map[*ir.Block]string)
+	for i, b := range f.Blocks {
+		for j, t := range b.Succs() {
+			falseBranch := j == 1
+			if falseBranch || i+1 == len(f.Blocks) || t != f.Blocks[i+1] {
+				c.labels[t] = ""
+			}
+		}
+	}
+	for _, b := range f.Blocks {
+		if _, ok := c.labels[b]; ok {
+			c.labels[b] = c.newLabel()
+		}
+	}
+
+	nslot := 0
+	if f.Level > 0 {
+		for _, v := range f.Vars {
+			nslot = maxInt(nslot, c.slots[v])
+		}
+	}
+	c.procProlog(f.Name, nslot)
+	if f.Result != nil {
+		// A function returning without assigning its result returns 0
+		c.move(c.variable(f.Result), "0")
+	}
+	for i, b := range f.Blocks {
+		if L := c.labels[b]; L != "" {
+			c.postLabel(L)
+		}
+		var next *ir.Block
+		if i+1 < len(f.Blocks) {
+			next = f.Blocks[i+1]
+		}
+		for _, in := range b.Instrs {
+			if in.Dst == ir.None {
+				c.genInstr(in, next)
+			}
+		}
+	}
+}
+
+// genInstr emits code for an instruction computing no value, followed in
+// layout by the block next.
+func (c *Compiler) genInstr(in *ir.Instr, next *ir.Block) {
+	switch in.Op {
+	case ir.Store:
+		fp, x := in.Args[0], in.Args[1]
+		if c.defs[fp].Op == ir.FP {
+			c.assign(c.variable(in.Var), x)
+			break
+		}
+		y := ""
+		if c.addressable(x) && !isMemory(c.inPlace(x)) {
+			y = c.inPlace(x)
+		} else {
+			c.eval(x)
+		}
+		c.eval(fp)
+		dst := c.m.frame(c.take(fp), c.offset(in.Var))
+		if y == "" {
+			y = c.take(x)
+		}
+		c.move(dst, y)
+
+	case ir.StoreGlobal:
+		c.assign(c.m.static(static(in.Var.Name)), in.Args[0])
+
+	case ir.StoreInd:
+		a, x := in.Args[0], in.Args[1]
+		var ra, y string
+		switch {
+		case c.addressable(x) && !isMemory(c.inPlace(x)):
+			c.eval(a)
+			ra, y = c.take(a), c.inPlace(x)
+		case c.calls[a] || c.calls[x]:
+			// The index of an array element is computed first
+			c.eval(a)
+			c.eval(x)
+			y = c.take(x)
+			ra = c.take(a, y)
+		default:
+			c.eval(x)
+			c.eval(a)
+			ra = c.take(a)
+			y = c.take(x, ra)
+		}
+		c.move(c.m.frame(ra, 0), y)
+
+	case ir.Call:
+		c.invoke(in)
+
+	case ir.Write:
+		x := in.Args[0]
+		if c.addressable(x) {
+			c.move(c.m.ax, c.inPlace(x))
 		} else {
-			report("cannot assign to " + obj.name + " (kind " + obj.kind.String() + ")")
+			c.eval(x)
+			c.move(c.m.ax, c.take(x))
 		}
+		c.printNumber()
 
-	case *ast.CallStmt:
-		obj := find(s.Proc.Name)
-		if obj.kind != procCls {
-			report("cannot call non-procedure " + obj.name + " (kind " + obj.kind.String() + ")")
+	case ir.Jump:
+		if in.Targets[0] != next {
+			c.branch(c.labels[in.Targets[0]])
 		}
-		call(obj, level)
 
-	case *ast.BeginStmt:
-		for _, stmt := range s.List {
-			genStmt(stmt)
+	case ir.If:
+		t, f := in.Targets[0], in.Targets[1]
+		switch cond := c.defs[in.Args[0]]; {
+		case cond.Op == ir.Const:
+			if cond.Value == 0 {
+				t = f
+			}
+		case cond.Op.IsRelation():
+			_, _, ncc := c.compare(cond, false)
+			c.emitln("J" + ncc + " " + c.labels[f])
+		case cond.Op == ir.Odd:
+			c.emitln("TEST " + c.register(cond.Args[0]) + ", 1")
+			c.emitln("JE " + c.labels[f])
+		default:
+			x := c.register(in.Args[0])
+			c.emitln("TEST " + x + ", " + x)
+			c.emitln("JE " + c.labels[f])
+		}
+		if t != next {
+			c.branch(c.labels[t])
 		}
 
-	case *ast.IfStmt:
-		l1 := newLabel()
-		genCond(s.Cond)
-		branchFalse(l1)
-		genStmt(s.Body)
-		postLabel(l1)
-
-	case *ast.WhileStmt:
-		l1 := newLabel()
-		l2 := newLabel()
-		postLabel(l1)
-		genCond(s.Cond)
-		branchFalse(l2)
-		genStmt(s.Body)
-		branch(l1)
-		postLabel(l2)
-
-	case *ast.SendStmt:
-		genExpr(s.X)
-		printNumber()
-
-	case *ast.ReceiveStmt:
-		inputNumber()
-		obj := find(s.Name.Name)
-		if obj.kind == varCls {
-			storeVariable(obj, level)
+	case ir.Ret:
+		if len(in.Args) > 0 {
+			x := in.Args[0]
+			if c.addressable(x) {
+				c.move(c.m.ax, c.inPlace(x))
+			} else {
+				c.eval(x)
+				c.move(c.m.ax, c.take(x))
+			}
+		}
+		c.procEpilog()
+
+	default:
+		panic(fmt.Sprintf("unsupported instruction: %v", in))
+	}
+	if len(c.live) > 0 {
+		panic(fmt.Sprintf("values left after %v", in))
+	}
+}
+
+// mnemonics maps an arithmetic operation to its instruction.
+var mnemonics = map[ir.Op]string{
+	ir.Add: "ADD",
+	ir.Sub: "SUB",
+	ir.Mul: "IMUL",
+}
+
+// conditions maps a relation to the condition codes of its truth and of its
+// falsity, after comparing its operands.
+var conditions = map[ir.Op][2]string{
+	ir.Eq: {"E", "NE"},
+	ir.Ne: {"NE", "E"},
+	ir.Lt: {"L", "GE"},
+	ir.Le: {"LE", "G"},
+	ir.Gt: {"G", "LE"},
+	ir.Ge: {"GE", "L"},
+}
+
+// converse maps a relation to the one holding with its operands swapped.
+var converse = map[ir.Op]ir.Op{
+	ir.Eq: ir.Eq,
+	ir.Ne: ir.Ne,
+	ir.Lt: ir.Gt,
+	ir.Le: ir.Ge,
+	ir.Gt: ir.Lt,
+	ir.Ge: ir.Le,
+}
+
+// eval evaluates the expression tree of r into a scratch register.
+func (c *Compiler) eval(r ir.Reg) {
+	in := c.defs[r]
+	switch op := in.Op; {
+	case op == ir.Const || op == ir.LoadGlobal || op == ir.Load && c.addressable(r):
+		c.emitln("MOV " + c.alloc(r) + ", " + c.inPlace(r))
+
+	case op == ir.Load || op == ir.Link || op == ir.Addr:
+		offset := c.m.link()
+		if op != ir.Link {
+			offset = c.offset(in.Var)
+		}
+		var reg, base string
+		if a := in.Args[0]; c.defs[a].Op == ir.FP {
+			base, reg = c.m.bp, c.alloc(r)
 		} else {
-			report("cannot receive into " + obj.name + " (kind " + obj.kind.String() + ")")
+			c.eval(a)
+			base = c.take(a)
+			reg = base
+			c.hold(r, reg)
+		}
+		mnemonic := "MOV"
+		if op == ir.Addr {
+			mnemonic = "LEA"
 		}
+		c.emitln(mnemonic + " " + reg + ", " + c.m.frame(base, offset))
+
+	case op == ir.AddrGlobal:
+		c.emitln("LEA " + c.alloc(r) + ", " + c.m.static(static(in.Var.Name)))
+
+	case op == ir.Elem:
+		c.element(in)
+
+	case op == ir.LoadInd:
+		c.eval(in.Args[0])
+		reg := c.take(in.Args[0])
+		c.hold(r, reg)
+		c.emitln("MOV " + reg + ", " + c.m.frame(reg, 0))
+
+	case op == ir.Read:
+		c.spillAll()
+		c.inputNumber()
+		c.hold(r, c.m.ax)
+
+	case op == ir.Call:
+		c.spillAll()
+		c.invoke(in)
+		c.hold(r, c.m.ax)
+
+	case op == ir.Neg:
+		c.eval(in.Args[0])
+		reg := c.take(in.Args[0])
+		c.hold(r, reg)
+		c.emitln("NEG " + reg)
+
+	case op == ir.Odd:
+		c.eval(in.Args[0])
+		reg := c.take(in.Args[0])
+		c.hold(r, reg)
+		c.emitln("TEST " + reg + ", 1")
+		c.setCond(reg, "NE", "E")
+
+	case op.IsRelation():
+		reg, cc, ncc := c.compare(in, true)
+		c.hold(r, reg)
+		c.setCond(reg, cc, ncc)
+
+	case op == ir.Div:
+		c.divide(in)
+		c.hold(r, c.m.ax)
+
+	case op.IsBinary():
+		x, y, _ := c.operands(in)
+		rx, oy := c.evalTwo(x, y)
+		c.hold(r, rx)
+		c.emitln(mnemonics[op] + " " + rx + ", " + oy)
+
+	default:
+		panic(fmt.Sprintf("unsupported instruction: %v", in))
 	}
 }
 
-// genCond emits code for the various conditions nodes.
-func genCond(c ast.Cond) {
-	switch c := c.(type) {
-	case *ast.OddCond:
-		genExpr(c.X)
-		testParity()
-		setOdd()
-
-	case *ast.RelCond:
-		genExpr(c.X)
-		push()
-		genExpr(c.Y)
-		popCompare()
-		switch c.Op {
-		case token.EQL:
-			setEqual()
-		case token.NEQ:
-			setNotEqual()
-		case token.LSS:
-			setLess()
-		case token.LEQ:
-			setLessOrEqual()
-		case token.GRT:
-			setGreater()
-		case token.GEQ:
-			setGreaterOrEqual()
+// element computes the address of an array element into a scratch
+// register. A constant index, in range, is added to the address of the
+// array; another is checked if enabled, and scaled to the size of a word.
+func (c *Compiler) element(in *ir.Instr) {
+	r, a, i := in.Dst, in.Args[0], in.Args[1]
+	if k := c.defs[i]; k.Op == ir.Const {
+		off := c.m.word * int(k.Value)
+		switch def := c.defs[a]; {
+		case def.Op == ir.AddrGlobal:
+			c.emitln("LEA " + c.alloc(r) + ", " + c.m.static(static(def.Var.Name)+" + "+strconv.Itoa(off)))
+		case def.Op == ir.Addr && c.defs[def.Args[0]].Op == ir.FP:
+			c.emitln("LEA " + c.alloc(r) + ", " + c.m.frame(c.m.bp, c.offset(def.Var)+off))
 		default:
-			report(fmt.Sprintf("unsupported relation operator: %q", c.Op))
+			c.eval(a)
+			reg := c.take(a)
+			c.hold(r, reg)
+			c.emitln("LEA " + reg + ", " + c.m.frame(reg, off))
+		}
+		return
+	}
+	ra, ri := c.evalBoth(a, i)
+	c.hold(r, ra)
+	if c.Bounds {
+		// A negative index is out of range as an unsigned number
+		L := c.newLabel()
+		c.emitln("CMP " + ri + ", " + strconv.FormatInt(in.Value, 10))
+		c.emitln("JB " + L)
+		c.emitln("MOV " + c.m.ax + ", " + strconv.Itoa(c.file.Position(in.Pos).Line))
+		c.emitln("CALL BOUNDS")
+		c.postLabel(L)
+	}
+	c.emitln("IMUL " + ri + ", " + ri + ", " + strconv.Itoa(c.m.word))
+	c.emitln("ADD " + ra + ", " + ri)
+}
+
+// evalTwo evaluates the operands x and y of an instruction, the one needing
+// more registers first unless either calls a function, and uses them up. It
+// returns the scratch register holding x, and the operand of y: in place if
+// addressable, or else the scratch register holding it.
+func (c *Compiler) evalTwo(x, y ir.Reg) (string, string) {
+	if c.addressable(y) {
+		c.eval(x)
+		return c.take(x), c.inPlace(y)
+	}
+	return c.evalBoth(x, y)
+}
+
+// evalBoth evaluates the operands x and y of an instruction into scratch
+// registers, the one needing more registers first unless either calls a
+// function, and uses them up, returning their registers.
+func (c *Compiler) evalBoth(x, y ir.Reg) (string, string) {
+	if c.need[y] > c.need[x] && !c.calls[x] && !c.calls[y] {
+		c.eval(y)
+		c.eval(x)
+		rx := c.take(x)
+		return rx, c.take(y, rx)
+	}
+	c.eval(x)
+	c.eval(y)
+	ry := c.take(y)
+	return c.take(x, ry), ry
+}
+
+// compare compares the operands of a relation, returning the condition
+// codes of its truth and falsity. The first operand is compared in place if
+// a variable, unless read after a call, or else in a scratch register, also
+// returned, as it is if into is set.
+func (c *Compiler) compare(in *ir.Instr, into bool) (reg, cc, ncc string) {
+	x, y, swapped := c.operands(in)
+	var oy string
+	if c.addressable(x) && !isImmediate(c.inPlace(x)) && !into && !c.calls[y] {
+		reg = c.inPlace(x)
+		oy = c.source(y, reg)
+		if isImmediate(oy) {
+			reg = c.sized(reg)
 		}
+	} else {
+		reg, oy = c.evalTwo(x, y)
 	}
+	c.emitln("CMP " + reg + ", " + oy)
+	op := in.Op
+	if swapped {
+		op = converse[op]
+	}
+	return reg, conditions[op][0], conditions[op][1]
+}
+
+// divide divides the operands of a division, leaving the quotient in ax.
+// The other values are spilled, as the division takes ax and dx.
+func (c *Compiler) divide(in *ir.Instr) {
+	rx, y := c.evalTwo(in.Args[0], in.Args[1])
+	c.spillAll()
+	ax, cx, dx := c.m.ax, c.m.cx, c.m.dx
+	switch {
+	case y == ax && rx == cx:
+		c.move(dx, ax)
+		c.move(ax, cx)
+		c.move(cx, dx)
+		y = cx
+	case y == ax:
+		c.move(cx, ax)
+		c.move(ax, rx)
+		y = cx
+	default:
+		c.move(ax, rx)
+		if y == dx || isImmediate(y) {
+			c.move(cx, y)
+			y = cx
+		}
+	}
+	c.emitln(c.m.extend) // Sign extend into dx
+	c.emitln("IDIV " + c.sized(y))
 }
 
-// genExpr emits code for the various expression nodes.
-func genExpr(x ast.Expr) {
-	switch x := x.(type) {
-	case *ast.UnaryExpr:
-		genExpr(x.X)
-		switch x.Op {
-		case token.PLUS: // Noop case
-		case token.MINUS:
-			negate()
-		default:
-			report(fmt.Sprintf("unsupported unary operator: %q", x.Op))
+// variable returns the operand of a variable of the current frame.
+func (c *Compiler) variable(v *ir.Var) string {
+	if reg, ok := c.vars[v]; ok {
+		return reg
+	}
+	return c.m.frame(c.m.bp, c.offset(v))
+}
+
+// assign stores the value of x into dst, a variable in a register or in
+// memory. Adding to, subtracting from or multiplying the variable itself
+// is done in place, except multiplying in memory, or by a function result
+// computed after reading the variable.
+func (c *Compiler) assign(dst string, x ir.Reg) {
+	in := c.defs[x]
+	if (in.Op == ir.Add || in.Op == ir.Sub || in.Op == ir.Mul && !isMemory(dst)) && !c.calls[x] {
+		a, b := in.Args[0], in.Args[1]
+		if in.Op != ir.Sub && c.isVar(b, dst) && !c.isVar(a, dst) {
+			a, b = b, a
+		}
+		if c.isVar(a, dst) {
+			y := c.source(b, dst)
+			if isImmediate(y) {
+				dst = c.sized(dst)
+			}
+			c.emitln(mnemonics[in.Op] + " " + dst + ", " + y)
+			return
 		}
+	}
+	c.move(dst, c.source(x, dst))
+}
 
-	case *ast.BinaryExpr:
-		genExpr(x.X)
-		push()
-		genExpr(x.Y)
-		switch x.Op {
-		case token.PLUS:
-			popAdd()
-		case token.MINUS:
-			popSub()
-			negate()
-		case token.TIMES:
-			popMul()
-		case token.DIV:
-			popDiv()
-		default:
-			report(fmt.Sprintf("unsupported binary operator: %q", x.Op))
+// isVar reports whether r is the value of the variable addressed by operand x.
+func (c *Compiler) isVar(r ir.Reg, x string) bool {
+	op := c.defs[r].Op
+	return (op == ir.Load || op == ir.LoadGlobal) && c.addressable(r) && c.inPlace(r) == x
+}
+
+// source evaluates r as the source operand of an instruction with operand
+// dst, returning it in place if addressable and not both in memory, or
+// else the scratch register holding it.
+func (c *Compiler) source(r ir.Reg, dst string) string {
+	if c.addressable(r) && !(isMemory(dst) && isMemory(c.inPlace(r))) {
+		return c.inPlace(r)
+	}
+	c.eval(r)
+	return c.take(r)
+}
+
+// register evaluates r, returning the register holding it: the register of
+// a variable, or a scratch register.
+func (c *Compiler) register(r ir.Reg) string {
+	if c.addressable(r) && c.defs[r].Op == ir.Load {
+		if reg, ok := c.vars[c.defs[r].Var]; ok {
+			return reg
 		}
+	}
+	c.eval(r)
+	return c.take(r)
+}
 
-	case *ast.Number:
-		loadConstant(x.Value)
+// move copies operand src into dst, unless the same.
+func (c *Compiler) move(dst, src string) {
+	if dst == src {
+		return
+	}
+	if isImmediate(src) {
+		dst = c.sized(dst)
+	}
+	c.emitln("MOV " + dst + ", " + src)
+}
 
-	case *ast.Ident:
-		obj := find(x.Name)
-		if obj.kind == varCls {
-			loadVariable(obj, level)
-		} else if obj.kind == constCls {
-			loadConstant(obj.val)
-		} else {
-			report("cannot use " + obj.name + " (kind " + obj.kind.String() + ") in expression")
+// offset returns the offset of a variable from its frame pointer: below it
+// for a local variable, and above the static link for a parameter. An
+// array is addressed by its first element, at the lowest address.
+func (c *Compiler) offset(v *ir.Var) int {
+	if v.Param {
+		return c.m.link() + c.m.word*v.Index
+	}
+	return -c.m.word * c.slots[v]
+}
+
+// layout lays out the frames of the functions of p: their local variables
+// take a slot each, and arrays one for each element, in order below the
+// frame pointer. The variables kept in registers take none.
+func (c *Compiler) layout(p *ir.Program) {
+	c.slots = make(map[*ir.Var]int)
+	for _, f := range p.Funcs {
+		c.registerVars(f)
+		n := 0
+		for _, v := range f.Vars {
+			if _, ok := c.vars[v]; ok {
+				continue
+			}
+			n += maxInt(1, v.Len)
+			c.slots[v] = n
 		}
 	}
 }
 
 // write writes to the output stream.
-func write(a ...interface{}) {
-	fmt.Fprint(out, a...)
+func (c *Compiler) write(a ...interface{}) {
+	fmt.Fprint(c.out, a...)
 }
 
 // writeln writes to the output stream, followed by a newline.
-func writeln(a ...interface{}) {
-	write(a...)
-	fmt.Fprintln(out)
+func (c *Compiler) writeln(a ...interface{}) {
+	c.write(a...)
+	fmt.Fprintln(c.out)
 }
 
 // emit emits an instruction.
-func emit(s string) {
-	write("\t", s)
+func (c *Compiler) emit(s string) {
+	c.write("\t", s)
 }
 
 // emit emits an instruction, followed by a newline.
-func emitln(s string) {
-	emit(s)
-	writeln()
+func (c *Compiler) emitln(s string) {
+	c.emit(s)
+	c.writeln()
 }
 
 // newLabel generates a unique label.
-func newLabel() string {
-	defer func() { labelno++ }()
-	return fmt.Sprintf("L%d", labelno)
+func (c *Compiler) newLabel() string {
+	defer func() { c.labelno++ }()
+	return fmt.Sprintf("L%d", c.labelno)
 }
 
 // postLabel posts a label.
-func postLabel(L string) {
-	write(L + ":")
-	writeln()
+func (c *Compiler) postLabel(L string) {
+	c.write(L + ":")
+	c.writeln()
 }
 
-// header writes the program header info.
-func header(name string) {
-	writeln("; program: \"" + name + "\"")
-	writeln(`;
-; asm:   nasm
-; os:    darwin
-; arch:  386
-;
+// entry returns the entry point symbol expected by the target linker.
+func (c *Compiler) entry() string {
+	if c.target.OS == "linux" {
+		return "_start"
+	}
+	return "start"
+}
 
-global  start           ; must be declared for linker (ld)
-`)
+// header writes the program header info.
+func (c *Compiler) header(name string) {
+	c.writeln("; program: \"" + name + "\"")
+	c.writeln(";")
+	c.writeln("; asm:   pl0/asm, in nasm syntax")
+	c.writeln("; os:    " + c.target.OS)
+	c.writeln("; arch:  " + c.target.Arch)
+	c.writeln(";")
+	c.writeln()
+	c.writeln(fmt.Sprintf("global  %-15s ; must be declared for linker (ld)", c.entry()))
+	c.writeln()
 }
 
 // prolog writes the program prolog.
-func prolog() {
-	writeln(`
-section .text
-start:                  ; tell linker entry point
-
+func (c *Compiler) prolog() {
+	c.writeln()
+	c.writeln("section .text")
+	c.writeln(fmt.Sprintf("%-23s ; tell linker entry point", c.entry()+":"))
+	c.write(`
 	; call main program
 	CALL MAIN
 
@@ -255,59 +662,83 @@ start:                  ; tell linker entry point
 ; compiled code starts here
 ;
 `)
+	c.writeln()
 }
 
 // epilog writes the program epilog.
-func epilog() {
-	writeln(`
+func (c *Compiler) epilog() {
+	c.writeln(`
 ; compiled code ends here
 ;`)
-	writeln()
+	c.writeln()
 }
 
-// call prepares and calls a procedure.
-func call(proc *object, level int) {
-	switch proc.lev {
-
-	// Child
-	case level + 1:
-		emitln("PUSH EBP")
-
-	// Peer
-	case level:
-		emitln("PUSH dword [EBP + 8]")
-
-	// Ancestor
+// invoke calls the procedure or function of a call instruction, pushing its
+// arguments in order.
+func (c *Compiler) invoke(in *ir.Instr) {
+	n := len(in.Args) - 1
+	for _, x := range in.Args[:n] {
+		c.push(x)
+	}
+	link := in.Args[n]
+	switch def := c.defs[link]; {
+	case def.Op == ir.FP:
+		c.call(in.Func.Name, c.m.bp, n)
+	case def.Op == ir.Link && c.defs[def.Args[0]].Op == ir.FP:
+		c.call(in.Func.Name, c.sized(c.m.frame(c.m.bp, c.m.link())), n)
 	default:
-		walk(level - proc.lev)
-		emitln("PUSH dword [EBX + 8]")
+		c.eval(link)
+		c.call(in.Func.Name, c.take(link), n)
+	}
+}
+
+// push pushes the value of r on the machine stack, as an argument.
+func (c *Compiler) push(r ir.Reg) {
+	if c.addressable(r) {
+		c.emitln("PUSH " + c.sized(c.inPlace(r)))
+		return
 	}
+	c.eval(r)
+	c.emitln("PUSH " + c.take(r))
+}
 
-	emitln("CALL " + proc.name)
-	emitln("ADD ESP, 4") // Cleanup stack after return from procedure call
+// call calls a procedure, whose nargs arguments are pushed, passing the
+// frame address in register link as its static link.
+func (c *Compiler) call(name, link string, nargs int) {
+	c.emitln("PUSH " + link)
+	c.emitln("CALL " + name)
+	c.emitln("ADD " + c.m.sp + ", " + strconv.Itoa(c.m.word*(1+nargs))) // Cleanup stack after return from procedure call
 }
 
 // doReturn from procedure call.
-func doReturn() {
-	emitln("RET")
-	writeln("")
+func (c *Compiler) doReturn() {
+	c.emitln("RET")
+	c.writeln("")
 }
 
 // write the prolog for a procedure.
-func procProlog(name string, nvar int) {
-	postLabel(name)
-	emitln("PUSH EBP")
-	emitln("MOV EBP, ESP")
-	emitln("SUB ESP, " + strconv.Itoa(4*nvar))
-	writeln("")
+func (c *Compiler) procProlog(name string, nvar int) {
+	c.postLabel(name)
+	c.emitln("PUSH " + c.m.bp)
+	c.emitln("MOV " + c.m.bp + ", " + c.m.sp)
+	if nvar > 0 {
+		c.emitln("SUB " + c.m.sp + ", " + strconv.Itoa(c.m.word*nvar))
+	}
+	for _, reg := range c.saved {
+		c.emitln("PUSH " + reg)
+	}
+	c.writeln("")
 }
 
 // write the epilog for a procedure.
-func procEpilog() {
-	writeln("")
-	emitln("MOV ESP, EBP")
-	emitln("POP EBP")
-	doReturn()
+func (c *Compiler) procEpilog() {
+	c.writeln("")
+	for i := len(c.saved) - 1; i >= 0; i-- {
+		c.emitln("POP " + c.saved[i])
+	}
+	c.emitln("MOV " + c.m.sp + ", " + c.m.bp)
+	c.emitln("POP " + c.m.bp)
+	c.doReturn()
 }
 
 // static prepends a variable with the "_" literal.
@@ -315,180 +746,49 @@ func static(name string) string {
 	return "_" + name
 }
 
-// allocStatic allocates storage for a static variable.
-func allocStatic(scope *object) {
-	writeln()
-	writeln()
-	writeln(`section .data`)
-	for x := scope.next; x != nil; x = x.next {
-		if x.kind == varCls {
-			writeln(static(x.name) + ": dd 0")
+// allocStatic allocates storage for the static variables, and the static
+// arrays in the zero filled bss section.
+func (c *Compiler) allocStatic(vars []*ir.Var) {
+	c.writeln()
+	c.writeln()
+	c.writeln(`section .data`)
+	var arrays []*ir.Var
+	for _, v := range vars {
+		if v.Len > 0 {
+			arrays = append(arrays, v)
+			continue
 		}
+		c.writeln(static(v.Name) + ": " + c.m.data + " 0")
 	}
-}
-
-// loadConstant loads the primary register with a constant.
-func loadConstant(number string) {
-	emitln("MOV EAX, " + number)
-}
-
-// storeVariable stores the primary register with static, local or non-local variable.
-func storeVariable(variable *object, level int) {
-	offset := -4 * variable.pos
-
-	switch variable.lev {
-
-	// static
-	case 0:
-		emitln("MOV [" + static(variable.name) + "], EAX")
-
-	// local
-	case level:
-		emitln("MOV [EBP + " + strconv.Itoa(offset) + "], EAX")
-
-	// non-local
-	default:
-		walk(level - variable.lev)
-		emitln("MOV [EBX + " + strconv.Itoa(offset) + "], EAX")
+	if len(arrays) == 0 {
+		return
 	}
-}
-
-// loadVariable loads the primary register with a static, local or non-local variable.
-func loadVariable(variable *object, level int) {
-	offset := -4 * variable.pos
-
-	switch variable.lev {
-
-	// static
-	case 0:
-		emitln("MOV EAX, [" + static(variable.name) + "]")
-
-	// local
-	case level:
-		emitln("MOV EAX, [EBP + " + strconv.Itoa(offset) + "]")
-
-	// non-local
-	default:
-		walk(level - variable.lev)
-		emitln("MOV EAX, [EBX + " + strconv.Itoa(offset) + "]")
-	}
-}
-
-// walk follows the static link chain n levels.
-func walk(n int) {
-	emitln("MOV EBX, [EBP + 8]")
-	for i := 1; i < n; i++ {
-		emitln("MOV EBX, [EBX + 8]")
+	c.writeln()
+	c.writeln(`section .bss`)
+	for _, v := range arrays {
+		c.writeln(static(v.Name) + ": " + c.m.reserve + " " + strconv.Itoa(v.Len))
 	}
 }
 
-// push primary register to stack.
-func push() {
-	emitln("PUSH EAX")
-}
-
-// negate primary register.
-func negate() {
-	emitln("NEG EAX")
-}
-
-// popMul multiplies top-of-stack by primary register.
-func popMul() {
-	emitln("POP ECX")
-	emitln("IMUL ECX")
-}
-
-// popDiv divides top of stack by primary register.
-func popDiv() {
-	emitln("MOV ECX, EAX")
-	emitln("POP EAX")
-	emitln("XOR EDX, EDX") // Clear EDX
-	emitln("IDIV ECX")
-}
-
-// popAdd adds top-of-stack to primary register.
-func popAdd() {
-	emitln("POP EDX")
-	emitln("ADD EAX, EDX")
-}
-
-// popSub subtracts top-of-stack from primary register.
-func popSub() {
-	emitln("POP EDX")
-	emitln("SUB EAX, EDX")
-}
-
-// popCompare compares top of stack with primary register.
-func popCompare() {
-	emitln("POP EDX")
-	emitln("CMP EDX, EAX")
-}
-
-// setEqual sets primary register if compare was "equal".
-func setEqual() {
-	emitln("CMOVE  EAX, [TRUE]")
-	emitln("CMOVNE EAX, [FALSE]")
-}
-
-// setNotEqual sets primary register if compare was "not equal".
-func setNotEqual() {
-	emitln("CMOVNE EAX, [TRUE]")
-	emitln("CMOVE  EAX, [FALSE]")
-}
-
-// setLess sets primary register if compare was "less than".
-func setLess() {
-	emitln("CMOVL  EAX, [TRUE]")
-	emitln("CMOVGE EAX, [FALSE]")
-}
-
-// setGreater sets primary register if compare was "greater than".
-func setGreater() {
-	emitln("CMOVG  EAX, [TRUE]")
-	emitln("CMOVLE EAX, [FALSE]")
-}
-
-// setLessOrEqual sets primary register if compare was "less or equal".
-func setLessOrEqual() {
-	emitln("CMOVLE EAX, [TRUE]")
-	emitln("CMOVG  EAX, [FALSE]")
-}
-
-// setGreaterOrEqual sets primary register if compare was "greater or equal".
-func setGreaterOrEqual() {
-	emitln("CMOVGE EAX, [TRUE]")
-	emitln("CMOVL  EAX, [FALSE]")
-}
-
-// testParity tests primary register for parity (even/odd).
-func testParity() {
-	emitln("TEST EAX, 1")
-}
-
-// setOdd sets primary register if parity test was "odd".
-func setOdd() {
-	emitln("CMOVPO EAX, [TRUE]")
-	emitln("CMOVPE EAX, [FALSE]")
+// setCond sets reg to TRUE if the condition code cc holds and to FALSE if
+// its negation ncc holds.
+func (c *Compiler) setCond(reg, cc, ncc string) {
+	c.emitln(fmt.Sprintf("%-6s %s, %s", "CMOV"+cc, reg, c.m.static("TRUE")))
+	c.emitln(fmt.Sprintf("%-6s %s, %s", "CMOV"+ncc, reg, c.m.static("FALSE")))
 }
 
 // branch jumps unconditional.
-func branch(L string) {
-	emitln("JMP " + L)
-}
-
-// branchFalse branches if primary register is false.
-func branchFalse(L string) {
-	emitln("TEST EAX, -1") // -1 is true
-	emitln("JE " + L)
+func (c *Compiler) branch(L string) {
+	c.emitln("JMP " + L)
 }
 
-// inputNumber reads a number into the primary register.
-func inputNumber() {
-	emitln("CALL SCANN")
+// inputNumber reads a number into ax.
+func (c *Compiler) inputNumber() {
+	c.emitln("CALL SCANN")
 }
 
-// printNumber prints primary register followed by a newline.
-func printNumber() {
-	emitln("CALL PRINTN")
-	emitln("CALL NEWLINE")
+// printNumber prints ax followed by a newline.
+func (c *Compiler) printNumber() {
+	c.emitln("CALL PRINTN")
+	c.emitln("CALL NEWLINE")
 }
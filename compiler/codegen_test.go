@@ -0,0 +1,306 @@
+package compiler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// compile compiles a program for linux/386, returning the assembly.
+func compile(t *testing.T, src string) string {
+	t.Helper()
+	var out bytes.Buffer
+	if err := NewCompiler(Linux386).ParseAndTranslate("", strings.NewReader(src), &out, "p"); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+// procedure returns the code of a procedure in assembly s.
+func procedure(s, name string) string {
+	i := strings.Index(s, "\n"+name+":\n")
+	if i < 0 {
+		return ""
+	}
+	s = s[i+1:]
+	return s[:strings.Index(s, "\tRET\n")+len("\tRET\n")]
+}
+
+func TestRegisters(t *testing.T) {
+	const src = `VAR a, b, c, d, e, x;
+PROCEDURE order;
+	x := a - (b - c) * (d - e);
+PROCEDURE spill;
+	x := (((a - b) - (c - d)) - ((e - a) - (b - c))) - (((d - e) - (a - b)) - ((c - d) - (e - a)));
+PROCEDURE divide;
+	x := a / (b - c) + (d - e) / 3;
+PROCEDURE leaf;
+	VAR i, s, t, u;
+	BEGIN
+		i := 0; s := 0; u := a;
+		WHILE i < a DO BEGIN s := s + i * i; i := i + 1 END;
+		t := s / 2;
+		x := s - t + u
+	END;
+PROCEDURE outer;
+	VAR i;
+	PROCEDURE inner; i := i + x;
+	BEGIN i := a; CALL inner; x := i END;
+BEGIN CALL order; CALL spill; CALL divide; CALL leaf; CALL outer END.`
+	tests := []struct {
+		name, want string
+	}{
+		// The operand needing more registers first
+		{"order", `order:
+	PUSH EBP
+	MOV EBP, ESP
+
+	MOV EAX, [_b]
+	SUB EAX, [_c]
+	MOV ECX, [_d]
+	SUB ECX, [_e]
+	IMUL EAX, ECX
+	MOV ECX, [_a]
+	SUB ECX, EAX
+	MOV [_x], ECX
+
+	MOV ESP, EBP
+	POP EBP
+	RET
+`},
+		// Spilling the oldest value
+		{"spill", `spill:
+	PUSH EBP
+	MOV EBP, ESP
+
+	MOV EAX, [_a]
+	SUB EAX, [_b]
+	MOV ECX, [_c]
+	SUB ECX, [_d]
+	SUB EAX, ECX
+	MOV ECX, [_e]
+	SUB ECX, [_a]
+	MOV EDX, [_b]
+	SUB EDX, [_c]
+	SUB ECX, EDX
+	SUB EAX, ECX
+	MOV ECX, [_d]
+	SUB ECX, [_e]
+	MOV EDX, [_a]
+	SUB EDX, [_b]
+	SUB ECX, EDX
+	MOV EDX, [_c]
+	SUB EDX, [_d]
+	PUSH EAX
+	MOV EAX, [_e]
+	SUB EAX, [_a]
+	SUB EDX, EAX
+	SUB ECX, EDX
+	POP EAX
+	SUB EAX, ECX
+	MOV [_x], EAX
+
+	MOV ESP, EBP
+	POP EBP
+	RET
+`},
+		// Moving the operands of divisions into place
+		{"divide", `divide:
+	PUSH EBP
+	MOV EBP, ESP
+
+	MOV EAX, [_a]
+	MOV ECX, [_b]
+	SUB ECX, [_c]
+	CDQ
+	IDIV ECX
+	MOV ECX, [_d]
+	SUB ECX, [_e]
+	PUSH EAX
+	MOV EAX, ECX
+	MOV ECX, 3
+	CDQ
+	IDIV ECX
+	POP ECX
+	ADD ECX, EAX
+	MOV [_x], ECX
+
+	MOV ESP, EBP
+	POP EBP
+	RET
+`},
+		// Variables of leaf procedures in callee-saved registers
+		{"leaf", `leaf:
+	PUSH EBP
+	MOV EBP, ESP
+	SUB ESP, 4
+	PUSH EBX
+	PUSH ESI
+	PUSH EDI
+
+	MOV EBX, 0
+	MOV ESI, 0
+	MOV EAX, [_a]
+	MOV [EBP + -4], EAX
+L0:
+	CMP EBX, [_a]
+	JGE L1
+	MOV EAX, EBX
+	IMUL EAX, EBX
+	ADD ESI, EAX
+	ADD EBX, 1
+	JMP L0
+L1:
+	MOV EAX, ESI
+	MOV ECX, 2
+	CDQ
+	IDIV ECX
+	MOV EDI, EAX
+	MOV EAX, ESI
+	SUB EAX, EDI
+	ADD EAX, [EBP + -4]
+	MOV [_x], EAX
+
+	POP EDI
+	POP ESI
+	POP EBX
+	MOV ESP, EBP
+	POP EBP
+	RET
+`},
+		// Frames in scratch registers
+		{"inner", `inner:
+	PUSH EBP
+	MOV EBP, ESP
+
+	MOV EAX, [EBP + 8]
+	MOV EAX, [EAX + -4]
+	ADD EAX, [_x]
+	MOV ECX, [EBP + 8]
+	MOV [ECX + -4], EAX
+
+	MOV ESP, EBP
+	POP EBP
+	RET
+`},
+		{"outer", `outer:
+	PUSH EBP
+	MOV EBP, ESP
+	SUB ESP, 4
+
+	MOV EAX, [_a]
+	MOV [EBP + -4], EAX
+	PUSH EBP
+	CALL inner
+	ADD ESP, 4
+	MOV EAX, [EBP + -4]
+	MOV [_x], EAX
+
+	MOV ESP, EBP
+	POP EBP
+	RET
+`},
+	}
+	s := compile(t, src)
+	for _, tt := range tests {
+		if got := procedure(s, tt.name); got != tt.want {
+			t.Errorf("%s:\ngot:\n%s\nwant:\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestArrays(t *testing.T) {
+	const src = `VAR g[4], i;
+PROCEDURE p;
+	VAR a[3], j;
+	BEGIN j := i; a[j] := g[2]; g[j + 1] := a[0] END;
+BEGIN CALL p END.`
+	const want = `p:
+	PUSH EBP
+	MOV EBP, ESP
+	SUB ESP, 12
+	PUSH EBX
+
+	MOV EBX, [_i]
+	LEA EAX, [_g + 8]
+	MOV EAX, [EAX + 0]
+	LEA ECX, [EBP + -12]
+	MOV EDX, EBX
+	CMP EDX, 3
+	JB L0
+	MOV EAX, 4
+	CALL BOUNDS
+L0:
+	IMUL EDX, EDX, 4
+	ADD ECX, EDX
+	MOV [ECX + 0], EAX
+	LEA EAX, [EBP + -12]
+	MOV EAX, [EAX + 0]
+	LEA ECX, [_g]
+	MOV EDX, EBX
+	ADD EDX, 1
+	CMP EDX, 4
+	JB L1
+	MOV EAX, 4
+	CALL BOUNDS
+L1:
+	IMUL EDX, EDX, 4
+	ADD ECX, EDX
+	MOV [ECX + 0], EAX
+
+	POP EBX
+	MOV ESP, EBP
+	POP EBP
+	RET
+`
+	c := NewCompiler(Linux386)
+	c.Bounds = true
+	var out bytes.Buffer
+	if err := c.ParseAndTranslate("", strings.NewReader(src), &out, "p"); err != nil {
+		t.Fatal(err)
+	}
+	s := out.String()
+	if got := procedure(s, "p"); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if !strings.Contains(s, "section .bss\n_g: resd 4\n") {
+		t.Errorf("no static allocation of g in:\n%s", s)
+	}
+	if s := compile(t, src); strings.Contains(s, "CALL BOUNDS") {
+		t.Errorf("bounds checked without Bounds:\n%s", procedure(s, "p"))
+	}
+}
+
+// instructions counts the instructions of the compiled code in assembly s.
+func instructions(s string) int {
+	s = s[strings.Index(s, "; compiled code starts here"):strings.Index(s, "section .data")]
+	n := 0
+	for _, line := range strings.Split(s, "\n") {
+		if in := parseInstr(line); in != nil && in.op != "" {
+			n++
+		}
+	}
+	return n
+}
+
+func TestInstructionCounts(t *testing.T) {
+	tests := []struct {
+		file string
+		max  int // With a stack of operands: 98 and 257
+	}{
+		{"../example/primes.pl0", 50},
+		{"../example/math.pl0", 146},
+	}
+	for _, tt := range tests {
+		src, err := ioutil.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := instructions(compile(t, string(src)))
+		t.Logf("%s: %d instructions", tt.file, n)
+		if n > tt.max {
+			t.Errorf("%s: %d instructions, want at most %d", tt.file, n, tt.max)
+		}
+	}
+}
@@ -2,26 +2,152 @@ package compiler
 
 import (
 	"fmt"
-	"os"
+	"strconv"
+
+	"pl0/compiler/ast"
+	"pl0/compiler/token"
+)
+
+// ErrorKind classifies compile errors.
+type ErrorKind int
+
+const (
+	SyntaxError    ErrorKind = iota // Malformed program text
+	UndefinedError                  // Use of an undeclared identifier
+	DuplicateError                  // Identifier declared twice in a scope
+	KindError                       // Identifier used contrary to its kind
+	ConstError                      // Invalid constant expression
+
+	// Warnings of Vet, for valid programs
+	UnusedWarning     // Identifier declared and not used
+	UnassignedWarning // Variable read before it is assigned
+	ShadowWarning     // Variable hiding a variable of an enclosing block
 )
 
-// report writes error message and halt.
-func report(s string) {
-	fmt.Fprintf(os.Stderr, "error:%d:%s\n", lineno, s)
-	os.Exit(1)
+func (k ErrorKind) String() string {
+	switch k {
+	case SyntaxError:
+		return "syntax"
+	case UndefinedError:
+		return "undefined"
+	case DuplicateError:
+		return "duplicate"
+	case KindError:
+		return "kind mismatch"
+	case ConstError:
+		return "constant"
+	case UnusedWarning:
+		return "unused"
+	case UnassignedWarning:
+		return "unassigned"
+	case ShadowWarning:
+		return "shadow"
+	default:
+		return "kind(" + strconv.Itoa(int(k)) + ")"
+	}
+}
+
+// An Error describes a problem found while compiling a program, or a
+// warning of Vet.
+type Error struct {
+	Pos  token.Position
+	Kind ErrorKind
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Pos.String() + ": " + e.Msg
+}
+
+// ErrorList is a list of errors, in the order they were found.
+type ErrorList []*Error
+
+// Add adds an error to the list.
+func (l *ErrorList) Add(pos token.Position, kind ErrorKind, msg string) {
+	*l = append(*l, &Error{Pos: pos, Kind: kind, Msg: msg})
+}
+
+// Error describes the first error and the number of the others.
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
+}
+
+// Err returns an error equivalent to this error list, or nil if the list
+// is empty.
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// DefaultMaxErrors is the number of errors recorded before giving up, when
+// the MaxErrors field of a scanner is zero.
+const DefaultMaxErrors = 10
+
+// bailout is the panic value used to unwind the parser to a recovery point.
+type bailout struct{}
+
+// error records an error at pos. A syntax error on the line of the previous
+// error is dropped, being most likely a consequence of it. Once the error
+// limit is reached, a final "too many errors" is recorded and further errors
+// are dropped.
+func (s *Scanner) error(pos token.Pos, kind ErrorKind, msg string) {
+	max := s.MaxErrors
+	if max == 0 {
+		max = DefaultMaxErrors
+	}
+	if max > 0 && len(s.errors) > max {
+		return
+	}
+	var position token.Position
+	if s.file != nil {
+		position = s.file.Position(pos)
+	}
+	if n := len(s.errors); kind == SyntaxError && n > 0 && s.errors[n-1].Pos.Line == position.Line {
+		return
+	}
+	if max > 0 && len(s.errors) == max {
+		msg = "too many errors"
+	}
+	s.errors.Add(position, kind, msg)
+}
+
+// catch stops the unwinding started by a bailout, storing the recorded
+// errors in err. Any other panic is propagated.
+func (s *Scanner) catch(err *error) {
+	if e := recover(); e != nil {
+		if _, ok := e.(bailout); !ok {
+			panic(e)
+		}
+	}
+	if *err == nil {
+		*err = s.errors.Err()
+	}
 }
 
 // undefined reports an undefined identifier.
-func undefined(ident string) {
-	report("undefined identifier " + ident)
+func (s *Scanner) undefined(id *ast.Ident) {
+	s.error(id.Pos(), UndefinedError, "undefined identifier "+id.Name)
 }
 
 // duplicate reports a duplicate identifier.
-func duplicate(ident string) {
-	report("duplicate identifier " + ident)
+func (s *Scanner) duplicate(id *ast.Ident) {
+	s.error(id.Pos(), DuplicateError, "duplicate identifier "+id.Name)
+}
+
+// mismatch reports an identifier used contrary to its kind.
+func (s *Scanner) mismatch(id *ast.Ident, msg string) {
+	s.error(id.Pos(), KindError, msg)
 }
 
-// expected reports what was expected.
-func expected(want, got string) {
-	report("unexpected " + got + ", expecting " + want)
+// expected reports what was expected at the current token.
+func (s *Scanner) expected(want string) {
+	s.error(s.pos, SyntaxError, "unexpected "+s.text+", expecting "+want)
 }
@@ -0,0 +1,68 @@
+package ir
+
+// Preds returns the predecessors of the blocks of f, indexed by block.
+func (f *Func) Preds() [][]*Block {
+	preds := make([][]*Block, len(f.Blocks))
+	for _, b := range f.Blocks {
+		for _, s := range b.Succs() {
+			preds[s.Index] = append(preds[s.Index], b)
+		}
+	}
+	return preds
+}
+
+// Callees returns the functions called by f, in order of their first call.
+func (f *Func) Callees() []*Func {
+	var callees []*Func
+	seen := make(map[*Func]bool)
+	for _, b := range f.Blocks {
+		for _, in := range b.Instrs {
+			if in.Op == Call && !seen[in.Func] {
+				seen[in.Func] = true
+				callees = append(callees, in.Func)
+			}
+		}
+	}
+	return callees
+}
+
+// Reachable returns the functions of p reachable from the main block
+// through calls, in the order of p.Funcs.
+func (p *Program) Reachable() []*Func {
+	seen := map[*Func]bool{p.Main: true}
+	work := []*Func{p.Main}
+	for len(work) > 0 {
+		f := work[len(work)-1]
+		work = work[:len(work)-1]
+		for _, g := range f.Callees() {
+			if !seen[g] {
+				seen[g] = true
+				work = append(work, g)
+			}
+		}
+	}
+	var funcs []*Func
+	for _, f := range p.Funcs {
+		if seen[f] {
+			funcs = append(funcs, f)
+		}
+	}
+	return funcs
+}
+
+// LoopDepth returns the number of loops enclosing each block of f, indexed
+// by block. A loop is a jump back in the layout, from the end of its body
+// to its head, as the loop statements are lowered.
+func (f *Func) LoopDepth() []int {
+	depth := make([]int, len(f.Blocks))
+	for _, b := range f.Blocks {
+		for _, s := range b.Succs() {
+			if s.Index <= b.Index {
+				for i := s.Index; i <= b.Index; i++ {
+					depth[i]++
+				}
+			}
+		}
+	}
+	return depth
+}
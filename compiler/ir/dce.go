@@ -0,0 +1,167 @@
+package ir
+
+import (
+	"sort"
+
+	"pl0/compiler/token"
+)
+
+// A Removal is a piece of dead code removed from a program.
+type Removal struct {
+	Pos token.Pos
+	Msg string
+}
+
+// Eliminate removes the dead code of p, whose constant expressions are
+// folded: the bodies of IF statements and WHILE loops whose condition is
+// constantly false, the ELSE branches of IF statements whose condition is
+// constantly true, and any other block left unreachable by a constant
+// condition, then the procedures not reachable from the main block through
+// calls, and the variables no remaining code uses. The frames of the
+// variables left are renumbered. It returns the removals, in source order.
+func Eliminate(p *Program) []Removal {
+	var removed []Removal
+	for _, f := range p.Funcs {
+		removed = append(removed, foldBranches(f)...)
+		pruneBlocks(f)
+	}
+
+	reachable := p.Reachable()
+	live := make(map[*Func]bool)
+	for _, f := range reachable {
+		live[f] = true
+	}
+	for _, f := range p.Funcs {
+		if !live[f] {
+			kind := "procedure "
+			if f.Result != nil {
+				kind = "function "
+			}
+			removed = append(removed, Removal{f.Pos, kind + f.Name + " removed: never called"})
+		}
+	}
+	p.Funcs = reachable
+
+	used := make(map[*Var]bool)
+	for _, f := range p.Funcs {
+		for _, b := range f.Blocks {
+			for _, in := range b.Instrs {
+				if in.Var != nil {
+					used[in.Var] = true
+				}
+			}
+		}
+	}
+	for _, f := range p.Funcs {
+		vars := f.Vars[:0]
+		for _, v := range f.Vars {
+			if !used[v] {
+				if !v.Temp {
+					removed = append(removed, Removal{v.Pos, "variable " + v.Name + " removed: never used"})
+				}
+				continue
+			}
+			vars = append(vars, v)
+			v.Index = len(vars)
+		}
+		f.Vars = vars
+	}
+
+	sort.SliceStable(removed, func(i, j int) bool { return removed[i].Pos < removed[j].Pos })
+	return removed
+}
+
+// foldBranches replaces the conditional branches of f on constants by
+// jumps, reporting the IF bodies, ELSE branches and WHILE loops so cut off.
+func foldBranches(f *Func) []Removal {
+	var removed []Removal
+	preds := f.Preds()
+	for _, b := range f.Blocks {
+		last := b.Last()
+		if last == nil || last.Op != If {
+			continue
+		}
+		n := len(b.Instrs)
+		cond := b.Instrs[n-2] // The operand tree of the If, folded
+		if cond.Op != Const || cond.Dst != last.Args[0] {
+			continue
+		}
+		loop := false // The If is the head of a WHILE loop
+		for _, p := range preds[b.Index] {
+			if p.Index >= b.Index {
+				loop = true
+			}
+		}
+		target := last.Targets[0]
+		if cond.Value == 0 {
+			target = last.Targets[1]
+		}
+		switch {
+		case last.Targets[1].Index <= b.Index:
+			// The UNTIL of a REPEAT loop, run forever or once
+		case cond.Value == 0 && loop:
+			removed = append(removed, Removal{last.Pos, "WHILE loop removed: condition always false"})
+		case cond.Value == 0:
+			removed = append(removed, Removal{last.Pos, "IF body removed: condition always false"})
+		case !loop && len(preds[last.Targets[1].Index]) == 1:
+			// Only an ELSE branch is entered from the If alone
+			removed = append(removed, Removal{last.Pos, "ELSE branch removed: condition always true"})
+		}
+		b.Instrs = append(b.Instrs[:n-2], &Instr{Op: Jump, Targets: []*Block{target}})
+	}
+	return removed
+}
+
+// pruneBlocks removes the blocks of f unreachable from its entry, and
+// merges the blocks only entered by a jump into the jumping block. The
+// blocks left are renumbered.
+func pruneBlocks(f *Func) {
+	seen := make(map[*Block]bool)
+	var visit func(b *Block)
+	visit = func(b *Block) {
+		if seen[b] {
+			return
+		}
+		seen[b] = true
+		for _, s := range b.Succs() {
+			visit(s)
+		}
+	}
+	visit(f.Blocks[0])
+	blocks := f.Blocks[:0]
+	for _, b := range f.Blocks {
+		if seen[b] {
+			b.Index = len(blocks)
+			blocks = append(blocks, b)
+		}
+	}
+	f.Blocks = blocks
+
+	preds := f.Preds()
+	merged := make(map[*Block]bool)
+	for _, b := range f.Blocks {
+		if merged[b] {
+			continue
+		}
+		for {
+			last := b.Last()
+			if last.Op != Jump {
+				break
+			}
+			s := last.Targets[0]
+			if s == b || s == f.Blocks[0] || len(preds[s.Index]) != 1 {
+				break
+			}
+			b.Instrs = append(b.Instrs[:len(b.Instrs)-1], s.Instrs...)
+			merged[s] = true
+		}
+	}
+	blocks = f.Blocks[:0]
+	for _, b := range f.Blocks {
+		if !merged[b] {
+			b.Index = len(blocks)
+			blocks = append(blocks, b)
+		}
+	}
+	f.Blocks = blocks
+}
@@ -0,0 +1,185 @@
+package ir
+
+// Fold folds the constant expressions of p, computing with numbers of the
+// given size in bits, and simplifies additions of 0 and multiplications and
+// divisions by 1 and multiplications by 0. The CONSTs are propagated as
+// they are lowered to constants. Divisions by a zero constant are left in
+// place, to trap at run time, as resolution reports those of the constant
+// expressions of the source, and so are array elements at a constant index
+// out of range.
+func Fold(p *Program, size int) {
+	for _, f := range p.Funcs {
+		for _, b := range f.Blocks {
+			fold(b, uint(size))
+		}
+	}
+}
+
+// folder holds the state of the folding of a block.
+type folder struct {
+	size    uint           // Size of numbers in bits
+	defs    map[Reg]*Instr // Instruction defining each register
+	subst   map[Reg]Reg    // Registers replacing those of removed instructions
+	removed map[*Instr]bool
+}
+
+// fold folds the constant expressions of a block.
+func fold(b *Block, size uint) {
+	f := &folder{
+		size:    size,
+		defs:    make(map[Reg]*Instr),
+		subst:   make(map[Reg]Reg),
+		removed: make(map[*Instr]bool),
+	}
+	for _, in := range b.Instrs {
+		for i, r := range in.Args {
+			if s, ok := f.subst[r]; ok {
+				in.Args[i] = s
+			}
+		}
+		if in.Dst != None {
+			f.defs[in.Dst] = in
+		}
+
+		switch op := in.Op; {
+		case op == Neg || op == Odd:
+			x, ok := f.constant(in.Args[0])
+			if !ok {
+				break
+			}
+			if op == Neg {
+				f.setConst(in, f.wrap(-x))
+			} else {
+				f.setConst(in, x&1)
+			}
+
+		case op.IsBinary():
+			x, xok := f.constant(in.Args[0])
+			y, yok := f.constant(in.Args[1])
+			if op == Div && yok && y == 0 {
+				break
+			}
+			if xok && yok {
+				if v, ok := eval(op, x, y, size); ok {
+					f.setConst(in, f.wrap(v))
+				}
+				break
+			}
+			f.simplify(in, x, xok, y, yok)
+		}
+	}
+
+	instrs := b.Instrs[:0]
+	for _, in := range b.Instrs {
+		if !f.removed[in] {
+			instrs = append(instrs, in)
+		}
+	}
+	b.Instrs = instrs
+}
+
+// wrap truncates v to the size of numbers, as the target arithmetic does.
+func (f *folder) wrap(v int64) int64 {
+	return v << (64 - f.size) >> (64 - f.size)
+}
+
+// constant returns the value of r, if a constant.
+func (f *folder) constant(r Reg) (int64, bool) {
+	if def := f.defs[r]; def != nil && def.Op == Const {
+		return f.wrap(def.Value), true
+	}
+	return 0, false
+}
+
+// setConst replaces in with a constant, removing its operands.
+func (f *folder) setConst(in *Instr, v int64) {
+	for _, r := range in.Args {
+		f.remove(r)
+	}
+	in.Op, in.Args, in.Value = Const, nil, v
+}
+
+// simplify simplifies an operation of a constant and a non-constant
+// operand, in the algebraic identities it is part of.
+func (f *folder) simplify(in *Instr, x int64, xok bool, y int64, yok bool) {
+	a, b := in.Args[0], in.Args[1]
+	switch {
+	case in.Op == Add && xok && x == 0, in.Op == Mul && xok && x == 1:
+		f.forward(in, b, a)
+	case in.Op == Add && yok && y == 0, in.Op == Sub && yok && y == 0,
+		in.Op == Mul && yok && y == 1, in.Op == Div && yok && y == 1:
+		f.forward(in, a, b)
+	case in.Op == Mul && (xok && x == 0 && f.pure(b) || yok && y == 0 && f.pure(a)):
+		f.setConst(in, 0)
+	}
+}
+
+// forward removes in, replacing its result with its operand keep, and
+// removing its constant operand drop.
+func (f *folder) forward(in *Instr, keep, drop Reg) {
+	f.remove(drop)
+	f.removed[in] = true
+	f.subst[in.Dst] = keep
+}
+
+// pure reports whether the computation of r has no effect besides its
+// value, so that it may be dropped. Divisions may trap.
+func (f *folder) pure(r Reg) bool {
+	def := f.defs[r]
+	switch def.Op {
+	case Div, Elem, Read, Call:
+		return false
+	}
+	for _, a := range def.Args {
+		if !f.pure(a) {
+			return false
+		}
+	}
+	return true
+}
+
+// remove removes the instructions computing r.
+func (f *folder) remove(r Reg) {
+	def := f.defs[r]
+	f.removed[def] = true
+	for _, a := range def.Args {
+		f.remove(a)
+	}
+}
+
+// eval computes a binary operation of constants, unless it overflows on
+// division.
+func eval(op Op, x, y int64, size uint) (int64, bool) {
+	truth := func(b bool) int64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	switch op {
+	case Add:
+		return x + y, true
+	case Sub:
+		return x - y, true
+	case Mul:
+		return x * y, true
+	case Div:
+		if y == -1 && x == -1<<(size-1) {
+			return 0, false // Traps, as the quotient is out of range
+		}
+		return x / y, true
+	case Eq:
+		return truth(x == y), true
+	case Ne:
+		return truth(x != y), true
+	case Lt:
+		return truth(x < y), true
+	case Le:
+		return truth(x <= y), true
+	case Gt:
+		return truth(x > y), true
+	case Ge:
+		return truth(x >= y), true
+	}
+	return 0, false
+}
@@ -0,0 +1,322 @@
+// Package ir defines the three-address intermediate representation of PL/0
+// programs, between the abstract syntax tree and the target code.
+//
+// Each procedure is a function made of basic blocks of instructions. The
+// instructions compute into virtual registers, each assigned exactly once.
+// Variables live in memory: globals are addressed by name, and the other
+// variables through the address of their frame, computed explicitly from
+// the frame of the current function by following static links:
+//
+//	t1 = fp
+//	t2 = link t1
+//	t3 = load t2[y]
+//
+// Parameters live in the frame of the callee too, pushed by the caller
+// along with the static link. A VAR parameter holds the address of the
+// variable passed to it, through which it is loaded and stored:
+//
+//	t1 = fp
+//	t2 = load t1[r]
+//	t3 = loadi t2
+//
+// An array is a variable of consecutive words, its elements addressed
+// from the address of the array, checked against its length:
+//
+//	t1 = fp
+//	t2 = addr t1[a]
+//	t3 = const 2
+//	t4 = elem t2, t3
+//	t5 = loadi t4
+//
+// A function stores its result in a variable of its frame, returned by its
+// last block, which RETURN statements jump to. Calling it yields the
+// result:
+//
+//	t4 = call f, t3, t1
+//
+// Expressions are lowered to trees: every register is used once, by an
+// instruction following its definition in the same block, and the operands
+// of an instruction are computed in order.
+package ir
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"pl0/compiler/token"
+)
+
+// Reg is a virtual register, holding a number or the address of a frame.
+// Registers are numbered from 1 within a function.
+type Reg int
+
+// None is the absence of a register.
+const None Reg = 0
+
+func (r Reg) String() string {
+	return fmt.Sprintf("t%d", int(r))
+}
+
+// Op is an instruction operation.
+type Op int
+
+// Operations, by instruction form.
+const (
+	Const Op = iota // dst = const Value
+
+	Neg // dst = neg a
+	Odd // dst = odd a
+
+	Add // dst = add a, b
+	Sub
+	Mul
+	Div
+	Eq // dst = eq a, b; relations yield 1 if true, 0 if false
+	Ne
+	Lt
+	Le
+	Gt
+	Ge
+
+	FP   // dst = fp: the frame of the current function
+	Link // dst = link a: the static link of frame a
+
+	Load        // dst = load a[Var]
+	Store       // store a[Var], b
+	LoadGlobal  // dst = gload Var
+	StoreGlobal // gstore Var, a
+	Addr        // dst = addr a[Var]: the address of a variable
+	AddrGlobal  // dst = gaddr Var
+	LoadInd     // dst = loadi a: the word at address a
+	StoreInd    // storei a, b
+	Elem        // dst = elem a, b: the address of element b of the array at address a, of length Value
+
+	Call  // [dst =] call Func, args..., a: the arguments, then the static link a passed to Func
+	Read  // dst = read
+	Write // write a
+
+	Jump // jump Targets[0]
+	If   // if a, Targets[0], Targets[1]: branch on a being true or false
+	Ret  // ret [a]: returning the result a of a function
+)
+
+var opNames = [...]string{
+	Const:       "const",
+	Neg:         "neg",
+	Odd:         "odd",
+	Add:         "add",
+	Sub:         "sub",
+	Mul:         "mul",
+	Div:         "div",
+	Eq:          "eq",
+	Ne:          "ne",
+	Lt:          "lt",
+	Le:          "le",
+	Gt:          "gt",
+	Ge:          "ge",
+	FP:          "fp",
+	Link:        "link",
+	Load:        "load",
+	Store:       "store",
+	LoadGlobal:  "gload",
+	StoreGlobal: "gstore",
+	Addr:        "addr",
+	AddrGlobal:  "gaddr",
+	LoadInd:     "loadi",
+	StoreInd:    "storei",
+	Elem:        "elem",
+	Call:        "call",
+	Read:        "read",
+	Write:       "write",
+	Jump:        "jump",
+	If:          "if",
+	Ret:         "ret",
+}
+
+func (op Op) String() string {
+	if 0 <= op && int(op) < len(opNames) {
+		return opNames[op]
+	}
+	return fmt.Sprintf("op(%d)", int(op))
+}
+
+// IsBinary reports whether op is an arithmetic operation or a relation of
+// two operands.
+func (op Op) IsBinary() bool {
+	return Add <= op && op <= Ge
+}
+
+// IsRelation reports whether op compares its two operands.
+func (op Op) IsRelation() bool {
+	return Eq <= op && op <= Ge
+}
+
+// IsTerminator reports whether op ends a basic block.
+func (op Op) IsTerminator() bool {
+	return op == Jump || op == If || op == Ret
+}
+
+// A Var is a variable, stored in the frame of the function declaring it,
+// or in static storage for the globals of the main block. Parameters are
+// pushed in order by the caller, and numbered from the last one.
+type Var struct {
+	Name  string
+	Level int       // Lexical level of the declaring function; 0 for globals
+	Index int       // Position in the frame, or among the parameters, from 1
+	Len   int       // Number of elements of an array; 0 for a single word
+	Param bool      // A parameter
+	Ref   bool      // A VAR parameter, holding the address of a variable
+	Temp  bool      // A temporary, such as the limit of a FOR loop
+	Pos   token.Pos // Position of the declaration, or of the statement using a temporary
+}
+
+// An Instr is a three-address instruction.
+type Instr struct {
+	Op      Op
+	Dst     Reg       // Result register, or None
+	Args    []Reg     // Operand registers
+	Value   int64     // Constant of a Const, or length of the array of an Elem
+	Var     *Var      // Variable of a Load, Store, LoadGlobal, StoreGlobal, Addr or AddrGlobal
+	Func    *Func     // Callee of a Call
+	Targets []*Block  // Successors of a Jump or If
+	Pos     token.Pos // Source position, or token.NoPos
+}
+
+func (in *Instr) String() string {
+	var b strings.Builder
+	if in.Dst != None {
+		fmt.Fprintf(&b, "%v = ", in.Dst)
+	}
+	b.WriteString(in.Op.String())
+	var ops []string
+	switch in.Op {
+	case Const:
+		ops = append(ops, fmt.Sprint(in.Value))
+	case Load, Addr:
+		ops = append(ops, fmt.Sprintf("%v[%s]", in.Args[0], in.Var.Name))
+	case Store:
+		ops = append(ops, fmt.Sprintf("%v[%s]", in.Args[0], in.Var.Name), in.Args[1].String())
+	case LoadGlobal, StoreGlobal, AddrGlobal:
+		ops = append(ops, in.Var.Name)
+		for _, r := range in.Args {
+			ops = append(ops, r.String())
+		}
+	case Call:
+		ops = append(ops, in.Func.Name)
+		for _, r := range in.Args {
+			ops = append(ops, r.String())
+		}
+	default:
+		for _, r := range in.Args {
+			ops = append(ops, r.String())
+		}
+		for _, t := range in.Targets {
+			ops = append(ops, t.String())
+		}
+	}
+	if len(ops) > 0 {
+		b.WriteString(" " + strings.Join(ops, ", "))
+	}
+	return b.String()
+}
+
+// A Block is a basic block: a sequence of instructions ending with a Jump,
+// an If or a Ret, and entered only at its start.
+type Block struct {
+	Index  int // Position in the function
+	Instrs []*Instr
+}
+
+func (b *Block) String() string {
+	return fmt.Sprintf("b%d", b.Index)
+}
+
+// Last returns the terminating instruction of the block, or nil if it is
+// empty.
+func (b *Block) Last() *Instr {
+	if len(b.Instrs) == 0 {
+		return nil
+	}
+	return b.Instrs[len(b.Instrs)-1]
+}
+
+// Succs returns the successors of the block.
+func (b *Block) Succs() []*Block {
+	if last := b.Last(); last != nil {
+		return last.Targets
+	}
+	return nil
+}
+
+// A Func is the code of a procedure or function, or of the main block.
+type Func struct {
+	Name    string
+	Level   int       // Lexical level of the body; 0 for the main block
+	Parent  *Func     // Lexically enclosing function; nil for the main block
+	Params  []*Var    // Parameters of the function, in order
+	Vars    []*Var    // Variables declared by the function, then its result
+	Result  *Var      // Variable holding the result of a function; nil for a procedure
+	Blocks  []*Block  // Basic blocks in layout order, the entry first
+	NumRegs int       // Number of registers used
+	Pos     token.Pos // Position of the declaration; token.NoPos for the main block
+}
+
+// NewReg returns a new register.
+func (f *Func) NewReg() Reg {
+	f.NumRegs++
+	return Reg(f.NumRegs)
+}
+
+// A Program is a lowered program.
+type Program struct {
+	Name  string
+	Funcs []*Func // Procedures, nested ones first, ending with Main
+	Main  *Func   // Main block, declaring the globals
+}
+
+// Fprint prints a readable listing of the program.
+func Fprint(w io.Writer, p *Program) error {
+	var b strings.Builder
+	for i, f := range p.Funcs {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "func %s (level %d", f.Name, f.Level)
+		if f.Parent != nil {
+			fmt.Fprintf(&b, ", in %s", f.Parent.Name)
+		}
+		b.WriteString(")")
+		for i, v := range f.Params {
+			if i == 0 {
+				b.WriteString(" param ")
+			} else {
+				b.WriteString(", ")
+			}
+			if v.Ref {
+				b.WriteString("VAR ")
+			}
+			b.WriteString(v.Name)
+		}
+		for i, v := range f.Vars {
+			if i == 0 {
+				b.WriteString(" var ")
+			} else {
+				b.WriteString(", ")
+			}
+			b.WriteString(v.Name)
+			if v.Len > 0 {
+				fmt.Fprintf(&b, "[%d]", v.Len)
+			}
+		}
+		b.WriteString("\n")
+		for _, blk := range f.Blocks {
+			fmt.Fprintf(&b, "%v:\n", blk)
+			for _, in := range blk.Instrs {
+				fmt.Fprintf(&b, "\t%v\n", in)
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
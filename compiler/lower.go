@@ -0,0 +1,468 @@
+package compiler
+
+import (
+	"fmt"
+	"strconv"
+
+	"pl0/compiler/ast"
+	"pl0/compiler/ir"
+	"pl0/compiler/token"
+)
+
+// Lower resolves the identifiers of a program, parsed without errors, and
+// lowers it to the intermediate representation. The errors, if any, are
+// returned in an ErrorList; the program is not lowered after resolution
+// errors.
+func Lower(prog *ast.Program) (p *ir.Program, err error) {
+	if err := Resolve(prog); err != nil {
+		return nil, err
+	}
+	var c Compiler
+	c.file = prog.File
+	defer c.catch(&err)
+	p = c.lower(prog)
+	if len(c.errors) > 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// lower lowers a program, resolved without errors, to the intermediate
+// representation.
+func (c *Compiler) lower(prog *ast.Program) *ir.Program {
+	c.level = 0
+	c.irVar = make(map[*ast.Object]*ir.Var)
+	c.irFn = make(map[*ast.Object]*ir.Func)
+	p := &ir.Program{Name: prog.Name, Main: &ir.Func{Name: "MAIN"}}
+	c.lowerBlock(p, p.Main, prog.Main)
+	return p
+}
+
+// lowerBlock lowers the block of f and its nested procedures, appending
+// them to the functions of p, innermost first.
+func (c *Compiler) lowerBlock(p *ir.Program, f *ir.Func, b *ast.Block) {
+	for _, v := range b.Vars {
+		obj := v.Name.Obj
+		w := &ir.Var{Name: obj.Name, Level: c.level, Index: obj.Offset + 1, Len: obj.Len, Pos: v.Pos()}
+		c.irVar[obj] = w
+		f.Vars = append(f.Vars, w)
+	}
+	if f.Result != nil {
+		f.Result.Index = len(f.Vars) + 1
+		f.Vars = append(f.Vars, f.Result)
+	}
+	for _, d := range b.Procs {
+		c.level++
+		g := &ir.Func{Name: d.Name.Name, Level: c.level, Parent: f, Pos: d.Name.Pos()}
+		if d.Name.Obj.Kind == ast.Func {
+			g.Result = &ir.Var{Name: d.Name.Name, Level: c.level, Pos: d.Name.Pos()}
+		}
+		c.irFn[d.Name.Obj] = g
+		for i, q := range d.Params {
+			w := &ir.Var{Name: q.Name.Name, Level: c.level, Index: len(d.Params) - i, Param: true, Ref: q.Var.IsValid(), Pos: q.Name.Pos()}
+			c.irVar[q.Name.Obj] = w
+			g.Params = append(g.Params, w)
+		}
+		c.lowerBlock(p, g, d.Block)
+		c.level--
+	}
+
+	// A function returns its result from an exit block
+	fn, cur, exit := c.fn, c.cur, c.exit
+	c.fn, c.exit = f, c.newBlock()
+	c.setBlock(c.newBlock())
+	c.lowerStmt(b.Body)
+	if f.Result != nil {
+		c.jump(c.exit)
+		c.setBlock(c.exit)
+		fp := c.value(ir.FP, token.NoPos)
+		x := c.instr(&ir.Instr{Op: ir.Load, Dst: c.fn.NewReg(), Args: []ir.Reg{fp}, Var: f.Result, Pos: b.End()})
+		c.instr(&ir.Instr{Op: ir.Ret, Args: []ir.Reg{x}})
+	} else {
+		c.instr(&ir.Instr{Op: ir.Ret})
+	}
+	c.fn, c.cur, c.exit = fn, cur, exit
+
+	p.Funcs = append(p.Funcs, f)
+}
+
+// newBlock returns a new block of the current function, to be placed with
+// setBlock.
+func (c *Compiler) newBlock() *ir.Block {
+	return &ir.Block{}
+}
+
+// setBlock places b after the blocks of the current function, and starts
+// appending instructions to it.
+func (c *Compiler) setBlock(b *ir.Block) {
+	b.Index = len(c.fn.Blocks)
+	c.fn.Blocks = append(c.fn.Blocks, b)
+	c.cur = b
+}
+
+// instr appends an instruction to the current block, returning its result
+// register, if any.
+func (c *Compiler) instr(in *ir.Instr) ir.Reg {
+	c.cur.Instrs = append(c.cur.Instrs, in)
+	return in.Dst
+}
+
+// value appends an instruction computing a new register.
+func (c *Compiler) value(op ir.Op, pos token.Pos, args ...ir.Reg) ir.Reg {
+	return c.instr(&ir.Instr{Op: op, Dst: c.fn.NewReg(), Args: args, Pos: pos})
+}
+
+// jump ends the current block with a jump to b.
+func (c *Compiler) jump(b *ir.Block) {
+	c.instr(&ir.Instr{Op: ir.Jump, Targets: []*ir.Block{b}})
+}
+
+// frame returns a register holding the frame of the function at the given
+// level, enclosing the current one.
+func (c *Compiler) frame(level int) ir.Reg {
+	r := c.value(ir.FP, token.NoPos)
+	for l := c.level; l > level; l-- {
+		r = c.value(ir.Link, token.NoPos, r)
+	}
+	return r
+}
+
+// address appends the instructions computing the address of a variable,
+// which for a VAR parameter is the address it holds.
+func (c *Compiler) address(obj *ast.Object, pos token.Pos) ir.Reg {
+	if obj.Level == 0 {
+		return c.instr(&ir.Instr{Op: ir.AddrGlobal, Dst: c.fn.NewReg(), Var: c.irVar[obj], Pos: pos})
+	}
+	op := ir.Addr
+	if obj.Ref {
+		op = ir.Load
+	}
+	fp := c.frame(obj.Level)
+	return c.instr(&ir.Instr{Op: op, Dst: c.fn.NewReg(), Args: []ir.Reg{fp}, Var: c.irVar[obj], Pos: pos})
+}
+
+// store appends the instructions storing x into a variable, or into the
+// result of an enclosing function.
+func (c *Compiler) store(obj *ast.Object, x ir.Reg, pos token.Pos) {
+	if obj.Kind == ast.Func {
+		fp := c.frame(obj.Level + 1)
+		c.instr(&ir.Instr{Op: ir.Store, Args: []ir.Reg{fp, x}, Var: c.irFn[obj].Result, Pos: pos})
+		return
+	}
+	if obj.Ref {
+		a := c.address(obj, pos)
+		c.instr(&ir.Instr{Op: ir.StoreInd, Args: []ir.Reg{a, x}, Pos: pos})
+		return
+	}
+	if obj.Level == 0 {
+		c.instr(&ir.Instr{Op: ir.StoreGlobal, Args: []ir.Reg{x}, Var: c.irVar[obj], Pos: pos})
+		return
+	}
+	fp := c.frame(obj.Level)
+	c.instr(&ir.Instr{Op: ir.Store, Args: []ir.Reg{fp, x}, Var: c.irVar[obj], Pos: pos})
+}
+
+// lowerAssign appends the instructions storing the value computed by x
+// into the variable or array element lhs. The index of an element is
+// computed first.
+func (c *Compiler) lowerAssign(lhs ast.Expr, x func() ir.Reg, pos token.Pos) {
+	if e, ok := lhs.(*ast.IndexExpr); ok {
+		a := c.lowerElem(e)
+		c.instr(&ir.Instr{Op: ir.StoreInd, Args: []ir.Reg{a, x()}, Pos: pos})
+		return
+	}
+	c.store(lhs.(*ast.Ident).Obj, x(), pos)
+}
+
+// lowerElem appends the instructions computing the address of an array
+// element.
+func (c *Compiler) lowerElem(x *ast.IndexExpr) ir.Reg {
+	obj := x.X.Obj
+	a := c.address(obj, x.Pos())
+	i := c.lowerExpr(x.Index)
+	return c.instr(&ir.Instr{Op: ir.Elem, Dst: c.fn.NewReg(), Args: []ir.Reg{a, i}, Value: int64(obj.Len), Pos: x.Index.Pos()})
+}
+
+// lowerStmt lowers the various statement nodes.
+func (c *Compiler) lowerStmt(s ast.Stmt) {
+	switch s := s.(type) {
+	case *ast.AssignStmt:
+		c.lowerAssign(s.Lhs, func() ir.Reg { return c.lowerExpr(s.Rhs) }, s.TokPos)
+
+	case *ast.CallStmt:
+		c.lowerCall(s.Proc.Obj, s.Args, false, s.Call)
+
+	case *ast.ReturnStmt:
+		x := c.lowerExpr(s.X)
+		fp := c.value(ir.FP, token.NoPos)
+		c.instr(&ir.Instr{Op: ir.Store, Args: []ir.Reg{fp, x}, Var: c.fn.Result, Pos: s.Return})
+		c.jump(c.exit)
+		c.setBlock(c.newBlock()) // For the unreachable statements following
+
+	case *ast.BeginStmt:
+		for _, stmt := range s.List {
+			c.lowerStmt(stmt)
+		}
+
+	case *ast.IfStmt:
+		body, els, done := c.newBlock(), c.newBlock(), c.newBlock()
+		if s.Else == nil {
+			els = done
+		}
+		cond := c.lowerCond(s.Cond)
+		c.instr(&ir.Instr{Op: ir.If, Args: []ir.Reg{cond}, Targets: []*ir.Block{body, els}, Pos: s.Then})
+		c.setBlock(body)
+		c.lowerStmt(s.Body)
+		c.jump(done)
+		if s.Else != nil {
+			c.setBlock(els)
+			c.lowerStmt(s.Else)
+			c.jump(done)
+		}
+		c.setBlock(done)
+
+	case *ast.WhileStmt:
+		head, body, done := c.newBlock(), c.newBlock(), c.newBlock()
+		c.jump(head)
+		c.setBlock(head)
+		cond := c.lowerCond(s.Cond)
+		c.instr(&ir.Instr{Op: ir.If, Args: []ir.Reg{cond}, Targets: []*ir.Block{body, done}, Pos: s.Do})
+		c.setBlock(body)
+		c.lowerStmt(s.Body)
+		c.jump(head)
+		c.setBlock(done)
+
+	case *ast.RepeatStmt:
+		body, done := c.newBlock(), c.newBlock()
+		c.jump(body)
+		c.setBlock(body)
+		for _, stmt := range s.List {
+			c.lowerStmt(stmt)
+		}
+		cond := c.lowerCond(s.Cond)
+		c.instr(&ir.Instr{Op: ir.If, Args: []ir.Reg{cond}, Targets: []*ir.Block{done, body}, Pos: s.Until})
+		c.setBlock(done)
+
+	case *ast.ForStmt:
+		c.lowerFor(s)
+
+	case *ast.SendStmt:
+		x := c.lowerExpr(s.X)
+		c.instr(&ir.Instr{Op: ir.Write, Args: []ir.Reg{x}, Pos: s.Send})
+
+	case *ast.ReceiveStmt:
+		c.lowerAssign(s.X, func() ir.Reg { return c.value(ir.Read, s.Recv) }, s.Recv)
+	}
+}
+
+// lowerFor lowers a FOR loop. The limit, unless constant, is stored in a
+// temporary of the function, after the start if it is not constant either,
+// so that the trees of both are evaluated in order. The loop is left when
+// the variable reaches the limit, before stepping it, so that it never
+// steps past the limit.
+func (c *Compiler) lowerFor(s *ast.ForStmt) {
+	enter, more, step := ir.Le, ir.Lt, ir.Add
+	if s.Dir == token.DOWNTO {
+		enter, more, step = ir.Ge, ir.Gt, ir.Sub
+	}
+	obj := s.Var.Obj
+	from := func() ir.Reg { return c.lowerExpr(s.From) }
+	limit := func() ir.Reg { return c.lowerExpr(s.Limit) }
+	if !constant(s.Limit) {
+		if !constant(s.From) {
+			t := c.temp(s.Pos())
+			c.storeTemp(t, from(), s.TokPos)
+			from = func() ir.Reg { return c.loadTemp(t, s.TokPos) }
+		}
+		t := c.temp(s.Pos())
+		c.storeTemp(t, limit(), s.DirPos)
+		limit = func() ir.Reg { return c.loadTemp(t, s.DirPos) }
+	}
+	c.store(obj, from(), s.TokPos)
+
+	body, next, done := c.newBlock(), c.newBlock(), c.newBlock()
+	cond := c.value(enter, s.DirPos, c.lowerExpr(s.Var), limit())
+	c.instr(&ir.Instr{Op: ir.If, Args: []ir.Reg{cond}, Targets: []*ir.Block{body, done}, Pos: s.Do})
+	c.setBlock(body)
+	c.lowerStmt(s.Body)
+	cond = c.value(more, s.DirPos, c.lowerExpr(s.Var), limit())
+	c.instr(&ir.Instr{Op: ir.If, Args: []ir.Reg{cond}, Targets: []*ir.Block{next, done}, Pos: s.Do})
+	c.setBlock(next)
+	x := c.value(step, s.DirPos, c.lowerExpr(s.Var), c.constant(1, s.DirPos))
+	c.store(obj, x, s.TokPos)
+	c.jump(body)
+	c.setBlock(done)
+}
+
+// constant reports whether x is a number or a constant.
+func constant(x ast.Expr) bool {
+	switch x := x.(type) {
+	case *ast.Number:
+		return true
+	case *ast.Ident:
+		return x.Obj.Kind == ast.Con
+	}
+	return false
+}
+
+// temp returns a new temporary of the current function, used by the
+// statement at pos.
+func (c *Compiler) temp(pos token.Pos) *ir.Var {
+	f := c.fn
+	t := &ir.Var{Level: f.Level, Index: len(f.Vars) + 1, Temp: true, Pos: pos}
+	t.Name = "temp." + strconv.Itoa(t.Index)
+	f.Vars = append(f.Vars, t)
+	return t
+}
+
+// storeTemp appends the instructions storing x into a temporary.
+func (c *Compiler) storeTemp(t *ir.Var, x ir.Reg, pos token.Pos) {
+	if t.Level == 0 {
+		c.instr(&ir.Instr{Op: ir.StoreGlobal, Args: []ir.Reg{x}, Var: t, Pos: pos})
+		return
+	}
+	fp := c.value(ir.FP, token.NoPos)
+	c.instr(&ir.Instr{Op: ir.Store, Args: []ir.Reg{fp, x}, Var: t, Pos: pos})
+}
+
+// loadTemp appends the instructions loading a temporary.
+func (c *Compiler) loadTemp(t *ir.Var, pos token.Pos) ir.Reg {
+	if t.Level == 0 {
+		return c.instr(&ir.Instr{Op: ir.LoadGlobal, Dst: c.fn.NewReg(), Var: t, Pos: pos})
+	}
+	fp := c.value(ir.FP, token.NoPos)
+	return c.instr(&ir.Instr{Op: ir.Load, Dst: c.fn.NewReg(), Args: []ir.Reg{fp}, Var: t, Pos: pos})
+}
+
+// lowerCall appends the instructions calling the procedure or function obj with
+// the given arguments, and returns the register of the result if wanted.
+func (c *Compiler) lowerCall(obj *ast.Object, args []ast.Expr, result bool, pos token.Pos) ir.Reg {
+	var regs []ir.Reg
+	for i, p := range obj.Proc.Params {
+		x := args[i]
+		e, elem := x.(*ast.IndexExpr)
+		switch {
+		case !p.Var.IsValid():
+			regs = append(regs, c.lowerExpr(x))
+		case elem:
+			regs = append(regs, c.lowerElem(e))
+		default:
+			regs = append(regs, c.address(x.(*ast.Ident).Obj, x.Pos()))
+		}
+	}
+	link := c.frame(obj.Level)
+	dst := ir.None
+	if result {
+		dst = c.fn.NewReg()
+	}
+	return c.instr(&ir.Instr{Op: ir.Call, Dst: dst, Args: append(regs, link), Func: c.irFn[obj], Pos: pos})
+}
+
+// relations maps a relation operator to its operation.
+var relations = map[token.Token]ir.Op{
+	token.EQL: ir.Eq,
+	token.NEQ: ir.Ne,
+	token.LSS: ir.Lt,
+	token.LEQ: ir.Le,
+	token.GRT: ir.Gt,
+	token.GEQ: ir.Ge,
+}
+
+// lowerCond lowers the various condition nodes.
+func (c *Compiler) lowerCond(cond ast.Cond) ir.Reg {
+	switch x := cond.(type) {
+	case *ast.OddCond:
+		return c.value(ir.Odd, x.Odd, c.lowerExpr(x.X))
+
+	case *ast.RelCond:
+		op, ok := relations[x.Op]
+		if !ok {
+			panic(fmt.Sprintf("unsupported relation operator: %q", x.Op))
+		}
+		a := c.lowerExpr(x.X)
+		b := c.lowerExpr(x.Y)
+		return c.value(op, x.OpPos, a, b)
+	}
+	panic(fmt.Sprintf("unsupported condition: %T", cond))
+}
+
+// arithmetic maps an arithmetic operator to its operation.
+var arithmetic = map[token.Token]ir.Op{
+	token.PLUS:  ir.Add,
+	token.MINUS: ir.Sub,
+	token.TIMES: ir.Mul,
+	token.DIV:   ir.Div,
+}
+
+// lowerExpr lowers the various expression nodes.
+func (c *Compiler) lowerExpr(x ast.Expr) ir.Reg {
+	switch x := x.(type) {
+	case *ast.UnaryExpr:
+		a := c.lowerExpr(x.X)
+		switch x.Op {
+		case token.PLUS: // Noop case
+			return a
+		case token.MINUS:
+			return c.value(ir.Neg, x.OpPos, a)
+		default:
+			panic(fmt.Sprintf("unsupported unary operator: %q", x.Op))
+		}
+
+	case *ast.BinaryExpr:
+		op, ok := arithmetic[x.Op]
+		if !ok {
+			panic(fmt.Sprintf("unsupported binary operator: %q", x.Op))
+		}
+		a := c.lowerExpr(x.X)
+		b := c.lowerExpr(x.Y)
+		return c.value(op, x.OpPos, a, b)
+
+	case *ast.Number:
+		return c.constant(c.number(x), x.Pos())
+
+	case *ast.CallExpr:
+		return c.lowerCall(x.Func.Obj, x.Args, true, x.Pos())
+
+	case *ast.IndexExpr:
+		return c.value(ir.LoadInd, x.Pos(), c.lowerElem(x))
+
+	case *ast.Ident:
+		switch obj := x.Obj; {
+		case obj.Kind == ast.Var && obj.Ref:
+			return c.value(ir.LoadInd, x.Pos(), c.address(obj, x.Pos()))
+		case obj.Kind == ast.Var && obj.Level == 0:
+			return c.instr(&ir.Instr{Op: ir.LoadGlobal, Dst: c.fn.NewReg(), Var: c.irVar[obj], Pos: x.Pos()})
+		case obj.Kind == ast.Var:
+			fp := c.frame(obj.Level)
+			return c.instr(&ir.Instr{Op: ir.Load, Dst: c.fn.NewReg(), Args: []ir.Reg{fp}, Var: c.irVar[obj], Pos: x.Pos()})
+		case obj.Kind == ast.Con:
+			return c.constant(obj.Value, x.Pos())
+		}
+	}
+	panic(fmt.Sprintf("unsupported expression: %T", x))
+}
+
+// constant appends an instruction loading a constant.
+func (c *Compiler) constant(v int64, pos token.Pos) ir.Reg {
+	return c.instr(&ir.Instr{Op: ir.Const, Dst: c.fn.NewReg(), Value: v, Pos: pos})
+}
+
+// number returns the value of a number, reporting numbers out of range:
+// out of the numbers of the target machine when translating to assembly,
+// or out of 64-bit numbers.
+func (c *Compiler) number(n *ast.Number) int64 {
+	v, err := strconv.ParseInt(n.Value, 10, int(c.size()))
+	if err != nil {
+		c.error(n.Pos(), SyntaxError, "number "+n.Value+" out of range")
+	}
+	return v
+}
+
+// size returns the size of numbers in bits: that of the words of the target
+// machine when translating to assembly, or 64.
+func (c *Compiler) size() uint {
+	if c.m.word > 0 {
+		return uint(8 * c.m.word)
+	}
+	return 64
+}
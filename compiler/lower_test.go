@@ -0,0 +1,432 @@
+package compiler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"pl0/compiler/ir"
+)
+
+func TestLower(t *testing.T) {
+	const src = `
+CONST k = 3;
+VAR x;
+PROCEDURE p;
+	VAR y;
+	PROCEDURE q;
+	BEGIN
+		IF ODD x THEN x := x - y;
+		WHILE x > 0 DO CALL q
+	END;
+BEGIN y := -k; CALL q END;
+BEGIN ? x; CALL p; ! x / 2 END.`
+	const want = `func q (level 2, in p)
+b0:
+	t1 = gload x
+	t2 = odd t1
+	if t2, b1, b2
+b1:
+	t3 = gload x
+	t4 = fp
+	t5 = link t4
+	t6 = load t5[y]
+	t7 = sub t3, t6
+	gstore x, t7
+	jump b2
+b2:
+	jump b3
+b3:
+	t8 = gload x
+	t9 = const 0
+	t10 = gt t8, t9
+	if t10, b4, b5
+b4:
+	t11 = fp
+	t12 = link t11
+	call q, t12
+	jump b3
+b5:
+	ret
+
+func p (level 1, in MAIN) var y
+b0:
+	t1 = const 3
+	t2 = neg t1
+	t3 = fp
+	store t3[y], t2
+	t4 = fp
+	call q, t4
+	ret
+
+func MAIN (level 0) var x
+b0:
+	t1 = read
+	gstore x, t1
+	t2 = fp
+	call p, t2
+	t3 = gload x
+	t4 = const 2
+	t5 = div t3, t4
+	write t5
+	ret
+`
+	prog, err := Parse("test.pl0", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Lower(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := ir.Fprint(&out, p); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Calls refer to the functions of the program
+	q := p.Funcs[0]
+	if call := q.Blocks[4].Instrs[2]; call.Op != ir.Call || call.Func != q {
+		t.Errorf("got %v, want a recursive call of q", call)
+	}
+	if p.Funcs[2] != p.Main || q.Parent != p.Funcs[1] || p.Funcs[1].Parent != p.Main {
+		t.Error("functions misordered or misnested")
+	}
+}
+
+func TestLowerParams(t *testing.T) {
+	const src = `
+VAR x;
+PROCEDURE p(a; VAR r);
+	VAR y;
+	BEGIN y := a; r := r + y; CALL p(y, r) END;
+CALL p(2, x).`
+	const want = `func p (level 1, in MAIN) param a, VAR r var y
+b0:
+	t1 = fp
+	t2 = load t1[a]
+	t3 = fp
+	store t3[y], t2
+	t4 = fp
+	t5 = load t4[r]
+	t6 = loadi t5
+	t7 = fp
+	t8 = load t7[y]
+	t9 = add t6, t8
+	t10 = fp
+	t11 = load t10[r]
+	storei t11, t9
+	t12 = fp
+	t13 = load t12[y]
+	t14 = fp
+	t15 = load t14[r]
+	t16 = fp
+	t17 = link t16
+	call p, t13, t15, t17
+	ret
+
+func MAIN (level 0) var x
+b0:
+	t1 = const 2
+	t2 = gaddr x
+	t3 = fp
+	call p, t1, t2, t3
+	ret
+`
+	prog, err := Parse("test.pl0", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Lower(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := ir.Fprint(&out, p); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLowerFunc(t *testing.T) {
+	const src = `
+FUNCTION f(n);
+	BEGIN IF n < 1 THEN RETURN 1; f := n * f(n - 1) END;
+! f(3).`
+	const want = `func f (level 1, in MAIN) param n var f
+b0:
+	t1 = fp
+	t2 = load t1[n]
+	t3 = const 1
+	t4 = lt t2, t3
+	if t4, b1, b3
+b1:
+	t5 = const 1
+	t6 = fp
+	store t6[f], t5
+	jump b4
+b2:
+	jump b3
+b3:
+	t7 = fp
+	t8 = load t7[n]
+	t9 = fp
+	t10 = load t9[n]
+	t11 = const 1
+	t12 = sub t10, t11
+	t13 = fp
+	t14 = link t13
+	t15 = call f, t12, t14
+	t16 = mul t8, t15
+	t17 = fp
+	store t17[f], t16
+	jump b4
+b4:
+	t18 = fp
+	t19 = load t18[f]
+	ret t19
+
+func MAIN (level 0)
+b0:
+	t1 = const 3
+	t2 = fp
+	t3 = call f, t1, t2
+	write t3
+	ret
+`
+	prog, err := Parse("test.pl0", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Lower(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := ir.Fprint(&out, p); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLowerErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"VAR x; BEGIN x := 1; y := 2 END.", "test.pl0:1:22: undefined identifier y"},
+		{"CONST c = 1; c := 2.", "test.pl0:1:14: cannot assign to c (kind CONST)"},
+		{"! 99999999999999999999.", "test.pl0:1:3: number 99999999999999999999 out of range"},
+	}
+	for _, tt := range tests {
+		prog, err := Parse("test.pl0", strings.NewReader(tt.src))
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.src, err)
+		}
+		p, err := Lower(prog)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%q: got %v, want %s", tt.src, err, tt.want)
+		}
+		if p != nil {
+			t.Errorf("%q: got a program despite errors", tt.src)
+		}
+	}
+}
+
+func TestGraphs(t *testing.T) {
+	const src = `
+VAR x;
+PROCEDURE p;
+	WHILE x > 0 DO BEGIN x := x - 1; CALL p END;
+PROCEDURE q;
+	CALL p;
+PROCEDURE r;
+	CALL q;
+BEGIN ? x; CALL p; CALL q; CALL p END.`
+	prog, err := Parse("test.pl0", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Lower(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := func(funcs []*ir.Func) string {
+		var s []string
+		for _, f := range funcs {
+			s = append(s, f.Name)
+		}
+		return strings.Join(s, " ")
+	}
+
+	// The loop of p: entry, head, body and exit blocks
+	f := p.Funcs[0]
+	var edges []string
+	for i, preds := range f.Preds() {
+		for _, b := range preds {
+			edges = append(edges, b.String()+"->"+f.Blocks[i].String())
+		}
+	}
+	if got, want := strings.Join(edges, " "), "b0->b1 b2->b1 b1->b2 b1->b3"; got != want {
+		t.Errorf("got edges %s, want %s", got, want)
+	}
+
+	if got, want := names(f.Callees()), "p"; got != want {
+		t.Errorf("got callees of p %s, want %s", got, want)
+	}
+	if got, want := names(p.Main.Callees()), "p q"; got != want {
+		t.Errorf("got callees of MAIN %s, want %s", got, want)
+	}
+	if got, want := names(p.Reachable()), "p q MAIN"; got != want {
+		t.Errorf("got reachable functions %s, want %s", got, want)
+	}
+}
+
+func TestFold(t *testing.T) {
+	tests := []struct {
+		src  string
+		size int
+		want string // Instructions of the main block
+	}{
+		{"CONST k = 3; ! k * 4 + 2 - (-1).", 64, "t8 = const 15; write t8; ret"},
+		{"IF 2 < 3 THEN ! 1.", 64, "t3 = const 1; if t3, b1, b2"},
+		{"IF ODD 4 THEN ! 1.", 64, "t2 = const 0; if t2, b1, b2"},
+
+		// Numbers wrap around as the target arithmetic does
+		{"! 9223372036854775807 + 1.", 64, "t3 = const -9223372036854775808; write t3; ret"},
+		{"! 2147483647 + 1.", 32, "t3 = const -2147483648; write t3; ret"},
+		{"! (2147483647 + 1) / 2.", 32, "t5 = const -1073741824; write t5; ret"},
+		{"! (0 - 2147483647 - 1) / (0 - 1).", 32, "t5 = const -2147483648; t8 = const -1; t9 = div t5, t8; write t9; ret"},
+
+		// Algebraic identities
+		{"VAR x; ! x + 0 + (0 + x).", 64, "t1 = gload x; t5 = gload x; t7 = add t1, t5; write t7; ret"},
+		{"VAR x; ! 1 * x * 1 - 0 / 1.", 64, "t2 = gload x; write t2; ret"},
+		{"VAR x; ! x * 0 + 0 * (x + 1).", 64, "t9 = const 0; write t9; ret"},
+		{"VAR x; ! 0 * (1 / x).", 64, "t1 = const 0; t2 = const 1; t3 = gload x; t4 = div t2, t3; t5 = mul t1, t4; write t5; ret"},
+	}
+	for _, tt := range tests {
+		prog, err := Parse("test.pl0", strings.NewReader(tt.src))
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.src, err)
+		}
+		p, err := Lower(prog)
+		if err != nil {
+			t.Fatalf("Lower(%q): %v", tt.src, err)
+		}
+		ir.Fold(p, tt.size)
+		var got []string
+		for _, in := range p.Main.Blocks[0].Instrs {
+			got = append(got, in.String())
+		}
+		if strings.Join(got, "; ") != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.src, strings.Join(got, "; "), tt.want)
+		}
+	}
+}
+
+func TestEliminate(t *testing.T) {
+	const src = `
+CONST debug = 0;
+VAR x, unused;
+PROCEDURE trace;
+	PROCEDURE show; ! x;
+	CALL show;
+PROCEDURE p;
+	VAR a, b, c;
+	BEGIN
+		a := 1; c := 2;
+		IF debug = 1 THEN BEGIN b := a; CALL trace END;
+		WHILE debug > 0 DO a := a + 1;
+		x := a + c
+	END;
+BEGIN CALL p; ! x END.`
+	const want = `func p (level 1, in MAIN) var a, c
+b0:
+	t1 = const 1
+	t2 = fp
+	store t2[a], t1
+	t3 = const 2
+	t4 = fp
+	store t4[c], t3
+	t21 = fp
+	t22 = load t21[a]
+	t23 = fp
+	t24 = load t23[c]
+	t25 = add t22, t24
+	gstore x, t25
+	ret
+
+func MAIN (level 0) var x
+b0:
+	t1 = fp
+	call p, t1
+	t2 = gload x
+	write t2
+	ret
+`
+	const wantRemoved = `test.pl0:3:8: variable unused removed: never used
+test.pl0:4:11: procedure trace removed: never called
+test.pl0:5:12: procedure show removed: never called
+test.pl0:8:9: variable b removed: never used
+test.pl0:11:16: IF body removed: condition always false
+test.pl0:12:19: WHILE loop removed: condition always false
+`
+	prog, err := Parse("test.pl0", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Lower(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir.Fold(p, 64)
+	var removed []string
+	for _, r := range ir.Eliminate(p) {
+		removed = append(removed, prog.File.Position(r.Pos).String()+": "+r.Msg+"\n")
+	}
+	var b bytes.Buffer
+	if err := ir.Fprint(&b, p); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if got := strings.Join(removed, ""); got != wantRemoved {
+		t.Errorf("got removals:\n%s\nwant:\n%s", got, wantRemoved)
+	}
+}
+
+func TestEliminateElse(t *testing.T) {
+	const src = "CONST debug = 1;\nBEGIN IF debug = 1 THEN ! 1 ELSE ! 2; IF debug = 0 THEN ! 3 ELSE ! 4 END."
+	prog, err := Parse("test.pl0", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Lower(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir.Fold(p, 64)
+	var removed []string
+	for _, r := range ir.Eliminate(p) {
+		removed = append(removed, prog.File.Position(r.Pos).String()+": "+r.Msg)
+	}
+	want := "test.pl0:2:20: ELSE branch removed: condition always true, test.pl0:2:52: IF body removed: condition always false"
+	if got := strings.Join(removed, ", "); got != want {
+		t.Errorf("got removals %s, want %s", got, want)
+	}
+	var got []string
+	for _, in := range p.Main.Blocks[0].Instrs {
+		got = append(got, in.String())
+	}
+	if want := "t4 = const 1; write t4; t10 = const 4; write t10; ret"; strings.Join(got, "; ") != want {
+		t.Errorf("got %s, want %s", strings.Join(got, "; "), want)
+	}
+}
@@ -0,0 +1,72 @@
+package compiler
+
+import (
+	"strconv"
+	"strings"
+)
+
+// machine describes the registers and storage layout of an architecture.
+type machine struct {
+	ax, bx, cx, dx string // General purpose registers
+	si, di         string // Index registers, used as general purpose registers
+	bp, sp         string // Frame and stack pointer registers
+	extend         string // Sign extends ax into dx, ahead of a division
+
+	word    int    // Size of a variable, stack slot or static link in bytes
+	ptr     string // Size specifier of a word sized memory operand
+	data    string // Data directive allocating a word
+	reserve string // Directive reserving uninitialized words
+	rel     string // Addressing mode prefix of a static memory operand
+}
+
+var i386 = machine{
+	ax: "EAX", bx: "EBX", cx: "ECX", dx: "EDX",
+	si: "ESI", di: "EDI",
+	bp: "EBP", sp: "ESP", extend: "CDQ",
+	word: 4, ptr: "dword", data: "dd", reserve: "resd",
+}
+
+// amd64 addresses statics relative to the instruction pointer, so the
+// resulting code is position independent.
+var amd64 = machine{
+	ax: "RAX", bx: "RBX", cx: "RCX", dx: "RDX",
+	si: "RSI", di: "RDI",
+	bp: "RBP", sp: "RSP", extend: "CQO",
+	word: 8, ptr: "qword", data: "dq", reserve: "resq", rel: "rel ",
+}
+
+// machines maps a target architecture to its machine description.
+var machines = map[string]machine{
+	"386":   i386,
+	"amd64": amd64,
+}
+
+// static returns a memory operand addressing a static label.
+func (m machine) static(label string) string {
+	return "[" + m.rel + label + "]"
+}
+
+// frame returns a memory operand addressing offset bytes from base register.
+func (m machine) frame(base string, offset int) string {
+	return "[" + base + " + " + strconv.Itoa(offset) + "]"
+}
+
+// link returns the offset of the static link from the frame pointer, placed
+// by the caller above the return address and saved frame pointer.
+func (m machine) link() int {
+	return 2 * m.word
+}
+
+// sized prefixes a memory operand with its size, for instructions whose
+// other operands do not tell it.
+func (m machine) sized(x string) string {
+	if isMemory(x) {
+		return m.ptr + " " + x
+	}
+	return x
+}
+
+// unsized removes the size prefix of a memory operand.
+func (m machine) unsized(x string) string {
+	return strings.TrimPrefix(x, m.ptr+" ")
+}
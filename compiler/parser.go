@@ -8,31 +8,79 @@ import (
 	"pl0/compiler/token"
 )
 
-// match checks for a specific token.
-func match(want token.Token) {
-	if tok == want {
-		next()
-	} else {
-		expected(want.String(), text)
+// A Parser holds the parser's internal state while processing a given
+// source. It must be initialized with Init before use, and parses a single
+// program or expression.
+//
+// The parser recovers from syntax errors by skipping to the next statement
+// or declaration, so that a single run reports as many errors as possible.
+// The parts of the program containing errors are replaced with BadStmt and
+// BadExpr nodes.
+type Parser struct {
+	Scanner
+}
+
+// match checks for a specific token, returning its position. On mismatch,
+// it unwinds to the nearest recovery point.
+func (p *Parser) match(want token.Token) token.Pos {
+	pos := p.pos
+	if p.tok != want {
+		p.fail(want.String())
 	}
+	p.next()
+	return pos
 }
 
-// ParseAndTranslate parses and translates a program.
-func ParseAndTranslate(in io.Reader, out io.Writer, name string) {
-	prog, err := Parse(name, in)
-	if err != nil {
-		report("failed to parse program: " + err.Error())
+// fail reports what was expected at the current token, and unwinds to the
+// nearest recovery point.
+func (p *Parser) fail(want string) {
+	p.expected(want)
+	panic(bailout{})
+}
+
+// atStmtEnd reports whether the current token may end a statement or a
+// declaration: ";", "END", "ELSE", "UNTIL", "CONST", "VAR", "PROCEDURE",
+// "FUNCTION", "." or the end of the source.
+func (p *Parser) atStmtEnd() bool {
+	switch p.tok {
+	case token.SEMICOLON, token.END, token.ELSE, token.UNTIL, token.CONST, token.VAR, token.PROCEDURE, token.FUNCTION, token.PERIOD, token.EOF:
+		return true
 	}
-	gen(prog, out)
+	return false
 }
 
-func ParseExpr(src io.Reader) ast.Expr {
-	initScanner(src)
-	next()
-	if tok == token.EOF {
-		return nil
+// skip skips the tokens up to the end of the current statement or
+// declaration.
+func (p *Parser) skip() {
+	for !p.atStmtEnd() {
+		p.next()
 	}
-	return parseExpr()
+}
+
+// sync stops the unwinding started by a syntax error, given the recovered
+// value e, and reports whether one occurred. The tokens up to the end of the
+// current statement or declaration are skipped.
+func (p *Parser) sync(e interface{}) bool {
+	if e == nil {
+		return false
+	}
+	if _, ok := e.(bailout); !ok {
+		panic(e)
+	}
+	p.skip()
+	return true
+}
+
+// ParseAndTranslate parses and translates a program for the given target.
+// It is safe to call from multiple goroutines.
+func ParseAndTranslate(filename string, in io.Reader, out io.Writer, name string, target Target) error {
+	return NewCompiler(target).ParseAndTranslate(filename, in, out, name)
+}
+
+func ParseExpr(src io.Reader) (ast.Expr, error) {
+	var p Parser
+	p.Init(token.NewFile(""), src)
+	return p.ParseExpr()
 }
 
 func Parse(filename string, src io.Reader) (*ast.Program, error) {
@@ -41,212 +89,441 @@ func Parse(filename string, src io.Reader) (*ast.Program, error) {
 		if err != nil {
 			return nil, err
 		}
+		defer f.Close()
 		src = f
 	}
-	initScanner(src)
-	next()
-	b := parseBlock()
-	match(token.PERIOD)
-	return &ast.Program{Name: filename, Main: b}, nil
+	var p Parser
+	p.Init(token.NewFile(filename), src)
+	return p.ParseProgram(filename)
+}
+
+// ParseExpr parses a single expression. On syntax errors, it returns a
+// partial expression and an ErrorList.
+func (p *Parser) ParseExpr() (x ast.Expr, err error) {
+	defer p.catch(&err)
+	p.next()
+	if p.tok == token.EOF {
+		return nil, nil
+	}
+	return p.parseExpr(), nil
+}
+
+// ParseProgram parses a whole program. On syntax errors, it returns a
+// partial program and an ErrorList.
+func (p *Parser) ParseProgram(name string) (prog *ast.Program, err error) {
+	defer p.catch(&err)
+	return p.parseProgram(name), nil
+}
+
+func (p *Parser) parseProgram(name string) *ast.Program {
+	p.next()
+	b := p.parseBlock()
+	period := p.pos
+	if p.tok != token.PERIOD {
+		p.expected(token.PERIOD.String())
+	}
+	return &ast.Program{Name: name, File: p.file, Main: b, Period: period}
 }
 
-func parseBlock() *ast.Block {
-	b := new(ast.Block)
+func (p *Parser) parseBlock() *ast.Block {
+	b := &ast.Block{Start: p.pos}
 
-	if tok == token.CONST {
-		match(token.CONST)
-		c := make([]*ast.ConstDecl, 1)
-		c[0] = parseConstDecl()
-		for tok == token.COMMA {
-			match(token.COMMA)
-			c = append(c, parseConstDecl())
+	if p.tok == token.CONST {
+		b.Consts = p.parseConsts()
+	}
+	if p.tok == token.VAR {
+		b.Vars = p.parseVars()
+	}
+	var procs []*ast.ProcDecl
+	for {
+		switch p.tok {
+		case token.PROCEDURE, token.FUNCTION:
+			if proc := p.parseProc(); proc != nil {
+				procs = append(procs, proc)
+			}
+			continue
+		case token.CONST:
+			// Declarations out of order are reported, and parsed on
+			p.error(p.pos, SyntaxError, "CONST declaration out of order")
+			b.Consts = append(b.Consts, p.parseConsts()...)
+			continue
+		case token.VAR:
+			p.error(p.pos, SyntaxError, "VAR declaration out of order")
+			b.Vars = append(b.Vars, p.parseVars()...)
+			continue
 		}
-		match(token.SEMICOLON)
-		b.Consts = c
-	}
-	if tok == token.VAR {
-		match(token.VAR)
-		v := make([]*ast.Ident, 1)
-		v[0] = parseIdent()
-		for tok == token.COMMA {
-			match(token.COMMA)
-			v = append(v, parseIdent())
+		break
+	}
+	b.Procs = procs
+
+	b.Body = p.parseStmt()
+	return b
+}
+
+// parseConsts parses the constant declarations. On syntax errors, it
+// returns the declarations parsed so far.
+func (p *Parser) parseConsts() (c []*ast.ConstDecl) {
+	defer func() {
+		if p.sync(recover()) && p.tok == token.SEMICOLON {
+			p.next()
 		}
-		match(token.SEMICOLON)
-		b.Vars = v
+	}()
+	p.match(token.CONST)
+	c = append(c, p.parseConstDecl())
+	for p.tok == token.COMMA {
+		p.match(token.COMMA)
+		c = append(c, p.parseConstDecl())
 	}
-	var p []*ast.ProcDecl
-	for tok == token.PROCEDURE {
-		p = append(p, parseProc())
+	p.match(token.SEMICOLON)
+	return c
+}
+
+func (p *Parser) parseConstDecl() *ast.ConstDecl {
+	name := p.parseIdent()
+	p.match(token.EQL)
+	return &ast.ConstDecl{Name: name, Value: p.parseNumber()}
+}
+
+// parseVars parses the variable declarations. On syntax errors, it returns
+// the declarations parsed so far.
+func (p *Parser) parseVars() (v []*ast.VarDecl) {
+	defer func() {
+		if p.sync(recover()) && p.tok == token.SEMICOLON {
+			p.next()
+		}
+	}()
+	p.match(token.VAR)
+	v = append(v, p.parseVarDecl())
+	for p.tok == token.COMMA {
+		p.match(token.COMMA)
+		v = append(v, p.parseVarDecl())
 	}
-	b.Procs = p
+	p.match(token.SEMICOLON)
+	return v
+}
 
-	b.Body = parseStmt()
-	return b
+// parseVarDecl parses a variable declaration, with the length of an array
+// in brackets.
+func (p *Parser) parseVarDecl() *ast.VarDecl {
+	d := &ast.VarDecl{Name: p.parseIdent()}
+	if p.tok == token.LBRACK {
+		d.Lbrack = p.match(token.LBRACK)
+		d.Len = p.parseNumber()
+		d.Rbrack = p.match(token.RBRACK)
+	}
+	return d
 }
 
-func parseConstDecl() *ast.ConstDecl {
-	name := parseIdent()
-	match(token.EQL)
-	return &ast.ConstDecl{Name: name, Value: parseNumber()}
+// parseProc parses a procedure or function declaration. On syntax errors,
+// it returns nil unless its block was parsed.
+func (p *Parser) parseProc() (d *ast.ProcDecl) {
+	d = &ast.ProcDecl{Procedure: p.pos, Tok: p.tok}
+	defer func() {
+		if !p.sync(recover()) {
+			return
+		}
+		if d.Block == nil {
+			d = nil
+		} else {
+			d.Semicolon = p.pos
+		}
+		if p.tok == token.SEMICOLON {
+			p.next()
+		}
+	}()
+	p.next() // PROCEDURE or FUNCTION
+	d.Name = p.parseIdent()
+	if p.tok == token.LPAREN {
+		d.Lparen = p.match(token.LPAREN)
+		d.Params = p.parseParams()
+		d.Rparen = p.match(token.RPARAN)
+	}
+	p.match(token.SEMICOLON)
+	d.Block = p.parseBlock()
+	d.Semicolon = p.match(token.SEMICOLON)
+	return d
 }
 
-func parseProc() *ast.ProcDecl {
-	match(token.PROCEDURE)
-	name := parseIdent()
-	match(token.SEMICOLON)
-	block := parseBlock()
-	match(token.SEMICOLON)
-	return &ast.ProcDecl{Name: name, Block: block}
+// parseParams parses the parameters of a procedure: groups of names
+// separated by ";", each passed by reference if prefixed by VAR. The list
+// may be empty.
+func (p *Parser) parseParams() (params []*ast.Param) {
+	if p.tok == token.RPARAN {
+		return nil
+	}
+	for {
+		var pos token.Pos
+		if p.tok == token.VAR {
+			pos = p.match(token.VAR)
+		}
+		params = append(params, &ast.Param{Var: pos, Name: p.parseIdent()})
+		for p.tok == token.COMMA {
+			p.match(token.COMMA)
+			params = append(params, &ast.Param{Var: pos, Name: p.parseIdent()})
+		}
+		if p.tok != token.SEMICOLON {
+			return params
+		}
+		p.next()
+	}
 }
 
-func parseStmt() ast.Stmt {
-	switch tok {
+// parseStmt parses a statement, or returns nil for an empty statement. On
+// syntax errors, it returns a BadStmt.
+func (p *Parser) parseStmt() (s ast.Stmt) {
+	pos := p.pos
+	defer func() {
+		if p.sync(recover()) {
+			s = &ast.BadStmt{From: pos, To: p.pos}
+		}
+	}()
+	switch p.tok {
 	case token.IDENT:
-		return parseAssign()
+		return p.parseAssign()
 	case token.CALL:
-		return parseCall()
+		return p.parseCall()
 	case token.SEND:
-		return parseSend()
+		return p.parseSend()
 	case token.RECV:
-		return parseReceive()
+		return p.parseReceive()
+	case token.RETURN:
+		return p.parseReturn()
 	case token.BEGIN:
-		return parseBegin()
+		return p.parseBegin()
 	case token.IF:
-		return parseIf()
+		return p.parseIf()
 	case token.WHILE:
-		return parseWhile()
+		return p.parseWhile()
+	case token.REPEAT:
+		return p.parseRepeat()
+	case token.FOR:
+		return p.parseFor()
 	}
 	return nil
 }
 
-func parseAssign() *ast.AssignStmt {
-	i := parseIdent()
-	match(token.BECOMES)
-	x := parseExpr()
-	return &ast.AssignStmt{Lhs: i, Rhs: x}
+func (p *Parser) parseAssign() *ast.AssignStmt {
+	lhs := p.parseVariable()
+	pos := p.match(token.BECOMES)
+	x := p.parseExpr()
+	return &ast.AssignStmt{Lhs: lhs, TokPos: pos, Rhs: x}
+}
+
+// parseVariable parses a variable, or an element of an array.
+func (p *Parser) parseVariable() ast.Expr {
+	id := p.parseIdent()
+	if p.tok != token.LBRACK {
+		return id
+	}
+	return p.parseIndex(id)
+}
+
+// parseIndex parses the index in brackets following the name of an array.
+func (p *Parser) parseIndex(id *ast.Ident) *ast.IndexExpr {
+	x := &ast.IndexExpr{X: id, Lbrack: p.match(token.LBRACK)}
+	x.Index = p.parseExpr()
+	x.Rbrack = p.match(token.RBRACK)
+	return x
+}
+
+func (p *Parser) parseCall() *ast.CallStmt {
+	pos := p.match(token.CALL)
+	s := &ast.CallStmt{Call: pos, Proc: p.parseIdent()}
+	if p.tok == token.LPAREN {
+		s.Lparen = p.match(token.LPAREN)
+		s.Args = p.parseArgs()
+		s.Rparen = p.match(token.RPARAN)
+	}
+	return s
+}
+
+// parseArgs parses a list of arguments separated by ",", which may be
+// empty.
+func (p *Parser) parseArgs() (args []ast.Expr) {
+	if p.tok == token.RPARAN {
+		return nil
+	}
+	args = append(args, p.parseExpr())
+	for p.tok == token.COMMA {
+		p.match(token.COMMA)
+		args = append(args, p.parseExpr())
+	}
+	return args
+}
+
+func (p *Parser) parseSend() *ast.SendStmt {
+	pos := p.match(token.SEND)
+	return &ast.SendStmt{Send: pos, X: p.parseExpr()}
 }
 
-func parseCall() *ast.CallStmt {
-	match(token.CALL)
-	return &ast.CallStmt{Proc: parseIdent()}
+func (p *Parser) parseReceive() *ast.ReceiveStmt {
+	pos := p.match(token.RECV)
+	return &ast.ReceiveStmt{Recv: pos, X: p.parseVariable()}
 }
 
-func parseSend() *ast.SendStmt {
-	match(token.SEND)
-	return &ast.SendStmt{X: parseExpr()}
+func (p *Parser) parseReturn() *ast.ReturnStmt {
+	pos := p.match(token.RETURN)
+	return &ast.ReturnStmt{Return: pos, X: p.parseExpr()}
 }
 
-func parseReceive() *ast.ReceiveStmt {
-	match(token.RECV)
-	return &ast.ReceiveStmt{Name: parseIdent()}
+func (p *Parser) parseBegin() *ast.BeginStmt {
+	pos := p.match(token.BEGIN)
+	s := p.parseList(token.END)
+	end := p.match(token.END)
+	return &ast.BeginStmt{Begin: pos, List: s, EndPos: end}
 }
 
-func parseBegin() *ast.BeginStmt {
-	match(token.BEGIN)
-	s := make([]ast.Stmt, 1)
-	s[0] = parseStmt()
-	for tok == token.SEMICOLON {
-		match(token.SEMICOLON)
-		s = append(s, parseStmt())
+// parseList parses a list of statements separated by ";", ending before
+// the given keyword.
+func (p *Parser) parseList(end token.Token) (s []ast.Stmt) {
+	for {
+		s = append(s, p.parseStmt())
+		if !p.atStmtEnd() {
+			// Skip the unexpected tokens following a statement
+			p.expected(end.String())
+			p.skip()
+		}
+		if p.tok != token.SEMICOLON {
+			return s
+		}
+		p.next()
 	}
-	match(token.END)
-	return &ast.BeginStmt{List: s}
 }
 
-func parseIf() *ast.IfStmt {
-	match(token.IF)
-	c := parseCond()
-	match(token.THEN)
-	s := parseStmt()
-	return &ast.IfStmt{Cond: c, Body: s}
+func (p *Parser) parseIf() *ast.IfStmt {
+	pos := p.match(token.IF)
+	c := p.parseCond()
+	then := p.match(token.THEN)
+	s := &ast.IfStmt{If: pos, Cond: c, Then: then, Body: p.parseStmt()}
+	// An ELSE belongs to the innermost IF, which parsed its body first
+	if p.tok == token.ELSE {
+		s.ElsePos = p.match(token.ELSE)
+		s.Else = p.parseStmt()
+	}
+	return s
 }
 
-func parseWhile() *ast.WhileStmt {
-	match(token.WHILE)
-	c := parseCond()
-	match(token.DO)
-	s := parseStmt()
-	return &ast.WhileStmt{Cond: c, Body: s}
+func (p *Parser) parseWhile() *ast.WhileStmt {
+	pos := p.match(token.WHILE)
+	c := p.parseCond()
+	do := p.match(token.DO)
+	s := p.parseStmt()
+	return &ast.WhileStmt{While: pos, Cond: c, Do: do, Body: s}
 }
 
-func parseCond() ast.Cond {
-	if tok == token.ODD {
-		match(token.ODD)
-		return &ast.OddCond{X: parseExpr()}
+func (p *Parser) parseRepeat() *ast.RepeatStmt {
+	pos := p.match(token.REPEAT)
+	s := p.parseList(token.UNTIL)
+	until := p.match(token.UNTIL)
+	return &ast.RepeatStmt{Repeat: pos, List: s, Until: until, Cond: p.parseCond()}
+}
+
+func (p *Parser) parseFor() *ast.ForStmt {
+	s := &ast.ForStmt{For: p.match(token.FOR)}
+	s.Var = p.parseIdent()
+	s.TokPos = p.match(token.BECOMES)
+	s.From = p.parseExpr()
+	if p.tok != token.TO && p.tok != token.DOWNTO {
+		p.fail("TO or DOWNTO")
 	}
-	return parseRel()
+	s.DirPos, s.Dir = p.pos, p.tok
+	p.next()
+	s.Limit = p.parseExpr()
+	s.Do = p.match(token.DO)
+	s.Body = p.parseStmt()
+	return s
 }
 
-func parseRel() *ast.RelCond {
-	x := parseExpr()
-	if !tok.IsRelop() {
-		expected("relation", text)
-		return nil
+func (p *Parser) parseCond() ast.Cond {
+	if p.tok == token.ODD {
+		pos := p.match(token.ODD)
+		return &ast.OddCond{Odd: pos, X: p.parseExpr()}
+	}
+	return p.parseRel()
+}
+
+func (p *Parser) parseRel() *ast.RelCond {
+	x := p.parseExpr()
+	if !p.tok.IsRelop() {
+		p.fail("relation")
 	}
-	op := tok
-	next()
-	return &ast.RelCond{X: x, Op: op, Y: parseExpr()}
+	pos, op := p.pos, p.tok
+	p.next()
+	return &ast.RelCond{X: x, OpPos: pos, Op: op, Y: p.parseExpr()}
 }
 
-func parseExpr() ast.Expr {
-	sign := tok
+// parseExpr parses an expression. The binary operators are left
+// associative, and a leading sign applies to the first term: it binds
+// looser than * and /, but tighter than the binary + and -. Thus -a*b is
+// -(a*b), and -a+b is (-a)+b.
+func (p *Parser) parseExpr() ast.Expr {
+	pos, sign := p.pos, p.tok
 	if sign.IsAddop() {
-		next()
+		p.next()
 	}
-	x := parseTerm()
+	x := p.parseTerm()
 	if sign.IsAddop() {
-		x = &ast.UnaryExpr{X: x, Op: sign}
+		x = &ast.UnaryExpr{OpPos: pos, Op: sign, X: x}
 	}
-	if tok.IsAddop() {
-		op := tok
-		next()
-		return &ast.BinaryExpr{X: x, Op: op, Y: parseExpr()}
+	for p.tok.IsAddop() {
+		pos, op := p.pos, p.tok
+		p.next()
+		x = &ast.BinaryExpr{X: x, OpPos: pos, Op: op, Y: p.parseTerm()}
 	}
 	return x
 }
 
-func parseTerm() ast.Expr {
-	x := parseFact()
-	if tok.IsMulop() {
-		op := tok
-		next()
-		return &ast.BinaryExpr{X: x, Op: op, Y: parseTerm()}
+// parseTerm parses a term. The binary operators are left associative.
+func (p *Parser) parseTerm() ast.Expr {
+	x := p.parseFact()
+	for p.tok.IsMulop() {
+		pos, op := p.pos, p.tok
+		p.next()
+		x = &ast.BinaryExpr{X: x, OpPos: pos, Op: op, Y: p.parseFact()}
 	}
 	return x
 }
 
-func parseFact() ast.Expr {
-	switch tok {
+func (p *Parser) parseFact() ast.Expr {
+	switch p.tok {
 	case token.IDENT:
-		return parseIdent()
+		id := p.parseIdent()
+		if p.tok == token.LBRACK {
+			return p.parseIndex(id)
+		}
+		if p.tok != token.LPAREN {
+			return id
+		}
+		x := &ast.CallExpr{Func: id, Lparen: p.match(token.LPAREN)}
+		x.Args = p.parseArgs()
+		x.Rparen = p.match(token.RPARAN)
+		return x
 	case token.NUMBER:
-		return parseNumber()
+		return p.parseNumber()
 	case token.LPAREN:
-		match(token.LPAREN)
-		x := parseExpr()
-		match(token.RPARAN)
+		p.match(token.LPAREN)
+		x := p.parseExpr()
+		p.match(token.RPARAN)
 		return x
-	default:
-		expected("expression", text)
 	}
-	return nil
+	p.expected("expression")
+	return &ast.BadExpr{From: p.pos, To: p.pos}
 }
 
-func parseIdent() *ast.Ident {
-	if tok != token.IDENT {
-		expected("identifier", text)
+func (p *Parser) parseIdent() *ast.Ident {
+	if p.tok != token.IDENT {
+		p.fail("identifier")
 	}
-	i := &ast.Ident{Name: text}
-	next()
+	i := &ast.Ident{NamePos: p.pos, Name: p.text}
+	p.next()
 	return i
 }
 
-func parseNumber() *ast.Number {
-	if tok != token.NUMBER {
-		expected("number", text)
+func (p *Parser) parseNumber() *ast.Number {
+	if p.tok != token.NUMBER {
+		p.fail("number")
 	}
-	n := &ast.Number{Value: text}
-	next()
+	n := &ast.Number{ValuePos: p.pos, Value: p.text}
+	p.next()
 	return n
 }
@@ -1,9 +1,11 @@
 package compiler
 
 import (
+	"bytes"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
 	"pl0/compiler/ast"
@@ -28,9 +30,25 @@ func TestParseExpr(t *testing.T) {
 		{"1 + 2", nil, 3},
 		{"9 - (5 + 3)", nil, 1},
 		{"z * (x / 2) - (y + 3)", Env{"z": 9, "x": 6, "y": 4}, 20},
+
+		// Left associativity
+		{"9 - 5 - 3", nil, 1},
+		{"16 / 4 / 2", nil, 2},
+		{"10 - 2 + 3", nil, 11},
+		{"2 * 3 / 4", nil, 1},
+		{"x - x - 1", Env{"x": 7}, -1},
+
+		// Unary minus
+		{"-2 - 3", nil, -5},
+		{"-7 / 2", nil, -3},
+		{"-x * 2 + 1", Env{"x": 4}, -7},
 	}
 	for _, tt := range tests {
-		x := ParseExpr(strings.NewReader(tt.in))
+		x, err := ParseExpr(strings.NewReader(tt.in))
+		if err != nil {
+			t.Errorf("ParseExpr(%q): %v", tt.in, err)
+			continue
+		}
 		got := Eval(x, tt.env)
 		if got != tt.want {
 			t.Errorf("ParseExpr(%q): got %d, want %d", tt.in, got, tt.want)
@@ -38,6 +56,48 @@ func TestParseExpr(t *testing.T) {
 	}
 }
 
+func TestParseExprTree(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"a - b - c", "((a - b) - c)"},
+		{"a / b / c", "((a / b) / c)"},
+		{"a - b + c", "((a - b) + c)"},
+		{"a * b / c * d", "(((a * b) / c) * d)"},
+		{"a - b * c - d", "((a - (b * c)) - d)"},
+		{"a - (b - c)", "(a - (b - c))"},
+		{"-a - b", "((-a) - b)"},
+		{"-a * b", "(-(a * b))"},
+		{"+a / b - c", "((+(a / b)) - c)"},
+	}
+	for _, tt := range tests {
+		x, err := ParseExpr(strings.NewReader(tt.in))
+		if err != nil {
+			t.Errorf("ParseExpr(%q): %v", tt.in, err)
+			continue
+		}
+		if got := show(x); got != tt.want {
+			t.Errorf("ParseExpr(%q): got %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+// show renders an expression fully parenthesized.
+func show(x ast.Expr) string {
+	switch n := x.(type) {
+	case *ast.Ident:
+		return n.Name
+	case *ast.Number:
+		return n.Value
+	case *ast.UnaryExpr:
+		return "(" + n.Op.String() + show(n.X) + ")"
+	case *ast.BinaryExpr:
+		return "(" + show(n.X) + " " + n.Op.String() + " " + show(n.Y) + ")"
+	}
+	return fmt.Sprintf("%T", x)
+}
+
 // Env maps identifiers to number values.
 type Env map[string]int
 
@@ -79,3 +139,410 @@ func Eval(x ast.Expr, e Env) int {
 	}
 	return 0
 }
+
+func TestParseAndTranslateConcurrent(t *testing.T) {
+	const src = `
+CONST k = 3;
+VAR x, y;
+PROCEDURE p;
+	VAR z;
+	BEGIN z := x * k; y := z END;
+BEGIN x := 2; CALL p; ! y END.
+`
+	var want bytes.Buffer
+	if err := ParseAndTranslate("", strings.NewReader(src), &want, "p", LinuxAMD64); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 8
+	outs := make([]bytes.Buffer, n)
+	var wg sync.WaitGroup
+	for i := range outs {
+		wg.Add(1)
+		go func(out *bytes.Buffer) {
+			defer wg.Done()
+			if err := ParseAndTranslate("", strings.NewReader(src), out, "p", LinuxAMD64); err != nil {
+				t.Error(err)
+			}
+		}(&outs[i])
+	}
+	wg.Wait()
+	for i := range outs {
+		if outs[i].String() != want.String() {
+			t.Errorf("translation %d differs from the sequential one:\n%s", i, outs[i].String())
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		kind ErrorKind
+		want string
+	}{
+		{"VAR x;\nBEGIN x := 1 END", SyntaxError, "2:17: unexpected EOF, expecting ."},
+		{"VAR x;\nx := 1 %", SyntaxError, "2:8: illegal character '%'"},
+		{"x := 1.", UndefinedError, "1:1: undefined identifier x"},
+		{"VAR x, x; x := 1.", DuplicateError, "1:8: duplicate identifier x"},
+		{"CONST k = 1;\nk := 2.", KindError, "2:1: cannot assign to k (kind CONST)"},
+		{"PROCEDURE p; ;\n! p.", KindError, "2:3: cannot use p (kind PROCEDURE) in expression"},
+		{"CONST k = 2;\n! 1 / (k - 2).", ConstError, "2:5: division by zero"},
+		{"PROCEDURE p(a, b); ;\nCALL p(1).", KindError, "2:6: wrong number of arguments in call to p: have 1, want 2"},
+		{"VAR x; PROCEDURE p(VAR a); ;\nCALL p(x + 1).", KindError, "2:8: cannot pass non-variable to VAR parameter a of p"},
+		{"CONST k = 1; PROCEDURE p(VAR a); ;\nCALL p(k).", KindError, "2:8: cannot pass non-variable to VAR parameter a of p"},
+		{"VAR x;\nRETURN x.", KindError, "2:1: RETURN outside function"},
+		{"FUNCTION f; PROCEDURE p; RETURN 1; CALL p;\n! f().", KindError, "1:26: RETURN outside function"},
+		{"PROCEDURE p; ;\n! p().", KindError, "2:3: cannot call non-function p (kind PROCEDURE)"},
+		{"FUNCTION f; ;\nCALL f.", KindError, "2:6: cannot call non-procedure f (kind FUNCTION)"},
+		{"FUNCTION f; ;\n! f.", KindError, "2:3: cannot use f (kind FUNCTION) in expression"},
+		{"FUNCTION f; ;\nf := 1.", KindError, "2:1: cannot assign to f (kind FUNCTION)"},
+		{"VAR i;\nFOR i := 1 UNTIL 2 DO ! i.", SyntaxError, "2:12: unexpected UNTIL, expecting TO or DOWNTO"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		err := ParseAndTranslate("e.pl0", strings.NewReader(tt.src), &out, "e", Linux386)
+		list, ok := err.(ErrorList)
+		if !ok || len(list) != 1 {
+			t.Errorf("%q: got error %v, want a single error", tt.src, err)
+			continue
+		}
+		if e := list[0]; e.Kind != tt.kind || e.Error() != "e.pl0:"+tt.want {
+			t.Errorf("%q: got %s error %q, want %s error %q", tt.src, e.Kind, e, tt.kind, tt.want)
+		}
+	}
+}
+
+func TestNumberRange(t *testing.T) {
+	const src = "CONST k = 2147483647;\nBEGIN ! k; ! 2147483648;\n! 0 - 2147483648 END."
+	tests := []struct {
+		target Target
+		want   string
+	}{
+		{Linux386, "2:14: number 2147483648 out of range, 3:7: number 2147483648 out of range"},
+		{LinuxAMD64, ""},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		c := NewCompiler(tt.target)
+		var got []string
+		if list, ok := c.ParseAndTranslate("", strings.NewReader(src), &out, "n").(ErrorList); ok {
+			for _, e := range list {
+				got = append(got, e.Error())
+			}
+		}
+		if strings.Join(got, ", ") != tt.want {
+			t.Errorf("%s: got errors %q, want %s", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestConstWrap(t *testing.T) {
+	const src = "CONST k = 65536;\nVAR a[2];\nBEGIN ! 1 / (k * k); a[k * k + 1] := 0 END."
+	tests := []struct {
+		target Target
+		want   string
+	}{
+		{Linux386, "3:11: division by zero"},
+		{LinuxAMD64, "3:24: index 4294967297 out of range [0:2]"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		c := NewCompiler(tt.target)
+		var got []string
+		if list, ok := c.ParseAndTranslate("", strings.NewReader(src), &out, "w").(ErrorList); ok {
+			for _, e := range list {
+				got = append(got, e.Error())
+			}
+		}
+		if strings.Join(got, ", ") != tt.want {
+			t.Errorf("%s: got errors %q, want %s", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	const src = `VAR x y;
+PROCEDURE p;
+	x := ;
+BEGIN
+	x := 1 2;
+	IF x THEN x := 3;
+	CALL ;
+	! x
+END.`
+	prog, err := Parse("r.pl0", strings.NewReader(src))
+	want := []string{
+		"r.pl0:1:7: unexpected y, expecting ;",
+		"r.pl0:3:7: unexpected ;, expecting expression",
+		"r.pl0:5:9: unexpected 2, expecting END",
+		"r.pl0:6:7: unexpected THEN, expecting relation",
+		"r.pl0:7:7: unexpected ;, expecting identifier",
+	}
+	list, _ := err.(ErrorList)
+	var got []string
+	for _, e := range list {
+		got = append(got, e.Error())
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got errors:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if prog == nil {
+		t.Fatal("got no partial program")
+	}
+
+	// The statements following errors are kept
+	body := prog.Main.Body.(*ast.BeginStmt)
+	var kinds []string
+	for _, s := range body.List {
+		kinds = append(kinds, fmt.Sprintf("%T", s))
+	}
+	wantKinds := "*ast.AssignStmt *ast.BadStmt *ast.BadStmt *ast.SendStmt"
+	if strings.Join(kinds, " ") != wantKinds {
+		t.Errorf("got statements %v, want %s", kinds, wantKinds)
+	}
+}
+
+func TestRecoveryDecls(t *testing.T) {
+	const src = `VAR x
+CONST k = 1;
+PROCEDURE p;
+	x := k;
+VAR y;
+BEGIN
+	x := ;
+	y := x
+END.`
+	prog, err := Parse("d.pl0", strings.NewReader(src))
+	want := []string{
+		"d.pl0:2:1: unexpected CONST, expecting ;",
+		"d.pl0:5:1: VAR declaration out of order",
+		"d.pl0:7:7: unexpected ;, expecting expression",
+	}
+	list, _ := err.(ErrorList)
+	var got []string
+	for _, e := range list {
+		got = append(got, e.Error())
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got errors:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// The declarations out of order are kept
+	if prog == nil {
+		t.Fatal("got no partial program")
+	}
+	b := prog.Main
+	if len(b.Consts) != 1 || len(b.Vars) != 2 || len(b.Procs) != 1 {
+		t.Errorf("got %d constants, %d variables and %d procedures, want 1, 2 and 1",
+			len(b.Consts), len(b.Vars), len(b.Procs))
+	}
+}
+
+func TestMaxErrors(t *testing.T) {
+	src := "BEGIN" + strings.Repeat("\nCALL ;", 20) + "\nEND."
+	var p Parser
+	p.Init(token.NewFile(""), strings.NewReader(src))
+	p.MaxErrors = 3
+	_, err := p.ParseProgram("m")
+	list, _ := err.(ErrorList)
+	if len(list) != 4 || list[3].Msg != "too many errors" {
+		t.Errorf("got errors %v, want 3 errors and a final too many errors", list)
+	}
+}
+
+func TestPositions(t *testing.T) {
+	const src = "VAR x;\nBEGIN\n  x := 10 + x\nEND."
+	prog, err := Parse("pos.pl0", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	begin := prog.Main.Body.(*ast.BeginStmt)
+	assign := begin.List[0].(*ast.AssignStmt)
+	sum := assign.Rhs.(*ast.BinaryExpr)
+	tests := []struct {
+		pos  token.Pos
+		want string
+	}{
+		{prog.Pos(), "pos.pl0:1:1"},
+		{prog.End(), "pos.pl0:4:5"},
+		{prog.Main.Vars[0].Pos(), "pos.pl0:1:5"},
+		{begin.Pos(), "pos.pl0:2:1"},
+		{begin.End(), "pos.pl0:4:4"},
+		{assign.Pos(), "pos.pl0:3:3"},
+		{assign.TokPos, "pos.pl0:3:5"},
+		{sum.Pos(), "pos.pl0:3:8"},
+		{sum.OpPos, "pos.pl0:3:11"},
+		{sum.End(), "pos.pl0:3:14"},
+	}
+	for i, tt := range tests {
+		if got := prog.File.Position(tt.pos).String(); got != tt.want {
+			t.Errorf("%d: got position %s, want %s", i, got, tt.want)
+		}
+	}
+}
+
+func TestParams(t *testing.T) {
+	const src = "VAR x, y;\nPROCEDURE p(a, b; VAR r); ;\nCALL p(1, x + 2, y)."
+	prog, err := Parse("params.pl0", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var params []string
+	for _, p := range prog.Main.Procs[0].Params {
+		s := p.Name.Name
+		if p.Var.IsValid() {
+			s = "VAR " + s
+		}
+		params = append(params, s)
+	}
+	if got, want := strings.Join(params, ", "), "a, b, VAR r"; got != want {
+		t.Errorf("got parameters %s, want %s", got, want)
+	}
+	call := prog.Main.Body.(*ast.CallStmt)
+	if len(call.Args) != 3 {
+		t.Fatalf("got %d arguments, want 3", len(call.Args))
+	}
+	if _, ok := call.Args[1].(*ast.BinaryExpr); !ok {
+		t.Errorf("got argument %T, want *ast.BinaryExpr", call.Args[1])
+	}
+	if got, want := prog.File.Position(call.End()).String(), "params.pl0:3:20"; got != want {
+		t.Errorf("got end %s, want %s", got, want)
+	}
+}
+
+func TestFunc(t *testing.T) {
+	const src = "FUNCTION f(a, b); RETURN a - b;\n! f(1, f(2, 3)) * 2."
+	prog, err := Parse("func.pl0", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := prog.Main.Procs[0]
+	if d.Tok != token.FUNCTION {
+		t.Errorf("got declaration %s, want FUNCTION", d.Tok)
+	}
+	if _, ok := d.Block.Body.(*ast.ReturnStmt); !ok {
+		t.Errorf("got body %T, want *ast.ReturnStmt", d.Block.Body)
+	}
+	mul := prog.Main.Body.(*ast.SendStmt).X.(*ast.BinaryExpr)
+	call, ok := mul.X.(*ast.CallExpr)
+	if !ok {
+		t.Fatalf("got operand %T, want *ast.CallExpr", mul.X)
+	}
+	if len(call.Args) != 2 {
+		t.Fatalf("got %d arguments, want 2", len(call.Args))
+	}
+	if _, ok := call.Args[1].(*ast.CallExpr); !ok {
+		t.Errorf("got argument %T, want *ast.CallExpr", call.Args[1])
+	}
+	if got, want := prog.File.Position(call.End()).String(), "func.pl0:2:16"; got != want {
+		t.Errorf("got end %s, want %s", got, want)
+	}
+}
+
+func TestArray(t *testing.T) {
+	const src = "VAR a[10], i;\nBEGIN ? a[i]; a[i + 1] := a[a[i]] END."
+	prog, err := Parse("array.pl0", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := prog.Main.Vars
+	if len(vars) != 2 || vars[0].Len == nil || vars[0].Len.Value != "10" || vars[1].Len != nil {
+		t.Fatalf("got variables %v, want a[10] and i", vars)
+	}
+	if got, want := prog.File.Position(vars[0].End()).String(), "array.pl0:1:10"; got != want {
+		t.Errorf("got end %s, want %s", got, want)
+	}
+	list := prog.Main.Body.(*ast.BeginStmt).List
+	if x, ok := list[0].(*ast.ReceiveStmt).X.(*ast.IndexExpr); !ok || x.X.Name != "a" {
+		t.Errorf("got receive into %T, want *ast.IndexExpr", list[0].(*ast.ReceiveStmt).X)
+	}
+	assign := list[1].(*ast.AssignStmt)
+	lhs, ok := assign.Lhs.(*ast.IndexExpr)
+	if !ok {
+		t.Fatalf("got assignment to %T, want *ast.IndexExpr", assign.Lhs)
+	}
+	if _, ok := lhs.Index.(*ast.BinaryExpr); !ok {
+		t.Errorf("got index %T, want *ast.BinaryExpr", lhs.Index)
+	}
+	rhs, ok := assign.Rhs.(*ast.IndexExpr)
+	if !ok {
+		t.Fatalf("got operand %T, want *ast.IndexExpr", assign.Rhs)
+	}
+	if _, ok := rhs.Index.(*ast.IndexExpr); !ok {
+		t.Errorf("got index %T, want *ast.IndexExpr", rhs.Index)
+	}
+	if got, want := prog.File.Position(rhs.End()).String(), "array.pl0:2:34"; got != want {
+		t.Errorf("got end %s, want %s", got, want)
+	}
+}
+
+func TestLoops(t *testing.T) {
+	const src = "VAR i, s;\nBEGIN REPEAT s := s + 1; UNTIL s > 9; FOR i := 9 DOWNTO s DO s := s + i END."
+	prog, err := Parse("loops.pl0", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := prog.Main.Body.(*ast.BeginStmt).List
+	repeat, ok := list[0].(*ast.RepeatStmt)
+	if !ok {
+		t.Fatalf("got statement %T, want *ast.RepeatStmt", list[0])
+	}
+	if len(repeat.List) != 2 || repeat.List[1] != nil {
+		t.Errorf("got %d statements %v, want an assignment and an empty statement", len(repeat.List), repeat.List)
+	}
+	loop, ok := list[1].(*ast.ForStmt)
+	if !ok {
+		t.Fatalf("got statement %T, want *ast.ForStmt", list[1])
+	}
+	if loop.Var.Name != "i" || loop.Dir != token.DOWNTO {
+		t.Errorf("got FOR %s %s, want FOR i DOWNTO", loop.Var.Name, loop.Dir)
+	}
+	if _, ok := loop.Body.(*ast.AssignStmt); !ok {
+		t.Errorf("got body %T, want *ast.AssignStmt", loop.Body)
+	}
+	for _, tt := range []struct {
+		pos  token.Pos
+		want string
+	}{
+		{repeat.Until, "loops.pl0:2:26"},
+		{repeat.End(), "loops.pl0:2:37"},
+		{loop.DirPos, "loops.pl0:2:50"},
+		{loop.Do, "loops.pl0:2:59"},
+		{loop.End(), "loops.pl0:2:72"},
+	} {
+		if got := prog.File.Position(tt.pos).String(); got != tt.want {
+			t.Errorf("got position %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestDanglingElse(t *testing.T) {
+	const src = "VAR x;\nIF x > 0 THEN IF x > 1 THEN x := 1 ELSE x := 2."
+	prog, err := Parse("else.pl0", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer := prog.Main.Body.(*ast.IfStmt)
+	inner, ok := outer.Body.(*ast.IfStmt)
+	if !ok {
+		t.Fatalf("got body %T, want *ast.IfStmt", outer.Body)
+	}
+	if outer.Else != nil || outer.ElsePos.IsValid() {
+		t.Errorf("got ELSE on the outer IF, want it on the inner one")
+	}
+	if _, ok := inner.Else.(*ast.AssignStmt); !ok {
+		t.Errorf("got else statement %T, want *ast.AssignStmt", inner.Else)
+	}
+	for _, tt := range []struct {
+		pos  token.Pos
+		want string
+	}{
+		{inner.ElsePos, "else.pl0:2:36"},
+		{inner.End(), "else.pl0:2:47"},
+		{outer.End(), "else.pl0:2:47"},
+	} {
+		if got := prog.File.Position(tt.pos).String(); got != tt.want {
+			t.Errorf("got position %s, want %s", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,485 @@
+package compiler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// instr is an instruction of the generated assembly, a label or a blank
+// line.
+type instr struct {
+	op    string   // Mnemonic, or "" for a label or blank line
+	args  []string // Operands
+	label string   // Name of a label
+	text  string   // Source line, or "" if rewritten
+}
+
+func (in *instr) String() string {
+	if in.text != "" || in.op == "" {
+		return in.text
+	}
+	if len(in.args) == 0 {
+		return "\t" + in.op
+	}
+	return "\t" + in.op + " " + strings.Join(in.args, ", ")
+}
+
+// parseInstr parses a line of assembly, returning nil if a directive or a
+// comment.
+func parseInstr(line string) *instr {
+	s := strings.TrimSpace(line)
+	if s == "" {
+		return &instr{text: line}
+	}
+	if name := strings.TrimSuffix(line, ":"); name != line && isLabel(name) {
+		return &instr{label: name, text: line}
+	}
+	if !strings.HasPrefix(line, "\t") || strings.HasPrefix(line, "\t;") {
+		return nil
+	}
+	in := &instr{text: line}
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		in.op = s[:i]
+		in.args = strings.Split(strings.TrimSpace(s[i+1:]), ", ")
+	} else {
+		in.op = s
+	}
+	return in
+}
+
+// newInstr returns a rewritten instruction.
+func newInstr(op string, args ...string) *instr {
+	return &instr{op: op, args: args}
+}
+
+// code is a run of instructions, labels and blank lines, without
+// directives or comments in between, being rewritten for machine m.
+type code struct {
+	m   machine
+	run []*instr
+}
+
+// A rule rewrites a sequence of n instructions starting at the instruction
+// i of code, reporting whether they match. The rules keep values in the
+// registers the generated code uses, relying on it to only jump within a
+// run, which it leaves by returning from a function.
+type rule struct {
+	name    string
+	n       int // Number of matched instructions; 0 for any
+	rewrite func(c *code, i int, in []*instr) ([]*instr, bool)
+}
+
+// rules is the table of peephole rules, tried in order at each instruction.
+var rules = []rule{
+	// JMP L1 / L0: / L1: => L0: / L1:
+	{"jump-next", 0, func(c *code, i int, in []*instr) ([]*instr, bool) {
+		if !isJump(in[0]) {
+			return nil, false
+		}
+		for j := 1; j < len(in) && in[j].op == ""; j++ {
+			if in[j].label == in[0].args[0] {
+				return in[1:], true
+			}
+		}
+		return nil, false
+	}},
+
+	// JE L0 / ... / L0: / JMP L1 => JE L1 / ... / L0: / JMP L1
+	{"jump-jump", 1, func(c *code, i int, in []*instr) ([]*instr, bool) {
+		if !isJump(in[0]) {
+			return nil, false
+		}
+		j := c.find(in[0].args[0])
+		for j >= 0 && j < len(c.run) && c.run[j].op == "" {
+			j++
+		}
+		if j < 0 || j == len(c.run) || !is(c.run[j], "JMP", "") || c.run[j].args[0] == in[0].args[0] {
+			return nil, false
+		}
+		return []*instr{newInstr(in[0].op, c.run[j].args[0])}, true
+	}},
+
+	// JL L0 / JMP L1 / L0: => JGE L1 / L0:
+	{"branch-over", 3, func(c *code, i int, in []*instr) ([]*instr, bool) {
+		ncc, ok := inverse[strings.TrimPrefix(in[0].op, "J")]
+		if ok && isJump(in[0]) && is(in[1], "JMP", "") && in[2].label == in[0].args[0] {
+			return []*instr{newInstr("J"+ncc, in[1].args[0]), in[2]}, true
+		}
+		return nil, false
+	}},
+
+	// CMP x, y / ... => ..., if no conditional jump reads the flags before
+	// they are written
+	{"compare", 1, func(c *code, i int, in []*instr) ([]*instr, bool) {
+		if (in[0].op == "CMP" || in[0].op == "TEST") && c.flagsDead(i+1) {
+			return nil, true
+		}
+		return nil, false
+	}},
+
+	// MOV x, EAX / MOV EAX, x => MOV x, EAX, and MOV EAX, x / MOV x, EAX =>
+	// MOV EAX, x, for any register
+	{"reload", 2, func(c *code, i int, in []*instr) ([]*instr, bool) {
+		if is(in[0], "MOV", "", "") && (isRegister(c.m, in[0].args[0]) || isRegister(c.m, in[0].args[1])) &&
+			is(in[1], "MOV", in[0].args[1], in[0].args[0]) {
+			return in[:1], true
+		}
+		return nil, false
+	}},
+
+	// MOV [x], EAX / MOV ECX, [x] => MOV [x], EAX / MOV ECX, EAX, and so
+	// for an immediate stored
+	{"forward", 2, func(c *code, i int, in []*instr) ([]*instr, bool) {
+		if is(in[0], "MOV", "", "") && isMemory(c.m.unsized(in[0].args[0])) &&
+			is(in[1], "MOV", "", c.m.unsized(in[0].args[0])) && isRegister(c.m, in[1].args[0]) {
+			return []*instr{in[0], newInstr("MOV", in[1].args[0], in[0].args[1])}, true
+		}
+		return nil, false
+	}},
+
+	// MOV EAX, x / ... => ..., if EAX is not read before being written
+	{"dead-move", 1, func(c *code, i int, in []*instr) ([]*instr, bool) {
+		if (is(in[0], "MOV", "", "") || is(in[0], "LEA", "", "")) && isRegister(c.m, in[0].args[0]) &&
+			c.dead(in[0].args[0], i+1) {
+			return nil, true
+		}
+		return nil, false
+	}},
+
+	// MOV EAX, EBX / ADD EAX, 2 / MOV ESI, EAX => MOV ESI, EBX / ADD ESI, 2,
+	// if EAX is not read after
+	{"rename", 0, func(c *code, i int, in []*instr) ([]*instr, bool) {
+		if !isDefinition(in[0]) || !isRegister(c.m, in[0].args[0]) {
+			return nil, false
+		}
+		t := in[0].args[0]
+		j := 1
+		for j < len(in) && isUpdate(in[j], t) {
+			j++
+		}
+		if j == len(in) || !is(in[j], "MOV", "", t) || !isRegister(c.m, in[j].args[0]) || in[j].args[0] == t {
+			return nil, false
+		}
+		r := in[j].args[0]
+		for _, x := range in[1:j] {
+			for _, a := range x.args {
+				if mentions(a, r) {
+					return nil, false
+				}
+			}
+		}
+		if !c.dead(t, i+j+1) {
+			return nil, false
+		}
+		var out []*instr
+		if !is(in[0], "MOV", t, r) {
+			out = append(out, newInstr(in[0].op, append([]string{r}, in[0].args[1:]...)...))
+		}
+		for _, x := range in[1:j] {
+			args := make([]string, len(x.args))
+			for k, a := range x.args {
+				args[k] = rename(a, t, r)
+			}
+			out = append(out, newInstr(x.op, args...))
+		}
+		return append(out, in[j+1:]...), true
+	}},
+
+	// MOV ECX, [x] / ADD EAX, ECX => ADD EAX, [x], and so for the other
+	// instructions taking an operand in memory or an immediate in place of
+	// a register, if ECX is not read after
+	{"operand", 2, func(c *code, i int, in []*instr) ([]*instr, bool) {
+		if !is(in[0], "MOV", "", "") || !isRegister(c.m, in[0].args[0]) || isWide(in[0].args[1]) {
+			return nil, false
+		}
+		t, x := in[0].args[0], in[0].args[1]
+		var out *instr
+		switch op := in[1].op; {
+		case is(in[1], "PUSH", t):
+			out = newInstr(op, c.m.sized(x))
+		case (op == "MOV" || op == "ADD" || op == "SUB" || op == "IMUL" || op == "CMP") &&
+			is(in[1], op, "", t) && in[1].args[0] != t:
+			y := c.m.unsized(in[1].args[0])
+			switch {
+			case !isMemory(y):
+				out = newInstr(op, y, x)
+			case op == "IMUL" || isMemory(x):
+			case isImmediate(x):
+				out = newInstr(op, c.m.sized(y), x)
+			default:
+				out = newInstr(op, y, x)
+			}
+		case (op == "CMP" || op == "TEST") && is(in[1], op, t, "") && !mentions(in[1].args[1], t) && !isImmediate(x):
+			switch y := in[1].args[1]; {
+			case isImmediate(y):
+				out = newInstr(op, c.m.sized(x), y)
+			case !isMemory(x) || !isMemory(y):
+				out = newInstr(op, x, y)
+			}
+		}
+		if out == nil || !c.dead(t, i+2) {
+			return nil, false
+		}
+		return []*instr{out}, true
+	}},
+}
+
+// inverse maps a condition code to the one of its negation.
+var inverse = map[string]string{
+	"E": "NE", "NE": "E",
+	"L": "GE", "GE": "L",
+	"LE": "G", "G": "LE",
+	"B": "AE", "AE": "B",
+}
+
+// peephole rewrites the instructions of the assembly read from r with the
+// peephole rules, until none applies, and writes the result to w.
+func peephole(m machine, r io.Reader, w io.Writer) error {
+	type line struct {
+		text string
+		in   *instr
+	}
+	var lines []line
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		lines = append(lines, line{sc.Text(), parseInstr(sc.Text())})
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	for i := 0; i < len(lines); {
+		if lines[i].in == nil {
+			fmt.Fprintln(bw, lines[i].text)
+			i++
+			continue
+		}
+		// A run of instructions, labels and blank lines, without
+		// directives or comments in between
+		var run []*instr
+		for ; i < len(lines) && lines[i].in != nil; i++ {
+			run = append(run, lines[i].in)
+		}
+		for _, in := range optimize(m, run) {
+			fmt.Fprintln(bw, in)
+		}
+	}
+	return bw.Flush()
+}
+
+// optimize applies the rules to a run of instructions until none applies.
+func optimize(m machine, run []*instr) []*instr {
+	c := &code{m: m, run: run}
+	for changed := true; changed; {
+		changed = false
+		for i := 0; i < len(c.run) && !changed; i++ {
+			for _, r := range rules {
+				window := c.run[i:]
+				if r.n > 0 {
+					if len(window) < r.n {
+						continue
+					}
+					window = window[:r.n]
+				}
+				out, ok := r.rewrite(c, i, window)
+				if !ok {
+					continue
+				}
+				rest := c.run[i+len(window):]
+				c.run = append(append(append([]*instr{}, c.run[:i]...), out...), rest...)
+				changed = true
+				break
+			}
+		}
+	}
+	return c.run
+}
+
+// dead reports whether register r is written before being read by the
+// instructions from i on, following the jumps. Only the accumulator,
+// holding the result, is read by a return, and all are taken as read at
+// the end of the run.
+func (c *code) dead(r string, i int) bool {
+	return c.deadFrom(r, i, make(map[int]bool))
+}
+
+// deadFrom is dead, ignoring the instructions seen already, whose paths
+// are followed elsewhere.
+func (c *code) deadFrom(r string, i int, seen map[int]bool) bool {
+	for ; i < len(c.run) && !seen[i]; i++ {
+		seen[i] = true
+		in := c.run[i]
+		switch {
+		case in.op == "":
+			continue
+		case reads(c.m, in, r):
+			return false
+		case writes(c.m, in, r) || in.op == "RET":
+			return true
+		case isJump(in):
+			j := c.find(in.args[0])
+			if j < 0 || !c.deadFrom(r, j, seen) {
+				return false
+			}
+			if in.op == "JMP" {
+				return true
+			}
+		}
+	}
+	return i < len(c.run)
+}
+
+// flagsDead reports whether the flags are written before being read by the
+// instructions from i on, until a jump.
+func (c *code) flagsDead(i int) bool {
+	for ; i < len(c.run); i++ {
+		switch op := c.run[i].op; {
+		case op == "":
+			continue
+		case strings.HasPrefix(op, "J") || strings.HasPrefix(op, "CMOV"):
+			return false
+		case op == "CMP" || op == "TEST" || op == "ADD" || op == "SUB" || op == "IMUL" || op == "NEG" || op == "CALL":
+			return true
+		}
+	}
+	return false
+}
+
+// find returns the index of label L in the run, or -1 if not there.
+func (c *code) find(L string) int {
+	for i, in := range c.run {
+		if in.label == L {
+			return i
+		}
+	}
+	return -1
+}
+
+// reads reports whether in reads register r: an operand involving it,
+// other than the destination of a definition or pop, or an implicit use. The
+// sign extension and division read the accumulator, the division and
+// multiplication of one operand the data register too, a call the
+// accumulator, passing a number to the runtime, and a return the result
+// in the accumulator.
+func reads(m machine, in *instr, r string) bool {
+	for i, a := range in.args {
+		if mentions(a, r) && !(i == 0 && a == r && (isDefinition(in) || in.op == "POP")) {
+			return true
+		}
+	}
+	switch in.op {
+	case m.extend, "CALL", "RET":
+		return r == m.ax
+	case "IDIV", "IMUL":
+		return len(in.args) == 1 && (r == m.ax || r == m.dx)
+	}
+	return false
+}
+
+// writes reports whether in writes register r, without reading it.
+func writes(m machine, in *instr, r string) bool {
+	switch {
+	case isDefinition(in) || in.op == "POP":
+		return in.args[0] == r
+	case in.op == m.extend:
+		return r == m.dx
+	}
+	return false
+}
+
+// isDefinition reports whether in writes its first operand from the others:
+// a move, a load of an address, or a multiplication of three operands.
+func isDefinition(in *instr) bool {
+	return is(in, "MOV", "", "") || is(in, "LEA", "", "") || is(in, "IMUL", "", "", "")
+}
+
+// isUpdate reports whether in updates register r with an arithmetic
+// operation on it.
+func isUpdate(in *instr, r string) bool {
+	return is(in, "ADD", r, "") || is(in, "SUB", r, "") || is(in, "IMUL", r, "") || is(in, "NEG", r)
+}
+
+// is reports whether in is the instruction op with the given operands,
+// an empty operand matching any.
+func is(in *instr, op string, args ...string) bool {
+	if in.op != op || len(in.args) != len(args) {
+		return false
+	}
+	for i, a := range args {
+		if a != "" && in.args[i] != a {
+			return false
+		}
+	}
+	return true
+}
+
+// isJump reports whether in is a jump.
+func isJump(in *instr) bool {
+	return strings.HasPrefix(in.op, "J") && len(in.args) == 1
+}
+
+// isLabel reports whether s is the name of a label.
+func isLabel(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !isAlnum(c) && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// isAlnum reports whether c is an ASCII letter or digit.
+func isAlnum(c rune) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9'
+}
+
+// isRegister reports whether s names a general purpose register.
+func isRegister(m machine, s string) bool {
+	return s == m.ax || s == m.bx || s == m.cx || s == m.dx || s == m.si || s == m.di
+}
+
+// isWide reports whether operand x is an immediate beyond 32 bits, which
+// only a move into a register takes.
+func isWide(x string) bool {
+	v, err := strconv.ParseInt(x, 10, 64)
+	return err == nil && int64(int32(v)) != v
+}
+
+// mentions reports whether operand x involves register r.
+func mentions(x, r string) bool {
+	for _, f := range strings.FieldsFunc(x, func(c rune) bool { return !isAlnum(c) }) {
+		if f == r {
+			return true
+		}
+	}
+	return false
+}
+
+// rename replaces register r in operand x with register s.
+func rename(x, r, s string) string {
+	var b strings.Builder
+	for i := 0; i < len(x); {
+		j := i
+		for j < len(x) && isAlnum(rune(x[j])) {
+			j++
+		}
+		switch {
+		case j == i:
+			b.WriteByte(x[i])
+			j++
+		case x[i:j] == r:
+			b.WriteString(s)
+		default:
+			b.WriteString(x[i:j])
+		}
+		i = j
+	}
+	return b.String()
+}
@@ -0,0 +1,346 @@
+package compiler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPeepholeRules(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		// Jumps to the next instruction, to jumps, or over jumps
+		{"JMP L1; L0:; L1:; MOV RAX, 1", "L0:; L1:; MOV RAX, 1"},
+		{"JE L0; CALL PRINTN; L0:; JMP L2; L1:; CALL NEWLINE; L2:; RET", "JE L2; CALL PRINTN; L0:; JMP L2; L1:; CALL NEWLINE; L2:; RET"},
+		{"L0:; JMP L0", "L0:; JMP L0"},
+		{"CMP RAX, 1; JL L0; JMP L1; L0:; CALL PRINTN; L1:; RET", "CMP RAX, 1; JGE L1; L0:; CALL PRINTN; L1:; RET"},
+
+		// Comparisons without a conditional jump
+		{"CMP RAX, 1; L0:; CALL PRINTN", "L0:; CALL PRINTN"},
+		{"CMP RAX, 1; MOV RAX, 2; JE L0; CALL PRINTN; L0:; RET", "CMP RAX, 1; MOV RAX, 2; JE L0; CALL PRINTN; L0:; RET"},
+
+		// Redundant loads and stores
+		{"MOV [RBP + -8], RAX; MOV RAX, [RBP + -8]", "MOV [RBP + -8], RAX"},
+		{"MOV [rel _x], RSI; MOV RSI, [rel _x]; ADD RSI, 1", "MOV [rel _x], RSI; ADD RSI, 1"},
+		{"MOV [RCX + -8], RAX; MOV RAX, [RCX + -8]; MOV RAX, [RCX + -8]", "MOV [RCX + -8], RAX"},
+		{"MOV RAX, [rel _x]; MOV [rel _x], RAX; CALL PRINTN", "MOV RAX, [rel _x]; CALL PRINTN"},
+		{"MOV [RBP + -8], RAX; ADD RAX, 1; MOV RAX, [RBP + -8]", "MOV [RBP + -8], RAX; ADD RAX, 1; MOV RAX, [RBP + -8]"},
+
+		// Loads of a value just stored
+		{"MOV [RBP + -8], RAX; MOV RCX, [RBP + -8]", "MOV [RBP + -8], RAX; MOV RCX, RAX"},
+		{"MOV qword [rel _x], 5; MOV RAX, [rel _x]", "MOV qword [rel _x], 5; MOV RAX, 5"},
+
+		// Moves into registers not read after, unless on a jump
+		{"MOV RBX, 0; ADD qword [rel _x], 1; MOV RBX, [rel _x]; MOV RAX, RBX; CALL PRINTN; POP RBX",
+			"ADD qword [rel _x], 1; MOV RAX, [rel _x]; CALL PRINTN; POP RBX"},
+		{"MOV RBX, 0; ADD qword [rel _x], 1; MOV RBX, [rel _x]; MOV RAX, RBX; CALL PRINTN",
+			"ADD qword [rel _x], 1; MOV RBX, [rel _x]; MOV RAX, RBX; CALL PRINTN"},
+		{"MOV RCX, 0; CMP RAX, 1; JE L0; MOV RCX, 1; L0:; MOV RAX, RCX; CALL PRINTN",
+			"MOV RCX, 0; CMP RAX, 1; JE L0; MOV RCX, 1; L0:; MOV RAX, RCX; CALL PRINTN"},
+		{"LEA RAX, [rel _a]; CMP RCX, 10; JB L0; MOV RAX, 13; CALL BOUNDS; L0:; ADD RAX, RCX; MOV RAX, [RAX + 0]; CALL PRINTN",
+			"LEA RAX, [rel _a]; CMP RCX, 10; JB L0; MOV RAX, 13; CALL BOUNDS; L0:; ADD RAX, RCX; MOV RAX, [RAX + 0]; CALL PRINTN"},
+
+		// Values computed in a scratch register, then moved
+		{"MOV RAX, RBX; ADD RAX, 2; MOV RSI, RAX; MOV RAX, [rel _x]; CALL PRINTN", "MOV RSI, RBX; ADD RSI, 2; MOV RAX, [rel _x]; CALL PRINTN"},
+		{"MOV RAX, RSI; SUB RAX, RBX; MOV RSI, RAX; MOV RAX, 1", "SUB RSI, RBX; MOV RAX, 1"},
+		{"MOV RAX, [RAX + 0]; IMUL RAX, RAX; MOV RBX, RAX; MOV RAX, 1", "MOV RBX, [RAX + 0]; IMUL RBX, RBX; MOV RAX, 1"},
+		{"MOV RAX, RBX; ADD RAX, RSI; MOV RSI, RAX; MOV RAX, 1", "MOV RAX, RBX; ADD RAX, RSI; MOV RSI, RAX; MOV RAX, 1"},
+		{"MOV RAX, RBX; ADD RAX, 2; MOV RSI, RAX; CALL PRINTN", "MOV RAX, RBX; ADD RAX, 2; MOV RSI, RAX; CALL PRINTN"},
+
+		// Operands in memory or immediates in place of registers
+		{"MOV RCX, [RCX + 0]; ADD RAX, RCX; RET", "ADD RAX, [RCX + 0]; RET"},
+		{"MOV RAX, 5; PUSH RAX; MOV RAX, [rel _x]; PUSH RAX; PUSH RBP; CALL h",
+			"PUSH 5; MOV RAX, [rel _x]; PUSH RAX; PUSH RBP; CALL h"},
+		{"MOV RAX, 5; MOV [rel _y], RAX; MOV RAX, 1; RET", "MOV qword [rel _y], 5; MOV RAX, 1; RET"},
+		{"MOV RAX, [rel _x]; TEST RAX, 1; JE L0; MOV RAX, 1; CALL PRINTN; L0:; MOV RAX, 2; CALL PRINTN",
+			"TEST qword [rel _x], 1; JE L0; MOV RAX, 1; CALL PRINTN; L0:; MOV RAX, 2; CALL PRINTN"},
+		{"MOV RCX, [rel _x]; IMUL [rel _y], RCX; RET", "MOV RCX, [rel _x]; IMUL [rel _y], RCX; RET"},
+		{"MOV RAX, 4294967296; ADD RCX, RAX; RET", "MOV RAX, 4294967296; ADD RCX, RAX; RET"},
+	}
+	for _, tt := range tests {
+		var run []*instr
+		for _, s := range strings.Split(tt.in, "; ") {
+			if !strings.HasSuffix(s, ":") {
+				s = "\t" + s
+			}
+			run = append(run, parseInstr(s))
+		}
+		var got []string
+		for _, in := range optimize(amd64, run) {
+			got = append(got, strings.Join(strings.Fields(in.String()), " "))
+		}
+		if strings.Join(got, "; ") != tt.want {
+			t.Errorf("%s:\ngot  %s\nwant %s", tt.in, strings.Join(got, "; "), tt.want)
+		}
+	}
+}
+
+// TestPeepholeAssembly checks the -S output of a procedure p for each rule.
+func TestPeepholeAssembly(t *testing.T) {
+	tests := []struct {
+		rules     string
+		src, want string
+	}{
+		{"jump-next, compare", `VAR x, y;
+PROCEDURE p;
+	BEGIN IF y > 0 THEN ELSE; ! x END;
+BEGIN CALL p END.`, `p:
+	PUSH EBP
+	MOV EBP, ESP
+
+L0:
+	MOV EAX, [_x]
+	CALL PRINTN
+	CALL NEWLINE
+
+	MOV ESP, EBP
+	POP EBP
+	RET
+`},
+		{"branch-over", `VAR x;
+PROCEDURE p;
+	IF x > 0 THEN ELSE ! 0;
+BEGIN CALL p END.`, `p:
+	PUSH EBP
+	MOV EBP, ESP
+
+	CMP dword [_x], 0
+	JG L1
+L0:
+	MOV EAX, 0
+	CALL PRINTN
+	CALL NEWLINE
+L1:
+
+	MOV ESP, EBP
+	POP EBP
+	RET
+`},
+		{"jump-jump", `VAR x, y;
+PROCEDURE p;
+	IF x > 0 THEN IF y > 0 THEN ! 1 ELSE ELSE ! 2;
+BEGIN CALL p END.`, `p:
+	PUSH EBP
+	MOV EBP, ESP
+
+	CMP dword [_x], 0
+	JLE L1
+	CMP dword [_y], 0
+	JLE L2
+	MOV EAX, 1
+	CALL PRINTN
+	CALL NEWLINE
+L0:
+	JMP L2
+L1:
+	MOV EAX, 2
+	CALL PRINTN
+	CALL NEWLINE
+L2:
+
+	MOV ESP, EBP
+	POP EBP
+	RET
+`},
+		{"reload", `VAR x, y;
+PROCEDURE p;
+	BEGIN x := y + 1; ! x END;
+BEGIN CALL p END.`, `p:
+	PUSH EBP
+	MOV EBP, ESP
+
+	MOV EAX, [_y]
+	ADD EAX, 1
+	MOV [_x], EAX
+	CALL PRINTN
+	CALL NEWLINE
+
+	MOV ESP, EBP
+	POP EBP
+	RET
+`},
+		{"forward", `VAR x;
+PROCEDURE p;
+	BEGIN x := 5; ! x END;
+BEGIN CALL p END.`, `p:
+	PUSH EBP
+	MOV EBP, ESP
+
+	MOV dword [_x], 5
+	MOV EAX, 5
+	CALL PRINTN
+	CALL NEWLINE
+
+	MOV ESP, EBP
+	POP EBP
+	RET
+`},
+		{"dead-move", `VAR x;
+FUNCTION p;
+	BEGIN x := x + 1; p := x END;
+BEGIN ! p() END.`, `p:
+	PUSH EBP
+	MOV EBP, ESP
+	PUSH EBX
+
+	ADD dword [_x], 1
+	MOV EAX, [_x]
+
+	POP EBX
+	MOV ESP, EBP
+	POP EBP
+	RET
+`},
+		{"rename", `VAR x;
+PROCEDURE p;
+	VAR a, b, c;
+	BEGIN ? b; ? c; a := b + c + 1; x := a * b; ! a END;
+BEGIN CALL p END.`, `p:
+	PUSH EBP
+	MOV EBP, ESP
+	PUSH EBX
+	PUSH ESI
+	PUSH EDI
+
+	CALL SCANN
+	MOV ESI, EAX
+	CALL SCANN
+	MOV EDI, EAX
+	MOV EBX, ESI
+	ADD EBX, EDI
+	ADD EBX, 1
+	MOV EAX, EBX
+	IMUL EAX, ESI
+	MOV [_x], EAX
+	MOV EAX, EBX
+	CALL PRINTN
+	CALL NEWLINE
+
+	POP EDI
+	POP ESI
+	POP EBX
+	MOV ESP, EBP
+	POP EBP
+	RET
+`},
+		{"operand", `VAR x;
+FUNCTION p(n);
+	IF n > 1 THEN p := n * p(n - 1) ELSE p := 1;
+BEGIN ! p(x) END.`, `p:
+	PUSH EBP
+	MOV EBP, ESP
+	SUB ESP, 4
+
+	MOV dword [EBP + -4], 0
+	CMP dword [EBP + 12], 1
+	JLE L0
+	PUSH dword [EBP + 12]
+	MOV EAX, [EBP + 12]
+	SUB EAX, 1
+	PUSH EAX
+	PUSH dword [EBP + 8]
+	CALL p
+	ADD ESP, 8
+	POP ECX
+	IMUL ECX, EAX
+	MOV [EBP + -4], ECX
+	JMP L1
+L0:
+	MOV dword [EBP + -4], 1
+L1:
+	MOV EAX, [EBP + -4]
+
+	MOV ESP, EBP
+	POP EBP
+	RET
+`},
+	}
+	for _, tt := range tests {
+		c := NewCompiler(Linux386)
+		c.Optimize = true
+		var out bytes.Buffer
+		if err := c.ParseAndTranslate("", strings.NewReader(tt.src), &out, "p"); err != nil {
+			t.Fatal(err)
+		}
+		if got := procedure(out.String(), "p"); got != tt.want {
+			t.Errorf("%s: got:\n%s\nwant:\n%s", tt.rules, got, tt.want)
+		}
+	}
+}
+
+func TestPeephole(t *testing.T) {
+	const src = `
+VAR x, y;
+PROCEDURE p;
+	VAR z;
+	BEGIN z := y; x := z; z := z + 1; y := x * z END;
+BEGIN
+	? x;
+	y := x - 2;
+	CALL p;
+	WHILE x / 3 < y DO x := x + y;
+	IF ODD x THEN ! x
+END.`
+	const want = `p:
+	PUSH EBP
+	MOV EBP, ESP
+	PUSH EBX
+
+	MOV EBX, [_y]
+	MOV [_x], EBX
+	ADD EBX, 1
+	MOV EAX, [_x]
+	IMUL EAX, EBX
+	MOV [_y], EAX
+
+	POP EBX
+	MOV ESP, EBP
+	POP EBP
+	RET
+
+MAIN:
+	PUSH EBP
+	MOV EBP, ESP
+
+	CALL SCANN
+	MOV [_x], EAX
+	SUB EAX, 2
+	MOV [_y], EAX
+	PUSH EBP
+	CALL p
+	ADD ESP, 4
+L0:
+	MOV EAX, [_x]
+	MOV ECX, 3
+	CDQ
+	IDIV ECX
+	CMP EAX, [_y]
+	JGE L1
+	MOV EAX, [_y]
+	ADD [_x], EAX
+	JMP L0
+L1:
+	MOV EAX, [_x]
+	TEST EAX, 1
+	JE L2
+	MOV EAX, [_x]
+	CALL PRINTN
+	CALL NEWLINE
+L2:
+
+	MOV ESP, EBP
+	POP EBP
+	RET
+`
+	c := NewCompiler(Linux386)
+	c.Optimize = true
+	var out bytes.Buffer
+	if err := c.ParseAndTranslate("", strings.NewReader(src), &out, "p"); err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+	if i, j := strings.Index(got, "p:\n"), strings.Index(got, "section .data"); i < 0 || j < 0 || strings.TrimSpace(got[i:j]) != strings.TrimSpace(want) {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
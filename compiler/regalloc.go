@@ -0,0 +1,303 @@
+package compiler
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"pl0/compiler/ir"
+)
+
+// The code generator evaluates each expression tree when generating the
+// instruction using its value, in the scratch registers ax, cx and dx. The
+// operands of an operation are evaluated in the order given by their
+// Sethi–Ullman numbers, the number of registers they need: the operand
+// needing more first, so that the other is evaluated with one register
+// less in use. Constants and variables are used in place, as immediate and
+// memory operands, rather than loaded in a register. When no register is
+// free, the oldest value is spilled to the machine stack; values are used
+// in the reverse order of their computation, so they are popped back in
+// order. Trees calling functions are evaluated in order, as the calls may
+// assign the variables read by the other operand, and spill every value
+// held, the function result coming back in ax.
+//
+// Leaf procedures, calling no other procedure, keep their most used local
+// variables in the callee-saved registers bx, si and di, which the runtime
+// preserves too. Their nested procedures, which may access the variables
+// in the frame, are never called while they run.
+
+// A pending value is a register of the function, computed and not yet used.
+type pending struct {
+	r   ir.Reg
+	reg string // Machine register holding the value, or "" if spilled
+}
+
+// scratch returns the registers holding the values of expressions.
+func (m machine) scratch() []string {
+	return []string{m.ax, m.cx, m.dx}
+}
+
+// calleeSaved returns the registers holding variables of leaf procedures.
+func (m machine) calleeSaved() []string {
+	return []string{m.bx, m.si, m.di}
+}
+
+// numberTrees records the instruction defining each register of f, its
+// Sethi–Ullman number, and whether its tree calls a function.
+func (c *Compiler) numberTrees(f *ir.Func) {
+	c.defs = make([]*ir.Instr, f.NumRegs+1)
+	c.need = make([]int, f.NumRegs+1)
+	c.calls = make([]bool, f.NumRegs+1)
+	for _, b := range f.Blocks {
+		for _, in := range b.Instrs {
+			if in.Dst == ir.None {
+				continue
+			}
+			c.defs[in.Dst] = in
+			c.calls[in.Dst] = in.Op == ir.Call
+			for _, a := range in.Args {
+				c.calls[in.Dst] = c.calls[in.Dst] || c.calls[a]
+			}
+			n := 1
+			switch op := in.Op; {
+			case op == ir.FP:
+				n = 0
+			case op == ir.Neg || op == ir.Odd || op == ir.Load || op == ir.Link || op == ir.Addr || op == ir.LoadInd:
+				n = maxInt(1, c.need[in.Args[0]])
+			case op == ir.Elem:
+				// A constant index is added to the address
+				nx, ny := c.need[in.Args[0]], c.need[in.Args[1]]
+				if c.defs[in.Args[1]].Op == ir.Const {
+					ny = 0
+				}
+				if n = maxInt(1, nx, ny); nx == ny {
+					n++
+				}
+			case op.IsBinary():
+				x, y, _ := c.operands(in)
+				nx, ny := c.need[x], c.need[y]
+				if c.addressable(y) {
+					ny = 0
+				}
+				if n = maxInt(nx, ny); nx == ny {
+					n++
+				}
+				if op == ir.Div {
+					n = maxInt(n, 2) // The dividend is extended into dx
+				}
+				c.need[in.Dst] = n
+				continue
+			}
+			c.need[in.Dst] = n
+		}
+	}
+}
+
+// registerVars selects the variables of f kept in registers, if a leaf
+// procedure: those used most, counting the uses in loops ten times for
+// each enclosing loop.
+func (c *Compiler) registerVars(f *ir.Func) {
+	c.vars = make(map[*ir.Var]string)
+	c.saved = nil
+	if f.Level == 0 || len(f.Callees()) > 0 {
+		return
+	}
+	uses := make(map[*ir.Var]int)
+	depth := f.LoopDepth()
+	for _, b := range f.Blocks {
+		weight := 1
+		for i := 0; i < depth[b.Index] && i < 6; i++ {
+			weight *= 10
+		}
+		for _, in := range b.Instrs {
+			if (in.Op == ir.Load || in.Op == ir.Store) && in.Var.Level == f.Level {
+				uses[in.Var] += weight
+			}
+		}
+	}
+	var vars []*ir.Var
+	for _, v := range f.Vars {
+		if uses[v] > 0 {
+			vars = append(vars, v)
+		}
+	}
+	sort.SliceStable(vars, func(i, j int) bool { return uses[vars[i]] > uses[vars[j]] })
+	for i, reg := range c.m.calleeSaved() {
+		if i == len(vars) {
+			break
+		}
+		c.vars[vars[i]] = reg
+		c.saved = append(c.saved, reg)
+	}
+}
+
+// operands returns the operands of a binary instruction in the order they
+// are combined: the first in a register, the second possibly in place.
+// Commutative operations and relations take an addressable first operand
+// second, reporting the swap, unless the other calls a function.
+func (c *Compiler) operands(in *ir.Instr) (x, y ir.Reg, swapped bool) {
+	a, b := in.Args[0], in.Args[1]
+	if in.Op != ir.Sub && in.Op != ir.Div && c.addressable(a) && !c.addressable(b) && !c.calls[b] {
+		return b, a, true
+	}
+	return a, b, false
+}
+
+// addressable reports whether the value of r may be used in place: a 32-bit
+// constant, or a variable of the current frame or a global.
+func (c *Compiler) addressable(r ir.Reg) bool {
+	in := c.defs[r]
+	switch in.Op {
+	case ir.Const:
+		return int64(int32(in.Value)) == in.Value
+	case ir.LoadGlobal:
+		return true
+	case ir.Load:
+		return c.defs[in.Args[0]].Op == ir.FP
+	}
+	return false
+}
+
+// inPlace returns the operand addressing the value of r, which is
+// addressable.
+func (c *Compiler) inPlace(r ir.Reg) string {
+	in := c.defs[r]
+	switch in.Op {
+	case ir.Const:
+		return strconv.FormatInt(in.Value, 10)
+	case ir.LoadGlobal:
+		return c.m.static(static(in.Var.Name))
+	}
+	if reg, ok := c.vars[in.Var]; ok {
+		return reg
+	}
+	return c.m.frame(c.m.bp, c.offset(in.Var))
+}
+
+// isMemory reports whether operand x addresses memory.
+func isMemory(x string) bool {
+	return x[0] == '['
+}
+
+// isImmediate reports whether operand x is a number.
+func isImmediate(x string) bool {
+	_, err := strconv.ParseInt(x, 10, 64)
+	return err == nil
+}
+
+// sized prefixes a memory operand with its size, for instructions whose
+// other operands do not tell it.
+func (c *Compiler) sized(x string) string {
+	return c.m.sized(x)
+}
+
+// alloc returns a free scratch register for r, other than those to avoid,
+// spilling the oldest value held in a register if none is free.
+func (c *Compiler) alloc(r ir.Reg, avoid ...string) string {
+	for {
+		if reg := c.free(avoid...); reg != "" {
+			c.hold(r, reg)
+			return reg
+		}
+		c.spill()
+	}
+}
+
+// free returns a scratch register holding no value, other than those to
+// avoid, or "" if none.
+func (c *Compiler) free(avoid ...string) string {
+	for _, reg := range c.m.scratch() {
+		if !c.busy(reg) && !contains(avoid, reg) {
+			return reg
+		}
+	}
+	return ""
+}
+
+// busy reports whether a value is held in reg.
+func (c *Compiler) busy(reg string) bool {
+	for _, v := range c.live {
+		if v.reg == reg {
+			return true
+		}
+	}
+	return false
+}
+
+// hold records that reg holds the value of r.
+func (c *Compiler) hold(r ir.Reg, reg string) {
+	c.live = append(c.live, pending{r, reg})
+}
+
+// spill pushes the oldest value held in a register on the machine stack.
+func (c *Compiler) spill() {
+	for i, v := range c.live {
+		if v.reg != "" {
+			c.emitln("PUSH " + v.reg)
+			c.live[i].reg = ""
+			return
+		}
+	}
+	panic("no register to spill")
+}
+
+// spillAll pushes the values held in registers on the machine stack.
+func (c *Compiler) spillAll() {
+	for c.held() {
+		c.spill()
+	}
+}
+
+// held reports whether a value is held in a register.
+func (c *Compiler) held() bool {
+	for _, v := range c.live {
+		if v.reg != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// take uses up the value of r, returning the scratch register holding it,
+// popped from the stack into a register other than those to avoid if
+// spilled.
+func (c *Compiler) take(r ir.Reg, avoid ...string) string {
+	for i := len(c.live) - 1; i >= 0; i-- {
+		v := c.live[i]
+		if v.r != r {
+			if v.reg == "" {
+				break // Spilled above r
+			}
+			continue
+		}
+		c.live = append(c.live[:i], c.live[i+1:]...)
+		if v.reg != "" {
+			return v.reg
+		}
+		// Spilled values are older than those held, leaving a register free
+		reg := c.free(avoid...)
+		c.emitln("POP " + reg)
+		return reg
+	}
+	panic(fmt.Sprintf("operand %v not computed or not on top of the stack", r))
+}
+
+// contains reports whether list contains s.
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// maxInt returns the largest of its arguments.
+func maxInt(x int, y ...int) int {
+	for _, n := range y {
+		if n > x {
+			x = n
+		}
+	}
+	return x
+}
@@ -0,0 +1,342 @@
+package compiler
+
+import (
+	"fmt"
+	"strconv"
+
+	"pl0/compiler/ast"
+	"pl0/compiler/token"
+)
+
+// MaxLen is the maximum length of an array.
+const MaxLen = 1 << 16
+
+// Resolve resolves the identifiers of a program, parsed without errors,
+// linking each to the object it denotes through its Obj field: the object
+// declared by a declaring identifier, or found in the enclosing scopes.
+// All the resolution errors are returned, in an ErrorList.
+func Resolve(prog *ast.Program) (err error) {
+	var c Compiler
+	c.file = prog.File
+	defer c.catch(&err)
+	c.resolve(prog)
+	return nil
+}
+
+// resolve resolves the identifiers of a program in a fresh symbol table.
+func (c *Compiler) resolve(prog *ast.Program) {
+	c.initScopes()
+	c.level = 0
+	c.procs = nil
+	c.loops = nil
+	c.resolveBlock(prog.Main)
+}
+
+// resolveBlock declares the objects of a block, and resolves the
+// identifiers of its procedures and body.
+func (c *Compiler) resolveBlock(b *ast.Block) {
+	for _, k := range b.Consts {
+		obj := c.newObj(k.Name, ast.Con)
+		obj.Value = c.number(k.Value)
+	}
+	for i, v := range b.Vars {
+		obj := c.newObj(v.Name, ast.Var)
+		obj.Offset = i
+		if v.Len == nil {
+			continue
+		}
+		n, err := strconv.ParseInt(v.Len.Value, 10, 64)
+		if err != nil || n < 1 || n > MaxLen {
+			c.error(v.Len.Pos(), ConstError, "invalid array length "+v.Len.Value)
+			n = 1
+		}
+		obj.Len = int(n)
+	}
+	for _, d := range b.Procs {
+		kind := ast.Proc
+		if d.Tok == token.FUNCTION {
+			kind = ast.Func
+		}
+		obj := c.newObj(d.Name, kind)
+		obj.Proc = d
+		c.level++
+		c.procs = append(c.procs, obj.Object)
+		c.openScope()
+		for i, p := range d.Params {
+			obj := c.newObj(p.Name, ast.Var)
+			obj.Offset = i
+			obj.Param = true
+			obj.Ref = p.Var.IsValid()
+		}
+		c.resolveBlock(d.Block)
+		obj.dsc = c.topScope.next
+		c.closeScope()
+		c.procs = c.procs[:len(c.procs)-1]
+		c.level--
+	}
+	c.resolveStmt(b.Body)
+}
+
+// resolveStmt resolves the identifiers of the various statement nodes,
+// checking their kind.
+func (c *Compiler) resolveStmt(s ast.Stmt) {
+	switch s := s.(type) {
+	case *ast.AssignStmt:
+		c.resolveVariable(s.Lhs, "assign to")
+		c.resolveExpr(s.Rhs)
+
+	case *ast.CallStmt:
+		obj := c.find(s.Proc)
+		if obj != nil && obj.Kind != ast.Proc {
+			c.mismatch(s.Proc, "cannot call non-procedure "+obj.Name+" (kind "+obj.Kind.String()+")")
+			obj = nil
+		}
+		for _, x := range s.Args {
+			c.resolveExpr(x)
+		}
+		if obj != nil {
+			c.checkArgs(s.Proc, s.Args, obj.Proc)
+		}
+
+	case *ast.ReturnStmt:
+		if n := len(c.procs); n == 0 || c.procs[n-1].Kind != ast.Func {
+			c.error(s.Return, KindError, "RETURN outside function")
+		}
+		c.resolveExpr(s.X)
+
+	case *ast.BeginStmt:
+		for _, stmt := range s.List {
+			c.resolveStmt(stmt)
+		}
+
+	case *ast.IfStmt:
+		c.resolveCond(s.Cond)
+		c.resolveStmt(s.Body)
+		c.resolveStmt(s.Else)
+
+	case *ast.WhileStmt:
+		c.resolveCond(s.Cond)
+		c.resolveStmt(s.Body)
+
+	case *ast.RepeatStmt:
+		for _, stmt := range s.List {
+			c.resolveStmt(stmt)
+		}
+		c.resolveCond(s.Cond)
+
+	case *ast.ForStmt:
+		obj := c.resolveLoopVar(s.Var)
+		c.resolveExpr(s.From)
+		c.resolveExpr(s.Limit)
+		c.loops = append(c.loops, obj)
+		c.resolveStmt(s.Body)
+		c.loops = c.loops[:len(c.loops)-1]
+
+	case *ast.SendStmt:
+		c.resolveExpr(s.X)
+
+	case *ast.ReceiveStmt:
+		c.resolveVariable(s.X, "receive into")
+	}
+}
+
+// resolveVariable resolves the variable or array element x, assigned or
+// received into as told by what. The name of an enclosing function denotes
+// its result, but only in an assignment.
+func (c *Compiler) resolveVariable(x ast.Expr, what string) {
+	id, ok := x.(*ast.Ident)
+	if !ok {
+		c.resolveExpr(x)
+		return
+	}
+	obj := c.find(id)
+	switch {
+	case obj == nil:
+	case c.looping(obj):
+		c.mismatch(id, "cannot "+what+" loop variable "+obj.Name)
+	case obj.Kind == ast.Var && obj.Len > 0:
+		c.mismatch(id, "cannot "+what+" array "+obj.Name)
+	case obj.Kind != ast.Var && (what != "assign to" || !c.encloses(obj)):
+		c.mismatch(id, "cannot "+what+" "+obj.Name+" (kind "+obj.Kind.String()+")")
+	}
+}
+
+// resolveLoopVar resolves the variable of a FOR loop, which must be a
+// variable of the current block or a global one, other than an array, a
+// parameter, or the variable of an enclosing loop. It returns its object,
+// or nil if invalid.
+func (c *Compiler) resolveLoopVar(id *ast.Ident) *ast.Object {
+	obj := c.find(id)
+	switch {
+	case obj == nil:
+		return nil
+	case obj.Kind != ast.Var:
+		c.mismatch(id, "cannot use "+obj.Name+" (kind "+obj.Kind.String()+") as loop variable")
+	case obj.Len > 0:
+		c.mismatch(id, "cannot use array "+obj.Name+" as loop variable")
+	case obj.Param || obj.Level != 0 && obj.Level != c.level:
+		c.mismatch(id, "loop variable "+obj.Name+" must be a local or global variable")
+	case c.looping(obj):
+		c.mismatch(id, "loop variable "+obj.Name+" already in use")
+	default:
+		return obj
+	}
+	return nil
+}
+
+// looping reports whether obj is the variable of a FOR loop enclosing the
+// current statement.
+func (c *Compiler) looping(obj *ast.Object) bool {
+	for _, v := range c.loops {
+		if v != nil && v == obj {
+			return true
+		}
+	}
+	return false
+}
+
+// encloses reports whether obj is a function enclosing the current block.
+func (c *Compiler) encloses(obj *ast.Object) bool {
+	for _, p := range c.procs {
+		if p == obj {
+			return obj.Kind == ast.Func
+		}
+	}
+	return false
+}
+
+// checkArgs checks the arguments of a call to the procedure or function d,
+// named by id: one for each parameter, and a variable or array element for
+// each VAR parameter.
+func (c *Compiler) checkArgs(id *ast.Ident, args []ast.Expr, d *ast.ProcDecl) {
+	if len(args) != len(d.Params) {
+		c.error(id.Pos(), KindError, fmt.Sprintf("wrong number of arguments in call to %s: have %d, want %d",
+			id.Name, len(args), len(d.Params)))
+		return
+	}
+	for i, p := range d.Params {
+		if !p.Var.IsValid() {
+			continue
+		}
+		switch x := args[i].(type) {
+		case *ast.Ident:
+			if x.Obj != nil && x.Obj.Kind == ast.Con {
+				c.error(x.Pos(), KindError, "cannot pass non-variable to VAR parameter "+p.Name.Name+" of "+id.Name)
+			}
+			if c.looping(x.Obj) {
+				c.error(x.Pos(), KindError, "cannot pass loop variable "+x.Name+" to VAR parameter "+p.Name.Name+" of "+id.Name)
+			}
+		case *ast.IndexExpr:
+			// Passed by the address of the element, its index checked
+		default:
+			c.error(x.Pos(), KindError, "cannot pass non-variable to VAR parameter "+p.Name.Name+" of "+id.Name)
+		}
+	}
+}
+
+// resolveCond resolves the identifiers of the various condition nodes.
+func (c *Compiler) resolveCond(cond ast.Cond) {
+	switch x := cond.(type) {
+	case *ast.OddCond:
+		c.resolveExpr(x.X)
+	case *ast.RelCond:
+		c.resolveExpr(x.X)
+		c.resolveExpr(x.Y)
+	}
+}
+
+// resolveExpr resolves the identifiers of the various expression nodes,
+// which must not denote procedures, nor functions but in calls, nor arrays
+// but indexed. Numbers out of range are reported too, divisions by a
+// constant expression of value 0, and array elements at a constant index
+// out of range.
+func (c *Compiler) resolveExpr(x ast.Expr) {
+	switch x := x.(type) {
+	case *ast.Number:
+		c.number(x)
+	case *ast.UnaryExpr:
+		c.resolveExpr(x.X)
+	case *ast.BinaryExpr:
+		c.resolveExpr(x.X)
+		c.resolveExpr(x.Y)
+		if v, ok := c.constValue(x.Y); ok && v == 0 && x.Op == token.DIV {
+			c.error(x.OpPos, ConstError, "division by zero")
+		}
+	case *ast.Ident:
+		obj := c.find(x)
+		switch {
+		case obj == nil:
+		case obj.Kind == ast.Proc || obj.Kind == ast.Func:
+			c.mismatch(x, "cannot use "+obj.Name+" (kind "+obj.Kind.String()+") in expression")
+		case obj.Kind == ast.Var && obj.Len > 0:
+			c.mismatch(x, "cannot use array "+obj.Name+" without index")
+		}
+	case *ast.IndexExpr:
+		obj := c.find(x.X)
+		if obj != nil && (obj.Kind != ast.Var || obj.Len == 0) {
+			c.mismatch(x.X, "cannot index non-array "+obj.Name+" (kind "+obj.Kind.String()+")")
+			obj = nil
+		}
+		c.resolveExpr(x.Index)
+		if i, ok := c.constValue(x.Index); ok && obj != nil && (i < 0 || i >= int64(obj.Len)) {
+			c.error(x.Index.Pos(), ConstError, fmt.Sprintf("index %d out of range [0:%d]", i, obj.Len))
+		}
+	case *ast.CallExpr:
+		obj := c.find(x.Func)
+		if obj != nil && obj.Kind != ast.Func {
+			c.mismatch(x.Func, "cannot call non-function "+obj.Name+" (kind "+obj.Kind.String()+")")
+			obj = nil
+		}
+		for _, a := range x.Args {
+			c.resolveExpr(a)
+		}
+		if obj != nil {
+			c.checkArgs(x.Func, x.Args, obj.Proc)
+		}
+	}
+}
+
+// constValue returns the value of x if a constant expression: numbers and
+// CONSTs, resolved, combined by operators, wrapping around as the numbers
+// of the target. A division overflowing or by 0 is not constant, as it
+// traps at run time.
+func (c *Compiler) constValue(x ast.Expr) (int64, bool) {
+	size := c.size()
+	wrap := func(v int64) int64 {
+		return v << (64 - size) >> (64 - size)
+	}
+	switch x := x.(type) {
+	case *ast.Number:
+		v, err := strconv.ParseInt(x.Value, 10, int(size))
+		return v, err == nil
+	case *ast.Ident:
+		if x.Obj != nil && x.Obj.Kind == ast.Con {
+			return x.Obj.Value, true
+		}
+	case *ast.UnaryExpr:
+		v, ok := c.constValue(x.X)
+		if x.Op == token.MINUS {
+			v = wrap(-v)
+		}
+		return v, ok
+	case *ast.BinaryExpr:
+		a, ok := c.constValue(x.X)
+		b, ok2 := c.constValue(x.Y)
+		if !ok || !ok2 {
+			break
+		}
+		switch x.Op {
+		case token.PLUS:
+			return wrap(a + b), true
+		case token.MINUS:
+			return wrap(a - b), true
+		case token.TIMES:
+			return wrap(a * b), true
+		case token.DIV:
+			if b != 0 && (b != -1 || a != -1<<(size-1)) {
+				return a / b, true
+			}
+		}
+	}
+	return 0, false
+}
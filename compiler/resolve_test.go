@@ -0,0 +1,199 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"pl0/compiler/ast"
+)
+
+func TestResolve(t *testing.T) {
+	const src = `CONST k = 7;
+VAR x, y;
+PROCEDURE p;
+	VAR y;
+	PROCEDURE q; x := y + k;
+	CALL q;
+BEGIN ? y; CALL p END.`
+	prog, err := Parse("test.pl0", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Resolve(prog); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each identifier, declaring or not, with its object
+	var got []string
+	ident := func(id *ast.Ident) {
+		obj := id.Obj
+		pos := prog.File.Position(id.Pos())
+		decl := prog.File.Position(obj.Pos)
+		got = append(got, fmt.Sprintf("%d:%d %s %s level %d offset %d value %d at %d:%d",
+			pos.Line, pos.Column, id.Name, obj.Kind, obj.Level, obj.Offset, obj.Value, decl.Line, decl.Column))
+	}
+	p := prog.Main.Procs[0]
+	q := p.Block.Procs[0]
+	ident(prog.Main.Consts[0].Name)
+	ident(prog.Main.Vars[1].Name)
+	ident(p.Name)
+	ident(p.Block.Vars[0].Name)
+	ident(q.Name)
+	assign := q.Block.Body.(*ast.AssignStmt)
+	ident(assign.Lhs.(*ast.Ident))
+	ident(assign.Rhs.(*ast.BinaryExpr).X.(*ast.Ident))
+	ident(assign.Rhs.(*ast.BinaryExpr).Y.(*ast.Ident))
+	ident(p.Block.Body.(*ast.CallStmt).Proc)
+	main := prog.Main.Body.(*ast.BeginStmt)
+	ident(main.List[0].(*ast.ReceiveStmt).X.(*ast.Ident))
+	ident(main.List[1].(*ast.CallStmt).Proc)
+	want := []string{
+		"1:7 k CONST level 0 offset 0 value 7 at 1:7",
+		"2:8 y VAR level 0 offset 1 value 0 at 2:8",
+		"3:11 p PROCEDURE level 0 offset 0 value 0 at 3:11",
+		"4:6 y VAR level 1 offset 0 value 0 at 4:6",
+		"5:12 q PROCEDURE level 1 offset 0 value 0 at 5:12",
+		"5:15 x VAR level 0 offset 0 value 0 at 2:5",
+		"5:20 y VAR level 1 offset 0 value 0 at 4:6",
+		"5:24 k CONST level 0 offset 0 value 7 at 1:7",
+		"6:7 q PROCEDURE level 1 offset 0 value 0 at 5:12",
+		"7:9 y VAR level 0 offset 1 value 0 at 2:8",
+		"7:17 p PROCEDURE level 0 offset 0 value 0 at 3:11",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if p.Name.Obj.Proc != p {
+		t.Errorf("got declaration %v of p, want %v", p.Name.Obj.Proc, p)
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	const src = `CONST c = 1, big = 99999999999999999999;
+VAR c, x;
+PROCEDURE p;
+	VAR p;
+	BEGIN c := 2; ? p; CALL x; x := q + p END;
+BEGIN CALL p; ! p; y := 1 END.`
+	want := []string{
+		"test.pl0:1:20: number 99999999999999999999 out of range",
+		"test.pl0:2:5: duplicate identifier c",
+		"test.pl0:5:8: cannot assign to c (kind CONST)",
+		"test.pl0:5:26: cannot call non-procedure x (kind VAR)",
+		"test.pl0:5:34: undefined identifier q",
+		"test.pl0:6:17: cannot use p (kind PROCEDURE) in expression",
+		"test.pl0:6:20: undefined identifier y",
+	}
+	prog, err := Parse("test.pl0", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Resolve(prog)
+	list, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("got error %v, want an ErrorList", err)
+	}
+	var got []string
+	for _, e := range list {
+		got = append(got, e.Error())
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got errors:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestResolveArrayErrors(t *testing.T) {
+	const src = `VAR a[3], b[0], x;
+PROCEDURE p(VAR v); ;
+BEGIN a := 1; ? a; x := a; x := x[1]; CALL p(a); p[1] := 2 END.`
+	want := []string{
+		"test.pl0:1:13: invalid array length 0",
+		"test.pl0:3:7: cannot assign to array a",
+		"test.pl0:3:17: cannot receive into array a",
+		"test.pl0:3:25: cannot use array a without index",
+		"test.pl0:3:33: cannot index non-array x (kind VAR)",
+		"test.pl0:3:46: cannot use array a without index",
+		"test.pl0:3:50: cannot index non-array p (kind PROCEDURE)",
+	}
+	prog, err := Parse("test.pl0", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	if list, ok := Resolve(prog).(ErrorList); ok {
+		for _, e := range list {
+			got = append(got, e.Error())
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got errors:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestResolveLoopErrors(t *testing.T) {
+	const src = `CONST k = 3; VAR a[3], i, j;
+PROCEDURE p(VAR v); VAR n;
+	PROCEDURE q; FOR n := 1 TO 2 DO ! n;
+	BEGIN FOR v := 1 TO 2 DO ! v; FOR i := 1 TO 2 DO ! i END;
+BEGIN
+	FOR k := 1 TO 2 DO ! k; FOR a := 1 TO 2 DO ! 1;
+	FOR i := 1 TO 2 DO FOR i := 2 DOWNTO 1 DO ! i;
+	FOR i := 1 TO 2 DO BEGIN i := 1; ? i; CALL p(i); FOR j := i TO 3 DO j := 1 END;
+	i := 1
+END.`
+	want := []string{
+		"test.pl0:3:19: loop variable n must be a local or global variable",
+		"test.pl0:4:12: loop variable v must be a local or global variable",
+		"test.pl0:6:6: cannot use k (kind CONST) as loop variable",
+		"test.pl0:6:30: cannot use array a as loop variable",
+		"test.pl0:7:25: loop variable i already in use",
+		"test.pl0:8:27: cannot assign to loop variable i",
+		"test.pl0:8:37: cannot receive into loop variable i",
+		"test.pl0:8:47: cannot pass loop variable i to VAR parameter v of p",
+		"test.pl0:8:70: cannot assign to loop variable j",
+	}
+	prog, err := Parse("test.pl0", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	if list, ok := Resolve(prog).(ErrorList); ok {
+		for _, e := range list {
+			got = append(got, e.Error())
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got errors:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestResolveConstErrors(t *testing.T) {
+	// Only the constant expressions are checked, whatever the code run
+	const src = `CONST k = 1;
+VAR x, a[2];
+PROCEDURE never; ! x / 0;
+BEGIN x := x / (k - 1); ! 1 / (-k + 1); ! x / (x * 0); ! x / (k - 1 + x); ! 1 / k;
+	a[k + 1] := a[k]; ? a[-k]; ! a[x * 0]; x[5] := 1 END.`
+	want := []string{
+		"test.pl0:3:22: division by zero",
+		"test.pl0:4:14: division by zero",
+		"test.pl0:4:29: division by zero",
+		"test.pl0:5:4: index 2 out of range [0:2]",
+		"test.pl0:5:24: index -1 out of range [0:2]",
+		"test.pl0:5:41: cannot index non-array x (kind VAR)",
+	}
+	prog, err := Parse("test.pl0", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	if list, ok := Resolve(prog).(ErrorList); ok {
+		for _, e := range list {
+			got = append(got, e.Error())
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got errors:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -9,29 +9,43 @@ import (
 
 const eot = 0x4 // End-of-Transmission (Ctrl+D / ^D)
 
-var (
-	in     *bufio.Reader // Input stream
-	look   byte          // Lookahead character
-	tok    token.Token   // Encoded token
-	text   string        // Unencoded token
-	lineno int           // Current lineno number
-)
+// A Scanner holds the scanner's internal state while processing a given
+// source. It must be initialized with Init before use.
+type Scanner struct {
+	file     *token.File   // Source file, recording line offsets
+	in       *bufio.Reader // Input stream
+	look     byte          // Lookahead character
+	offset   int           // Offset of the lookahead character
+	rdOffset int           // Offset of the next character to read
+	pos      token.Pos     // Position of the token
+	tok      token.Token   // Encoded token
+	text     string        // Unencoded token
+
+	errors    ErrorList // Errors found so far
+	MaxErrors int       // Error limit; 0 means DefaultMaxErrors, < 0 no limit
+}
 
-func initScanner(r io.Reader) {
-	in = bufio.NewReader(r)
-	getChar()
-	lineno = 1
+// Init prepares the scanner s to tokenize the source read from r, recording
+// its lines in file.
+func (s *Scanner) Init(file *token.File, r io.Reader) {
+	s.file = file
+	s.in = bufio.NewReader(r)
+	s.look, s.offset, s.rdOffset = 0, 0, 0
+	s.errors = nil
+	s.getChar()
 }
 
 // getChar reads new character from the input stream.
-func getChar() {
-	if b, err := in.ReadByte(); err == io.EOF {
-		look = eot
-	} else {
-		look = b
+func (s *Scanner) getChar() {
+	if s.look == '\n' {
+		s.file.AddLine(s.rdOffset)
 	}
-	if look == '\n' {
-		lineno++
+	s.offset = s.rdOffset
+	if b, err := s.in.ReadByte(); err == io.EOF {
+		s.look = eot
+	} else {
+		s.look = b
+		s.rdOffset++
 	}
 }
 
@@ -60,50 +74,44 @@ func isWhite(c byte) bool {
 }
 
 // skipWhite skips over leading white space or comment field.
-func skipWhite() {
-	for isWhite(look) {
-		for look == '{' {
-			skipComment()
+func (s *Scanner) skipWhite() {
+	for isWhite(s.look) {
+		for s.look == '{' {
+			s.skipComment()
 		}
-		getChar()
+		s.getChar()
 	}
 }
 
 // skipComment skips a comment field.
-func skipComment() {
-	for look != '}' && look != eot {
-		getChar()
-		if look == '{' {
-			skipComment()
+func (s *Scanner) skipComment() {
+	for s.look != '}' && s.look != eot {
+		s.getChar()
+		if s.look == '{' {
+			s.skipComment()
 		}
 	}
-	getChar()
+	s.getChar()
 }
 
 // scanIdent scans an identifier.
-func scanIdent() {
-	text = ""
-	if !isAlpha(look) {
-		expected("identifier", string(look))
-	}
-	for isAlNum(look) {
-		text += string(look)
-		getChar()
+func (s *Scanner) scanIdent() {
+	s.text = ""
+	for isAlNum(s.look) {
+		s.text += string(s.look)
+		s.getChar()
 	}
-	tok = token.Lookup(text)
+	s.tok = token.Lookup(s.text)
 }
 
 // scanNumber scans a Number.
-func scanNumber() {
-	text = ""
-	if !isDigit(look) {
-		expected("number", string(look))
-	}
-	for isDigit(look) {
-		text += string(look)
-		getChar()
+func (s *Scanner) scanNumber() {
+	s.text = ""
+	for isDigit(s.look) {
+		s.text += string(s.look)
+		s.getChar()
 	}
-	tok = token.NUMBER
+	s.tok = token.NUMBER
 }
 
 var singles = [256]token.Token{
@@ -114,6 +122,8 @@ var singles = [256]token.Token{
 	'?': token.RECV,
 	'(': token.LPAREN,
 	')': token.RPARAN,
+	'[': token.LBRACK,
+	']': token.RBRACK,
 
 	'=': token.EQL,
 	'#': token.NEQ,
@@ -125,41 +135,45 @@ var singles = [256]token.Token{
 }
 
 // next scans the input stream for the next token.
-func next() {
-	skipWhite()
-	if look == eot {
-		tok, text = token.EOF, token.EOF.String()
+func (s *Scanner) next() {
+	s.skipWhite()
+	s.pos = s.file.Pos(s.offset)
+	if s.look == eot {
+		s.tok, s.text = token.EOF, token.EOF.String()
 		return
 	}
-	if isAlpha(look) {
-		scanIdent()
+	if isAlpha(s.look) {
+		s.scanIdent()
 		return
 	}
-	if isDigit(look) {
-		scanNumber()
+	if isDigit(s.look) {
+		s.scanNumber()
 		return
 	}
-	if t := singles[look]; t != token.NULL {
-		tok, text = t, t.String()
-		getChar()
+	if t := singles[s.look]; t != token.NULL {
+		s.tok, s.text = t, t.String()
+		s.getChar()
 		return
 	}
-	switch look {
+	switch s.look {
 	case ':':
-		tok, text = follow('=', token.BECOMES, token.NULL)
+		s.tok, s.text = s.follow('=', token.BECOMES, token.NULL)
 	case '>':
-		tok, text = follow('=', token.GEQ, token.GRT)
+		s.tok, s.text = s.follow('=', token.GEQ, token.GRT)
 	case '<':
-		tok, text = follow('=', token.LEQ, token.LSS)
+		s.tok, s.text = s.follow('=', token.LEQ, token.LSS)
 	default:
-		report("illegal character '" + string(look) + "'")
+		// Skip the character, and scan the following token
+		s.error(s.pos, SyntaxError, "illegal character '"+string(s.look)+"'")
+		s.getChar()
+		s.next()
 	}
 }
 
-func follow(expect byte, fyes, fno token.Token) (token.Token, string) {
-	getChar()
-	if look == expect {
-		getChar()
+func (s *Scanner) follow(expect byte, fyes, fno token.Token) (token.Token, string) {
+	s.getChar()
+	if s.look == expect {
+		s.getChar()
 		return fyes, fyes.String()
 	}
 	return fno, fno.String()
@@ -6,117 +6,88 @@ import (
 	"os"
 	"strconv"
 	"text/tabwriter"
-)
-
-type class int
 
-const (
-	headCls class = iota
-	varCls
-	constCls
-	procCls
+	"pl0/compiler/ast"
 )
 
-func (c class) String() string {
-	switch c {
-	case varCls:
-		return "VAR"
-	case constCls:
-		return "CONST"
-	case procCls:
-		return "PROCEDURE"
-	default:
-		return "kind(" + strconv.Itoa(int(c)) + ")"
-	}
-}
-
+// An object is an entry of the symbol table: a declared object, linked to
+// the next one of its scope. The head of a scope has no object, and links
+// to the enclosing scope; a procedure links to the objects of its scope.
 type object struct {
-	name string
-	kind class
-	lev  int
+	*ast.Object
 	next *object
 	dsc  *object
-	val  string
-	pos  int
 }
 
-var universe, topScope *object
-
-func openScope() {
-	topScope = &object{kind: headCls, dsc: topScope, next: nil}
+func (c *Compiler) openScope() {
+	c.topScope = &object{dsc: c.topScope}
 }
 
-func closeScope() {
-	topScope = topScope.dsc
+func (c *Compiler) closeScope() {
+	c.topScope = c.topScope.dsc
 }
 
-func init() {
-	topScope = nil
-	openScope()
-	universe = topScope
+// initScopes resets the symbol table to an empty universe scope.
+func (c *Compiler) initScopes() {
+	c.topScope = nil
+	c.openScope()
+	c.universe = c.topScope
 }
 
-// newObj creates a new object and places it in the symbol table.
-func newObj(id string, class class) *object {
-	var obj, x *object
-	x = topScope
-	for x.next != nil && x.next.name != id {
+// newObj declares an object of the given kind at the current level, linking
+// id to it. A duplicate is reported, and left out of the symbol table.
+func (c *Compiler) newObj(id *ast.Ident, kind ast.ObjKind) *object {
+	obj := &object{Object: &ast.Object{Kind: kind, Name: id.Name, Level: c.level, Pos: id.Pos()}}
+	id.Obj = obj.Object
+	x := c.topScope
+	for x.next != nil && x.next.Name != id.Name {
 		x = x.next
 	}
 	if x.next == nil {
-		obj = new(object)
-		obj.name = id
-		obj.kind = class
-		obj.next = nil
 		x.next = obj
 	} else {
-		duplicate(id)
+		c.duplicate(id)
 	}
 	return obj
 }
 
-// find traverses the symbol table looking for a matching object.
-func find(id string) *object {
-	var s, x *object
-	s = topScope
-	for {
-		x = s.next
-		for x != nil && x.name != id {
-			x = x.next
+// find traverses the symbol table looking for the object named by id,
+// linking id to it. An undefined identifier is reported, and left unlinked.
+func (c *Compiler) find(id *ast.Ident) *ast.Object {
+	for s := c.topScope; s != nil; s = s.dsc {
+		for x := s.next; x != nil; x = x.next {
+			if x.Name == id.Name {
+				id.Obj = x.Object
+				return x.Object
+			}
 		}
-		s = s.dsc
-		if x != nil || s == nil {
-			break
-		}
-	}
-	if x == nil {
-		undefined(id)
 	}
-	return x
+	id.Obj = nil
+	c.undefined(id)
+	return nil
 }
 
-// DumpTable dumps the symbol table.
-func DumpTable() error {
+// DumpTable dumps the symbol table of the last translated program.
+func (c *Compiler) DumpTable() error {
 	const padding = 3
 	w := tabwriter.NewWriter(os.Stderr, 0, 0, padding, ' ', 0)
 	fmt.Fprintln(w, "Symbol\tClass\tValue\tLevel\tPosition\t")
 	fmt.Fprintln(w, "------\t-----\t-----\t-----\t--------\t")
 	fmt.Fprintln(w, "\t\t\t\t\t")
-	dump(w, universe)
+	dump(w, c.universe.next)
 	return w.Flush()
 }
 
 func dump(w io.Writer, x *object) {
-	if x == nil {
-		return
-	}
-	for {
-		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t\n",
-			x.name, x.kind, x.val, x.lev, x.pos)
-		dump(w, x.dsc)
-		x = x.next
-		if x == nil {
-			break
+	for ; x != nil; x = x.next {
+		var val, pos string
+		switch x.Kind {
+		case ast.Con:
+			val = strconv.FormatInt(x.Value, 10)
+		case ast.Var:
+			pos = strconv.Itoa(x.Offset + 1)
 		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t\n", x.Name, x.Kind, val, x.Level, pos)
+		dump(w, x.dsc)
 	}
 }
@@ -0,0 +1,60 @@
+package compiler
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Target identifies the operating system and architecture for which code
+// is generated.
+type Target struct {
+	OS   string
+	Arch string
+}
+
+// Supported targets.
+var (
+	Darwin386   = Target{"darwin", "386"}
+	DarwinAMD64 = Target{"darwin", "amd64"}
+	Linux386    = Target{"linux", "386"}
+	LinuxAMD64  = Target{"linux", "amd64"}
+)
+
+var targets = []Target{Darwin386, DarwinAMD64, Linux386, LinuxAMD64}
+
+// DefaultTarget is the target matching the host operating system and
+// architecture, falling back to 386 on other architectures.
+var DefaultTarget = Darwin386
+
+func init() {
+	host := Target{runtime.GOOS, runtime.GOARCH}
+	for _, t := range targets {
+		if t == host {
+			DefaultTarget = t
+			return
+		}
+	}
+	if host.OS == "linux" {
+		DefaultTarget = Linux386
+	}
+}
+
+// ParseTarget parses a target in "os/arch" form.
+func ParseTarget(s string) (Target, error) {
+	i := strings.Index(s, "/")
+	if i < 0 {
+		return Target{}, fmt.Errorf("malformed target %q, expecting os/arch", s)
+	}
+	t := Target{OS: s[:i], Arch: s[i+1:]}
+	for _, x := range targets {
+		if x == t {
+			return t, nil
+		}
+	}
+	return Target{}, fmt.Errorf("unsupported target %q", s)
+}
+
+func (t Target) String() string {
+	return t.OS + "/" + t.Arch
+}
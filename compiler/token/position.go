@@ -0,0 +1,108 @@
+package token
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Pos is a compact encoding of a source position within a file: the byte
+// offset plus one. It can be converted into a Position by the File.
+type Pos int
+
+// NoPos is the zero value of Pos, holding no position information.
+const NoPos Pos = 0
+
+// IsValid reports whether the position is valid.
+func (p Pos) IsValid() bool {
+	return p != NoPos
+}
+
+// Position describes a source position. A Position is valid if the line
+// number is > 0.
+type Position struct {
+	Filename string // Filename, if any
+	Offset   int    // Byte offset, starting at 0
+	Line     int    // Line number, starting at 1
+	Column   int    // Column number, starting at 1 (byte count)
+}
+
+// IsValid reports whether the position is valid.
+func (pos Position) IsValid() bool {
+	return pos.Line > 0
+}
+
+// String returns a string in one of several forms:
+//
+//	file:line:column    valid position with file name
+//	line:column         valid position without file name
+//	file                invalid position with file name
+//	-                   invalid position without file name
+func (pos Position) String() string {
+	s := pos.Filename
+	if pos.IsValid() {
+		if s != "" {
+			s += ":"
+		}
+		s += fmt.Sprintf("%d:%d", pos.Line, pos.Column)
+	}
+	if s == "" {
+		s = "-"
+	}
+	return s
+}
+
+// File records the line structure of a source file, to translate between
+// a Pos and a Position.
+type File struct {
+	name  string
+	lines []int // Offset of the first character of each line
+}
+
+// NewFile returns a file with the given name and a single line.
+func NewFile(filename string) *File {
+	return &File{name: filename, lines: []int{0}}
+}
+
+// Name returns the file name.
+func (f *File) Name() string {
+	return f.name
+}
+
+// LineCount returns the number of lines in the file.
+func (f *File) LineCount() int {
+	return len(f.lines)
+}
+
+// AddLine records the offset of the first character of a new line. It is
+// ignored unless it is larger than the previous line offset.
+func (f *File) AddLine(offset int) {
+	if offset > f.lines[len(f.lines)-1] {
+		f.lines = append(f.lines, offset)
+	}
+}
+
+// Pos returns the Pos value for the given file offset.
+func (f *File) Pos(offset int) Pos {
+	return Pos(offset + 1)
+}
+
+// Offset returns the offset of the position p.
+func (f *File) Offset(p Pos) int {
+	return int(p) - 1
+}
+
+// Position returns the Position value for the given file position p.
+// An invalid p is converted into an invalid Position.
+func (f *File) Position(p Pos) Position {
+	if !p.IsValid() {
+		return Position{Filename: f.name}
+	}
+	offset := f.Offset(p)
+	i := sort.Search(len(f.lines), func(i int) bool { return f.lines[i] > offset }) - 1
+	return Position{
+		Filename: f.name,
+		Offset:   offset,
+		Line:     i + 1,
+		Column:   offset - f.lines[i] + 1,
+	}
+}
@@ -14,6 +14,8 @@ const (
 	SEND      // !
 	LPAREN    // (
 	RPARAN    // )
+	LBRACK    // [
+	RBRACK    // ]
 
 	relop_start
 	EQL // =
@@ -42,13 +44,21 @@ const (
 	CONST
 	VAR
 	PROCEDURE
+	FUNCTION
+	RETURN
 	CALL
 	BEGIN
 	END
 	IF
 	THEN
+	ELSE
 	WHILE
 	DO
+	REPEAT
+	UNTIL
+	FOR
+	TO
+	DOWNTO
 	ODD
 	keywords_end
 )
@@ -65,6 +75,8 @@ var tokens = [...]string{
 	SEND:      "!",
 	LPAREN:    "(",
 	RPARAN:    ")",
+	LBRACK:    "[",
+	RBRACK:    "]",
 
 	EQL: "=",
 	NEQ: "#",
@@ -84,13 +96,21 @@ var tokens = [...]string{
 	CONST:     "CONST",
 	VAR:       "VAR",
 	PROCEDURE: "PROCEDURE",
+	FUNCTION:  "FUNCTION",
+	RETURN:    "RETURN",
 	CALL:      "CALL",
 	BEGIN:     "BEGIN",
 	END:       "END",
 	IF:        "IF",
 	THEN:      "THEN",
+	ELSE:      "ELSE",
 	WHILE:     "WHILE",
 	DO:        "DO",
+	REPEAT:    "REPEAT",
+	UNTIL:     "UNTIL",
+	FOR:       "FOR",
+	TO:        "TO",
+	DOWNTO:    "DOWNTO",
 	ODD:       "ODD",
 }
 
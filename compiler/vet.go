@@ -0,0 +1,370 @@
+package compiler
+
+import (
+	"fmt"
+	"sort"
+
+	"pl0/compiler/ast"
+	"pl0/compiler/ir"
+)
+
+// A usage counts the uses of a declared object.
+type usage struct {
+	reads  int // Uses in expressions
+	writes int // Assignments and receives
+	calls  int // Calls, other than recursive ones
+}
+
+// A vetter looks for suspicious constructs in a resolved program.
+type vetter struct {
+	Scanner
+	uses   map[*ast.Object]*usage
+	blocks []*ast.Block  // Blocks enclosing the current one
+	procs  []*ast.Object // Procedures and functions enclosing the current block
+}
+
+// Vet reports the suspicious constructs of a program, parsed without errors:
+// variables never read, or read before they are assigned along some path,
+// constants never used, procedures and functions never called, functions
+// which may return without a result, and variables shadowing a variable of
+// an enclosing block. The warnings are sorted by position.
+// Resolution errors are returned as by Lower, without warnings.
+func Vet(prog *ast.Program) (ErrorList, error) {
+	p, err := Lower(prog)
+	if err != nil {
+		return nil, err
+	}
+	v := &vetter{uses: make(map[*ast.Object]*usage)}
+	v.file = prog.File
+	v.MaxErrors = -1
+	v.block(prog.Main, nil)
+	v.unassigned(p)
+	sort.SliceStable(v.errors, func(i, j int) bool {
+		return v.errors[i].Pos.Offset < v.errors[j].Pos.Offset
+	})
+	return v.errors, nil
+}
+
+// block counts the uses of the objects declared by b, and reports those
+// unused once its body is walked. The parameters of its procedure are
+// counted, but never reported.
+func (v *vetter) block(b *ast.Block, params []*ast.Param) {
+	for _, p := range params {
+		v.shadow(p.Name)
+		v.uses[p.Name.Obj] = new(usage)
+	}
+	var decls []*ast.Ident
+	for _, k := range b.Consts {
+		decls = append(decls, k.Name)
+	}
+	for _, d := range b.Vars {
+		v.shadow(d.Name)
+		decls = append(decls, d.Name)
+	}
+	for _, d := range b.Procs {
+		decls = append(decls, d.Name)
+	}
+	for _, id := range decls {
+		v.uses[id.Obj] = new(usage)
+	}
+	for _, d := range b.Procs {
+		v.blocks = append(v.blocks, b)
+		v.procs = append(v.procs, d.Name.Obj)
+		v.block(d.Block, d.Params)
+		v.blocks = v.blocks[:len(v.blocks)-1]
+		v.procs = v.procs[:len(v.procs)-1]
+	}
+	v.stmt(b.Body)
+
+	for _, id := range decls {
+		u := v.uses[id.Obj]
+		switch kind := id.Obj.Kind; {
+		case kind == ast.Var && u.reads == 0 && u.writes == 0:
+			v.error(id.Pos(), UnusedWarning, "variable "+id.Name+" declared and not used")
+		case kind == ast.Var && u.reads == 0:
+			v.error(id.Pos(), UnusedWarning, "variable "+id.Name+" assigned and never read")
+		case kind == ast.Con && u.reads == 0:
+			v.error(id.Pos(), UnusedWarning, "constant "+id.Name+" declared and not used")
+		case kind == ast.Proc && u.calls == 0:
+			v.error(id.Pos(), UnusedWarning, "procedure "+id.Name+" declared and never called")
+		case kind == ast.Func && u.calls == 0:
+			v.error(id.Pos(), UnusedWarning, "function "+id.Name+" declared and never called")
+		}
+	}
+}
+
+// shadow reports a variable or parameter declared by id shadowing a
+// variable of an enclosing block.
+func (v *vetter) shadow(id *ast.Ident) {
+	for i := len(v.blocks) - 1; i >= 0; i-- {
+		var params []*ast.Param
+		if i > 0 {
+			params = v.procs[i-1].Proc.Params
+		}
+		outer := declared(v.blocks[i], params, id.Name)
+		if outer == nil {
+			continue
+		}
+		if outer.Kind == ast.Var {
+			pos := v.file.Position(outer.Pos)
+			what := "variable"
+			if id.Obj.Param {
+				what = "parameter"
+			}
+			v.error(id.Pos(), ShadowWarning, fmt.Sprintf("%s %s shadows %s declared at %d:%d", what, id.Name, id.Name, pos.Line, pos.Column))
+		}
+		return
+	}
+}
+
+// declared returns the object named name declared by b or among the
+// parameters of its procedure, or nil if none.
+func declared(b *ast.Block, params []*ast.Param, name string) *ast.Object {
+	for _, p := range params {
+		if p.Name.Name == name {
+			return p.Name.Obj
+		}
+	}
+	for _, k := range b.Consts {
+		if k.Name.Name == name {
+			return k.Name.Obj
+		}
+	}
+	for _, d := range b.Vars {
+		if d.Name.Name == name {
+			return d.Name.Obj
+		}
+	}
+	for _, d := range b.Procs {
+		if d.Name.Name == name {
+			return d.Name.Obj
+		}
+	}
+	return nil
+}
+
+// stmt counts the uses of objects in the various statement nodes.
+func (v *vetter) stmt(s ast.Stmt) {
+	switch s := s.(type) {
+	case *ast.AssignStmt:
+		v.assign(s.Lhs)
+		v.expr(s.Rhs)
+
+	case *ast.CallStmt:
+		v.call(s.Proc, s.Args)
+
+	case *ast.ReturnStmt:
+		v.expr(s.X)
+
+	case *ast.BeginStmt:
+		for _, stmt := range s.List {
+			v.stmt(stmt)
+		}
+
+	case *ast.IfStmt:
+		v.cond(s.Cond)
+		v.stmt(s.Body)
+		v.stmt(s.Else)
+
+	case *ast.WhileStmt:
+		v.cond(s.Cond)
+		v.stmt(s.Body)
+
+	case *ast.RepeatStmt:
+		for _, stmt := range s.List {
+			v.stmt(stmt)
+		}
+		v.cond(s.Cond)
+
+	case *ast.ForStmt:
+		// The loop compares the variable it assigns to the limit
+		v.expr(s.From)
+		v.expr(s.Limit)
+		v.uses[s.Var.Obj].writes++
+		v.uses[s.Var.Obj].reads++
+		v.stmt(s.Body)
+
+	case *ast.SendStmt:
+		v.expr(s.X)
+
+	case *ast.ReceiveStmt:
+		v.assign(s.X)
+	}
+}
+
+// assign counts the uses of objects in the variable or array element x
+// assigned.
+func (v *vetter) assign(x ast.Expr) {
+	switch x := x.(type) {
+	case *ast.Ident:
+		v.uses[x.Obj].writes++
+	case *ast.IndexExpr:
+		v.uses[x.X.Obj].writes++
+		v.expr(x.Index)
+	}
+}
+
+// cond counts the uses of objects in the various condition nodes.
+func (v *vetter) cond(cond ast.Cond) {
+	switch x := cond.(type) {
+	case *ast.OddCond:
+		v.expr(x.X)
+	case *ast.RelCond:
+		v.expr(x.X)
+		v.expr(x.Y)
+	}
+}
+
+// expr counts the uses of objects in the various expression nodes.
+func (v *vetter) expr(x ast.Expr) {
+	switch x := x.(type) {
+	case *ast.UnaryExpr:
+		v.expr(x.X)
+	case *ast.BinaryExpr:
+		v.expr(x.X)
+		v.expr(x.Y)
+	case *ast.Ident:
+		v.uses[x.Obj].reads++
+	case *ast.IndexExpr:
+		v.uses[x.X.Obj].reads++
+		v.expr(x.Index)
+	case *ast.CallExpr:
+		v.call(x.Func, x.Args)
+	}
+}
+
+// call counts the uses of objects in a call of the procedure or function
+// named by id.
+func (v *vetter) call(id *ast.Ident, args []ast.Expr) {
+	// A variable or array element passed to a VAR parameter may be read
+	// and assigned
+	for i, x := range args {
+		v.expr(x)
+		if !id.Obj.Proc.Params[i].Var.IsValid() {
+			continue
+		}
+		switch x := x.(type) {
+		case *ast.Ident:
+			v.uses[x.Obj].writes++
+		case *ast.IndexExpr:
+			v.uses[x.X.Obj].writes++
+		}
+	}
+	for _, p := range v.procs {
+		if p == id.Obj {
+			return // A recursive call
+		}
+	}
+	v.uses[id.Obj].calls++
+}
+
+// unassigned reports the variables of each function of p read before they
+// are assigned along some path from its entry. A call is taken to assign
+// the variables the callee, or a function it calls, may assign, and taking
+// the address of a variable to assign it. Variables are checked in the
+// function declaring them only, and the result of a function when it
+// returns.
+func (v *vetter) unassigned(p *ir.Program) {
+	stores := mayStore(p)
+	for _, f := range p.Funcs {
+		own := func(w *ir.Var) bool {
+			return w != nil && w.Index <= len(f.Vars) && f.Vars[w.Index-1] == w
+		}
+
+		// assigned[b][i] tells whether variable i is assigned on entry of
+		// block b, along all paths
+		n := len(f.Vars)
+		assigned := make([][]bool, len(f.Blocks))
+		for i := range assigned {
+			assigned[i] = make([]bool, n)
+			for j := range assigned[i] {
+				assigned[i][j] = i > 0
+			}
+		}
+		preds := f.Preds()
+		transfer := func(b *ir.Block, entry []bool, visit func(*ir.Instr, []bool)) []bool {
+			out := append([]bool(nil), entry...)
+			for _, in := range b.Instrs {
+				if visit != nil {
+					visit(in, out)
+				}
+				switch {
+				case (in.Op == ir.Store || in.Op == ir.StoreGlobal || in.Op == ir.Addr || in.Op == ir.AddrGlobal) && own(in.Var):
+					out[in.Var.Index-1] = true
+				case in.Op == ir.Call:
+					for w := range stores[in.Func] {
+						if own(w) {
+							out[w.Index-1] = true
+						}
+					}
+				}
+			}
+			return out
+		}
+		for changed := true; changed; {
+			changed = false
+			for _, b := range f.Blocks[1:] {
+				in := make([]bool, n)
+				for j := range in {
+					in[j] = true
+				}
+				for _, pred := range preds[b.Index] {
+					for j, ok := range transfer(pred, assigned[pred.Index], nil) {
+						in[j] = in[j] && ok
+					}
+				}
+				for j := range in {
+					if in[j] != assigned[b.Index][j] {
+						assigned[b.Index] = in
+						changed = true
+						break
+					}
+				}
+			}
+		}
+
+		reported := make(map[*ir.Var]bool)
+		for _, b := range f.Blocks {
+			transfer(b, assigned[b.Index], func(in *ir.Instr, state []bool) {
+				if (in.Op == ir.Load || in.Op == ir.LoadGlobal) && own(in.Var) && !state[in.Var.Index-1] && !reported[in.Var] {
+					reported[in.Var] = true
+					if in.Var == f.Result {
+						v.error(f.Pos, UnassignedWarning, "function "+f.Name+" may return without a result")
+						return
+					}
+					v.error(in.Pos, UnassignedWarning, "variable "+in.Var.Name+" may be read before it is assigned")
+				}
+			})
+		}
+	}
+}
+
+// mayStore returns the variables each function of p may assign, itself or
+// through the functions it calls.
+func mayStore(p *ir.Program) map[*ir.Func]map[*ir.Var]bool {
+	stores := make(map[*ir.Func]map[*ir.Var]bool)
+	for _, f := range p.Funcs {
+		stores[f] = make(map[*ir.Var]bool)
+		for _, b := range f.Blocks {
+			for _, in := range b.Instrs {
+				if in.Op == ir.Store || in.Op == ir.StoreGlobal {
+					stores[f][in.Var] = true
+				}
+			}
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, f := range p.Funcs {
+			for _, g := range f.Callees() {
+				for w := range stores[g] {
+					if !stores[f][w] {
+						stores[f][w] = true
+						changed = true
+					}
+				}
+			}
+		}
+	}
+	return stores
+}
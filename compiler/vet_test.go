@@ -0,0 +1,151 @@
+package compiler
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// vet returns the warnings of a program, one per line.
+func vet(t *testing.T, name, src string) string {
+	t.Helper()
+	prog, err := Parse(name, strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	warnings, err := Vet(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	for _, w := range warnings {
+		b.WriteString(w.Error() + " (" + w.Kind.String() + ")\n")
+	}
+	return b.String()
+}
+
+func TestVet(t *testing.T) {
+	const src = `
+CONST k = 1, unused = 2;
+VAR x, y, z, w;
+PROCEDURE set; y := k;
+PROCEDURE never; CALL never;
+PROCEDURE p;
+	VAR a, b, x;
+	BEGIN
+		IF ODD w THEN a := 1;
+		! a;
+		b := 2;
+		x := 0
+	END;
+PROCEDURE q;
+	VAR c;
+	PROCEDURE init; c := 3;
+	BEGIN CALL init; ! c END;
+BEGIN
+	? w;
+	CALL set; ! y;
+	WHILE z < 10 DO z := z + 1;
+	CALL p; CALL q
+END.`
+	const want = `test.pl0:2:14: constant unused declared and not used (unused)
+test.pl0:3:5: variable x declared and not used (unused)
+test.pl0:5:11: procedure never declared and never called (unused)
+test.pl0:7:9: variable b assigned and never read (unused)
+test.pl0:7:12: variable x shadows x declared at 3:5 (shadow)
+test.pl0:7:12: variable x assigned and never read (unused)
+test.pl0:10:5: variable a may be read before it is assigned (unassigned)
+test.pl0:21:8: variable z may be read before it is assigned (unassigned)
+`
+	if got := vet(t, "test.pl0", src); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestVetShadow(t *testing.T) {
+	src, err := ioutil.ReadFile("../test/t.nest1.pl0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `t.nest1.pl0:7:13: variable j shadows j declared at 4:12 (shadow)
+t.nest1.pl0:18:13: variable i shadows i declared at 4:9 (shadow)
+`
+	if got := vet(t, "t.nest1.pl0", string(src)); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestVetParams(t *testing.T) {
+	const src = `
+VAR x, y;
+PROCEDURE p(a; VAR r);
+	VAR b;
+	PROCEDURE q(a); ! a;
+	BEGIN r := a; CALL q(b) END;
+PROCEDURE init(VAR v); v := 1;
+BEGIN CALL init(y); ! y; CALL p(1, x); ! x END.`
+	const want = `test.pl0:5:14: parameter a shadows a declared at 3:13 (shadow)
+test.pl0:6:23: variable b may be read before it is assigned (unassigned)
+`
+	if got := vet(t, "test.pl0", src); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestVetFunc(t *testing.T) {
+	const src = `
+VAR x;
+FUNCTION sq(a); sq := a * a;
+FUNCTION f(a); IF a > 0 THEN RETURN a;
+FUNCTION never(); RETURN never();
+FUNCTION g(VAR r); BEGIN r := 1; RETURN 0 END;
+BEGIN ! sq(f(2)) + g(x); ! x END.`
+	const want = `test.pl0:4:10: function f may return without a result (unassigned)
+test.pl0:5:10: function never declared and never called (unused)
+`
+	if got := vet(t, "test.pl0", src); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestVetArrays(t *testing.T) {
+	const src = `
+VAR a[3], b[3], u[2], i;
+BEGIN a[i] := 1; b[a[0]] := 2; i := 1 END.`
+	const want = `test.pl0:2:11: variable b assigned and never read (unused)
+test.pl0:2:17: variable u declared and not used (unused)
+test.pl0:3:9: variable i may be read before it is assigned (unassigned)
+`
+	if got := vet(t, "test.pl0", src); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestVetLoops(t *testing.T) {
+	const src = `
+VAR i, j, s;
+BEGIN
+	FOR i := 1 TO 3 DO s := s + i;
+	REPEAT j := j + 1 UNTIL j > 3
+END.`
+	const want = `test.pl0:4:26: variable s may be read before it is assigned (unassigned)
+test.pl0:5:14: variable j may be read before it is assigned (unassigned)
+`
+	if got := vet(t, "test.pl0", src); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestVetErrors(t *testing.T) {
+	prog, err := Parse("test.pl0", strings.NewReader("VAR x; y := x."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	warnings, err := Vet(prog)
+	if want := "test.pl0:1:8: undefined identifier y"; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+	if warnings != nil {
+		t.Errorf("got warnings %v despite errors", warnings)
+	}
+}
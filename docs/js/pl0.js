@@ -0,0 +1,50 @@
+// pl0.js runs PL/0 programs compiled to WebAssembly with 'pl0 -emit wasm'.
+//
+// Usage, in a page:
+//
+//   var bytes = await (await fetch('primes.wasm')).arrayBuffer();
+//   await PL0.run(bytes, '', function (line) { console.log(line); });
+//
+// Numbers are 64-bit, and cross the JavaScript boundary as BigInts.
+var PL0 = (function () {
+  'use strict';
+
+  // run instantiates the module in bytes and runs its main block. The lines
+  // of the input string are read by ? statements, and write is called with
+  // the output line of each ! statement. The returned promise is rejected
+  // on invalid input, on an array index out of range, and when the program
+  // traps (e.g. division by zero).
+  function run(bytes, input, write) {
+    var lines = input === '' ? [] : input.replace(/\n$/, '').split('\n');
+    var next = 0;
+    var imports = {
+      pl0: {
+        print: function (x) {
+          write(String(x));
+        },
+        read: function () {
+          if (next >= lines.length) {
+            throw new Error('unexpected end of input');
+          }
+          var line = lines[next++].trim();
+          if (!/^[-+]?[0-9]+$/.test(line)) {
+            throw new Error('invalid input number');
+          }
+          return BigInt.asIntN(64, BigInt(line));
+        },
+        bounds: function (line) {
+          throw new Error('index out of range at line ' + line);
+        }
+      }
+    };
+    return WebAssembly.instantiate(bytes, imports).then(function (result) {
+      result.instance.exports.main();
+    });
+  }
+
+  return { run: run };
+})();
+
+if (typeof module !== 'undefined') {
+  module.exports = PL0;
+}
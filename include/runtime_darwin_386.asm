@@ -5,6 +5,9 @@ TRUE:   dq  -1                              ; True
 FALSE:  dq  0                               ; False
 EINVAL: db  'invalid input number', 0xa
 ELEN:   equ $-EINVAL
+EBOUNDS: db 'index out of range at line '
+BLEN:   equ $-EBOUNDS
+OUTFD:  dd  1                               ; File descriptor written by WRITE
 
 section .bss
 IOB: resb 1              ; I/O buffer used by READ and WRITE
@@ -23,6 +26,29 @@ PERROR:
     call EXIT
 
 
+; BOUNDS reports an array index out of range at the line in eax, on the
+; standard error stream, and halts with a failure status
+BOUNDS:
+    mov dword [OUTFD], 2 ; write to stderr from now on
+    push eax
+    push dword BLEN      ; write the length of error msg
+    push dword EBOUNDS   ; reference error msg to write
+    push dword 2         ; file descriptor (stderr)
+    sub esp, 4           ; darwin syscall need "extra space" on stack
+    mov eax, 4           ; system call number (sys_write)
+    int 0x80             ; call kernel
+    add esp, 16          ; clean stack (3 arguments * 4 + 4 bytes extra space)
+    pop eax
+
+    call PRINTN          ; write the line number
+    call NEWLINE
+
+    push dword 1         ; exit code
+    mov eax, 1           ; system call number (sys_exit)
+    sub esp, 4           ; darwin syscall need "extra space" on stack
+    int 0x80             ; call kernel
+
+
 ; READ reads a byte from the standard input stream into the I/O buffer
 READ:
     push eax             ; preserve eax, restore before procedure returns
@@ -47,7 +73,7 @@ WRITE:
 
     push dword 1         ; write only one byte
     push dword IOB       ; reference buffer to write
-    push dword 1         ; file descriptor (stdout)
+    push dword [OUTFD]   ; file descriptor (stdout, or stderr)
     sub esp, 4           ; darwin syscall need "extra space" on stack
     mov eax, 4           ; system call number (sys_write)
     int 0x80             ; call kernel
@@ -83,6 +109,7 @@ DRAIN:
 PRINTN:
     push eax            ; preserve eax, restore before procedure returns
     push ebp            ; preserve ebp, restore before procedure returns
+    push ebx            ; preserve ebx, restore before procedure returns
 
     cmp eax, 0
     je .zero
@@ -127,6 +154,7 @@ PRINTN:
     call WRITE
 
 .done:
+    pop ebx
     pop ebp
     pop eax
     ret
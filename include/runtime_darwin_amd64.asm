@@ -0,0 +1,220 @@
+; Darwin
+
+section .data
+TRUE:   dq  -1                              ; True
+FALSE:  dq  0                               ; False
+EINVAL: db  'invalid input number', 0xa
+ELEN:   equ $-EINVAL
+EBOUNDS: db 'index out of range at line '
+BLEN:   equ $-EBOUNDS
+OUTFD:  dq  1                               ; File descriptor written by WRITE
+
+section .bss
+IOB: resb 1              ; I/O buffer used by READ and WRITE
+
+section .text
+
+; PERROR reports invalid input error and halts
+PERROR:
+    mov rdx, ELEN            ; write the length of error msg
+    lea rsi, [rel EINVAL]    ; reference error msg to write
+    mov rdi, 1               ; file descriptor (stdout)
+    mov rax, 0x2000004       ; system call number (sys_write)
+    syscall                  ; call kernel
+
+    call EXIT
+
+
+; BOUNDS reports an array index out of range at the line in rax, on the
+; standard error stream, and halts with a failure status
+BOUNDS:
+    mov qword [rel OUTFD], 2 ; write to stderr from now on
+    push rax
+    mov rdx, BLEN            ; write the length of error msg
+    lea rsi, [rel EBOUNDS]   ; reference error msg to write
+    mov rdi, 2               ; file descriptor (stderr)
+    mov rax, 0x2000004       ; system call number (sys_write)
+    syscall                  ; call kernel
+    pop rax
+
+    call PRINTN              ; write the line number
+    call NEWLINE
+
+    mov rdi, 1               ; exit code
+    mov rax, 0x2000001       ; system call number (sys_exit)
+    syscall                  ; call kernel
+
+
+; READ reads a byte from the standard input stream into the I/O buffer
+READ:
+    push rax             ; preserve registers, restore before procedure returns
+    push rcx             ; (syscall clobbers rcx)
+    push rdx
+    push rsi
+    push rdi
+
+    mov rdx, 1           ; read only one byte
+    lea rsi, [rel IOB]   ; reference buffer to read into
+    mov rdi, 0           ; file descriptor (stdin)
+    mov rax, 0x2000003   ; system call number (sys_read)
+    syscall              ; call kernel
+
+    pop rdi
+    pop rsi
+    pop rdx
+    pop rcx
+    pop rax
+    ret
+
+
+; WRITE writes the byte in al register to the standard output stream.
+WRITE:
+    push rax             ; preserve registers, restore before procedure returns
+    push rcx             ; (syscall clobbers rcx)
+    push rdx
+    push rsi
+    push rdi
+    mov byte [rel IOB], al   ; copy rax LO byte to i/o buffer
+
+    mov rdx, 1           ; write only one byte
+    lea rsi, [rel IOB]   ; reference buffer to write
+    mov rdi, [rel OUTFD] ; file descriptor (stdout, or stderr)
+    mov rax, 0x2000004   ; system call number (sys_write)
+    syscall              ; call kernel
+
+    pop rdi
+    pop rsi
+    pop rdx
+    pop rcx
+    pop rax
+    ret
+
+
+; DRAIN reads the remaining bytes from the standard input stream
+DRAIN:
+    push rbx             ; preserve rbx, restore before procedure returns
+
+    xor rbx, rbx
+
+.next:
+    call READ
+    mov bl, byte [rel IOB]
+
+    cmp bl, 0xa          ; ascii character '\n'
+    je .done
+
+    jmp .next
+
+.done:
+
+    pop rbx
+    ret
+
+
+; PRINTN writes the integer in the rax register to the standard output stream.
+PRINTN:
+    push rax            ; preserve rax, restore before procedure returns
+    push rbp            ; preserve rbp, restore before procedure returns
+    push rbx            ; preserve rbx, restore before procedure returns
+
+    cmp rax, 0
+    je .zero
+    jg .positive
+
+    ; integer is negative, write sign and negate
+    push rax
+    mov rax, 0x2d       ; ascii character '-'
+    call WRITE
+    pop rax
+    neg rax
+
+.positive:
+    xor rbx, rbx        ; clear digits counter
+
+.digits:
+    cmp rax, 0
+    je .convert
+
+    xor rdx, rdx        ; clear reminder
+    mov rcx, 10         ; divisor
+    div rcx             ; divide, put quotient in rax and reminder in rdx
+
+    push rdx            ; push digit onto stack
+    inc rbx             ; increment digits counter
+
+    jmp .digits    ; repeat
+
+.convert:
+    cmp rbx, 0
+    je .done
+
+    dec rbx
+    pop rax
+    add rax, 0x30       ; convert digit to ascii by adding '0' character
+    call WRITE
+
+    jmp .convert
+
+.zero:
+    mov rax, 0x30       ; copy ascii '0' character
+    call WRITE
+
+.done:
+    pop rbx
+    pop rbp
+    pop rax
+    ret
+
+; SCANN reads from the standard input stream a number into the rax register
+SCANN:
+    push rbx             ; preserve rbx, restore before procedure returns
+
+    xor rax, rax
+    xor rbx, rbx
+
+.nextDigit:
+    call READ
+    mov bl, byte [rel IOB]
+
+    ; EOF?
+    cmp bl, 0xa
+    je .done
+
+    ; isDigit?
+    cmp bl, '0'       ; < ascii '0' character
+    jl .invalid
+    cmp bl, '9'       ; > ascii '9' character
+    jg .invalid
+
+    imul rax, 10
+    sub bl, '0'       ; convert to decimal representation by subtracting '0'
+    add rax, rbx
+
+    jmp .nextDigit
+
+.invalid:
+    call DRAIN
+    call PERROR
+
+.done:
+    pop rbx
+    ret
+
+
+; NEWLINE writes a newline character ("\n") to the standard output stream.
+NEWLINE:
+    push rax             ; preserve rax, restore before procedure returns
+
+    mov rax, 0x0A
+    call WRITE
+
+    pop rax
+    ret
+
+; EXIT returns control to the operating system
+EXIT:
+    mov rdi, 0          ; exit code
+    mov rax, 0x2000001  ; system call number (sys_exit)
+    syscall             ; call kernel
+
+    ; no need to clean up stack after program exit
@@ -0,0 +1,383 @@
+// Package interp implements a tree-walking interpreter for PL/0 programs.
+//
+// Programs are resolved as for compiling them, so that the interpreter
+// rejects the same programs, and finds the object denoted by each
+// identifier through its Obj field. Each procedure activation gets a frame
+// holding its variables and a static link to the frame of the lexically
+// enclosing procedure, so that non-local variables are found as in the
+// native code, by level. The elements of an array follow each other among
+// the variables. Its parameters refer to a copy of the argument, or to the
+// variable passed by reference. The frame of a function holds its result
+// too, which a RETURN statement sets before unwinding the statements of its
+// body.
+//
+// Numbers are 64-bit, whatever the target the program is otherwise compiled
+// for, and arithmetic wraps around on overflow: a program overflowing the
+// 32-bit numbers of a 386 executable prints different results when run by
+// the interpreter.
+package interp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"pl0/compiler"
+	"pl0/compiler/ast"
+	"pl0/compiler/token"
+)
+
+// MaxDepth is the maximum number of nested procedure activations.
+const MaxDepth = 10000
+
+// An Error describes a problem found while running a program.
+type Error struct {
+	Pos token.Position
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return e.Pos.String() + ": " + e.Msg
+}
+
+// frame is a procedure or function activation.
+type frame struct {
+	vars   []int64
+	params []*int64
+	link   *frame // Frame of the lexically enclosing block
+	level  int    // Level of the block; 0 for the main block
+	result int64  // Result of a function
+	done   bool   // A RETURN statement was run
+}
+
+// interpreter holds the state of a running program.
+type interpreter struct {
+	file  *token.File
+	in    *bufio.Reader
+	out   io.Writer
+	slots map[*ast.Object]int // Index of each variable in its frame
+	sizes map[*ast.Block]int  // Number of variables of each block, counting array elements
+	depth int
+}
+
+// bailout is the panic value carrying a runtime error up to Run.
+type bailout struct{ err *Error }
+
+// Run resolves and executes prog, reading the input of ? statements from
+// in and writing the output of ! statements to out. Resolution errors are
+// returned in a compiler.ErrorList, without running the program; a runtime
+// error is an *Error.
+func Run(prog *ast.Program, in io.Reader, out io.Writer) (err error) {
+	if err := compiler.Resolve(prog); err != nil {
+		return err
+	}
+	it := &interpreter{
+		file:  prog.File,
+		in:    bufio.NewReader(in),
+		out:   out,
+		slots: make(map[*ast.Object]int),
+		sizes: make(map[*ast.Block]int),
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			b, ok := e.(bailout)
+			if !ok {
+				panic(e)
+			}
+			err = b.err
+		}
+	}()
+	it.block(prog.Main, nil, nil)
+	return nil
+}
+
+// errorf stops the program with an error at pos.
+func (it *interpreter) errorf(pos token.Pos, format string, args ...interface{}) {
+	var position token.Position
+	if it.file != nil {
+		position = it.file.Position(pos)
+	}
+	panic(bailout{&Error{Pos: position, Msg: fmt.Sprintf(format, args...)}})
+}
+
+// layout assigns the variables of block b their index in its frames, the
+// elements of an array following each other.
+func (it *interpreter) layout(b *ast.Block) int {
+	if n, ok := it.sizes[b]; ok {
+		return n
+	}
+	n := 0
+	for _, v := range b.Vars {
+		it.slots[v.Name.Obj] = n
+		if v.Name.Obj.Len > 0 {
+			n += v.Name.Obj.Len
+		} else {
+			n++
+		}
+	}
+	it.sizes[b] = n
+	return n
+}
+
+// block runs block b at the given level in a new frame with the given
+// static link, and returns it. The frame of a procedure refers to its
+// arguments.
+func (it *interpreter) block(b *ast.Block, args []*int64, link *frame) *frame {
+	f := &frame{vars: make([]int64, it.layout(b)), params: args, link: link}
+	if link != nil {
+		f.level = link.level + 1
+	}
+	it.stmt(f, b.Body)
+	return f
+}
+
+// call runs the procedure or function named by id with the given
+// arguments, and returns its frame. The call is at pos.
+func (it *interpreter) call(f *frame, pos token.Pos, id *ast.Ident, args []ast.Expr) *frame {
+	if it.depth == MaxDepth {
+		it.errorf(pos, "stack overflow")
+	}
+	d := id.Obj.Proc
+	values := it.args(f, d, args)
+	it.depth++
+	h := it.block(d.Block, values, f.outer(id.Obj.Level))
+	it.depth--
+	return h
+}
+
+// outer returns the frame of the block at the given level, f or one
+// lexically enclosing it.
+func (f *frame) outer(level int) *frame {
+	for f.level > level {
+		f = f.link
+	}
+	return f
+}
+
+// variable returns the storage of the variable or array element x, or of
+// the result of the enclosing function it names.
+func (it *interpreter) variable(f *frame, x ast.Expr) *int64 {
+	if e, ok := x.(*ast.IndexExpr); ok {
+		return it.element(f, e)
+	}
+	obj := x.(*ast.Ident).Obj
+	switch {
+	case obj.Kind == ast.Func:
+		return &f.outer(obj.Level + 1).result
+	case obj.Param:
+		return f.outer(obj.Level).params[obj.Offset]
+	}
+	return &f.outer(obj.Level).vars[it.slots[obj]]
+}
+
+// element returns the storage of an array element, checking its index.
+func (it *interpreter) element(f *frame, x *ast.IndexExpr) *int64 {
+	obj := x.X.Obj
+	i := it.expr(f, x.Index)
+	if i < 0 || i >= int64(obj.Len) {
+		it.errorf(x.Index.Pos(), "index %d out of range [0:%d]", i, obj.Len)
+	}
+	return &f.outer(obj.Level).vars[it.slots[obj]+int(i)]
+}
+
+// args returns the arguments of a call to the procedure or function d: a
+// copy of the value of each expression, or the variable passed by
+// reference.
+func (it *interpreter) args(f *frame, d *ast.ProcDecl, exprs []ast.Expr) []*int64 {
+	args := make([]*int64, len(exprs))
+	for i, x := range exprs {
+		if d.Params[i].Var.IsValid() {
+			args[i] = it.variable(f, x)
+			continue
+		}
+		v := it.expr(f, x)
+		args[i] = &v
+	}
+	return args
+}
+
+func (it *interpreter) stmt(f *frame, s ast.Stmt) {
+	switch s := s.(type) {
+	case nil:
+		// Empty statement
+
+	case *ast.AssignStmt:
+		v := it.variable(f, s.Lhs)
+		*v = it.expr(f, s.Rhs)
+
+	case *ast.CallStmt:
+		it.call(f, s.Pos(), s.Proc, s.Args)
+
+	case *ast.ReturnStmt:
+		f.result = it.expr(f, s.X)
+		f.done = true
+
+	case *ast.SendStmt:
+		fmt.Fprintln(it.out, it.expr(f, s.X))
+
+	case *ast.ReceiveStmt:
+		v := it.variable(f, s.X)
+		*v = it.read(s.Pos())
+
+	case *ast.BeginStmt:
+		for _, s := range s.List {
+			if f.done {
+				break
+			}
+			it.stmt(f, s)
+		}
+
+	case *ast.IfStmt:
+		if it.cond(f, s.Cond) {
+			it.stmt(f, s.Body)
+		} else {
+			it.stmt(f, s.Else)
+		}
+
+	case *ast.WhileStmt:
+		for !f.done && it.cond(f, s.Cond) {
+			it.stmt(f, s.Body)
+		}
+
+	case *ast.RepeatStmt:
+		for !f.done {
+			for _, s := range s.List {
+				if f.done {
+					break
+				}
+				it.stmt(f, s)
+			}
+			if f.done || it.cond(f, s.Cond) {
+				break
+			}
+		}
+
+	case *ast.ForStmt:
+		it.loop(f, s)
+
+	default:
+		it.errorf(s.Pos(), "cannot run %T", s)
+	}
+}
+
+// loop runs a FOR loop, whose limit is evaluated once. The loop is left
+// when the variable reaches the limit, before stepping it.
+func (it *interpreter) loop(f *frame, s *ast.ForStmt) {
+	v := it.variable(f, s.Var)
+	from, limit := it.expr(f, s.From), it.expr(f, s.Limit)
+	*v = from
+	step := int64(1)
+	if s.Dir == token.DOWNTO {
+		step = -1
+	}
+	// before reports whether x comes before y in the order of the loop
+	before := func(x, y int64) bool {
+		return step > 0 && x < y || step < 0 && x > y
+	}
+	if before(limit, from) {
+		return
+	}
+	for !f.done {
+		it.stmt(f, s.Body)
+		if f.done || !before(*v, limit) {
+			break
+		}
+		*v += step
+	}
+}
+
+func (it *interpreter) cond(f *frame, c ast.Cond) bool {
+	switch c := c.(type) {
+	case *ast.OddCond:
+		return it.expr(f, c.X)%2 != 0
+
+	case *ast.RelCond:
+		x, y := it.expr(f, c.X), it.expr(f, c.Y)
+		switch c.Op {
+		case token.EQL:
+			return x == y
+		case token.NEQ:
+			return x != y
+		case token.LSS:
+			return x < y
+		case token.LEQ:
+			return x <= y
+		case token.GRT:
+			return x > y
+		case token.GEQ:
+			return x >= y
+		}
+	}
+	panic(fmt.Sprintf("unsupported condition: %T", c))
+}
+
+func (it *interpreter) expr(f *frame, x ast.Expr) int64 {
+	switch x := x.(type) {
+	case *ast.Number:
+		return it.number(x)
+
+	case *ast.Ident:
+		if x.Obj.Kind == ast.Con {
+			return x.Obj.Value
+		}
+		return *it.variable(f, x)
+
+	case *ast.IndexExpr:
+		return *it.element(f, x)
+
+	case *ast.CallExpr:
+		return it.call(f, x.Pos(), x.Func, x.Args).result
+
+	case *ast.UnaryExpr:
+		v := it.expr(f, x.X)
+		if x.Op == token.MINUS {
+			return -v
+		}
+		return v
+
+	case *ast.BinaryExpr:
+		a, b := it.expr(f, x.X), it.expr(f, x.Y)
+		switch x.Op {
+		case token.PLUS:
+			return a + b
+		case token.MINUS:
+			return a - b
+		case token.TIMES:
+			return a * b
+		case token.DIV:
+			if b == 0 {
+				it.errorf(x.OpPos, "division by zero")
+			}
+			return a / b
+		}
+		panic(fmt.Sprintf("unsupported binary operator: %q", x.Op))
+
+	default:
+		it.errorf(x.Pos(), "cannot evaluate %T", x)
+	}
+	return 0
+}
+
+// number returns the value of a number, checked by resolution.
+func (it *interpreter) number(n *ast.Number) int64 {
+	v, _ := strconv.ParseInt(n.Value, 10, 64)
+	return v
+}
+
+// read reads a line holding a number from the input.
+func (it *interpreter) read(pos token.Pos) int64 {
+	line, err := it.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		if err == io.EOF {
+			it.errorf(pos, "unexpected end of input")
+		}
+		it.errorf(pos, "%v", err)
+	}
+	v, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+	if err != nil {
+		it.errorf(pos, "invalid input number")
+	}
+	return v
+}
@@ -0,0 +1,171 @@
+package interp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"pl0/compiler"
+)
+
+var outputRE = regexp.MustCompile(`\{\s*Output:([^}]*)\}`)
+
+// TestPrograms runs the test programs, comparing their output with the
+// expected output noted in their { Output: ... } comments.
+func TestPrograms(t *testing.T) {
+	files, err := filepath.Glob("../test/t.*.pl0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no test programs found")
+	}
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []string
+		for _, m := range outputRE.FindAllSubmatch(src, -1) {
+			want = append(want, strings.Fields(string(m[1]))...)
+		}
+		if want == nil {
+			t.Errorf("%s: missing expected output", file)
+			continue
+		}
+		prog, err := compiler.Parse(file, bytes.NewReader(src))
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		var out bytes.Buffer
+		if err := Run(prog, strings.NewReader(""), &out); err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		got := strings.Fields(out.String())
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: got %v, want %v", file, got, want)
+		}
+	}
+}
+
+func run(t *testing.T, src, in string) (string, error) {
+	prog, err := compiler.Parse("test.pl0", strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", src, err)
+	}
+	var out bytes.Buffer
+	err = Run(prog, strings.NewReader(in), &out)
+	return out.String(), err
+}
+
+func TestInput(t *testing.T) {
+	const src = `
+VAR a, b;
+BEGIN
+	? a; ? b;
+	! a + b;
+	! a * b
+END.`
+	tests := []struct {
+		in, want string
+	}{
+		{"2\n3\n", "5\n6\n"},
+		{" -4 \n10", "6\n-40\n"},
+	}
+	for _, tt := range tests {
+		got, err := run(t, src, tt.in)
+		if err != nil {
+			t.Errorf("input %q: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("input %q: got %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestStaticLink(t *testing.T) {
+	// The recursive calls of q must see the x of the outer activation of
+	// p, rather than the one of the most recent activation.
+	const src = `
+VAR n;
+PROCEDURE p;
+	VAR x;
+	PROCEDURE q;
+	BEGIN
+		! x;
+		IF n > 0 THEN BEGIN n := n - 1; CALL p END
+	END;
+BEGIN
+	x := n;
+	CALL q
+END;
+BEGIN n := 2; CALL p END.`
+	got, err := run(t, src, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2\n1\n0\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		src, in, want string
+	}{
+		{"VAR x; BEGIN x := 0; ! 1 / x END.", "", "test.pl0:1:26: division by zero"},
+		{"VAR x; ? x.", "abc\n", "test.pl0:1:8: invalid input number"},
+		{"VAR x; ? x.", "", "test.pl0:1:8: unexpected end of input"},
+		{"PROCEDURE p; CALL p; CALL p.", "", "test.pl0:1:14: stack overflow"},
+		{"VAR a[2], i; BEGIN i := 2; a[i] := 1 END.", "", "test.pl0:1:30: index 2 out of range [0:2]"},
+		{"VAR a[2], x; x := a[x - 1].", "", "test.pl0:1:21: index -1 out of range [0:2]"},
+	}
+	for _, tt := range tests {
+		_, err := run(t, tt.src, tt.in)
+		if _, ok := err.(*Error); !ok {
+			t.Errorf("%q: got %v, want runtime error %q", tt.src, err, tt.want)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.src, err, tt.want)
+		}
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	// The program is rejected as when compiled, although the errors are
+	// in code never run.
+	const src = `VAR x;
+PROCEDURE never; ! y;
+BEGIN
+	! 1; x := 1;
+	IF x = 2 THEN z := 3;
+	IF x = 2 THEN CALL never(1, 2)
+END.`
+	want := []string{
+		"test.pl0:2:20: undefined identifier y",
+		"test.pl0:5:16: undefined identifier z",
+		"test.pl0:6:21: wrong number of arguments in call to never: have 2, want 0",
+	}
+	out, err := run(t, src, "")
+	list, ok := err.(compiler.ErrorList)
+	if !ok {
+		t.Fatalf("got error %v, want a compiler.ErrorList", err)
+	}
+	var got []string
+	for _, e := range list {
+		got = append(got, e.Error())
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got errors:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if out != "" {
+		t.Errorf("got output %q, want none", out)
+	}
+}
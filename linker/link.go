@@ -6,22 +6,31 @@ import (
 	"os"
 )
 
-const (
-	pageSize uint32 = 4096
-	pageMask        = ^(pageSize - 1)
-)
+const pageSize uint32 = 4096
 
 // Header
 const (
 	CpuSubtypeX86All = 0x3
 	NoUndefs         = 0x1
+
+	header32Len = 28
+	header64Len = 32
 )
 
 // Load command length
 const (
-	segment32Len  = 56
-	section32Len  = 68
-	unixThreadLen = 80
+	segment32Len    = 56
+	section32Len    = 68
+	unixThreadLen   = 80
+	segment64Len    = 72
+	section64Len    = 80
+	unixThread64Len = 184
+)
+
+// Thread state flavors
+const (
+	x86ThreadState32 = 0x1
+	x86ThreadState64 = 0x4
 )
 
 // Protection values
@@ -54,20 +63,35 @@ type unixThread struct {
 	State  [16]uint32
 }
 
-// Link creates a Mach-O executable.
-func Link(dst, src string) error {
-	var err error
+type unixThread64 struct {
+	Cmd    macho.LoadCmd
+	Len    uint32
+	Flavor uint32
+	Count  uint32
+	State  [21]uint64
+}
 
-	// Open input file
-	in, err := openMacho(src)
-	if err != nil {
-		return err
+// LinkObject creates an executable of the given format from an object.
+func LinkObject(dst string, obj *Object, format Format) error {
+	switch {
+	case format == ELF:
+		return linkELF(dst, obj)
+	case obj.Is64:
+		return linkMacho64(dst, obj)
+	default:
+		return linkMacho(dst, obj)
 	}
+}
 
+// linkMacho creates a 32-bit Mach-O executable.
+func linkMacho(dst string, obj *Object) error {
 	/*
 	 * Create executable layout
 	 */
-	var addr, ncmd, cmdsz, entry uint32
+	var addr, ncmd, cmdsz uint32
+
+	// Headers are mapped at the start of the __TEXT segment
+	hdrLen := uint32(header32Len + 3*segment32Len + 3*section32Len + unixThreadLen)
 
 	// Segment: __PAGEZERO
 	pageZero := macho.Segment32{
@@ -88,12 +112,8 @@ func Link(dst, src string) error {
 	cmdsz += pageZero.Len
 
 	// Segment: __TEXT
-	_, textContent, err := in.section("__text")
-	if err != nil {
-		return err
-	}
-	textLen := uint32(len(textContent))
-	textSize := (textLen + pageSize - 1) & pageMask
+	textLen := uint32(len(obj.Text))
+	textSize := align(hdrLen+textLen, pageSize)
 	textSeg := macho.Segment32{
 		Cmd:     macho.LoadCmdSegment,
 		Len:     segment32Len + section32Len,
@@ -125,9 +145,8 @@ func Link(dst, src string) error {
 	cmdsz += textSeg.Len
 
 	// Segment: __DATA
-	dataStart, dataContent, _ := in.section("__data")
-	dataLen := uint32(len(dataContent))
-	dataSize := (dataLen + pageSize - 1) & pageMask
+	dataLen := align(uint32(len(obj.Data)), 16)
+	dataSize := align(dataLen+obj.Bss, pageSize)
 	dataSeg := macho.Segment32{
 		Cmd:     macho.LoadCmdSegment,
 		Len:     segment32Len + section32Len*2,
@@ -154,13 +173,11 @@ func Link(dst, src string) error {
 		Reserve1: 0,
 		Reserve2: 0,
 	}
-	_, bssContent, _ := in.section("__bss")
-	bssLen := uint32(len(bssContent))
 	bssSect := macho.Section32{
 		Name:     str16("__bss"),
 		Seg:      str16("__DATA"),
-		Addr:     dataSeg.Addr,
-		Size:     bssLen,
+		Addr:     dataSeg.Addr + dataLen,
+		Size:     obj.Bss,
 		Offset:   0,
 		Align:    0,
 		Reloff:   0,
@@ -174,44 +191,35 @@ func Link(dst, src string) error {
 	cmdsz += dataSeg.Len
 
 	// Relocate text symbols now that we got data layout
-	relocs, err := in.relocs("__text")
-	if err != nil {
-		return err
-	}
-	for _, r := range relocs {
-		content := textContent[r.Addr : r.Addr+1<<r.Len]
-		value := binary.LittleEndian.Uint32(content)
-		binary.LittleEndian.PutUint32(content, dataSeg.Addr+(value-dataStart))
-	}
-
-	// Lookup entry address
-	if entry, err = in.entry(); err != nil {
-		return err
-	}
+	obj.relocate([nsect]uint64{
+		Text: uint64(textSect.Addr),
+		Data: uint64(dataSect.Addr),
+		Bss:  uint64(bssSect.Addr),
+	})
 
 	// Unix Thread Command
 	thread := unixThread{
 		Cmd:    macho.LoadCmdUnixThread,
 		Len:    unixThreadLen,
-		Flavor: 0x1, // i386_THREAD_STATE
+		Flavor: x86ThreadState32,
 		Count:  16,
 		State: [16]uint32{
-			0, // AX
-			0, // BX
-			0, // CX
-			0, // DX
-			0, // DI
-			0, // SI
-			0, // BP
-			0, // SP
-			0, // SS
-			0, // FLAGS
-			textSect.Addr + entry, // IP
-			0, // CS
-			0, // DS
-			0, // ES
-			0, // FS
-			0, // GS
+			0,                         // AX
+			0,                         // BX
+			0,                         // CX
+			0,                         // DX
+			0,                         // DI
+			0,                         // SI
+			0,                         // BP
+			0,                         // SP
+			0,                         // SS
+			0,                         // FLAGS
+			textSect.Addr + obj.Entry, // IP
+			0,                         // CS
+			0,                         // DS
+			0,                         // ES
+			0,                         // FS
+			0,                         // GS
 		},
 	}
 	ncmd += 1
@@ -232,6 +240,7 @@ func Link(dst, src string) error {
 	if err != nil {
 		return err
 	}
+	defer out.Close()
 
 	// Write header and load commands
 	bw := &binaryWriter{w: out, bo: binary.LittleEndian}
@@ -245,15 +254,151 @@ func Link(dst, src string) error {
 	bw.write(thread)
 
 	// Write text, data and bss contents
-	bw.writeAt(textContent, int64(textSect.Offset))
-	bw.writeAt(make([]byte, dataSeg.Memsz), int64(dataSeg.Offset))
-	bw.writeAt(dataContent, int64(dataSeg.Offset))
+	bw.writeAt(obj.Text, int64(textSect.Offset))
+	bw.writeAt(make([]byte, dataSeg.Filesz), int64(dataSeg.Offset))
+	bw.writeAt(obj.Data, int64(dataSeg.Offset))
 
-	if bw.err != nil {
-		return bw.err
+	return bw.err
+}
+
+// linkMacho64 creates a 64-bit Mach-O executable.
+func linkMacho64(dst string, obj *Object) error {
+	/*
+	 * Create executable layout
+	 */
+	var addr uint64
+	var ncmd, cmdsz uint32
+
+	// Headers are mapped at the start of the __TEXT segment
+	hdrLen := uint32(header64Len + 3*segment64Len + 3*section64Len + unixThread64Len)
+
+	// Segment: __PAGEZERO, covering the whole 32-bit address space
+	pageZero := macho.Segment64{
+		Cmd:     macho.LoadCmdSegment64,
+		Len:     segment64Len,
+		Name:    str16("__PAGEZERO"),
+		Addr:    0,
+		Memsz:   1 << 32,
+		Maxprot: P_NONE,
+		Prot:    P_NONE,
+	}
+	addr = pageZero.Addr + pageZero.Memsz
+	ncmd += 1
+	cmdsz += pageZero.Len
+
+	// Segment: __TEXT
+	textLen := uint32(len(obj.Text))
+	textSize := uint64(align(hdrLen+textLen, pageSize))
+	textSeg := macho.Segment64{
+		Cmd:     macho.LoadCmdSegment64,
+		Len:     segment64Len + section64Len,
+		Name:    str16("__TEXT"),
+		Addr:    addr,
+		Memsz:   textSize,
+		Offset:  0,
+		Filesz:  textSize,
+		Maxprot: P_RDEXEC,
+		Prot:    P_RDEXEC,
+		Nsect:   1,
+	}
+	textSect := macho.Section64{
+		Name:   str16("__text"),
+		Seg:    str16("__TEXT"),
+		Addr:   textSeg.Addr + textSeg.Memsz - uint64(textLen),
+		Size:   uint64(textLen),
+		Offset: uint32(textSeg.Filesz) - textLen,
+		Flags:  S_PURE_INSTRUCTIONS | S_SOME_INSTRUCTIONS,
 	}
+	addr = textSeg.Addr + textSeg.Memsz
+	ncmd += 1
+	cmdsz += textSeg.Len
+
+	// Segment: __DATA
+	dataLen := align(uint32(len(obj.Data)), 16)
+	dataSize := uint64(align(dataLen+obj.Bss, pageSize))
+	dataSeg := macho.Segment64{
+		Cmd:     macho.LoadCmdSegment64,
+		Len:     segment64Len + section64Len*2,
+		Name:    str16("__DATA"),
+		Addr:    addr,
+		Memsz:   dataSize,
+		Offset:  textSeg.Offset + textSeg.Filesz,
+		Filesz:  dataSize,
+		Maxprot: P_RDWR,
+		Prot:    P_RDWR,
+		Nsect:   2,
+	}
+	dataSect := macho.Section64{
+		Name:   str16("__data"),
+		Seg:    str16("__DATA"),
+		Addr:   dataSeg.Addr,
+		Size:   uint64(dataLen),
+		Offset: uint32(dataSeg.Offset),
+		Flags:  S_REGULAR,
+	}
+	bssSect := macho.Section64{
+		Name:  str16("__bss"),
+		Seg:   str16("__DATA"),
+		Addr:  dataSeg.Addr + uint64(dataLen),
+		Size:  uint64(obj.Bss),
+		Flags: S_ZEROFILL,
+	}
+	ncmd += 1
+	cmdsz += dataSeg.Len
+
+	// Relocate text symbols now that we got data layout
+	obj.relocate([nsect]uint64{
+		Text: textSect.Addr,
+		Data: dataSect.Addr,
+		Bss:  bssSect.Addr,
+	})
+
+	// Unix Thread Command
+	thread := unixThread64{
+		Cmd:    macho.LoadCmdUnixThread,
+		Len:    unixThread64Len,
+		Flavor: x86ThreadState64,
+		Count:  42,
+	}
+	thread.State[16] = textSect.Addr + uint64(obj.Entry) // RIP
+	ncmd += 1
+	cmdsz += thread.Len
+
+	header := macho.FileHeader{
+		Magic:  macho.Magic64,
+		Cpu:    macho.CpuAmd64,
+		SubCpu: CpuSubtypeX86All,
+		Type:   macho.TypeExec,
+		Ncmd:   ncmd,
+		Cmdsz:  cmdsz,
+		Flags:  NoUndefs,
+	}
+
+	// Write output file
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0700)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// Write header and load commands
+	bw := &binaryWriter{w: out, bo: binary.LittleEndian}
+	bw.write(header)
+	bw.write(uint32(0)) // Reserved
+	bw.write(pageZero)
+	bw.write(textSeg)
+	bw.write(textSect)
+	bw.write(dataSeg)
+	bw.write(dataSect)
+	bw.write(bssSect)
+	bw.write(thread)
+
+	// Write text, data and bss contents
+	bw.writeAt(obj.Text, int64(textSect.Offset))
+	bw.writeAt(make([]byte, dataSeg.Filesz), int64(dataSeg.Offset))
+	bw.writeAt(obj.Data, int64(dataSeg.Offset))
 
-	return nil
+	return bw.err
 }
 
 func str16(s string) [16]byte {
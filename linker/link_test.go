@@ -0,0 +1,234 @@
+package linker
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testObject returns an object whose text refers to a byte of its data by
+// absolute address, and to a byte of its bss relative to the address
+// following the field, with its entry point past the first instruction.
+func testObject(is64 bool) *Object {
+	return &Object{
+		Is64:  is64,
+		Text:  []byte{0x90, 0xb8, 0, 0, 0, 0, 0x8d, 0x05, 0, 0, 0, 0, 0xc3},
+		Data:  []byte("pl0"),
+		Bss:   64,
+		Entry: 1,
+		Relocs: []Reloc{
+			{Off: 2, Sect: Data, Addend: 2},
+			{Off: 8, Sect: Bss, Addend: 8, PCRel: true},
+		},
+	}
+}
+
+// An image is an executable read back: its entry point, and the address
+// and contents of its sections.
+type image struct {
+	entry    uint64
+	textAddr uint64
+	text     []byte
+	dataAddr uint64
+	data     []byte
+	bssAddr  uint64
+	bssLen   uint64
+}
+
+// checkImage checks that img holds the sections of the object returned by
+// testObject, relocated to their addresses.
+func checkImage(t *testing.T, name string, img image) {
+	t.Helper()
+	obj := testObject(false)
+	if want := img.textAddr + uint64(obj.Entry); img.entry != want {
+		t.Errorf("%s: got entry %#x, want %#x", name, img.entry, want)
+	}
+	if len(img.text) != len(obj.Text) {
+		t.Fatalf("%s: got text % x, want %d bytes", name, img.text, len(obj.Text))
+	}
+	text := append([]byte(nil), img.text...)
+	for _, r := range obj.Relocs {
+		copy(text[r.Off:r.Off+4], obj.Text[r.Off:])
+	}
+	if !bytes.Equal(text, obj.Text) {
+		t.Errorf("%s: got text % x, want % x", name, img.text, obj.Text)
+	}
+	want := []uint32{
+		uint32(img.dataAddr + 2),
+		uint32(img.bssAddr + 8 - (img.textAddr + 8 + 4)),
+	}
+	for i, r := range obj.Relocs {
+		if got := binary.LittleEndian.Uint32(img.text[r.Off:]); got != want[i] {
+			t.Errorf("%s: got field at %d %#x, want %#x", name, r.Off, got, want[i])
+		}
+	}
+	if !bytes.HasPrefix(img.data, obj.Data) {
+		t.Errorf("%s: got data % x, want % x", name, img.data, obj.Data)
+	}
+	if img.bssAddr < img.dataAddr+uint64(len(obj.Data)) || img.bssLen < uint64(obj.Bss) {
+		t.Errorf("%s: got bss of %d bytes at %#x, want %d bytes after the data at %#x",
+			name, img.bssLen, img.bssAddr, obj.Bss, img.dataAddr)
+	}
+}
+
+func TestLinkELF(t *testing.T) {
+	tests := []struct {
+		is64    bool
+		class   elf.Class
+		machine elf.Machine
+	}{
+		{false, elf.ELFCLASS32, elf.EM_386},
+		{true, elf.ELFCLASS64, elf.EM_X86_64},
+	}
+	dir, err := ioutil.TempDir("", "linker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tt := range tests {
+		name := filepath.Join(dir, tt.class.String())
+		if err := LinkObject(name, testObject(tt.is64), ELF); err != nil {
+			t.Fatal(err)
+		}
+		f, err := elf.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if f.Class != tt.class || f.Machine != tt.machine || f.Type != elf.ET_EXEC {
+			t.Errorf("%s: got %v %v %v, want %v %v ET_EXEC", tt.class, f.Class, f.Machine, f.Type, tt.class, tt.machine)
+		}
+
+		// The text ends the segment mapping the headers, and the data
+		// segment holds the data followed by the bss
+		if len(f.Progs) != 2 {
+			t.Fatalf("%s: got %d program headers, want 2", tt.class, len(f.Progs))
+		}
+		for i, flags := range []elf.ProgFlag{elf.PF_R | elf.PF_X, elf.PF_R | elf.PF_W} {
+			p := f.Progs[i]
+			if p.Type != elf.PT_LOAD || p.Flags != flags || p.Vaddr%uint64(pageSize) != p.Off%uint64(pageSize) {
+				t.Errorf("%s: got segment %d %v %v at %#x from offset %#x, want PT_LOAD %v page aligned",
+					tt.class, i, p.Type, p.Flags, p.Vaddr, p.Off, flags)
+			}
+		}
+		textSeg, dataSeg := f.Progs[0], f.Progs[1]
+		if textSeg.Off != 0 {
+			t.Errorf("%s: got text segment at offset %#x, want 0", tt.class, textSeg.Off)
+		}
+		textLen := uint64(len(testObject(tt.is64).Text))
+		img := image{
+			entry:    f.Entry,
+			textAddr: textSeg.Vaddr + textSeg.Filesz - textLen,
+			text:     make([]byte, textLen),
+			dataAddr: dataSeg.Vaddr,
+			data:     make([]byte, dataSeg.Filesz),
+			bssAddr:  dataSeg.Vaddr + dataSeg.Filesz,
+			bssLen:   dataSeg.Memsz - dataSeg.Filesz,
+		}
+		if _, err := textSeg.ReadAt(img.text, int64(textSeg.Filesz-textLen)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dataSeg.ReadAt(img.data, 0); err != nil {
+			t.Fatal(err)
+		}
+		checkImage(t, tt.class.String(), img)
+	}
+}
+
+func TestLinkMacho(t *testing.T) {
+	tests := []struct {
+		is64 bool
+		cpu  macho.Cpu
+	}{
+		{false, macho.Cpu386},
+		{true, macho.CpuAmd64},
+	}
+	dir, err := ioutil.TempDir("", "linker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tt := range tests {
+		name := filepath.Join(dir, tt.cpu.String())
+		if err := LinkObject(name, testObject(tt.is64), MachO); err != nil {
+			t.Fatal(err)
+		}
+		f, err := macho.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if f.Cpu != tt.cpu || f.Type != macho.TypeExec {
+			t.Errorf("%s: got %v %v, want %v %v", tt.cpu, f.Cpu, f.Type, tt.cpu, macho.TypeExec)
+		}
+
+		// The page zero segment traps null pointers, and the others map
+		// the sections
+		for _, seg := range []struct {
+			name string
+			prot uint32
+		}{
+			{"__PAGEZERO", P_NONE},
+			{"__TEXT", P_RDEXEC},
+			{"__DATA", P_RDWR},
+		} {
+			s := f.Segment(seg.name)
+			if s == nil {
+				t.Errorf("%s: missing segment %s", tt.cpu, seg.name)
+				continue
+			}
+			if s.Prot != seg.prot || s.Maxprot != seg.prot || s.Addr%uint64(pageSize) != s.Offset%uint64(pageSize) {
+				t.Errorf("%s: got segment %s protected %#x at %#x from offset %#x, want %#x page aligned",
+					tt.cpu, seg.name, s.Prot, s.Addr, s.Offset, seg.prot)
+			}
+		}
+		if s := f.Segment("__PAGEZERO"); s != nil && (s.Addr != 0 || s.Memsz == 0 || s.Filesz != 0) {
+			t.Errorf("%s: got page zero of %#x bytes at %#x, want it at 0", tt.cpu, s.Memsz, s.Addr)
+		}
+
+		var img image
+		for _, sect := range []struct {
+			name     string
+			addr     *uint64
+			contents *[]byte
+			size     *uint64
+		}{
+			{"__text", &img.textAddr, &img.text, nil},
+			{"__data", &img.dataAddr, &img.data, nil},
+			{"__bss", &img.bssAddr, nil, &img.bssLen},
+		} {
+			s := f.Section(sect.name)
+			if s == nil {
+				t.Fatalf("%s: missing section %s", tt.cpu, sect.name)
+			}
+			*sect.addr = s.Addr
+			if sect.contents != nil {
+				if *sect.contents, err = s.Data(); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				*sect.size = s.Size
+			}
+		}
+
+		// The entry point is the instruction pointer of the thread state
+		// of the LC_UNIXTHREAD command
+		for _, l := range f.Loads {
+			raw := l.Raw()
+			if binary.LittleEndian.Uint32(raw) != uint32(macho.LoadCmdUnixThread) {
+				continue
+			}
+			if tt.is64 {
+				img.entry = binary.LittleEndian.Uint64(raw[16+16*8:]) // RIP
+			} else {
+				img.entry = uint64(binary.LittleEndian.Uint32(raw[16+10*4:])) // EIP
+			}
+		}
+		checkImage(t, tt.cpu.String(), img)
+	}
+}
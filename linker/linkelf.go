@@ -0,0 +1,151 @@
+package linker
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"os"
+)
+
+// Base address of an executable image
+const (
+	elfBase32 uint32 = 0x08048000
+	elfBase64 uint64 = 0x00400000
+)
+
+// Header lengths
+const (
+	elfHeader32Len = 52
+	elfProg32Len   = 32
+	elfHeader64Len = 64
+	elfProg64Len   = 56
+)
+
+// elfLayout places the text segment, mapped together with the file headers,
+// followed by the data segment holding data and the zero filled bss.
+type elfLayout struct {
+	textOff  uint32 // File offset of the text section
+	dataOff  uint32 // File offset of the data segment
+	dataLen  uint32 // Size of the data section, padded for bss alignment
+	textAddr uint64 // Address of the text section
+	dataAddr uint64 // Address of the data segment
+}
+
+func layoutELF(obj *Object, base uint64, hdrLen uint32) elfLayout {
+	var l elfLayout
+	l.textOff = hdrLen
+	l.dataOff = align(l.textOff+uint32(len(obj.Text)), pageSize)
+	l.dataLen = align(uint32(len(obj.Data)), 16)
+	l.textAddr = base + uint64(l.textOff)
+	l.dataAddr = base + uint64(l.dataOff)
+	obj.relocate([nsect]uint64{
+		Text: l.textAddr,
+		Data: l.dataAddr,
+		Bss:  l.dataAddr + uint64(l.dataLen),
+	})
+	return l
+}
+
+func elfIdent(class elf.Class) [elf.EI_NIDENT]byte {
+	var ident [elf.EI_NIDENT]byte
+	copy(ident[:], elf.ELFMAG)
+	ident[elf.EI_CLASS] = byte(class)
+	ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	ident[elf.EI_OSABI] = byte(elf.ELFOSABI_NONE)
+	return ident
+}
+
+// linkELF creates a static ELF executable.
+func linkELF(dst string, obj *Object) error {
+	var header, textSeg, dataSeg interface{}
+	var l elfLayout
+
+	textLen := uint32(len(obj.Text))
+	if obj.Is64 {
+		l = layoutELF(obj, elfBase64, elfHeader64Len+2*elfProg64Len)
+		header = elf.Header64{
+			Ident:     elfIdent(elf.ELFCLASS64),
+			Type:      uint16(elf.ET_EXEC),
+			Machine:   uint16(elf.EM_X86_64),
+			Version:   uint32(elf.EV_CURRENT),
+			Entry:     l.textAddr + uint64(obj.Entry),
+			Phoff:     elfHeader64Len,
+			Ehsize:    elfHeader64Len,
+			Phentsize: elfProg64Len,
+			Phnum:     2,
+		}
+		textSeg = elf.Prog64{
+			Type:   uint32(elf.PT_LOAD),
+			Flags:  uint32(elf.PF_R | elf.PF_X),
+			Off:    0,
+			Vaddr:  elfBase64,
+			Paddr:  elfBase64,
+			Filesz: uint64(l.textOff + textLen),
+			Memsz:  uint64(l.textOff + textLen),
+			Align:  uint64(pageSize),
+		}
+		dataSeg = elf.Prog64{
+			Type:   uint32(elf.PT_LOAD),
+			Flags:  uint32(elf.PF_R | elf.PF_W),
+			Off:    uint64(l.dataOff),
+			Vaddr:  l.dataAddr,
+			Paddr:  l.dataAddr,
+			Filesz: uint64(l.dataLen),
+			Memsz:  uint64(l.dataLen + obj.Bss),
+			Align:  uint64(pageSize),
+		}
+	} else {
+		l = layoutELF(obj, uint64(elfBase32), elfHeader32Len+2*elfProg32Len)
+		header = elf.Header32{
+			Ident:     elfIdent(elf.ELFCLASS32),
+			Type:      uint16(elf.ET_EXEC),
+			Machine:   uint16(elf.EM_386),
+			Version:   uint32(elf.EV_CURRENT),
+			Entry:     uint32(l.textAddr) + obj.Entry,
+			Phoff:     elfHeader32Len,
+			Ehsize:    elfHeader32Len,
+			Phentsize: elfProg32Len,
+			Phnum:     2,
+		}
+		textSeg = elf.Prog32{
+			Type:   uint32(elf.PT_LOAD),
+			Off:    0,
+			Vaddr:  elfBase32,
+			Paddr:  elfBase32,
+			Filesz: l.textOff + textLen,
+			Memsz:  l.textOff + textLen,
+			Flags:  uint32(elf.PF_R | elf.PF_X),
+			Align:  pageSize,
+		}
+		dataSeg = elf.Prog32{
+			Type:   uint32(elf.PT_LOAD),
+			Off:    l.dataOff,
+			Vaddr:  uint32(l.dataAddr),
+			Paddr:  uint32(l.dataAddr),
+			Filesz: l.dataLen,
+			Memsz:  l.dataLen + obj.Bss,
+			Flags:  uint32(elf.PF_R | elf.PF_W),
+			Align:  pageSize,
+		}
+	}
+
+	// Write output file
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0700)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// Write header and program headers
+	bw := &binaryWriter{w: out, bo: binary.LittleEndian}
+	bw.write(header)
+	bw.write(textSeg)
+	bw.write(dataSeg)
+
+	// Write text and data contents
+	bw.writeAt(obj.Text, int64(l.textOff))
+	bw.writeAt(make([]byte, l.dataLen), int64(l.dataOff))
+	bw.writeAt(obj.Data, int64(l.dataOff))
+
+	return bw.err
+}
@@ -0,0 +1,58 @@
+package linker
+
+import "encoding/binary"
+
+// Format identifies an executable file container format.
+type Format int
+
+const (
+	MachO Format = iota
+	ELF
+)
+
+// Section identifies a section of an object.
+type Section int
+
+const (
+	Text Section = iota
+	Data
+	Bss
+	nsect
+)
+
+// Object is a relocatable object reduced to what the linker needs,
+// independent of any container format.
+type Object struct {
+	Is64 bool // Object holds x86-64 code, otherwise i386 code
+
+	Text   []byte
+	Data   []byte
+	Bss    uint32  // Size of the zero filled bss section
+	Relocs []Reloc // Relocations in the text section
+	Entry  uint32  // Offset of the entry point in the text section
+}
+
+// Reloc is a 32-bit field in the text section referring to a location in
+// one of the object sections.
+type Reloc struct {
+	Off    uint32  // Offset of the field in the text section
+	Sect   Section // Section holding the location
+	Addend uint32  // Offset of the location within Sect
+	PCRel  bool    // Field is relative to the address following it
+}
+
+// relocate patches the text section given the address of each section.
+func (obj *Object) relocate(addr [nsect]uint64) {
+	for _, r := range obj.Relocs {
+		value := addr[r.Sect] + uint64(r.Addend)
+		if r.PCRel {
+			value -= addr[Text] + uint64(r.Off) + 4
+		}
+		binary.LittleEndian.PutUint32(obj.Text[r.Off:], uint32(value))
+	}
+}
+
+// align rounds n up to a multiple of a, a power of two.
+func align(n, a uint32) uint32 {
+	return (n + a - 1) &^ (a - 1)
+}
@@ -13,7 +13,6 @@ usage() {
     echo
     echo "        build     build compiler executable and tools"
     echo "        clean     remove all build and testing artifacts"
-    echo "        deps      download and setup dependencies"
     echo "        release   create release tarball"
     echo "        test      run all tests"
     echo
@@ -25,7 +24,6 @@ if [ $# -eq 0 ] || [ $1 = "-h" ] || [ $1 = "--help" ]; then
 fi
 
 CWD=$(pwd)
-TEMPDIR="$CWD/tmp"
 
 do_build() {
     VERSION=$1
@@ -37,27 +35,6 @@ do_clean() {
     rm -f bin/pl0 bin/vis a.out out1 out2
 }
 
-do_deps() {
-    echo -n "Download Dependencies... "
-    mkdir -p bin $TEMPDIR
-
-    case $(uname -s) in
-        Darwin)
-            NASM="nasm-2.13.03"
-            FILENAME="$NASM-macosx.zip"
-            curl -fsSL https://www.nasm.us/pub/nasm/releasebuilds/2.13.03/macosx/$FILENAME -o $TEMPDIR/$FILENAME
-            cd $TEMPDIR
-                unzip -oq $FILENAME
-                cp $NASM/nasm ../bin/asm
-            cd $CWD
-            ;;
-    esac
-
-    rm -rf $TEMPDIR
-
-    echo "DONE."
-}
-
 do_release() {
     if ! git diff-index --quiet HEAD --; then
         echo "WARNING: working directory not clean"
@@ -72,7 +49,6 @@ do_release() {
     VERSION=$1
 
     do_clean
-    do_deps
     do_build $VERSION
 
     OS=`go env GOOS`
@@ -103,9 +79,6 @@ case "$1" in
     clean)
         do_clean
         ;;
-    deps)
-        do_deps
-        ;;
     release)
         VERSION=$2
         if [ -z "$VERSION" ]; then
@@ -0,0 +1,383 @@
+package pcode
+
+import (
+	"fmt"
+	"strconv"
+
+	"pl0/compiler"
+	"pl0/compiler/ast"
+	"pl0/compiler/token"
+)
+
+// codegen holds the state of the translation of a program.
+type codegen struct {
+	file   *token.File
+	prog   *Program
+	level  int                   // Level of the current block
+	params []int                 // Number of parameters of the enclosing blocks, by level
+	procs  map[*ast.Object]int64 // Addresses of the procedures
+	vars   map[*ast.Object]int64 // Offsets of the variables in their frame
+	top    int64                 // Offset of the next cell above the variables of the current block, and the limits of its FOR loops
+	errors compiler.ErrorList
+}
+
+// Compile resolves and translates a program to P-code. The error, if any,
+// is a compiler.ErrorList.
+func Compile(prog *ast.Program) (*Program, error) {
+	if err := compiler.Resolve(prog); err != nil {
+		return nil, err
+	}
+	g := &codegen{
+		file:   prog.File,
+		prog:   &Program{},
+		params: []int{0},
+		procs:  make(map[*ast.Object]int64),
+		vars:   make(map[*ast.Object]int64),
+	}
+	if g.file != nil {
+		g.prog.Filename = g.file.Name()
+	}
+	g.block("MAIN", prog.Main)
+	if err := g.errors.Err(); err != nil {
+		return nil, err
+	}
+	return g.prog, nil
+}
+
+// error records an error at pos.
+func (g *codegen) error(pos token.Pos, kind compiler.ErrorKind, msg string) {
+	g.errors.Add(g.position(pos), kind, msg)
+}
+
+func (g *codegen) position(pos token.Pos) token.Position {
+	if g.file == nil {
+		return token.Position{}
+	}
+	return g.file.Position(pos)
+}
+
+// emit appends an instruction, and returns its address.
+func (g *codegen) emit(pos token.Pos, op Opcode, l int, a int64) int {
+	p := g.position(pos)
+	g.prog.Code = append(g.prog.Code, Instr{Op: op, L: l, A: a, Line: p.Line, Column: p.Column})
+	return len(g.prog.Code) - 1
+}
+
+// pc returns the address of the next instruction.
+func (g *codegen) pc() int {
+	return len(g.prog.Code)
+}
+
+// addr returns the address of a variable in its frame. The parameters
+// precede the frame, pushed by the caller.
+func (g *codegen) addr(obj *ast.Object) int64 {
+	if obj.Param {
+		return int64(obj.Offset - g.params[obj.Level])
+	}
+	return g.vars[obj]
+}
+
+// index pushes the index of an array element, checked.
+func (g *codegen) index(x *ast.IndexExpr) {
+	g.expr(x.Index)
+	g.emit(x.Index.Pos(), CHK, 0, int64(x.X.Obj.Len))
+}
+
+// assign translates the assignment of the value pushed by value to the
+// variable or array element lhs, whose index is pushed first.
+func (g *codegen) assign(pos token.Pos, lhs ast.Expr, value func()) {
+	if x, ok := lhs.(*ast.IndexExpr); ok {
+		g.index(x)
+		value()
+		obj := x.X.Obj
+		g.emit(pos, STX, g.level-obj.Level, g.addr(obj))
+		return
+	}
+	value()
+	g.store(pos, lhs.(*ast.Ident).Obj)
+}
+
+// load pushes the value of a variable.
+func (g *codegen) load(pos token.Pos, obj *ast.Object) {
+	op := LOD
+	if obj.Ref {
+		op = LDI
+	}
+	g.emit(pos, op, g.level-obj.Level, g.addr(obj))
+}
+
+// result returns the address of the result of the function declaring the
+// block at the given level, reserved by the caller before the arguments.
+func (g *codegen) result(level int) int64 {
+	return int64(-g.params[level] - 1)
+}
+
+// store pops into a variable, or into the result of an enclosing function.
+func (g *codegen) store(pos token.Pos, obj *ast.Object) {
+	if obj.Kind == ast.Func {
+		g.emit(pos, STO, g.level-obj.Level-1, g.result(obj.Level+1))
+		return
+	}
+	op := STO
+	if obj.Ref {
+		op = STI
+	}
+	g.emit(pos, op, g.level-obj.Level, g.addr(obj))
+}
+
+// block translates a block, laying out its variables. A block with
+// procedures starts with a jump over their code to its body.
+func (g *codegen) block(name string, b *ast.Block) {
+	g.prog.Procs = append(g.prog.Procs, Proc{Name: name, Addr: g.pc()})
+	size := int64(3)
+	for _, v := range b.Vars {
+		g.vars[v.Name.Obj] = size
+		if n := v.Name.Obj.Len; n > 0 {
+			size += int64(n) // An array takes a word per element
+		} else {
+			size++
+		}
+	}
+	jmp := -1
+	if len(b.Procs) > 0 {
+		jmp = g.emit(b.Pos(), JMP, 0, 0)
+	}
+	for _, p := range b.Procs {
+		g.procs[p.Name.Obj] = int64(g.pc())
+		g.level++
+		g.params = append(g.params, len(p.Params))
+		g.block(p.Name.Name, p.Block)
+		g.params = g.params[:g.level]
+		g.level--
+	}
+	if jmp >= 0 {
+		g.prog.Code[jmp].A = int64(g.pc())
+	}
+	g.top = size
+	g.emit(b.Pos(), INT, 0, size)
+	g.stmt(b.Body)
+	g.emit(b.End(), OPR, 0, Ret)
+}
+
+func (g *codegen) stmt(s ast.Stmt) {
+	switch s := s.(type) {
+	case nil:
+		// Empty statement
+
+	case *ast.AssignStmt:
+		g.assign(s.TokPos, s.Lhs, func() { g.expr(s.Rhs) })
+
+	case *ast.CallStmt:
+		g.call(s.Pos(), s.Proc.Obj, s.Args)
+
+	case *ast.ReturnStmt:
+		g.expr(s.X)
+		g.emit(s.Pos(), STO, 0, g.result(g.level))
+		g.emit(s.Pos(), OPR, 0, Ret)
+
+	case *ast.SendStmt:
+		g.expr(s.X)
+		g.emit(s.Pos(), OPR, 0, Print)
+
+	case *ast.ReceiveStmt:
+		g.assign(s.Pos(), s.X, func() { g.emit(s.Pos(), OPR, 0, Input) })
+
+	case *ast.BeginStmt:
+		for _, s := range s.List {
+			g.stmt(s)
+		}
+
+	case *ast.IfStmt:
+		g.cond(s.Cond)
+		jpc := g.emit(s.Then, JPC, 0, 0)
+		g.stmt(s.Body)
+		if s.Else != nil {
+			jmp := g.emit(s.ElsePos, JMP, 0, 0)
+			g.prog.Code[jpc].A = int64(g.pc())
+			g.stmt(s.Else)
+			jpc = jmp
+		}
+		g.prog.Code[jpc].A = int64(g.pc())
+
+	case *ast.WhileStmt:
+		loop := g.pc()
+		g.cond(s.Cond)
+		jpc := g.emit(s.Do, JPC, 0, 0)
+		g.stmt(s.Body)
+		g.emit(s.Pos(), JMP, 0, int64(loop))
+		g.prog.Code[jpc].A = int64(g.pc())
+
+	case *ast.RepeatStmt:
+		loop := g.pc()
+		for _, s := range s.List {
+			g.stmt(s)
+		}
+		g.cond(s.Cond)
+		g.emit(s.Until, JPC, 0, int64(loop))
+
+	case *ast.ForStmt:
+		g.loop(s)
+
+	default:
+		panic(fmt.Sprintf("unsupported statement: %T", s))
+	}
+}
+
+// loop translates a FOR loop. Its limit is kept in a cell pushed above the
+// variables of the frame, and the limits of the enclosing loops. The loop
+// is left when the variable reaches the limit, before stepping it.
+func (g *codegen) loop(s *ast.ForStmt) {
+	enter, more, step := int64(Leq), int64(Lss), int64(Add)
+	if s.Dir == token.DOWNTO {
+		enter, more, step = Geq, Gtr, Sub
+	}
+	obj, limit := s.Var.Obj, g.top
+	g.top++
+	g.emit(s.Pos(), INT, 0, 1)
+	g.expr(s.From)
+	g.expr(s.Limit)
+	g.emit(s.DirPos, STO, 0, limit)
+	g.store(s.TokPos, obj)
+
+	g.load(s.Var.Pos(), obj)
+	g.emit(s.DirPos, LOD, 0, limit)
+	g.emit(s.DirPos, OPR, 0, enter)
+	enterJpc := g.emit(s.Do, JPC, 0, 0)
+	body := g.pc()
+	g.stmt(s.Body)
+	g.load(s.Var.Pos(), obj)
+	g.emit(s.DirPos, LOD, 0, limit)
+	g.emit(s.DirPos, OPR, 0, more)
+	moreJpc := g.emit(s.Do, JPC, 0, 0)
+	g.load(s.Var.Pos(), obj)
+	g.emit(s.DirPos, LIT, 0, 1)
+	g.emit(s.DirPos, OPR, 0, step)
+	g.store(s.TokPos, obj)
+	g.emit(s.Pos(), JMP, 0, int64(body))
+	g.prog.Code[enterJpc].A = int64(g.pc())
+	g.prog.Code[moreJpc].A = int64(g.pc())
+	g.emit(s.Pos(), INT, 0, -1)
+	g.top--
+}
+
+// call calls a procedure or function with the given arguments. The result
+// of a function is left on the stack.
+func (g *codegen) call(pos token.Pos, obj *ast.Object, args []ast.Expr) {
+	if obj.Kind == ast.Func {
+		g.emit(pos, INT, 0, 1)
+	}
+	for i, p := range obj.Proc.Params {
+		x := args[i]
+		if !p.Var.IsValid() {
+			g.expr(x)
+			continue
+		}
+		// The address of the array element, of the variable, or the one
+		// held by a VAR parameter
+		if e, ok := x.(*ast.IndexExpr); ok {
+			g.index(e)
+			g.emit(x.Pos(), LDA, g.level-e.X.Obj.Level, g.addr(e.X.Obj))
+			g.emit(x.Pos(), OPR, 0, Add)
+			continue
+		}
+		arg := x.(*ast.Ident).Obj
+		op := LDA
+		if arg.Ref {
+			op = LOD
+		}
+		g.emit(x.Pos(), op, g.level-arg.Level, g.addr(arg))
+	}
+	g.emit(pos, CAL, g.level-obj.Level, g.procs[obj])
+	if n := len(args); n > 0 {
+		g.emit(pos, INT, 0, int64(-n))
+	}
+}
+
+var relations = map[token.Token]int64{
+	token.EQL: Eql,
+	token.NEQ: Neq,
+	token.LSS: Lss,
+	token.LEQ: Leq,
+	token.GRT: Gtr,
+	token.GEQ: Geq,
+}
+
+func (g *codegen) cond(c ast.Cond) {
+	switch c := c.(type) {
+	case *ast.OddCond:
+		g.expr(c.X)
+		g.emit(c.Odd, OPR, 0, Odd)
+
+	case *ast.RelCond:
+		g.expr(c.X)
+		g.expr(c.Y)
+		op, ok := relations[c.Op]
+		if !ok {
+			panic(fmt.Sprintf("unsupported relation operator: %q", c.Op))
+		}
+		g.emit(c.OpPos, OPR, 0, op)
+
+	default:
+		panic(fmt.Sprintf("unsupported condition: %T", c))
+	}
+}
+
+var operations = map[token.Token]int64{
+	token.PLUS:  Add,
+	token.MINUS: Sub,
+	token.TIMES: Mul,
+	token.DIV:   Div,
+}
+
+func (g *codegen) expr(x ast.Expr) {
+	switch x := x.(type) {
+	case *ast.Number:
+		g.emit(x.Pos(), LIT, 0, g.number(x))
+
+	case *ast.Ident:
+		switch obj := x.Obj; obj.Kind {
+		case ast.Con:
+			g.emit(x.Pos(), LIT, 0, obj.Value)
+		case ast.Var:
+			g.load(x.Pos(), obj)
+		}
+
+	case *ast.UnaryExpr:
+		g.expr(x.X)
+		switch x.Op {
+		case token.PLUS: // Noop case
+		case token.MINUS:
+			g.emit(x.OpPos, OPR, 0, Neg)
+		default:
+			panic(fmt.Sprintf("unsupported unary operator: %q", x.Op))
+		}
+
+	case *ast.BinaryExpr:
+		g.expr(x.X)
+		g.expr(x.Y)
+		op, ok := operations[x.Op]
+		if !ok {
+			panic(fmt.Sprintf("unsupported binary operator: %q", x.Op))
+		}
+		g.emit(x.OpPos, OPR, 0, op)
+
+	case *ast.IndexExpr:
+		g.index(x)
+		obj := x.X.Obj
+		g.emit(x.Pos(), LDX, g.level-obj.Level, g.addr(obj))
+
+	case *ast.CallExpr:
+		g.call(x.Pos(), x.Func.Obj, x.Args)
+
+	default:
+		panic(fmt.Sprintf("unsupported expression: %T", x))
+	}
+}
+
+func (g *codegen) number(n *ast.Number) int64 {
+	v, err := strconv.ParseInt(n.Value, 10, 64)
+	if err != nil {
+		g.error(n.Pos(), compiler.SyntaxError, "number "+n.Value+" out of range")
+	}
+	return v
+}
@@ -0,0 +1,35 @@
+package pcode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Disassemble writes a listing of the program, one instruction per line,
+// with the procedure entry points as labels. Each line shows the address,
+// the instruction, and as a comment the source position along with the
+// name of the operation of an OPR instruction.
+func Disassemble(w io.Writer, p *Program) error {
+	labels := make(map[int][]string)
+	for _, proc := range p.Procs {
+		labels[proc.Addr] = append(labels[proc.Addr], proc.Name)
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "; %s\n", p.Filename)
+	for addr, i := range p.Code {
+		for _, name := range labels[addr] {
+			fmt.Fprintf(bw, "%s:\n", name)
+		}
+		fmt.Fprintf(bw, "%5d  %-14v ;", addr, i)
+		if i.Line > 0 {
+			fmt.Fprintf(bw, " %d:%d", i.Line, i.Column)
+		}
+		if i.Op == OPR {
+			fmt.Fprintf(bw, " %s", operationNames[i.A])
+		}
+		fmt.Fprintln(bw)
+	}
+	return bw.Flush()
+}
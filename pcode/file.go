@@ -0,0 +1,190 @@
+package pcode
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The .p0c file format stores a program as a header followed by sections
+// of unsigned (u) and signed (s) varints:
+//
+//	magic    "P0C" followed by the version byte
+//	filename u length, bytes
+//	procs    u count, then for each: u length, name bytes, u address
+//	code     u count, then for each: opcode byte, u L, s A, u line, u column
+//
+// Version 2 adds the instructions of parameters: LDA, LDI, STI, and INT
+// freeing cells. Version 3 adds the instructions of arrays: CHK, LDX and
+// STX.
+const (
+	magic   = "P0C"
+	version = 3
+)
+
+// Limits on the sections of a file, guarding against corrupt input.
+const (
+	maxString = 1 << 12
+	maxCount  = 1 << 24
+)
+
+// ErrFormat is returned when reading a file not in the .p0c format.
+var ErrFormat = errors.New("not a p0c file")
+
+// Write writes a program in the .p0c format.
+func Write(w io.Writer, p *Program) error {
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, binary.MaxVarintLen64)
+	uvarint := func(v uint64) {
+		bw.Write(buf[:binary.PutUvarint(buf, v)])
+	}
+	str := func(s string) {
+		uvarint(uint64(len(s)))
+		bw.WriteString(s)
+	}
+
+	bw.WriteString(magic)
+	bw.WriteByte(version)
+	str(p.Filename)
+	uvarint(uint64(len(p.Procs)))
+	for _, proc := range p.Procs {
+		str(proc.Name)
+		uvarint(uint64(proc.Addr))
+	}
+	uvarint(uint64(len(p.Code)))
+	for _, i := range p.Code {
+		bw.WriteByte(byte(i.Op))
+		uvarint(uint64(i.L))
+		bw.Write(buf[:binary.PutVarint(buf, i.A)])
+		uvarint(uint64(i.Line))
+		uvarint(uint64(i.Column))
+	}
+	return bw.Flush()
+}
+
+// reader decodes a file, keeping the first error.
+type reader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (r *reader) fail(err error) {
+	if r.err == nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		r.err = err
+	}
+}
+
+func (r *reader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	b, err := r.r.ReadByte()
+	r.fail(err)
+	return b
+}
+
+func (r *reader) uvarint(max uint64) uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(r.r)
+	r.fail(err)
+	if v > max {
+		r.fail(fmt.Errorf("p0c: value %d out of range", v))
+		return 0
+	}
+	return v
+}
+
+func (r *reader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(r.r)
+	r.fail(err)
+	return v
+}
+
+func (r *reader) string() string {
+	n := r.uvarint(maxString)
+	if r.err != nil {
+		return ""
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r.r, b)
+	r.fail(err)
+	return string(b)
+}
+
+// Read reads a program in the .p0c format, and checks its instructions
+// are well formed.
+func Read(rd io.Reader) (*Program, error) {
+	r := &reader{r: bufio.NewReader(rd)}
+	var hdr [len(magic) + 1]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil || string(hdr[:len(magic)]) != magic {
+		return nil, ErrFormat
+	}
+	if v := hdr[len(magic)]; v < 1 || v > version {
+		return nil, fmt.Errorf("p0c: unsupported version %d", hdr[len(magic)])
+	}
+
+	p := &Program{Filename: r.string()}
+	n := r.uvarint(maxCount)
+	for k := uint64(0); k < n && r.err == nil; k++ {
+		name := r.string()
+		addr := r.uvarint(maxCount)
+		p.Procs = append(p.Procs, Proc{Name: name, Addr: int(addr)})
+	}
+	n = r.uvarint(maxCount)
+	for k := uint64(0); k < n && r.err == nil; k++ {
+		var i Instr
+		i.Op = Opcode(r.byte())
+		i.L = int(r.uvarint(maxCount))
+		i.A = r.varint()
+		i.Line = int(r.uvarint(maxCount))
+		i.Column = int(r.uvarint(maxCount))
+		p.Code = append(p.Code, i)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// check reports the first malformed instruction of the program.
+func (p *Program) check() error {
+	for addr, i := range p.Code {
+		var bad bool
+		switch i.Op {
+		case OPR:
+			_, ok := operationNames[i.A]
+			bad = !ok
+		case CAL, JMP, JPC:
+			bad = i.A < 0 || i.A >= int64(len(p.Code))
+		case INT:
+			bad = i.A < -maxCount || i.A > maxCount
+		case CHK:
+			bad = i.A < 1 || i.A > maxCount
+		case LIT, LOD, STO, LDA, LDI, STI, LDX, STX:
+		default:
+			bad = true
+		}
+		if bad {
+			return fmt.Errorf("p0c: invalid instruction %v at %d", i, addr)
+		}
+	}
+	for _, proc := range p.Procs {
+		if proc.Addr >= len(p.Code) {
+			return fmt.Errorf("p0c: invalid address %d of procedure %s", proc.Addr, proc.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Package pcode implements the stack machine of Wirth's PL/0 compiler: its
+// instruction set, a compiler from the abstract syntax tree, a file format
+// for compiled programs, a disassembler and a virtual machine.
+//
+// Each procedure activation has a frame on the stack, starting with three
+// cells: the static link (SL) to the frame of the lexically enclosing
+// procedure, the dynamic link (DL) to the frame of the caller, and the
+// return address (RA). The variables of the procedure follow, with the
+// elements of an array in order, indexed by a cell popped from the stack
+// and checked against its length beforehand, then the limit of each FOR
+// loop running, pushed when it starts. The arguments of a call are pushed
+// by the caller before its frame, and popped after the return: the
+// parameters are at negative offsets from the frame. A VAR parameter holds
+// the address of the variable passed to it. The caller of a function
+// reserves a cell for its result before the arguments, left on top of the
+// stack once they are popped.
+package pcode
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Opcode is the operation code of an instruction.
+type Opcode uint8
+
+const (
+	LIT Opcode = iota // Push the constant A
+	OPR               // Perform the operation A
+	LOD               // Push the variable at offset A of the frame L levels out
+	STO               // Pop into the variable at offset A of the frame L levels out
+	CAL               // Call the procedure at A, declared L levels out
+	INT               // Allocate A cells on the stack, or free -A cells
+	JMP               // Jump to A
+	JPC               // Pop, and jump to A if zero
+	LDA               // Push the address of the variable at offset A of the frame L levels out
+	LDI               // Push the cell addressed by the variable at offset A of the frame L levels out
+	STI               // Pop into the cell addressed by the variable at offset A of the frame L levels out
+	CHK               // Check the top of the stack is an index from 0 to A-1
+	LDX               // Pop i, push the variable at offset A+i of the frame L levels out
+	STX               // Pop x and i, store x into the variable at offset A+i of the frame L levels out
+
+	numOpcodes
+)
+
+var opcodeNames = [...]string{
+	LIT: "LIT",
+	OPR: "OPR",
+	LOD: "LOD",
+	STO: "STO",
+	CAL: "CAL",
+	INT: "INT",
+	JMP: "JMP",
+	JPC: "JPC",
+	LDA: "LDA",
+	LDI: "LDI",
+	STI: "STI",
+	CHK: "CHK",
+	LDX: "LDX",
+	STX: "STX",
+}
+
+func (op Opcode) String() string {
+	if op < numOpcodes {
+		return opcodeNames[op]
+	}
+	return "opcode(" + strconv.Itoa(int(op)) + ")"
+}
+
+// Operations of the OPR instruction, given by its A field. The numbering
+// follows Wirth, with print and input added.
+const (
+	Ret   = 0  // Return from procedure
+	Neg   = 1  // Negate the top of the stack
+	Add   = 2  // Pop y and x, push x + y
+	Sub   = 3  // Pop y and x, push x - y
+	Mul   = 4  // Pop y and x, push x * y
+	Div   = 5  // Pop y and x, push x / y
+	Odd   = 6  // Replace the top of the stack with its parity
+	Eql   = 8  // Pop y and x, push x = y
+	Neq   = 9  // Pop y and x, push x # y
+	Lss   = 10 // Pop y and x, push x < y
+	Geq   = 11 // Pop y and x, push x >= y
+	Gtr   = 12 // Pop y and x, push x > y
+	Leq   = 13 // Pop y and x, push x <= y
+	Print = 14 // Pop and print a number
+	Input = 15 // Read and push a number
+)
+
+var operationNames = map[int64]string{
+	Ret:   "ret",
+	Neg:   "neg",
+	Add:   "add",
+	Sub:   "sub",
+	Mul:   "mul",
+	Div:   "div",
+	Odd:   "odd",
+	Eql:   "eql",
+	Neq:   "neq",
+	Lss:   "lss",
+	Geq:   "geq",
+	Gtr:   "gtr",
+	Leq:   "leq",
+	Print: "print",
+	Input: "input",
+}
+
+// Instr is a single instruction.
+type Instr struct {
+	Op Opcode
+	L  int   // Level difference
+	A  int64 // Address, value or operation
+
+	Line, Column int // Source position, or 0 if unknown
+}
+
+func (i Instr) String() string {
+	return fmt.Sprintf("%s %d, %d", i.Op, i.L, i.A)
+}
+
+// Proc records the entry point of a procedure, for the disassembler.
+type Proc struct {
+	Name string
+	Addr int
+}
+
+// Program is a compiled program. It starts at address 0, and stops when
+// the main block returns to address 0.
+type Program struct {
+	Filename string  // Source file name, used in error positions
+	Code     []Instr // Instructions
+	Procs    []Proc  // Procedures, including the main block
+}
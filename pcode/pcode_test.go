@@ -0,0 +1,273 @@
+package pcode
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"pl0/compiler"
+)
+
+var outputRE = regexp.MustCompile(`\{\s*Output:([^}]*)\}`)
+
+func compile(t *testing.T, filename, src string) *Program {
+	prog, err := compiler.Parse(filename, strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	p, err := Compile(prog)
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	return p
+}
+
+// TestPrograms compiles the test programs, writes and reads them back in
+// the .p0c format, and runs them, comparing their output with the expected
+// output noted in their { Output: ... } comments.
+func TestPrograms(t *testing.T) {
+	files, err := filepath.Glob("../test/t.*.pl0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no test programs found")
+	}
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []string
+		for _, m := range outputRE.FindAllSubmatch(src, -1) {
+			want = append(want, strings.Fields(string(m[1]))...)
+		}
+		p := compile(t, file, string(src))
+
+		var buf bytes.Buffer
+		if err := Write(&buf, p); err != nil {
+			t.Fatalf("%s: Write: %v", file, err)
+		}
+		p, err = Read(&buf)
+		if err != nil {
+			t.Errorf("%s: Read: %v", file, err)
+			continue
+		}
+
+		var out bytes.Buffer
+		if err := Run(p, strings.NewReader(""), &out); err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		got := strings.Fields(out.String())
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: got %v, want %v", file, got, want)
+		}
+	}
+}
+
+func TestInput(t *testing.T) {
+	p := compile(t, "test.pl0", `
+VAR a, b;
+BEGIN
+	? a; ? b;
+	! a - b;
+	! a / b
+END.`)
+	var out bytes.Buffer
+	if err := Run(p, strings.NewReader("-7\n2\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "-9\n-3\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStep(t *testing.T) {
+	p := compile(t, "test.pl0", `
+VAR x;
+PROCEDURE p;
+	VAR y;
+BEGIN y := x; x := y + 1 END;
+BEGIN x := 41; CALL p END.`)
+	vm := NewVM(p, strings.NewReader(""), ioutil.Discard)
+	var steps int
+	var called bool
+	for !vm.Halted() {
+		if err := vm.Step(); err != nil {
+			t.Fatal(err)
+		}
+		steps++
+		if vm.B > 0 {
+			// Inside p: the static link is the frame of the main block
+			if sl := vm.Stack[vm.B]; sl != 0 {
+				t.Errorf("static link of p: got %d, want 0", sl)
+			}
+			called = true
+		}
+	}
+	if !called {
+		t.Error("p was not called")
+	}
+	if got := vm.Stack[3]; got != 42 {
+		t.Errorf("x: got %d, want 42", got)
+	}
+	if steps != 14 {
+		t.Errorf("got %d steps, want 14", steps)
+	}
+	if err := vm.Step(); err != nil || !vm.Halted() {
+		t.Errorf("Step after halt: %v, halted %v", err, vm.Halted())
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	p := compile(t, "test.pl0", `VAR x;
+PROCEDURE p; x := -x;
+BEGIN ? x; IF ODD x THEN CALL p; ! x END.`)
+	var out bytes.Buffer
+	if err := Disassemble(&out, p); err != nil {
+		t.Fatal(err)
+	}
+	want := `; test.pl0
+MAIN:
+    0  JMP 0, 6       ; 1:1
+p:
+    1  INT 0, 3       ; 2:14
+    2  LOD 1, 3       ; 2:20
+    3  OPR 0, 1       ; 2:19 neg
+    4  STO 1, 3       ; 2:16
+    5  OPR 0, 0       ; 2:21 ret
+    6  INT 0, 4       ; 1:1
+    7  OPR 0, 15      ; 3:7 input
+    8  STO 0, 3       ; 3:7
+    9  LOD 0, 3       ; 3:19
+   10  OPR 0, 6       ; 3:15 odd
+   11  JPC 0, 13      ; 3:21
+   12  CAL 0, 1       ; 3:26
+   13  LOD 0, 3       ; 3:36
+   14  OPR 0, 14      ; 3:34 print
+   15  OPR 0, 0       ; 3:41 ret
+`
+	if got := out.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestDisassembleParams(t *testing.T) {
+	p := compile(t, "test.pl0", `VAR x;
+PROCEDURE p(a; VAR r); r := r + a;
+CALL p(2, x).`)
+	var out bytes.Buffer
+	if err := Disassemble(&out, p); err != nil {
+		t.Fatal(err)
+	}
+	want := `; test.pl0
+MAIN:
+    0  JMP 0, 7       ; 1:1
+p:
+    1  INT 0, 3       ; 2:24
+    2  LDI 0, -1      ; 2:29
+    3  LOD 0, -2      ; 2:33
+    4  OPR 0, 2       ; 2:31 add
+    5  STI 0, -1      ; 2:26
+    6  OPR 0, 0       ; 2:34 ret
+    7  INT 0, 4       ; 1:1
+    8  LIT 0, 2       ; 3:8
+    9  LDA 0, 3       ; 3:11
+   10  CAL 0, 1       ; 3:1
+   11  INT 0, -2      ; 3:1
+   12  OPR 0, 0       ; 3:13 ret
+`
+	if got := out.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"! y.", []string{"test.pl0:1:3: undefined identifier y"}},
+		{"CONST c = 1; VAR c; c := 2.", []string{
+			"test.pl0:1:18: duplicate identifier c",
+			"test.pl0:1:21: cannot assign to c (kind CONST)",
+		}},
+		{"VAR x; PROCEDURE p; ; BEGIN ! p; CALL x END.", []string{
+			"test.pl0:1:31: cannot use p (kind PROCEDURE) in expression",
+			"test.pl0:1:39: cannot call non-procedure x (kind VAR)",
+		}},
+	}
+	for _, tt := range tests {
+		prog, err := compiler.Parse("test.pl0", strings.NewReader(tt.src))
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.src, err)
+		}
+		_, err = Compile(prog)
+		list, ok := err.(compiler.ErrorList)
+		if !ok {
+			t.Errorf("%q: got %v, want an ErrorList", tt.src, err)
+			continue
+		}
+		var got []string
+		for _, e := range list {
+			got = append(got, e.Error())
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%q: got %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	tests := []struct {
+		src, in, want string
+	}{
+		{"VAR x; BEGIN x := 0; ! 1 / x END.", "", "test.pl0:1:26: division by zero"},
+		{"VAR x; ? x.", "abc\n", "test.pl0:1:8: invalid input number"},
+		{"VAR x; ? x.", "", "test.pl0:1:8: unexpected end of input"},
+		{"PROCEDURE p; CALL p; CALL p.", "", "test.pl0:1:14: stack overflow"},
+		{"VAR a[2], i; BEGIN i := 2; a[i] := 1 END.", "", "test.pl0:1:30: index 2 out of range [0:2]"},
+		{"VAR a[2], i; ? a[i - 1].", "1\n", "test.pl0:1:18: index -1 out of range [0:2]"},
+	}
+	for _, tt := range tests {
+		p := compile(t, "test.pl0", tt.src)
+		err := Run(p, strings.NewReader(tt.in), ioutil.Discard)
+		if err == nil {
+			t.Errorf("%q: no error, want %q", tt.src, tt.want)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.src, err, tt.want)
+		}
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	var buf bytes.Buffer
+	p := compile(t, "test.pl0", "VAR x; WHILE x < 3 DO x := x + 1.")
+	if err := Write(&buf, p); err != nil {
+		t.Fatal(err)
+	}
+	good := buf.Bytes()
+
+	if _, err := Read(strings.NewReader("#!/bin/sh\n")); err != ErrFormat {
+		t.Errorf("bad magic: got %v, want %v", err, ErrFormat)
+	}
+	if _, err := Read(bytes.NewReader(good[:len(good)-3])); err == nil {
+		t.Error("truncated file: no error")
+	}
+
+	// Make the final jump go past the end of the code
+	p.Code[len(p.Code)-2].A = 100
+	buf.Reset()
+	if err := Write(&buf, p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Read(&buf); err == nil || !strings.Contains(err.Error(), "invalid instruction") {
+		t.Errorf("bad jump: got %v, want invalid instruction", err)
+	}
+}
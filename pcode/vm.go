@@ -0,0 +1,377 @@
+package pcode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"pl0/compiler/token"
+)
+
+// MaxStack is the maximum number of cells on the stack of a VM.
+const MaxStack = 1 << 20
+
+// An Error describes a problem found while running a program.
+type Error struct {
+	Pos token.Position
+	PC  int // Address of the failing instruction
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return e.Pos.String() + ": " + e.Msg
+}
+
+// VM is a virtual machine running a program. Its registers and stack are
+// exported, so that a program can be run one instruction at a time and
+// inspected between steps.
+type VM struct {
+	Prog  *Program
+	P     int     // Program register: address of the next instruction
+	B     int     // Base register: frame of the current procedure
+	T     int     // Top register: top of the stack, or -1 if empty
+	Stack []int64 // Stack cells; only Stack[:T+1] are in use
+
+	// Trace, if not nil, receives each instruction along with the stack
+	// before it is executed.
+	Trace io.Writer
+
+	in     *bufio.Reader
+	out    io.Writer
+	halted bool
+}
+
+// NewVM returns a virtual machine ready to run prog, reading the input of
+// ? statements from in and writing the output of ! statements to out.
+func NewVM(prog *Program, in io.Reader, out io.Writer) *VM {
+	vm := &VM{Prog: prog, in: bufio.NewReader(in), out: out}
+	vm.Reset()
+	return vm
+}
+
+// Reset prepares the VM to run the program from the start. The frame of
+// the main block is at the bottom of the stack, with zero links.
+func (vm *VM) Reset() {
+	vm.P, vm.B, vm.T = 0, 0, -1
+	vm.Stack = append(vm.Stack[:0], 0, 0, 0)
+	vm.halted = false
+}
+
+// Run runs the program to completion.
+func Run(prog *Program, in io.Reader, out io.Writer) error {
+	return NewVM(prog, in, out).Run()
+}
+
+// Run runs the program until it stops, or fails.
+func (vm *VM) Run() error {
+	for !vm.halted {
+		if err := vm.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Halted reports whether the program has stopped.
+func (vm *VM) Halted() bool {
+	return vm.halted
+}
+
+// errorf returns an error at the instruction at pc.
+func (vm *VM) errorf(pc int, format string, args ...interface{}) error {
+	pos := token.Position{Filename: vm.Prog.Filename}
+	if pc >= 0 && pc < len(vm.Prog.Code) {
+		pos.Line, pos.Column = vm.Prog.Code[pc].Line, vm.Prog.Code[pc].Column
+	}
+	return &Error{Pos: pos, PC: pc, Msg: fmt.Sprintf(format, args...)}
+}
+
+// base returns the frame l levels out of the current one, following the
+// static links.
+func (vm *VM) base(l int) int {
+	b := vm.B
+	for ; l > 0 && b >= 0 && b <= vm.T; l-- {
+		b = int(vm.Stack[b])
+	}
+	return b
+}
+
+// reserve makes room on the stack for cells up to t.
+func (vm *VM) reserve(pc, t int) error {
+	if t >= MaxStack {
+		return vm.errorf(pc, "stack overflow")
+	}
+	for len(vm.Stack) <= t {
+		vm.Stack = append(vm.Stack, 0)
+	}
+	return nil
+}
+
+// grow sets the top of the stack to t. New cells are zeroed, except the
+// links of the current frame, stored by CAL above the top of the stack.
+func (vm *VM) grow(pc, t int) error {
+	if err := vm.reserve(pc, t); err != nil {
+		return err
+	}
+	i := vm.T + 1
+	if i < vm.B+3 {
+		i = vm.B + 3
+	}
+	for ; i <= t; i++ {
+		vm.Stack[i] = 0
+	}
+	vm.T = t
+	return nil
+}
+
+// Step executes a single instruction. It does nothing once the program has
+// stopped.
+func (vm *VM) Step() error {
+	if vm.halted {
+		return nil
+	}
+	pc := vm.P
+	if pc < 0 || pc >= len(vm.Prog.Code) {
+		return vm.errorf(pc, "invalid address %d", pc)
+	}
+	i := vm.Prog.Code[pc]
+	if vm.Trace != nil {
+		vm.trace(pc, i)
+	}
+	vm.P++
+
+	// Check operands are on the stack, and frame references are valid
+	need := 0
+	switch i.Op {
+	case OPR:
+		switch i.A {
+		case Ret, Input:
+		case Neg, Odd, Print:
+			need = 1
+		default:
+			need = 2
+		}
+	case STO, STI, JPC, CHK, LDX:
+		need = 1
+	case STX:
+		need = 2
+	case INT:
+		need = int(-i.A)
+	}
+	if vm.T+1 < need {
+		return vm.errorf(pc, "stack underflow")
+	}
+	var addr int
+	switch i.Op {
+	case LOD, STO, CAL, LDA, LDI, STI, LDX, STX:
+		b := vm.base(i.L)
+		addr = b + int(i.A)
+		if b < 0 || b > vm.T || i.Op != CAL && (addr < 0 || addr > vm.T) {
+			return vm.errorf(pc, "invalid frame reference %v", i)
+		}
+		if i.Op == LDX || i.Op == STX {
+			// The index is on top, or below the value stored
+			x := vm.Stack[vm.T-need+1]
+			if x < 0 || x > int64(vm.T-addr) {
+				return vm.errorf(pc, "invalid address %d", int64(addr)+x)
+			}
+			addr += int(x)
+		}
+		if i.Op == CAL {
+			addr = b
+		}
+		if i.Op == LDI || i.Op == STI {
+			addr = int(vm.Stack[addr])
+			if addr < 0 || addr > vm.T {
+				return vm.errorf(pc, "invalid address %d", addr)
+			}
+		}
+	}
+
+	s := vm.Stack
+	switch i.Op {
+	case LIT:
+		if err := vm.grow(pc, vm.T+1); err != nil {
+			return err
+		}
+		vm.Stack[vm.T] = i.A
+
+	case OPR:
+		return vm.operation(pc, i.A)
+
+	case LOD, LDI:
+		if err := vm.grow(pc, vm.T+1); err != nil {
+			return err
+		}
+		vm.Stack[vm.T] = vm.Stack[addr]
+
+	case LDA:
+		if err := vm.grow(pc, vm.T+1); err != nil {
+			return err
+		}
+		vm.Stack[vm.T] = int64(addr)
+
+	case STO, STI:
+		s[addr] = s[vm.T]
+		vm.T--
+
+	case CHK:
+		if x := s[vm.T]; x < 0 || x >= i.A {
+			return vm.errorf(pc, "index %d out of range [0:%d]", x, i.A)
+		}
+
+	case LDX:
+		s[vm.T] = s[addr]
+
+	case STX:
+		s[addr] = s[vm.T]
+		vm.T -= 2
+
+	case CAL:
+		t := vm.T
+		if err := vm.reserve(pc, t+3); err != nil {
+			return err
+		}
+		vm.Stack[t+1] = int64(addr) // Static link
+		vm.Stack[t+2] = int64(vm.B) // Dynamic link
+		vm.Stack[t+3] = int64(vm.P) // Return address
+		vm.B = t + 1
+		vm.P = int(i.A)
+
+	case INT:
+		if err := vm.grow(pc, vm.T+int(i.A)); err != nil {
+			return err
+		}
+
+	case JMP:
+		vm.P = int(i.A)
+
+	case JPC:
+		if s[vm.T] == 0 {
+			vm.P = int(i.A)
+		}
+		vm.T--
+
+	default:
+		return vm.errorf(pc, "invalid instruction %v", i)
+	}
+	vm.halted = vm.P == 0
+	return nil
+}
+
+// operation performs operation op of the OPR instruction at pc.
+func (vm *VM) operation(pc int, op int64) error {
+	s, t := vm.Stack, vm.T
+	switch op {
+	case Ret:
+		if vm.B+2 > vm.T {
+			return vm.errorf(pc, "stack underflow")
+		}
+		vm.T = vm.B - 1
+		vm.P = int(s[vm.B+2])
+		vm.B = int(s[vm.B+1])
+		vm.halted = vm.P == 0
+		return nil
+
+	case Neg:
+		s[t] = -s[t]
+
+	case Odd:
+		s[t] &= 1
+
+	case Print:
+		vm.T--
+		if _, err := fmt.Fprintln(vm.out, s[t]); err != nil {
+			return err
+		}
+
+	case Input:
+		v, err := vm.read(pc)
+		if err != nil {
+			return err
+		}
+		if err := vm.grow(pc, t+1); err != nil {
+			return err
+		}
+		vm.Stack[t+1] = v
+
+	default:
+		x, y := s[t-1], s[t]
+		var v int64
+		switch op {
+		case Add:
+			v = x + y
+		case Sub:
+			v = x - y
+		case Mul:
+			v = x * y
+		case Div:
+			if y == 0 {
+				return vm.errorf(pc, "division by zero")
+			}
+			v = x / y
+		case Eql:
+			v = bool2int(x == y)
+		case Neq:
+			v = bool2int(x != y)
+		case Lss:
+			v = bool2int(x < y)
+		case Geq:
+			v = bool2int(x >= y)
+		case Gtr:
+			v = bool2int(x > y)
+		case Leq:
+			v = bool2int(x <= y)
+		default:
+			return vm.errorf(pc, "invalid operation %d", op)
+		}
+		vm.T--
+		s[vm.T] = v
+	}
+	return nil
+}
+
+func bool2int(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// read reads a line holding a number from the input.
+func (vm *VM) read(pc int) (int64, error) {
+	line, err := vm.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		if err == io.EOF {
+			return 0, vm.errorf(pc, "unexpected end of input")
+		}
+		return 0, vm.errorf(pc, "%v", err)
+	}
+	v, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+	if err != nil {
+		return 0, vm.errorf(pc, "invalid input number")
+	}
+	return v, nil
+}
+
+// trace writes the instruction at pc and the stack, marking the frames.
+func (vm *VM) trace(pc int, i Instr) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%5d  %-12v", pc, i)
+	if i.Op == OPR {
+		fmt.Fprintf(&b, " %-6s", operationNames[i.A])
+	} else {
+		b.WriteString("       ")
+	}
+	b.WriteString(" [")
+	for k := 0; k <= vm.T && k < len(vm.Stack); k++ {
+		if k == vm.B {
+			b.WriteString(" |")
+		}
+		fmt.Fprintf(&b, " %d", vm.Stack[k])
+	}
+	b.WriteString(" ]\n")
+	io.WriteString(vm.Trace, b.String())
+}
@@ -0,0 +1,625 @@
+package wasm
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"pl0/compiler"
+	"pl0/compiler/ast"
+	"pl0/compiler/token"
+)
+
+// Type indices
+const (
+	printType  = iota // (i64) -> ()
+	readType          // () -> (i64)
+	boundsType        // (i32) -> ()
+	mainType          // () -> ()
+	procTypes         // (i32, ...) -> ([i64]): the procedures and functions, by signature
+)
+
+// Function indices of the imports, and of the main block
+const (
+	printFunc = iota
+	readFunc
+	boundsFunc
+	mainFunc
+)
+
+// Memory layout
+const (
+	memoryPages = 16 // Initial size of the memory, in 64 KiB pages
+	linkSize    = 8  // Size of the static link in a frame, padded
+	wordSize    = 8  // Size of a variable
+	unrolled    = 16 // Maximum number of variables zeroed by unrolled stores
+)
+
+// codegen holds the state of the translation of a program.
+type codegen struct {
+	file   *token.File
+	level  int                    // Level of the current block
+	params []int                  // Number of parameters of the enclosing blocks, by level
+	result []uint32               // Offset of the result of the enclosing blocks, by level; 0 for a procedure
+	funcs  map[*ast.Object]uint32 // Function indices of the procedures
+	slots  map[*ast.Object]int    // Offsets of the variables after the parameters, in words
+	errors compiler.ErrorList
+
+	types  []signature // Signatures of the procedure types
+	sigs   []uint32    // Type indices of the functions, from the main block on
+	bodies [][]byte    // Function bodies, from the main block on
+	code   *buffer     // Instructions of the current function
+	fp     uint32      // Local holding the frame pointer of the current function, followed by an i32 and an i64 scratch local
+	loops  int         // Number of FOR loops enclosing the current statement
+	limits int         // Number of locals holding the limits of FOR loops, after the scratch locals
+}
+
+// Compile resolves a program and writes the WebAssembly module translating
+// it to w. The error, if any, is a compiler.ErrorList, in which case nothing
+// is written.
+func Compile(w io.Writer, prog *ast.Program) error {
+	if err := compiler.Resolve(prog); err != nil {
+		return err
+	}
+	g := &codegen{file: prog.File, params: []int{0}, result: []uint32{0}, funcs: make(map[*ast.Object]uint32), slots: make(map[*ast.Object]int)}
+	g.sigs = append(g.sigs, mainType)
+	g.bodies = append(g.bodies, nil)
+	g.block(mainFunc, nil, prog.Main, g.layout(prog.Main))
+	if err := g.errors.Err(); err != nil {
+		return err
+	}
+	_, err := w.Write(g.module())
+	return err
+}
+
+// module encodes the module.
+func (g *codegen) module() []byte {
+	var m, s buffer
+	m.WriteString("\x00asm")
+	m.Write([]byte{1, 0, 0, 0})
+
+	s.Write([]byte{0x60, 1, i64, 0}) // print
+	s.Write([]byte{0x60, 0, 1, i64}) // read
+	s.Write([]byte{0x60, 1, i32, 0}) // bounds
+	s.Write([]byte{0x60, 0, 0})      // main
+	for _, t := range g.types {
+		s.WriteByte(0x60)
+		s.vec([]byte(t.params))
+		s.vec([]byte(t.results))
+	}
+	m.section(typeSection, procTypes+len(g.types), s.Bytes())
+
+	s.Reset()
+	s.name("pl0")
+	s.name("print")
+	s.WriteByte(funcExternal)
+	s.u32(printType)
+	s.name("pl0")
+	s.name("read")
+	s.WriteByte(funcExternal)
+	s.u32(readType)
+	s.name("pl0")
+	s.name("bounds")
+	s.WriteByte(funcExternal)
+	s.u32(boundsType)
+	m.section(importSection, 3, s.Bytes())
+
+	s.Reset()
+	for _, t := range g.sigs {
+		s.u32(t)
+	}
+	m.section(functionSection, len(g.sigs), s.Bytes())
+
+	s.Reset()
+	s.WriteByte(0) // No maximum
+	s.u32(memoryPages)
+	m.section(memorySection, 1, s.Bytes())
+
+	// The stack pointer, starting at the top of the memory
+	s.Reset()
+	s.Write([]byte{i32, 1}) // Mutable
+	s.i32const(memoryPages << 16)
+	s.op(opEnd)
+	m.section(globalSection, 1, s.Bytes())
+
+	s.Reset()
+	s.name("main")
+	s.WriteByte(funcExternal)
+	s.u32(mainFunc)
+	s.name("memory")
+	s.WriteByte(memoryExternal)
+	s.u32(0)
+	m.section(exportSection, 2, s.Bytes())
+
+	s.Reset()
+	for _, body := range g.bodies {
+		s.vec(body)
+	}
+	m.section(codeSection, len(g.bodies), s.Bytes())
+	return m.Bytes()
+}
+
+// error records an error at pos.
+func (g *codegen) error(pos token.Pos, kind compiler.ErrorKind, msg string) {
+	g.errors.Add(g.position(pos), kind, msg)
+}
+
+// position returns the position of pos in the source file, if known.
+func (g *codegen) position(pos token.Pos) token.Position {
+	if g.file == nil {
+		return token.Position{}
+	}
+	return g.file.Position(pos)
+}
+
+// signature is the type of a procedure or function: the value types
+// of its parameters and results.
+type signature struct {
+	params, results string
+}
+
+// procType returns the index of the type of procedure or function d,
+// adding it to the types if new.
+func (g *codegen) procType(d *ast.ProcDecl) uint32 {
+	params := []byte{i32} // The static link
+	for _, p := range d.Params {
+		if p.Var.IsValid() {
+			params = append(params, i32)
+		} else {
+			params = append(params, i64)
+		}
+	}
+	t := signature{params: string(params)}
+	if d.Tok == token.FUNCTION {
+		t.results = string([]byte{i64})
+	}
+	for i, u := range g.types {
+		if u == t {
+			return uint32(procTypes + i)
+		}
+	}
+	g.types = append(g.types, t)
+	return uint32(procTypes + len(g.types) - 1)
+}
+
+// block translates a block to the function with the given index and
+// parameters, after the functions of its procedures. Its variables, laid
+// out beforehand, take the given number of words. The block of a function
+// returns its result.
+func (g *codegen) block(fn uint32, params []*ast.Param, b *ast.Block, words int) {
+	for _, p := range b.Procs {
+		idx := uint32(mainFunc + len(g.bodies))
+		g.sigs = append(g.sigs, g.procType(p))
+		g.bodies = append(g.bodies, nil)
+		g.funcs[p.Name.Obj] = idx
+		g.level++
+		g.params = append(g.params, len(p.Params))
+		n := g.layout(p.Block)
+		var result uint32
+		if p.Tok == token.FUNCTION {
+			result = uint32(linkSize + wordSize*(len(p.Params)+n))
+		}
+		g.result = append(g.result, result)
+		g.block(idx, p.Params, p.Block, n)
+		g.params = g.params[:g.level]
+		g.result = g.result[:g.level]
+		g.level--
+	}
+
+	// The main block has no static link parameter
+	g.code = new(buffer)
+	g.limits = 0
+	g.fp = uint32(1 + len(params))
+	if fn == mainFunc {
+		g.fp = 0
+	}
+	size := int64(linkSize + wordSize*(len(params)+words))
+	result := g.result[g.level]
+	if result != 0 {
+		size += wordSize
+	}
+	g.prolog(size, fn == mainFunc, params)
+	g.stmt(b.Body)
+	if result != 0 {
+		g.code.op(opLocalGet, g.fp)
+		g.code.op(opI64Load, align64, result)
+	}
+	g.epilog(size)
+
+	var body buffer
+	body.Write([]byte{2, 2, i32}) // The frame pointer and scratch locals
+	body.u32(uint32(1 + g.limits))
+	body.WriteByte(i64)
+	body.Write(g.code.Bytes())
+	body.WriteByte(opEnd)
+	g.bodies[fn-mainFunc] = body.Bytes()
+}
+
+// layout sets the offsets of the variables of b, and returns the number
+// of words they take.
+func (g *codegen) layout(b *ast.Block) int {
+	n := 0
+	for _, v := range b.Vars {
+		obj := v.Name.Obj
+		g.slots[obj] = n
+		if obj.Len > 0 {
+			n += obj.Len
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// prolog allocates the frame of a function, storing the static link and
+// the parameters, and zeroing the variables. It traps on stack overflow.
+func (g *codegen) prolog(size int64, main bool, params []*ast.Param) {
+	c := g.code
+	c.op(opGlobalGet, 0)
+	c.i32const(size)
+	c.op(opI32LtU)
+	c.op(opIf, blockVoid)
+	c.op(opUnreachable)
+	c.op(opEnd)
+
+	c.op(opGlobalGet, 0)
+	c.i32const(size)
+	c.op(opI32Sub)
+	c.op(opLocalTee, g.fp)
+	c.op(opGlobalSet, 0)
+
+	c.op(opLocalGet, g.fp)
+	if main {
+		c.i32const(0)
+	} else {
+		c.op(opLocalGet, 0)
+	}
+	c.op(opI32Store, align32, 0)
+	off := int64(linkSize)
+	for i, p := range params {
+		c.op(opLocalGet, g.fp)
+		c.op(opLocalGet, uint32(1+i))
+		if p.Var.IsValid() {
+			c.op(opI32Store, align32, uint32(off))
+		} else {
+			c.op(opI64Store, align64, uint32(off))
+		}
+		off += wordSize
+	}
+	if size-off <= unrolled*wordSize {
+		for ; off < size; off += wordSize {
+			c.op(opLocalGet, g.fp)
+			c.i64const(0)
+			c.op(opI64Store, align64, uint32(off))
+		}
+		return
+	}
+
+	// Zero the words down from the end of the frame
+	p := g.fp + 1
+	c.op(opLocalGet, g.fp)
+	c.i32const(size)
+	c.op(opI32Add)
+	c.op(opLocalSet, p)
+	c.op(opLoop, blockVoid)
+	c.op(opLocalGet, p)
+	c.i32const(wordSize)
+	c.op(opI32Sub)
+	c.op(opLocalTee, p)
+	c.i64const(0)
+	c.op(opI64Store, align64, 0)
+	c.op(opLocalGet, g.fp)
+	c.i32const(off)
+	c.op(opI32Add)
+	c.op(opLocalGet, p)
+	c.op(opI32LtU)
+	c.op(opBrIf, 0)
+	c.op(opEnd)
+}
+
+// epilog releases the frame of a function.
+func (g *codegen) epilog(size int64) {
+	c := g.code
+	c.op(opLocalGet, g.fp)
+	c.i32const(size)
+	c.op(opI32Add)
+	c.op(opGlobalSet, 0)
+}
+
+// frame pushes the address of the frame of the block at the given level,
+// following static links from the current frame.
+func (g *codegen) frame(level int) {
+	g.code.op(opLocalGet, g.fp)
+	for l := g.level; l > level; l-- {
+		g.code.op(opI32Load, align32, 0)
+	}
+}
+
+// offset returns the offset of a variable in its frame, after the
+// parameters of its block.
+func (g *codegen) offset(obj *ast.Object) uint32 {
+	if obj.Param {
+		return uint32(linkSize + wordSize*obj.Offset)
+	}
+	return uint32(linkSize + wordSize*(g.params[obj.Level]+g.slots[obj]))
+}
+
+// variable pushes the address of the frame holding a variable, or the
+// address held by a VAR parameter, and returns the offset of the variable
+// from it. The variable of a function is its result.
+func (g *codegen) variable(obj *ast.Object) uint32 {
+	if obj.Kind == ast.Func {
+		g.frame(obj.Level + 1)
+		return g.result[obj.Level+1]
+	}
+	g.frame(obj.Level)
+	if obj.Ref {
+		g.code.op(opI32Load, align32, g.offset(obj))
+		return 0
+	}
+	return g.offset(obj)
+}
+
+// element pushes the address of the frame holding an array plus the
+// offset of an element from the array, and returns the offset of the array
+// from the frame. If the index is out of range, it calls bounds with the
+// line of the index, and traps.
+func (g *codegen) element(x *ast.IndexExpr) uint32 {
+	c := g.code
+	off := g.variable(x.X.Obj)
+	i := g.fp + 2
+	g.expr(x.Index)
+	c.op(opLocalTee, i)
+	c.i64const(int64(x.X.Obj.Len))
+	c.op(opI64GeU)
+	c.op(opIf, blockVoid)
+	c.i32const(int64(g.position(x.Index.Pos()).Line))
+	c.op(opCall, boundsFunc)
+	c.op(opUnreachable)
+	c.op(opEnd)
+	c.op(opLocalGet, i)
+	c.i64const(wordSize)
+	c.op(opI64Mul)
+	c.op(opI32WrapI64)
+	c.op(opI32Add)
+	return off
+}
+
+// lvalue pushes the address of the frame holding a variable or array
+// element, or an address from which to offset it, and returns the offset.
+func (g *codegen) lvalue(x ast.Expr) uint32 {
+	if x, ok := x.(*ast.IndexExpr); ok {
+		return g.element(x)
+	}
+	return g.variable(x.(*ast.Ident).Obj)
+}
+
+func (g *codegen) stmt(s ast.Stmt) {
+	c := g.code
+	switch s := s.(type) {
+	case nil:
+		// Empty statement
+
+	case *ast.AssignStmt:
+		off := g.lvalue(s.Lhs)
+		g.expr(s.Rhs)
+		c.op(opI64Store, align64, off)
+
+	case *ast.CallStmt:
+		g.call(s.Proc.Obj, s.Args)
+
+	case *ast.ReturnStmt:
+		g.expr(s.X)
+		g.epilog(int64(g.result[g.level] + wordSize))
+		c.op(opReturn)
+
+	case *ast.SendStmt:
+		g.expr(s.X)
+		c.op(opCall, printFunc)
+
+	case *ast.ReceiveStmt:
+		off := g.lvalue(s.X)
+		c.op(opCall, readFunc)
+		c.op(opI64Store, align64, off)
+
+	case *ast.BeginStmt:
+		for _, s := range s.List {
+			g.stmt(s)
+		}
+
+	case *ast.IfStmt:
+		g.cond(s.Cond)
+		c.op(opIf, blockVoid)
+		g.stmt(s.Body)
+		if s.Else != nil {
+			c.op(opElse)
+			g.stmt(s.Else)
+		}
+		c.op(opEnd)
+
+	case *ast.WhileStmt:
+		c.op(opBlock, blockVoid)
+		c.op(opLoop, blockVoid)
+		g.cond(s.Cond)
+		c.op(opI32Eqz)
+		c.op(opBrIf, 1) // Exit the block
+		g.stmt(s.Body)
+		c.op(opBr, 0) // Repeat the loop
+		c.op(opEnd)
+		c.op(opEnd)
+
+	case *ast.RepeatStmt:
+		c.op(opLoop, blockVoid)
+		for _, s := range s.List {
+			g.stmt(s)
+		}
+		g.cond(s.Cond)
+		c.op(opI32Eqz)
+		c.op(opBrIf, 0) // Repeat the loop
+		c.op(opEnd)
+
+	case *ast.ForStmt:
+		g.loop(s)
+
+	default:
+		panic(fmt.Sprintf("unsupported statement: %T", s))
+	}
+}
+
+// loop translates a FOR loop. Its limit is held by a local of the
+// function, one for each level of nesting. The loop is left when the
+// variable reaches the limit, before stepping it.
+func (g *codegen) loop(s *ast.ForStmt) {
+	c := g.code
+	skip, leave, step := byte(opI64GtS), byte(opI64GeS), byte(opI64Add)
+	if s.Dir == token.DOWNTO {
+		skip, leave, step = opI64LtS, opI64LeS, opI64Sub
+	}
+	obj := s.Var.Obj
+	limit := g.fp + 3 + uint32(g.loops)
+	g.loops++
+	if g.loops > g.limits {
+		g.limits = g.loops
+	}
+	off := g.variable(obj)
+	g.expr(s.From)
+	g.expr(s.Limit)
+	c.op(opLocalSet, limit)
+	c.op(opI64Store, align64, off)
+
+	c.op(opBlock, blockVoid)
+	c.op(opI64Load, align64, g.variable(obj))
+	c.op(opLocalGet, limit)
+	c.op(skip)
+	c.op(opBrIf, 0) // Exit the block
+	c.op(opLoop, blockVoid)
+	g.stmt(s.Body)
+	c.op(opI64Load, align64, g.variable(obj))
+	c.op(opLocalGet, limit)
+	c.op(leave)
+	c.op(opBrIf, 1) // Exit the block
+	off = g.variable(obj)
+	c.op(opI64Load, align64, g.variable(obj))
+	c.i64const(1)
+	c.op(step)
+	c.op(opI64Store, align64, off)
+	c.op(opBr, 0) // Repeat the loop
+	c.op(opEnd)
+	c.op(opEnd)
+	g.loops--
+}
+
+// call calls a procedure or function with the given arguments. The result
+// of a function is left on the stack.
+func (g *codegen) call(obj *ast.Object, args []ast.Expr) {
+	c := g.code
+	g.frame(obj.Level)
+	for i, p := range obj.Proc.Params {
+		x := args[i]
+		if !p.Var.IsValid() {
+			g.expr(x)
+			continue
+		}
+		// The address of the variable or array element
+		if off := g.lvalue(x); off != 0 {
+			c.i32const(int64(off))
+			c.op(opI32Add)
+		}
+	}
+	c.op(opCall, g.funcs[obj])
+}
+
+var relations = map[token.Token]byte{
+	token.EQL: opI64Eq,
+	token.NEQ: opI64Ne,
+	token.LSS: opI64LtS,
+	token.LEQ: opI64LeS,
+	token.GRT: opI64GtS,
+	token.GEQ: opI64GeS,
+}
+
+// cond pushes the value of a condition, as an i32.
+func (g *codegen) cond(cond ast.Cond) {
+	c := g.code
+	switch x := cond.(type) {
+	case *ast.OddCond:
+		g.expr(x.X)
+		c.i64const(1)
+		c.op(opI64And)
+		c.op(opI64Eqz)
+		c.op(opI32Eqz)
+
+	case *ast.RelCond:
+		op, ok := relations[x.Op]
+		if !ok {
+			panic(fmt.Sprintf("unsupported relation operator: %q", x.Op))
+		}
+		g.expr(x.X)
+		g.expr(x.Y)
+		c.op(op)
+
+	default:
+		panic(fmt.Sprintf("unsupported condition: %T", cond))
+	}
+}
+
+var operations = map[token.Token]byte{
+	token.PLUS:  opI64Add,
+	token.MINUS: opI64Sub,
+	token.TIMES: opI64Mul,
+	token.DIV:   opI64DivS,
+}
+
+// expr pushes the value of an expression, as an i64.
+func (g *codegen) expr(x ast.Expr) {
+	c := g.code
+	switch x := x.(type) {
+	case *ast.Number:
+		c.i64const(g.number(x))
+
+	case *ast.Ident:
+		if obj := x.Obj; obj.Kind == ast.Con {
+			c.i64const(obj.Value)
+		} else {
+			c.op(opI64Load, align64, g.variable(obj))
+		}
+
+	case *ast.UnaryExpr:
+		switch x.Op {
+		case token.PLUS:
+			g.expr(x.X)
+		case token.MINUS:
+			c.i64const(0)
+			g.expr(x.X)
+			c.op(opI64Sub)
+		default:
+			panic(fmt.Sprintf("unsupported unary operator: %q", x.Op))
+		}
+
+	case *ast.BinaryExpr:
+		op, ok := operations[x.Op]
+		if !ok {
+			panic(fmt.Sprintf("unsupported binary operator: %q", x.Op))
+		}
+		g.expr(x.X)
+		g.expr(x.Y)
+		c.op(op)
+
+	case *ast.IndexExpr:
+		c.op(opI64Load, align64, g.element(x))
+
+	case *ast.CallExpr:
+		g.call(x.Func.Obj, x.Args)
+
+	default:
+		panic(fmt.Sprintf("unsupported expression: %T", x))
+	}
+}
+
+func (g *codegen) number(n *ast.Number) int64 {
+	v, err := strconv.ParseInt(n.Value, 10, 64)
+	if err != nil {
+		g.error(n.Pos(), compiler.SyntaxError, "number "+n.Value+" out of range")
+	}
+	return v
+}
@@ -0,0 +1,185 @@
+// Package wasm translates PL/0 programs to binary WebAssembly modules.
+//
+// The main block becomes the exported function "main", and each procedure
+// a function taking the static link as first parameter, followed by its
+// own: an i64 passed by value, or the i32 address of a variable passed by
+// reference. A function returns its result as an i64. Activation frames
+// are allocated in linear memory, on a stack
+// growing down from the top of the memory, whose pointer is a global. A
+// frame holds the static link, the address of the frame of the lexically
+// enclosing block, followed by the parameters, stored there on entry so
+// that nested procedures find them, the variables, and the result of a
+// function:
+//
+//	offset 0   static link (i32, padded to 8 bytes)
+//	offset 8   first parameter (i64, or i32 padded to 8 bytes)
+//	...
+//	           first variable (i64, or n i64 for an array of length n)
+//	...
+//	           result (i64)
+//
+// Numbers are 64-bit. The ! and ? statements call the functions print and
+// read, imported from the module "pl0", and an array index out of range
+// calls bounds with its source line, to report it, before trapping:
+//
+//	(import "pl0" "print" (func (param i64)))
+//	(import "pl0" "read" (func (result i64)))
+//	(import "pl0" "bounds" (func (param i32)))
+//
+// Division by zero traps, as does a stack overflow.
+package wasm
+
+import (
+	"bytes"
+)
+
+// Value types
+const (
+	i32 = 0x7f
+	i64 = 0x7e
+)
+
+// Section ids
+const (
+	typeSection     = 1
+	importSection   = 2
+	functionSection = 3
+	memorySection   = 5
+	globalSection   = 6
+	exportSection   = 7
+	codeSection     = 10
+)
+
+// External kinds of imports and exports
+const (
+	funcExternal   = 0
+	memoryExternal = 2
+)
+
+// Instruction opcodes
+const (
+	opUnreachable = 0x00
+	opBlock       = 0x02
+	opLoop        = 0x03
+	opIf          = 0x04
+	opElse        = 0x05
+	opEnd         = 0x0b
+	opBr          = 0x0c
+	opBrIf        = 0x0d
+	opReturn      = 0x0f
+	opCall        = 0x10
+	opLocalGet    = 0x20
+	opLocalSet    = 0x21
+	opLocalTee    = 0x22
+	opGlobalGet   = 0x23
+	opGlobalSet   = 0x24
+	opI32Load     = 0x28
+	opI64Load     = 0x29
+	opI32Store    = 0x36
+	opI64Store    = 0x37
+	opI32Const    = 0x41
+	opI64Const    = 0x42
+	opI32Eqz      = 0x45
+	opI32LtU      = 0x49
+	opI64Eqz      = 0x50
+	opI64Eq       = 0x51
+	opI64Ne       = 0x52
+	opI64LtS      = 0x53
+	opI64GtS      = 0x55
+	opI64LeS      = 0x57
+	opI64GeS      = 0x59
+	opI64GeU      = 0x5a
+	opI32Add      = 0x6a
+	opI32Sub      = 0x6b
+	opI64Add      = 0x7c
+	opI64Sub      = 0x7d
+	opI64Mul      = 0x7e
+	opI64DivS     = 0x7f
+	opI64And      = 0x83
+	opI32WrapI64  = 0xa7
+
+	blockVoid = 0x40 // Empty block type
+)
+
+// Alignment exponents of memory accesses
+const (
+	align32 = 2
+	align64 = 3
+)
+
+// buffer accumulates the encoding of a module or of a part of it.
+type buffer struct {
+	bytes.Buffer
+}
+
+// u32 appends an unsigned LEB128 number.
+func (b *buffer) u32(v uint32) {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			c |= 0x80
+		}
+		b.WriteByte(c)
+		if v == 0 {
+			return
+		}
+	}
+}
+
+// s64 appends a signed LEB128 number.
+func (b *buffer) s64(v int64) {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		done := v == 0 && c&0x40 == 0 || v == -1 && c&0x40 != 0
+		if !done {
+			c |= 0x80
+		}
+		b.WriteByte(c)
+		if done {
+			return
+		}
+	}
+}
+
+// name appends a length prefixed string.
+func (b *buffer) name(s string) {
+	b.u32(uint32(len(s)))
+	b.WriteString(s)
+}
+
+// vec appends a length prefixed sequence of bytes.
+func (b *buffer) vec(p []byte) {
+	b.u32(uint32(len(p)))
+	b.Write(p)
+}
+
+// section appends a section holding a vector of n entries.
+func (b *buffer) section(id byte, n int, entries []byte) {
+	var s buffer
+	s.u32(uint32(n))
+	s.Write(entries)
+	b.WriteByte(id)
+	b.vec(s.Bytes())
+}
+
+// op appends an instruction with unsigned immediates.
+func (b *buffer) op(op byte, imm ...uint32) {
+	b.WriteByte(op)
+	for _, v := range imm {
+		b.u32(v)
+	}
+}
+
+// i32const appends an i32.const instruction.
+func (b *buffer) i32const(v int64) {
+	b.WriteByte(opI32Const)
+	b.s64(v)
+}
+
+// i64const appends an i64.const instruction.
+func (b *buffer) i64const(v int64) {
+	b.WriteByte(opI64Const)
+	b.s64(v)
+}
@@ -0,0 +1,625 @@
+package wasm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"pl0/compiler"
+)
+
+func compile(t *testing.T, filename, src string) []byte {
+	prog, err := compiler.Parse(filename, strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	var out bytes.Buffer
+	if err := Compile(&out, prog); err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	return out.Bytes()
+}
+
+// decoder reads the encoding of a module, keeping the first error.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf(format, args...)
+	}
+	d.b = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.b) == 0 {
+		d.fail("unexpected end")
+		return 0
+	}
+	c := d.b[0]
+	d.b = d.b[1:]
+	return c
+}
+
+func (d *decoder) u32() uint32 {
+	var v uint32
+	for shift := uint(0); shift < 35; shift += 7 {
+		c := d.byte()
+		v |= uint32(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return v
+		}
+	}
+	d.fail("u32 too long")
+	return 0
+}
+
+func (d *decoder) s64() int64 {
+	var v int64
+	var shift uint
+	for shift < 70 {
+		c := d.byte()
+		v |= int64(c&0x7f) << shift
+		shift += 7
+		if c&0x80 == 0 {
+			if shift < 64 && c&0x40 != 0 {
+				v |= -1 << shift
+			}
+			return v
+		}
+	}
+	d.fail("s64 too long")
+	return 0
+}
+
+func (d *decoder) bytes(n uint32) []byte {
+	if uint32(len(d.b)) < n {
+		d.fail("unexpected end")
+		return nil
+	}
+	p := d.b[:n]
+	d.b = d.b[n:]
+	return p
+}
+
+func (d *decoder) name() string {
+	return string(d.bytes(d.u32()))
+}
+
+func (d *decoder) valtype() byte {
+	t := d.byte()
+	if t != i32 && t != i64 {
+		d.fail("invalid value type %#x", t)
+	}
+	return t
+}
+
+type funcType struct {
+	params, results []byte
+}
+
+// module is the decoded contents of a module.
+type module struct {
+	types   []funcType
+	imports []string // Module and name of the imported functions
+	funcs   []uint32 // Type indices, of the imported functions first
+	globals []byte   // Global types
+	mutable []bool   // Global mutability
+	exports []string // Exported names
+	bodies  [][]byte // Function bodies
+	memory  int      // Initial pages
+}
+
+// decode decodes a module, checking the sections are well formed and
+// consistent, and validates the function bodies.
+func decode(b []byte) (*module, error) {
+	d := &decoder{b: b}
+	if !bytes.HasPrefix(b, []byte("\x00asm\x01\x00\x00\x00")) {
+		return nil, errors.New("bad header")
+	}
+	d.bytes(8)
+
+	m := &module{memory: -1}
+	var last byte
+	var nfuncs int
+	for len(d.b) > 0 && d.err == nil {
+		id := d.byte()
+		if id <= last {
+			return nil, fmt.Errorf("section %d out of order", id)
+		}
+		last = id
+		s := &decoder{b: d.bytes(d.u32())}
+		n := int(s.u32())
+		for i := 0; i < n && s.err == nil; i++ {
+			switch id {
+			case typeSection:
+				if s.byte() != 0x60 {
+					s.fail("bad function type")
+				}
+				var ft funcType
+				for k := s.u32(); k > 0 && s.err == nil; k-- {
+					ft.params = append(ft.params, s.valtype())
+				}
+				for k := s.u32(); k > 0 && s.err == nil; k-- {
+					ft.results = append(ft.results, s.valtype())
+				}
+				m.types = append(m.types, ft)
+			case importSection:
+				name := s.name() + "." + s.name()
+				if s.byte() != funcExternal {
+					s.fail("import %s is not a function", name)
+				}
+				m.imports = append(m.imports, name)
+				m.funcs = append(m.funcs, s.u32())
+			case functionSection:
+				m.funcs = append(m.funcs, s.u32())
+				nfuncs++
+			case memorySection:
+				if s.byte() != 0 {
+					s.fail("bad memory limits")
+				}
+				m.memory = int(s.u32())
+			case globalSection:
+				m.globals = append(m.globals, s.valtype())
+				m.mutable = append(m.mutable, s.byte() == 1)
+				if s.byte() != opI32Const {
+					s.fail("bad global initializer")
+				}
+				s.s64()
+				if s.byte() != opEnd {
+					s.fail("bad global initializer")
+				}
+			case exportSection:
+				name := s.name()
+				kind, idx := s.byte(), s.u32()
+				switch {
+				case kind == funcExternal && int(idx) >= len(m.funcs):
+					s.fail("export %s of undefined function %d", name, idx)
+				case kind == memoryExternal && (idx != 0 || m.memory < 0):
+					s.fail("export %s of undefined memory %d", name, idx)
+				}
+				m.exports = append(m.exports, name)
+			case codeSection:
+				m.bodies = append(m.bodies, s.bytes(s.u32()))
+			default:
+				s.fail("unexpected section %d", id)
+			}
+		}
+		if s.err != nil {
+			return nil, fmt.Errorf("section %d: %v", id, s.err)
+		}
+		if len(s.b) > 0 {
+			return nil, fmt.Errorf("section %d: %d trailing bytes", id, len(s.b))
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	for _, t := range m.funcs {
+		if int(t) >= len(m.types) {
+			return nil, fmt.Errorf("undefined type %d", t)
+		}
+	}
+	if len(m.bodies) != nfuncs {
+		return nil, fmt.Errorf("%d functions, but %d bodies", nfuncs, len(m.bodies))
+	}
+	for i, body := range m.bodies {
+		fn := len(m.imports) + i
+		if err := m.validate(m.types[m.funcs[fn]], body); err != nil {
+			return nil, fmt.Errorf("function %d: %v", fn, err)
+		}
+	}
+	return m, nil
+}
+
+// unknown is the type of an operand popped from the unreachable part of
+// a block, matching any type.
+const unknown = 0
+
+// ctrl is an entry of the control stack of the validator.
+type ctrl struct {
+	op          byte // Block, loop, if, or end for the function body
+	height      int  // Operand stack height at the start of the block
+	unreachable bool // The rest of the block is unreachable
+}
+
+// validate type checks a function body, for the instructions used by the
+// code generator.
+func (m *module) validate(ft funcType, body []byte) error {
+	d := &decoder{b: body}
+	locals := append([]byte(nil), ft.params...)
+	for n := d.u32(); n > 0 && d.err == nil; n-- {
+		count, t := d.u32(), d.valtype()
+		for ; count > 0; count-- {
+			locals = append(locals, t)
+		}
+	}
+
+	var stack []byte
+	ctrls := []ctrl{{op: opEnd}}
+	push := func(t ...byte) { stack = append(stack, t...) }
+	pop := func(want byte) {
+		c := &ctrls[len(ctrls)-1]
+		if len(stack) == c.height {
+			if !c.unreachable {
+				d.fail("operand stack underflow")
+			}
+			return
+		}
+		got := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if got != want && got != unknown && want != unknown {
+			d.fail("got operand of type %#x, want %#x", got, want)
+		}
+	}
+	local := func() byte {
+		i := d.u32()
+		if int(i) >= len(locals) {
+			d.fail("undefined local %d", i)
+			return unknown
+		}
+		return locals[i]
+	}
+	global := func() uint32 {
+		i := d.u32()
+		if int(i) >= len(m.globals) {
+			d.fail("undefined global %d", i)
+		}
+		return i
+	}
+	memarg := func(align uint32) {
+		if m.memory < 0 {
+			d.fail("memory access without memory")
+		}
+		if a := d.u32(); a > align {
+			d.fail("alignment 2**%d larger than natural", a)
+		}
+		d.u32()
+	}
+	label := func() {
+		if depth := d.u32(); int(depth) >= len(ctrls) {
+			d.fail("undefined label %d", depth)
+		}
+	}
+	binary := func(operand, result byte) {
+		pop(operand)
+		pop(operand)
+		push(result)
+	}
+
+	for len(ctrls) > 0 && d.err == nil {
+		switch op := d.byte(); op {
+		case opUnreachable:
+			c := &ctrls[len(ctrls)-1]
+			stack = stack[:c.height]
+			c.unreachable = true
+		case opBlock, opLoop, opIf:
+			if bt := d.byte(); bt != blockVoid {
+				d.fail("unsupported block type %#x", bt)
+			}
+			if op == opIf {
+				pop(i32)
+			}
+			ctrls = append(ctrls, ctrl{op: op, height: len(stack)})
+		case opElse:
+			c := &ctrls[len(ctrls)-1]
+			if c.op != opIf {
+				d.fail("else outside of if")
+				break
+			}
+			if len(stack) != c.height && !(c.unreachable && len(stack) < c.height) {
+				d.fail("%d values left at end of then branch", len(stack)-c.height)
+			}
+			stack = stack[:c.height]
+			c.op, c.unreachable = opElse, false
+		case opEnd:
+			c := ctrls[len(ctrls)-1]
+			results := 0
+			if c.op == opEnd {
+				results = len(ft.results)
+				for k := len(ft.results) - 1; k >= 0; k-- {
+					pop(ft.results[k])
+				}
+			}
+			if len(stack) != c.height && !(c.unreachable && len(stack) < c.height) {
+				d.fail("%d values left at end of block", len(stack)-c.height)
+			}
+			stack = stack[:c.height]
+			ctrls = ctrls[:len(ctrls)-1]
+			if results > 0 {
+				push(ft.results...)
+			}
+		case opBr:
+			label()
+			c := &ctrls[len(ctrls)-1]
+			stack = stack[:c.height]
+			c.unreachable = true
+		case opBrIf:
+			label()
+			pop(i32)
+		case opReturn:
+			for k := len(ft.results) - 1; k >= 0; k-- {
+				pop(ft.results[k])
+			}
+			c := &ctrls[len(ctrls)-1]
+			stack = stack[:c.height]
+			c.unreachable = true
+		case opCall:
+			fn := d.u32()
+			if int(fn) >= len(m.funcs) {
+				d.fail("call of undefined function %d", fn)
+				break
+			}
+			callee := m.types[m.funcs[fn]]
+			for k := len(callee.params) - 1; k >= 0; k-- {
+				pop(callee.params[k])
+			}
+			push(callee.results...)
+		case opLocalGet:
+			push(local())
+		case opLocalSet:
+			pop(local())
+		case opLocalTee:
+			t := local()
+			pop(t)
+			push(t)
+		case opGlobalGet:
+			push(m.globals[global()])
+		case opGlobalSet:
+			i := global()
+			if !m.mutable[i] {
+				d.fail("set of immutable global %d", i)
+			}
+			pop(m.globals[i])
+		case opI32Load:
+			memarg(align32)
+			pop(i32)
+			push(i32)
+		case opI64Load:
+			memarg(align64)
+			pop(i32)
+			push(i64)
+		case opI32Store:
+			memarg(align32)
+			pop(i32)
+			pop(i32)
+		case opI64Store:
+			memarg(align64)
+			pop(i64)
+			pop(i32)
+		case opI32Const:
+			d.s64()
+			push(i32)
+		case opI64Const:
+			d.s64()
+			push(i64)
+		case opI32Eqz:
+			pop(i32)
+			push(i32)
+		case opI64Eqz:
+			pop(i64)
+			push(i32)
+		case opI32LtU:
+			binary(i32, i32)
+		case opI64Eq, opI64Ne, opI64LtS, opI64GtS, opI64LeS, opI64GeS, opI64GeU:
+			binary(i64, i32)
+		case opI32Add, opI32Sub:
+			binary(i32, i32)
+		case opI64Add, opI64Sub, opI64Mul, opI64DivS, opI64And:
+			binary(i64, i64)
+		case opI32WrapI64:
+			pop(i64)
+			push(i32)
+		default:
+			d.fail("unexpected opcode %#x", op)
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.b) > 0 {
+		return fmt.Errorf("%d bytes after the end of the body", len(d.b))
+	}
+	return nil
+}
+
+// TestValidate decodes and validates the modules of the test and example
+// programs.
+func TestValidate(t *testing.T) {
+	files, err := filepath.Glob("../test/t.*.pl0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	examples, err := filepath.Glob("../example/*.pl0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = append(files, examples...)
+	if len(files) == 0 {
+		t.Fatal("no test programs found")
+	}
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := decode(compile(t, file, string(src)))
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		if got, want := strings.Join(m.imports, " "), "pl0.print pl0.read pl0.bounds"; got != want {
+			t.Errorf("%s: imports %s, want %s", file, got, want)
+		}
+		if got, want := strings.Join(m.exports, " "), "main memory"; got != want {
+			t.Errorf("%s: exports %s, want %s", file, got, want)
+		}
+	}
+}
+
+func TestModule(t *testing.T) {
+	m, err := decode(compile(t, "test.pl0", `
+CONST big = 9223372036854775807;
+VAR x;
+PROCEDURE p;
+	VAR y, z;
+	PROCEDURE q;
+	BEGIN
+		IF ODD x THEN x := -x;
+		WHILE y < 3 DO y := y + 1;
+		z := big / y
+	END;
+BEGIN ? y; CALL q; ! z END;
+CALL p.`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Imports, main block and the two procedures
+	if len(m.funcs) != 6 || len(m.bodies) != 3 {
+		t.Errorf("got %d functions and %d bodies, want 6 and 3", len(m.funcs), len(m.bodies))
+	}
+	if m.memory != memoryPages {
+		t.Errorf("got %d memory pages, want %d", m.memory, memoryPages)
+	}
+	if len(m.globals) != 1 || m.globals[0] != i32 || !m.mutable[0] {
+		t.Errorf("got globals %v, want a mutable i32 stack pointer", m.globals)
+	}
+}
+
+func TestLEB128(t *testing.T) {
+	for _, v := range []int64{0, 1, -1, 63, 64, -64, -65, 1 << 31, -1 << 63, 1<<63 - 1} {
+		var b buffer
+		b.s64(v)
+		d := &decoder{b: b.Bytes()}
+		if got := d.s64(); got != v || d.err != nil || len(d.b) > 0 {
+			t.Errorf("s64(%d): decoded %d, %v", v, got, d.err)
+		}
+	}
+	for _, v := range []uint32{0, 127, 128, 1<<32 - 1} {
+		var b buffer
+		b.u32(v)
+		d := &decoder{b: b.Bytes()}
+		if got := d.u32(); got != v || d.err != nil || len(d.b) > 0 {
+			t.Errorf("u32(%d): decoded %d, %v", v, got, d.err)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"! y.", []string{"test.pl0:1:3: undefined identifier y"}},
+		{"CONST c = 1; VAR c; c := 2.", []string{
+			"test.pl0:1:18: duplicate identifier c",
+			"test.pl0:1:21: cannot assign to c (kind CONST)",
+		}},
+		{"VAR x; PROCEDURE p; ; BEGIN ! p; CALL x END.", []string{
+			"test.pl0:1:31: cannot use p (kind PROCEDURE) in expression",
+			"test.pl0:1:39: cannot call non-procedure x (kind VAR)",
+		}},
+	}
+	for _, tt := range tests {
+		prog, err := compiler.Parse("test.pl0", strings.NewReader(tt.src))
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.src, err)
+		}
+		var out bytes.Buffer
+		err = Compile(&out, prog)
+		list, ok := err.(compiler.ErrorList)
+		if !ok {
+			t.Errorf("%q: got %v, want an ErrorList", tt.src, err)
+			continue
+		}
+		var got []string
+		for _, e := range list {
+			got = append(got, e.Error())
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%q: got %q, want %q", tt.src, got, tt.want)
+		}
+		if out.Len() > 0 {
+			t.Errorf("%q: output written despite errors", tt.src)
+		}
+	}
+}
+
+var outputRE = regexp.MustCompile(`\{\s*Output:([^}]*)\}`)
+
+// TestRun runs the test programs with node, if installed, through the
+// loader of the course site.
+func TestRun(t *testing.T) {
+	if _, err := exec.LookPath("node"); err != nil {
+		t.Skip("node not found")
+	}
+	dir, err := ioutil.TempDir("", "wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	loader, err := filepath.Abs("../docs/js/pl0.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := `
+var fs = require('fs');
+var PL0 = require(process.argv[1]);
+PL0.run(fs.readFileSync(process.argv[2]), process.argv[3], console.log).catch(function (e) {
+	console.error(e.message);
+	process.exit(1);
+});
+`
+	files, err := filepath.Glob("../test/t.*.pl0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(name, src, in string) (string, error) {
+		wasm := filepath.Join(dir, "prog.wasm")
+		if err := ioutil.WriteFile(wasm, compile(t, name, src), 0666); err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command("node", "-e", script, loader, wasm, in).CombinedOutput()
+		return string(out), err
+	}
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []string
+		for _, m := range outputRE.FindAllSubmatch(src, -1) {
+			want = append(want, strings.Fields(string(m[1]))...)
+		}
+		out, err := run(file, string(src), "")
+		if err != nil {
+			t.Errorf("%s: %v\n%s", file, err, out)
+			continue
+		}
+		if got := strings.Fields(out); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: got %v, want %v", file, got, want)
+		}
+	}
+
+	out, err := run("test.pl0", "VAR x, y; BEGIN ? x; ? y; ! x * y; ! x / y END.", "-7\n2\n")
+	if err != nil || out != "-14\n-3\n" {
+		t.Errorf("input: got %q, %v", out, err)
+	}
+	out, err = run("test.pl0", "VAR x; BEGIN ? x; ! 1 / x END.", "0\n")
+	if err == nil || !strings.Contains(out, "divide by zero") {
+		t.Errorf("division by zero: got %q, %v", out, err)
+	}
+	out, err = run("test.pl0", "VAR a[2], i;\nBEGIN ? i; a[i] := 1 END.", "2\n")
+	if err == nil || !strings.Contains(out, "index out of range at line 2") {
+		t.Errorf("index out of range: got %q, %v", out, err)
+	}
+}